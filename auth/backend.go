@@ -56,6 +56,12 @@ type Config struct {
 
 type Backend interface {
 	Authenticate(username, password string) error
+	Close()
+}
+
+// GroupBackend is implemented by backends which are able to check group memberships.
+type GroupBackend interface {
+	IsMember(username, group string) (bool, error)
 }
 
 type NullBackend struct {
@@ -65,6 +71,9 @@ func (b *NullBackend) Authenticate(username, password string) error {
 	return fmt.Errorf("invalid username/password")
 }
 
+func (b *NullBackend) Close() {
+}
+
 func metricsCommon(prom prometheus.Registerer) (err error) {
 	if err = prom.Register(authRequests); err != nil {
 		return
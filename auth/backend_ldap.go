@@ -52,15 +52,17 @@ var (
 )
 
 type LDAPConfig struct {
-	Servers          []string             `yaml:"servers"`
-	RootDN           string               `yaml:"root-dn"`
-	ManagerDN        string               `yaml:"manager-dn"`
-	ManagerPassword  string               `yaml:"manager-password"`
-	UserSearchBase   string               `yaml:"user-search-base"`
-	UserSearchFilter string               `yaml:"user-search-filter"`
-	UserDNTemplate   string               `yaml:"user-dn-template"`
-	StartTLS         bool                 `yaml:"start-tls"`
-	TLS              *tlsconfig.TLSConfig `yaml:"tls"`
+	Servers           []string             `yaml:"servers"`
+	RootDN            string               `yaml:"root-dn"`
+	ManagerDN         string               `yaml:"manager-dn"`
+	ManagerPassword   string               `yaml:"manager-password"`
+	UserSearchBase    string               `yaml:"user-search-base"`
+	UserSearchFilter  string               `yaml:"user-search-filter"`
+	UserDNTemplate    string               `yaml:"user-dn-template"`
+	GroupSearchBase   string               `yaml:"group-search-base"`
+	GroupSearchFilter string               `yaml:"group-search-filter"`
+	StartTLS          bool                 `yaml:"start-tls"`
+	TLS               *tlsconfig.TLSConfig `yaml:"tls"`
 }
 
 type LDAPBackend struct {
@@ -77,6 +79,12 @@ func NewLDAPBackend(conf *LDAPConfig, prom prometheus.Registerer, infoLog, dbgLo
 	if conf.UserSearchFilter == "" {
 		conf.UserSearchFilter = "(&(objectClass=inetOrgPerson)(uid={0}))"
 	}
+	if conf.GroupSearchBase == "" {
+		conf.GroupSearchBase = conf.RootDN
+	}
+	if conf.GroupSearchFilter == "" {
+		conf.GroupSearchFilter = "(&(objectClass=groupOfNames)(cn={1})(member={0}))"
+	}
 	if len(conf.Servers) == 0 {
 		return nil, fmt.Errorf("ldap: at least server must be configured")
 	}
@@ -140,14 +148,14 @@ func (b *LDAPBackend) getUserDN(l *ldap.Conn, username string) (string, bool, er
 	return sr.Entries[0].DN, false, nil
 }
 
-func (b *LDAPBackend) authenticate(server, username, password string) (bool, error) {
+func (b *LDAPBackend) dial(server string) (*ldap.Conn, error) {
 	opts := []ldap.DialOpt{}
 	srvTLSConf := &tls.Config{}
 
 	if b.conf.TLS != nil {
 		sn, err := serverNameFromUrl(server)
 		if err != nil {
-			return true, err
+			return nil, err
 		}
 		srvTLSConf = b.tlsConf.Clone()
 		srvTLSConf.ServerName = sn
@@ -158,15 +166,24 @@ func (b *LDAPBackend) authenticate(server, username, password string) (bool, err
 
 	l, err := ldap.DialURL(server, opts...)
 	if err != nil {
-		return true, err
+		return nil, err
 	}
-	defer l.Close() //nolint:errcheck
 
 	if srvTLSConf != nil && b.conf.StartTLS {
 		if err = l.StartTLS(srvTLSConf); err != nil {
-			return true, err
+			l.Close() //nolint:errcheck
+			return nil, err
 		}
 	}
+	return l, nil
+}
+
+func (b *LDAPBackend) authenticate(server, username, password string) (bool, error) {
+	l, err := b.dial(server)
+	if err != nil {
+		return true, err
+	}
+	defer l.Close() //nolint:errcheck
 
 	userdn, retry, err := b.getUserDN(l, username)
 	if err != nil {
@@ -208,3 +225,52 @@ func (b *LDAPBackend) Authenticate(username, password string) (err error) {
 	authRequestsSuccess.WithLabelValues().Inc()
 	return nil
 }
+
+func (b *LDAPBackend) isMember(server, username, group string) (bool, bool, error) {
+	l, err := b.dial(server)
+	if err != nil {
+		return true, false, err
+	}
+	defer l.Close() //nolint:errcheck
+
+	userdn, retry, err := b.getUserDN(l, username)
+	if err != nil {
+		return retry, false, err
+	}
+	if b.conf.ManagerDN != "" && b.conf.ManagerPassword != "" {
+		if err = l.Bind(b.conf.ManagerDN, b.conf.ManagerPassword); err != nil {
+			return true, false, err
+		}
+	}
+
+	f := strings.NewReplacer("{0}", ldap.EscapeFilter(userdn), "{1}", ldap.EscapeFilter(group), "{2}", ldap.EscapeFilter(username)).Replace(b.conf.GroupSearchFilter)
+	searchRequest := ldap.NewSearchRequest(b.conf.GroupSearchBase, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 0, 0, false, f, []string{"dn"}, nil)
+	sr, err := l.Search(searchRequest)
+	if err != nil {
+		return true, false, err
+	}
+	return false, len(sr.Entries) > 0, nil
+}
+
+func (b *LDAPBackend) IsMember(username, group string) (member bool, err error) {
+	retry := false
+	for i, server := range b.conf.Servers {
+		now := time.Now()
+		retry, member, err = b.isMember(server, username, group)
+		ldapRequestDuration.WithLabelValues(server).Observe(time.Since(now).Seconds())
+		if !retry {
+			ldapRequestsSuccess.WithLabelValues(server).Inc()
+			break
+		}
+		ldapRequestsFailed.WithLabelValues(server).Inc()
+		other := "... trying another server"
+		if i+1 >= len(b.conf.Servers) {
+			other = ""
+		}
+		b.dbgLog.Printf("ldap: group lookup on server '%s' failed: %v%s", server, err, other)
+	}
+	return
+}
+
+func (b *LDAPBackend) Close() {
+}
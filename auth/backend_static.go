@@ -51,6 +51,7 @@ type StaticConfig struct {
 
 type StaticBackend struct {
 	htpasswd *htpasswd.File
+	watcher  *fsnotify.Watcher
 	infoLog  *log.Logger
 	dbgLog   *log.Logger
 }
@@ -67,7 +68,7 @@ func NewStaticBackend(conf *StaticConfig, prom prometheus.Registerer, infoLog, d
 	b := &StaticBackend{htpasswd: file, infoLog: infoLog, dbgLog: dbgLog}
 	if conf.AutoReload {
 		staticReloadLastSuccess.SetToCurrentTime()
-		err = runFileWatcher([]string{conf.HTPasswd}, b.watchFileErrorCB, b.watchFileEventCB)
+		b.watcher, err = runFileWatcher([]string{conf.HTPasswd}, b.watchFileErrorCB, b.watchFileEventCB)
 		if err != nil {
 			return nil, err
 		}
@@ -75,6 +76,7 @@ func NewStaticBackend(conf *StaticConfig, prom prometheus.Registerer, infoLog, d
 	if prom != nil {
 		err = b.initPrometheus(prom)
 		if err != nil {
+			b.Close()
 			return nil, err
 		}
 	}
@@ -125,3 +127,9 @@ func (b *StaticBackend) Authenticate(username, password string) error {
 	authRequestsSuccess.WithLabelValues().Inc()
 	return nil
 }
+
+func (b *StaticBackend) Close() {
+	if b.watcher != nil {
+		b.watcher.Close()
+	}
+}
@@ -76,8 +76,10 @@ type WhawtyAuthBackend struct {
 	store           *store.Dir
 	storeMutex      sync.RWMutex
 	upgradeChan     chan whawtyUpgradeRequest
+	upgradeStop     chan struct{}
 	upgradeHTTPHost string
 	upgradeTLSConf  *tls.Config
+	watcher         *fsnotify.Watcher
 	infoLog         *log.Logger
 	dbgLog          *log.Logger
 }
@@ -108,14 +110,16 @@ func NewWhawtyAuthBackend(conf *WhawtyAuthConfig, prom prometheus.Registerer, in
 	}
 	if conf.AutoReload {
 		whawtyReloadLastSuccess.SetToCurrentTime()
-		err = runFileWatcher([]string{conf.ConfigFile}, b.watchFileErrorCB, b.watchFileEventCB)
+		b.watcher, err = runFileWatcher([]string{conf.ConfigFile}, b.watchFileErrorCB, b.watchFileEventCB)
 		if err != nil {
+			b.Close()
 			return nil, err
 		}
 	}
 	if prom != nil {
 		err = b.initPrometheus(prom)
 		if err != nil {
+			b.Close()
 			return nil, err
 		}
 	}
@@ -152,9 +156,15 @@ func remoteHTTPUpgrade(upgrade whawtyUpgradeRequest, remote, httpHost string, cl
 	return true
 }
 
-func remoteHTTPUpgrader(upgradeChan <-chan whawtyUpgradeRequest, remote, httpHost string, client *http.Client, infoLog, dbgLog *log.Logger) {
+func remoteHTTPUpgrader(upgradeChan <-chan whawtyUpgradeRequest, stop <-chan struct{}, remote, httpHost string, client *http.Client, infoLog, dbgLog *log.Logger) {
 	sem := make(chan bool, MaxConcurrentRemoteUpgrades)
-	for upgrade := range upgradeChan {
+	for {
+		var upgrade whawtyUpgradeRequest
+		select {
+		case <-stop:
+			return
+		case upgrade = <-upgradeChan:
+		}
 		select {
 		case sem <- true:
 			dbgLog.Printf("whawty-auth: upgrading '%s' via %s", upgrade.Username, remote)
@@ -182,6 +192,7 @@ func (b *WhawtyAuthBackend) runRemoteUpgrader(remote string) error {
 	}
 
 	b.upgradeChan = make(chan whawtyUpgradeRequest, 10)
+	b.upgradeStop = make(chan struct{})
 	httpClient := &http.Client{}
 
 	switch r.Scheme {
@@ -197,7 +208,7 @@ func (b *WhawtyAuthBackend) runRemoteUpgrader(remote string) error {
 	default:
 		return fmt.Errorf("whawty-auth: invalid upgrade url: %s", remote)
 	}
-	go remoteHTTPUpgrader(b.upgradeChan, remote, b.upgradeHTTPHost, httpClient, b.infoLog, b.dbgLog)
+	go remoteHTTPUpgrader(b.upgradeChan, b.upgradeStop, remote, b.upgradeHTTPHost, httpClient, b.infoLog, b.dbgLog)
 	return nil
 }
 
@@ -265,3 +276,12 @@ func (b *WhawtyAuthBackend) Authenticate(username, password string) error {
 	}
 	return nil
 }
+
+func (b *WhawtyAuthBackend) Close() {
+	if b.watcher != nil {
+		b.watcher.Close()
+	}
+	if b.upgradeStop != nil {
+		close(b.upgradeStop)
+	}
+}
@@ -73,25 +73,28 @@ func watchFileLoop(w *fsnotify.Watcher, files []string, errorCB watchFileErrorCB
 	}
 }
 
-func runFileWatcher(files []string, errorCB watchFileErrorCB, eventCB watchFileEventCB) error {
+func runFileWatcher(files []string, errorCB watchFileErrorCB, eventCB watchFileEventCB) (*fsnotify.Watcher, error) {
 	w, err := fsnotify.NewWatcher()
 	if err != nil {
-		return err
+		return nil, err
 	}
 	go watchFileLoop(w, files, errorCB, eventCB)
 
 	for _, file := range files {
 		st, err := os.Lstat(file)
 		if err != nil {
-			return err
+			w.Close()
+			return nil, err
 		}
 		if st.IsDir() {
-			return fmt.Errorf("'%s' is a directory, not a file", file)
+			w.Close()
+			return nil, fmt.Errorf("'%s' is a directory, not a file", file)
 		}
 
 		if err = w.Add(filepath.Dir(file)); err != nil {
-			return err
+			w.Close()
+			return nil, err
 		}
 	}
-	return nil
+	return w, nil
 }
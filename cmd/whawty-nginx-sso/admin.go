@@ -0,0 +1,309 @@
+//
+// Copyright (c) 2023 whawty contributors (see AUTHORS file)
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// * Neither the name of whawty.nginx-sso nor the names of its
+//   contributors may be used to endorse or promote products derived from
+//   this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+//
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+	"time"
+
+	"github.com/flosch/pongo2/v6"
+	"github.com/gin-gonic/gin"
+	"github.com/oklog/ulid/v2"
+	"github.com/whawty/nginx-sso/auth"
+	"github.com/whawty/nginx-sso/cookie"
+	"github.com/whawty/nginx-sso/ui"
+)
+
+const (
+	adminDateTimeLocalFormat = "2006-01-02T15:04"
+)
+
+func checkAdminConfig(conf *AdminConfig, b auth.Backend) error {
+	if len(conf.Users) == 0 && conf.Group == "" {
+		return fmt.Errorf("admin: at least one of 'users' or 'group' must be set")
+	}
+	if conf.Group != "" {
+		if _, ok := b.(auth.GroupBackend); !ok {
+			return fmt.Errorf("admin: the auth backend does not support group memberships")
+		}
+	}
+	return nil
+}
+
+func (h *HandlerContext) isAdmin(username string) bool {
+	state, release := h.useAuth()
+	defer release()
+	conf := state.conf.Admin
+	if conf == nil {
+		return false
+	}
+	for _, user := range conf.Users {
+		if user == username {
+			return true
+		}
+	}
+	if conf.Group == "" {
+		return false
+	}
+	groups, ok := state.auth.(auth.GroupBackend)
+	if !ok {
+		return false
+	}
+	member, err := groups.IsMember(username, conf.Group)
+	if err != nil {
+		wl.Printf("admin: failed to check whether user '%s' is a member of group '%s': %v", username, conf.Group, err)
+		return false
+	}
+	return member
+}
+
+// verifyAdmin returns the session of the user if it is an admin. If not, a response has already been sent.
+func (h *HandlerContext) verifyAdmin(c *gin.Context, html bool) *cookie.Session {
+	session, err := h.verifyCookie(c)
+	if err != nil {
+		if html {
+			base := h.getBasePath(c)
+			c.Redirect(http.StatusSeeOther, path.Join(base, "login")+"?redir="+url.QueryEscape(path.Join(base, "admin")))
+		} else {
+			c.JSON(http.StatusUnauthorized, WebError{err.Error()})
+		}
+		return nil
+	}
+	if !h.isAdmin(session.Username) {
+		wl.Printf("admin: denied access for user '%s'", session.Username)
+		if html {
+			c.Data(http.StatusForbidden, "text/plain", []byte("permission denied"))
+		} else {
+			c.JSON(http.StatusForbidden, WebError{"permission denied"})
+		}
+		return nil
+	}
+	h.renewCookie(c, session)
+	h.cookies.Touch(*session, c.ClientIP())
+	return session
+}
+
+type AdminRevokeRequest struct {
+	User   string `form:"user" json:"user"`
+	ID     string `form:"id" json:"id"`
+	Before string `form:"before" json:"before"`
+}
+
+type AdminRevokeResult struct {
+	Revoked uint `json:"revoked"`
+}
+
+func (h *HandlerContext) adminRevoke(admin string, req AdminRevokeRequest) (uint, error) {
+	if req.ID != "" {
+		if req.User == "" {
+			return 0, errors.New("revoking a session requires the user")
+		}
+		id, err := ulid.ParseStrict(req.ID)
+		if err != nil {
+			return 0, fmt.Errorf("invalid session: %v", err)
+		}
+		if err = h.cookies.RevokeID(req.User, id); err != nil {
+			return 0, err
+		}
+		wl.Printf("admin: user '%s' revoked session('%v') of user '%s'", admin, id, req.User)
+		return 1, nil
+	}
+	if req.User != "" {
+		wl.Printf("admin: user '%s' revokes all sessions of user '%s'", admin, req.User)
+		return h.cookies.RevokeUser(req.User)
+	}
+	if req.Before != "" {
+		before, err := time.Parse(time.RFC3339, req.Before)
+		if err != nil {
+			if before, err = time.ParseInLocation(adminDateTimeLocalFormat, req.Before, time.Local); err != nil {
+				return 0, fmt.Errorf("invalid timestamp: %s", req.Before)
+			}
+		}
+		wl.Printf("admin: user '%s' revokes all sessions issued before %v", admin, before)
+		return h.cookies.RevokeIssuedBefore(before)
+	}
+	return 0, errors.New("one of 'user', 'id' or 'before' must be set")
+}
+
+func (h *HandlerContext) renderAdmin(c *gin.Context, code int, session *cookie.Session, alerts []ui.Alert) {
+	login := h.conf().Login
+	login.BasePath = h.getBasePath(c)
+	search := c.Query("search")
+	user := c.Query("user")
+	tmplCtx := pongo2.Context{"login": login, "session": session, "search": search, "user": user}
+	tmplCtx["now"] = time.Now().Format(adminDateTimeLocalFormat)
+	if users, err := h.cookies.ListUsers(search); err == nil {
+		tmplCtx["users"] = users
+	} else {
+		alerts = append(alerts, ui.Alert{Level: ui.AlertDanger, Heading: "failed to load users", Message: err.Error()})
+	}
+	if user != "" {
+		if sessions, err := h.listSessions(user); err == nil {
+			tmplCtx["sessions"] = sessions
+		} else {
+			alerts = append(alerts, ui.Alert{Level: ui.AlertDanger, Heading: "failed to load user sessions", Message: err.Error()})
+		}
+	}
+	tmplCtx["alerts"] = alerts
+	c.HTML(code, "admin.htmpl", tmplCtx)
+	logTemplateErrors(c)
+}
+
+func (h *HandlerContext) handleAdminGet(c *gin.Context) {
+	session := h.verifyAdmin(c, true)
+	if session == nil {
+		return
+	}
+	h.renderAdmin(c, http.StatusOK, session, nil)
+}
+
+// checkSameOrigin rejects requests which have been sent by a page from another origin. Browsers add
+// Sec-Fetch-Site and/or Origin to all POST requests, if strict is set requests without both are rejected too.
+func checkSameOrigin(c *gin.Context, strict bool) error {
+	switch site := c.GetHeader("Sec-Fetch-Site"); site {
+	case "same-origin", "none":
+		return nil
+	case "":
+	default:
+		return fmt.Errorf("cross-origin request denied (Sec-Fetch-Site: %s)", site)
+	}
+	origin := c.GetHeader("Origin")
+	if origin == "" {
+		if strict {
+			return errors.New("request has no Origin header")
+		}
+		return nil
+	}
+	if u, err := url.Parse(origin); err != nil || u.Host != c.Request.Host {
+		return fmt.Errorf("cross-origin request denied (Origin: %s)", origin)
+	}
+	return nil
+}
+
+func (h *HandlerContext) handleAdminPost(c *gin.Context) {
+	if err := checkSameOrigin(c, true); err != nil {
+		wl.Printf("admin: %v", err)
+		c.Data(http.StatusForbidden, "text/plain", []byte(err.Error()))
+		return
+	}
+	session := h.verifyAdmin(c, true)
+	if session == nil {
+		return
+	}
+	var req AdminRevokeRequest
+	if err := c.ShouldBind(&req); err != nil {
+		alert := ui.Alert{Level: ui.AlertDanger, Heading: "invalid request", Message: err.Error()}
+		h.renderAdmin(c, http.StatusBadRequest, session, []ui.Alert{alert})
+		return
+	}
+	cnt, err := h.adminRevoke(session.Username, req)
+	if err != nil {
+		alert := ui.Alert{Level: ui.AlertDanger, Heading: "failed to revoke sessions", Message: err.Error()}
+		h.renderAdmin(c, http.StatusBadRequest, session, []ui.Alert{alert})
+		return
+	}
+	alert := ui.Alert{Level: ui.AlertSuccess, Heading: "success", Message: fmt.Sprintf("revoked %d session(s)", cnt)}
+	h.renderAdmin(c, http.StatusOK, session, []ui.Alert{alert})
+}
+
+func (h *HandlerContext) handleAdminAPIUsers(c *gin.Context) {
+	if h.verifyAdmin(c, false) == nil {
+		return
+	}
+	users, err := h.cookies.ListUsers(c.Query("search"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, WebError{err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, users)
+}
+
+func (h *HandlerContext) handleAdminAPISessions(c *gin.Context) {
+	if h.verifyAdmin(c, false) == nil {
+		return
+	}
+	var list cookie.SessionFullList
+	var err error
+	if user := c.Query("user"); user != "" {
+		list, err = h.cookies.ListUser(user)
+	} else {
+		list, err = h.cookies.ListAll()
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, WebError{err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, h.sessionInfos(list))
+}
+
+func (h *HandlerContext) handleAdminAPIWatermarks(c *gin.Context) {
+	if h.verifyAdmin(c, false) == nil {
+		return
+	}
+	watermarks, err := h.cookies.ListWatermarks()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, WebError{err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, watermarks)
+}
+
+func (h *HandlerContext) handleAdminAPIRevoke(c *gin.Context) {
+	// requiring JSON makes sure browsers won't send this cross-origin without a CORS preflight
+	if c.ContentType() != "application/json" {
+		c.JSON(http.StatusUnsupportedMediaType, WebError{"content type must be application/json"})
+		return
+	}
+	if err := checkSameOrigin(c, false); err != nil {
+		wl.Printf("admin: %v", err)
+		c.JSON(http.StatusForbidden, WebError{err.Error()})
+		return
+	}
+	session := h.verifyAdmin(c, false)
+	if session == nil {
+		return
+	}
+	var req AdminRevokeRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, WebError{err.Error()})
+		return
+	}
+	cnt, err := h.adminRevoke(session.Username, req)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, WebError{err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, AdminRevokeResult{Revoked: cnt})
+}
@@ -46,11 +46,19 @@ type LoginConfig struct {
 	Title         string `yaml:"title"`
 }
 
+type AdminConfig struct {
+	Users []string `yaml:"users"`
+	Group string   `yaml:"group"`
+}
+
 type WebConfig struct {
-	Listen      string               `yaml:"listen"`
-	TLS         *tlsconfig.TLSConfig `yaml:"tls"`
-	Login       LoginConfig          `yaml:"login"`
-	Revocations struct {
+	Listen         string               `yaml:"listen"`
+	TLS            *tlsconfig.TLSConfig `yaml:"tls"`
+	TrustedProxies []string             `yaml:"trusted-proxies"`
+	Login          LoginConfig          `yaml:"login"`
+	GeoIP          *GeoIPConfig         `yaml:"geoip"`
+	Admin          *AdminConfig         `yaml:"admin"`
+	Revocations    struct {
 		Tokens []string `yaml:"tokens"`
 	} `yaml:"revocations"`
 }
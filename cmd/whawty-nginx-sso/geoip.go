@@ -0,0 +1,101 @@
+//
+// Copyright (c) 2023 whawty contributors (see AUTHORS file)
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// * Neither the name of whawty.nginx-sso nor the names of its
+//   contributors may be used to endorse or promote products derived from
+//   this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+//
+
+package main
+
+import (
+	"net"
+	"os"
+	"strings"
+
+	"github.com/oschwald/geoip2-golang"
+)
+
+type GeoIPConfig struct {
+	Database string `yaml:"database"`
+	Language string `yaml:"language"`
+}
+
+type GeoIPLookup struct {
+	db       *geoip2.Reader
+	city     bool
+	language string
+}
+
+func newGeoIPLookup(conf *GeoIPConfig) (*GeoIPLookup, error) {
+	// the database is read into memory so that a reload can safely replace it while
+	// requests are still using the old one
+	data, err := os.ReadFile(conf.Database)
+	if err != nil {
+		return nil, err
+	}
+	db, err := geoip2.FromBytes(data)
+	if err != nil {
+		return nil, err
+	}
+	g := &GeoIPLookup{db: db, language: conf.Language}
+	if g.language == "" {
+		g.language = "en"
+	}
+	dbType := db.Metadata().DatabaseType
+	g.city = strings.Contains(dbType, "City") || strings.Contains(dbType, "Enterprise")
+	wl.Printf("geoip: successfully loaded %s database: %s", dbType, conf.Database)
+	return g, nil
+}
+
+// Lookup returns a human readable location of ip or an empty string if the location is not known.
+func (g *GeoIPLookup) Lookup(ip string) string {
+	if g == nil || ip == "" {
+		return ""
+	}
+	addr := net.ParseIP(ip)
+	if addr == nil {
+		return ""
+	}
+	if !g.city {
+		record, err := g.db.Country(addr)
+		if err != nil {
+			return ""
+		}
+		return record.Country.Names[g.language]
+	}
+	record, err := g.db.City(addr)
+	if err != nil {
+		return ""
+	}
+	var parts []string
+	if city := record.City.Names[g.language]; city != "" {
+		parts = append(parts, city)
+	}
+	if country := record.Country.Names[g.language]; country != "" {
+		parts = append(parts, country)
+	}
+	return strings.Join(parts, ", ")
+}
@@ -34,6 +34,8 @@ import (
 	"io"
 	"log"
 	"os"
+	"os/signal"
+	"syscall"
 
 	"github.com/urfave/cli"
 	"github.com/whawty/nginx-sso/auth"
@@ -72,9 +74,34 @@ func cmdRun(c *cli.Context) error {
 		return cli.NewExitError(err.Error(), 2)
 	}
 
+	state, err := newHandlerState(&conf.Web, auth)
+	if err != nil {
+		return cli.NewExitError(err.Error(), 2)
+	}
+	h := &HandlerContext{cookies: cookies}
+	h.state.Store(state)
+
+	reloader, err := newReloader(c.GlobalString("config"), prom.reg(), cookies, h)
+	if err != nil {
+		return cli.NewExitError(err.Error(), 2)
+	}
+	go reloader.run(c.Bool("watch-config"))
+
 	go prom.run()
 
-	if err := runWeb(&conf.Web, prom, cookies, auth); err != nil {
+	go func() {
+		sig := make(chan os.Signal, 1)
+		signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+		s := <-sig
+		wl.Printf("got signal '%v', shutting down", s)
+		if err := cookies.Close(); err != nil {
+			wl.Printf("failed to close cookie store: %v", err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}()
+
+	if err := runWeb(&conf.Web, prom, h); err != nil {
 		return cli.NewExitError(err.Error(), 4)
 	}
 
@@ -99,6 +126,43 @@ func main() {
 			Name:   "run",
 			Usage:  "run the sso backend",
 			Action: cmdRun,
+			Flags: []cli.Flag{
+				cli.BoolFlag{
+					Name:   "watch-config",
+					Usage:  "reload the configuration whenever the config file changes (SIGHUP always triggers a reload)",
+					EnvVar: "WHAWTY_NGINX_SSO_WATCH_CONFIG",
+				},
+			},
+		},
+		{
+			Name:  "store",
+			Usage: "manage the cookie store of a stopped instance",
+			Subcommands: []cli.Command{
+				{
+					Name:   "export",
+					Usage:  "export all sessions, revocations and watermarks as JSON Lines",
+					Action: cmdStoreExport,
+					Flags: []cli.Flag{
+						cli.StringFlag{
+							Name:  "output",
+							Value: "-",
+							Usage: "path to the file to write the export to, the file must not exist ('-' for stdout)",
+						},
+					},
+				},
+				{
+					Name:   "import",
+					Usage:  "import sessions, revocations and watermarks from an export",
+					Action: cmdStoreImport,
+					Flags: []cli.Flag{
+						cli.StringFlag{
+							Name:  "input",
+							Value: "-",
+							Usage: "path to the file to read the export from ('-' for stdin)",
+						},
+					},
+				},
+			},
 		},
 	}
 
@@ -0,0 +1,181 @@
+//
+// Copyright (c) 2023 whawty contributors (see AUTHORS file)
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// * Neither the name of whawty.nginx-sso nor the names of its
+//   contributors may be used to endorse or promote products derived from
+//   this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+//
+
+package main
+
+import (
+	"errors"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"syscall"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/whawty/nginx-sso/auth"
+	"github.com/whawty/nginx-sso/cookie"
+)
+
+var (
+	configReloadFailed      = prometheus.NewGauge(prometheus.GaugeOpts{Subsystem: "config", Name: "reload_failed"})
+	configReloadLastSuccess = prometheus.NewGauge(prometheus.GaugeOpts{Subsystem: "config", Name: "successful_reload_timestamp_seconds"})
+)
+
+// reloadRegisterer ignores metrics which have already been registered by the previous instance
+// of a reloaded component.
+type reloadRegisterer struct {
+	prometheus.Registerer
+}
+
+func (r reloadRegisterer) Register(c prometheus.Collector) error {
+	err := r.Registerer.Register(c)
+	if are := (prometheus.AlreadyRegisteredError{}); errors.As(err, &are) {
+		return nil
+	}
+	return err
+}
+
+func (r reloadRegisterer) MustRegister(cs ...prometheus.Collector) {
+	for _, c := range cs {
+		if err := r.Register(c); err != nil {
+			panic(err)
+		}
+	}
+}
+
+type Reloader struct {
+	configfile string
+	mutex      sync.Mutex
+	prom       prometheus.Registerer
+	cookies    *cookie.Store
+	handler    *HandlerContext
+}
+
+func newReloader(configfile string, prom prometheus.Registerer, cookies *cookie.Store, handler *HandlerContext) (*Reloader, error) {
+	r := &Reloader{configfile: configfile, cookies: cookies, handler: handler}
+	if prom != nil {
+		if err := prom.Register(configReloadFailed); err != nil {
+			return nil, err
+		}
+		if err := prom.Register(configReloadLastSuccess); err != nil {
+			return nil, err
+		}
+		r.prom = reloadRegisterer{prom}
+	}
+	configReloadLastSuccess.SetToCurrentTime()
+	return r, nil
+}
+
+func (r *Reloader) reload() {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if err := r.reloadConfig(); err != nil {
+		configReloadFailed.Set(1)
+		wl.Printf("reload: reloading configuration failed: %v, keeping current configuration", err)
+		return
+	}
+	configReloadFailed.Set(0)
+	configReloadLastSuccess.SetToCurrentTime()
+	wl.Printf("reload: successfully reloaded configuration from: %s", r.configfile)
+}
+
+func (r *Reloader) reloadConfig() error {
+	conf, err := readConfig(r.configfile)
+	if err != nil {
+		return err
+	}
+	current := r.handler.state.Load()
+	if conf.Web.Listen != current.conf.Listen || !reflect.DeepEqual(conf.Web.TLS, current.conf.TLS) ||
+		!reflect.DeepEqual(conf.Web.TrustedProxies, current.conf.TrustedProxies) {
+		wl.Printf("reload: changes to 'web.listen', 'web.tls' and 'web.trusted-proxies' will only take effect after a restart")
+	}
+	conf.Web.Listen = current.conf.Listen
+	conf.Web.TLS = current.conf.TLS
+	conf.Web.TrustedProxies = current.conf.TrustedProxies
+
+	backend, err := auth.NewBackend(&conf.Auth, r.prom, wl, wdl)
+	if err != nil {
+		return err
+	}
+	state, err := newHandlerState(&conf.Web, backend)
+	if err != nil {
+		backend.Close()
+		return err
+	}
+	if err = r.cookies.ReloadKeys(&conf.Cookie); err != nil {
+		backend.Close()
+		return err
+	}
+
+	old := r.handler.state.Swap(state)
+	// requests which loaded the old state just before the swap might still be using its auth backend
+	go old.closeAuth()
+	return nil
+}
+
+func (r *Reloader) run(watch bool) {
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGHUP)
+
+	var events <-chan fsnotify.Event
+	var watchErrors <-chan error
+	if watch {
+		w, err := fsnotify.NewWatcher()
+		if err == nil {
+			err = w.Add(filepath.Dir(r.configfile))
+		}
+		if err != nil {
+			wl.Printf("reload: failed to watch config file: %v, only SIGHUP will trigger a reload", err)
+		} else {
+			events = w.Events
+			watchErrors = w.Errors
+			wl.Printf("reload: watching config file '%s' for changes", r.configfile)
+		}
+	}
+
+	for {
+		select {
+		case <-sig:
+			wl.Printf("reload: got SIGHUP, reloading configuration")
+			r.reload()
+		case event := <-events:
+			if filepath.Clean(event.Name) != filepath.Clean(r.configfile) || !event.Has(fsnotify.Write|fsnotify.Create) {
+				continue
+			}
+			wl.Printf("reload: config file has changed, reloading configuration")
+			r.reload()
+		case err := <-watchErrors:
+			wl.Printf("reload: got error from fsnotify watcher: %v", err)
+		}
+	}
+}
@@ -0,0 +1,114 @@
+//
+// Copyright (c) 2023 whawty contributors (see AUTHORS file)
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// * Neither the name of whawty.nginx-sso nor the names of its
+//   contributors may be used to endorse or promote products derived from
+//   this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+//
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/urfave/cli"
+	"github.com/whawty/nginx-sso/cookie"
+)
+
+// openStoreBackend opens the cookie store backend of the configuration. This is meant to be used
+// while the instance is stopped, the bolt backend will refuse to open a database which is in use.
+func openStoreBackend(c *cli.Context) (cookie.StoreBackend, error) {
+	conf, err := readConfig(c.GlobalString("config"))
+	if err != nil {
+		return nil, err
+	}
+	if b := conf.Cookie.Backend; b.InMemory != nil && b.InMemory.Snapshot == nil {
+		return nil, fmt.Errorf("the in-memory backend does not persist any sessions unless snapshots are configured")
+	}
+	return cookie.NewStoreBackend(&conf.Cookie.Backend, nil)
+}
+
+func closeStoreBackend(backend cookie.StoreBackend) error {
+	if closer, ok := backend.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+func cmdStoreExport(c *cli.Context) error {
+	backend, err := openStoreBackend(c)
+	if err != nil {
+		return cli.NewExitError(err.Error(), 2)
+	}
+	defer closeStoreBackend(backend) //nolint:errcheck
+
+	out := os.Stdout
+	if path := c.String("output"); path != "-" {
+		if out, err = os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600); err != nil {
+			return cli.NewExitError(err.Error(), 2)
+		}
+		defer out.Close() //nolint:errcheck
+	}
+
+	stats, err := cookie.ExportBackend(backend, out)
+	if err != nil {
+		return cli.NewExitError(fmt.Sprintf("export failed: %v", err), 3)
+	}
+	if out != os.Stdout {
+		if err = out.Sync(); err != nil {
+			return cli.NewExitError(fmt.Sprintf("export failed: %v", err), 3)
+		}
+	}
+	// stdout might be used for the export itself
+	fmt.Fprintf(os.Stderr, "exported %v from %s\n", stats, backend.Name())
+	return nil
+}
+
+func cmdStoreImport(c *cli.Context) error {
+	backend, err := openStoreBackend(c)
+	if err != nil {
+		return cli.NewExitError(err.Error(), 2)
+	}
+
+	in := os.Stdin
+	if path := c.String("input"); path != "-" {
+		if in, err = os.Open(path); err != nil {
+			return cli.NewExitError(err.Error(), 2)
+		}
+		defer in.Close() //nolint:errcheck
+	}
+
+	stats, err := cookie.ImportBackend(backend, in)
+	if cerr := closeStoreBackend(backend); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return cli.NewExitError(fmt.Sprintf("import failed after adding %v: %v", stats, err), 3)
+	}
+	fmt.Fprintf(os.Stderr, "imported %v into %s\n", stats, backend.Name())
+	return nil
+}
@@ -31,16 +31,22 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
 	"errors"
+	"fmt"
 	"net"
 	"net/http"
 	"path"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/flosch/pongo2/v6"
 	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/render"
 	"github.com/mileusna/useragent"
 	"github.com/oklog/ulid/v2"
 	"github.com/prometheus/client_golang/prometheus"
@@ -92,10 +98,113 @@ func getAgentInfo(c *gin.Context) cookie.AgentInfo {
 	return cookie.AgentInfo{Name: ua.Name, OS: ua.OS, DeviceType: deviceType}
 }
 
+func getClientInfo(c *gin.Context) cookie.ClientInfo {
+	return cookie.ClientInfo{IP: c.ClientIP(), UserAgent: c.GetHeader("User-Agent")}
+}
+
+type handlerState struct {
+	conf  *WebConfig
+	auth  auth.Backend
+	html  render.HTMLRender
+	geoip *GeoIPLookup
+	// authMutex is held (read-locked) while the auth backend is in use, closeAuth waits for those requests
+	authMutex  sync.RWMutex
+	authClosed bool
+}
+
+// closeAuth closes the auth backend once all requests still using it are done.
+func (s *handlerState) closeAuth() {
+	s.authMutex.Lock()
+	defer s.authMutex.Unlock()
+	s.authClosed = true
+	s.auth.Close()
+}
+
+func newHandlerState(config *WebConfig, auth auth.Backend) (*handlerState, error) {
+	if config.Login.Title == "" {
+		config.Login.Title = "whawty.nginx-sso Login"
+	}
+
+	var htmlTmplLoader pongo2.TemplateLoader
+	if config.Login.TemplatesPath != "" {
+		var err error
+		htmlTmplLoader, err = pongo2.NewLocalFileSystemLoader(config.Login.TemplatesPath)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		htmlTmplLoader = pongo2.NewFSLoader(ui.Assets)
+	}
+	set := pongo2.NewSet("html", htmlTmplLoader)
+	for _, name := range []string{"login.htmpl", "logged-in.htmpl", "admin.htmpl"} {
+		if _, err := set.FromCache(name); err != nil {
+			return nil, err
+		}
+	}
+	if config.Admin != nil {
+		if err := checkAdminConfig(config.Admin, auth); err != nil {
+			return nil, err
+		}
+	}
+	state := &handlerState{conf: config, auth: auth}
+	state.html = pongo2gin.New(pongo2gin.RenderOptions{TemplateSet: set, ContentType: "text/html; charset=utf-8"})
+	if config.GeoIP != nil {
+		var err error
+		if state.geoip, err = newGeoIPLookup(config.GeoIP); err != nil {
+			return nil, err
+		}
+	}
+	return state, nil
+}
+
+// useAuth returns the current state whose auth backend may be used until release is called.
+func (h *HandlerContext) useAuth() (state *handlerState, release func()) {
+	for {
+		state = h.state.Load()
+		state.authMutex.RLock()
+		if !state.authClosed {
+			return state, state.authMutex.RUnlock
+		}
+		// the state has been replaced by a reload in the meantime
+		state.authMutex.RUnlock()
+	}
+}
+
 type HandlerContext struct {
-	conf    *WebConfig
 	cookies *cookie.Store
-	auth    auth.Backend
+	state   atomic.Pointer[handlerState]
+}
+
+func (h *HandlerContext) conf() *WebConfig {
+	return h.state.Load().conf
+}
+
+// Instance implements render.HTMLRender using the templates of the currently active state.
+func (h *HandlerContext) Instance(name string, data any) render.Render {
+	return h.state.Load().html.Instance(name, data)
+}
+
+type SessionInfo struct {
+	cookie.SessionFull
+	LoginLocation string `json:"login-location,omitempty"`
+	LastLocation  string `json:"last-location,omitempty"`
+}
+
+func (h *HandlerContext) listSessions(username string) ([]SessionInfo, error) {
+	list, err := h.cookies.ListUser(username)
+	if err != nil {
+		return nil, err
+	}
+	return h.sessionInfos(list), nil
+}
+
+func (h *HandlerContext) sessionInfos(list cookie.SessionFullList) []SessionInfo {
+	geoip := h.state.Load().geoip
+	sessions := make([]SessionInfo, 0, len(list))
+	for _, s := range list {
+		sessions = append(sessions, SessionInfo{SessionFull: s, LoginLocation: geoip.Lookup(s.LoginIP), LastLocation: geoip.Lookup(s.LastIP)})
+	}
+	return sessions
 }
 
 func (h *HandlerContext) verifyCookie(c *gin.Context) (*cookie.Session, error) {
@@ -106,16 +215,32 @@ func (h *HandlerContext) verifyCookie(c *gin.Context) (*cookie.Session, error) {
 	if cookie == "" {
 		return nil, errors.New("no cookie found")
 	}
-	session, err := h.cookies.Verify(cookie)
+	session, err := h.cookies.Verify(cookie, getClientInfo(c))
 	if err != nil {
 		return nil, err
 	}
 	return &session, nil
 }
 
+func setSessionCookie(c *gin.Context, value string, opts cookie.Options) {
+	c.SetSameSite(http.SameSiteLaxMode)
+	c.SetCookie(opts.Name, value, opts.MaxAge, "/", opts.Domain, opts.Secure, true)
+}
+
+func (h *HandlerContext) renewCookie(c *gin.Context, session *cookie.Session) {
+	value, opts, err := h.cookies.Renew(session)
+	if err != nil {
+		wl.Printf("failed to renew session('%v'): %v", session.ID, err)
+		return
+	}
+	if value != "" {
+		setSessionCookie(c, value, opts)
+	}
+}
+
 func (h *HandlerContext) getBasePath(c *gin.Context) string {
-	if h.conf.Login.BasePath != "" {
-		return strings.TrimRight(h.conf.Login.BasePath, "/")
+	if h.conf().Login.BasePath != "" {
+		return strings.TrimRight(h.conf().Login.BasePath, "/")
 	}
 	hdr := c.GetHeader("X-BasePath")
 	if hdr != "" {
@@ -125,10 +250,10 @@ func (h *HandlerContext) getBasePath(c *gin.Context) string {
 }
 
 func (h *HandlerContext) renderLoggedIn(c *gin.Context, code int, session *cookie.Session, alerts []ui.Alert) {
-	login := h.conf.Login
+	login := h.conf().Login
 	login.BasePath = h.getBasePath(c)
-	tmplCtx := pongo2.Context{"login": login, "session": session}
-	if sessions, err := h.cookies.ListUser(session.Username); err == nil {
+	tmplCtx := pongo2.Context{"login": login, "session": session, "admin": h.isAdmin(session.Username)}
+	if sessions, err := h.listSessions(session.Username); err == nil {
 		tmplCtx["sessions"] = sessions
 	} else {
 		alerts = append(alerts, ui.Alert{Level: ui.AlertDanger, Heading: "failed to load user sessions", Message: err.Error()})
@@ -144,17 +269,21 @@ func (h *HandlerContext) handleAuth(c *gin.Context) {
 		c.Data(http.StatusUnauthorized, "text/plain", []byte(err.Error()))
 		return
 	}
+	h.renewCookie(c, session)
+	h.cookies.Touch(*session, c.ClientIP())
 	c.Header("X-Username", session.Username)
 	c.Status(http.StatusOK)
 }
 
 func (h *HandlerContext) handleLoginGet(c *gin.Context) {
 	if session, err := h.verifyCookie(c); err == nil {
+		h.renewCookie(c, session)
+		h.cookies.Touch(*session, c.ClientIP())
 		h.renderLoggedIn(c, http.StatusOK, session, nil)
 		return
 	}
 
-	login := h.conf.Login
+	login := h.conf().Login
 	login.BasePath = h.getBasePath(c)
 	tmplCtx := pongo2.Context{"login": login}
 	tmplCtx["redirect"], _ = c.GetQuery("redir")
@@ -163,7 +292,7 @@ func (h *HandlerContext) handleLoginGet(c *gin.Context) {
 }
 
 func (h *HandlerContext) handleLoginPost(c *gin.Context) {
-	login := h.conf.Login
+	login := h.conf().Login
 	login.BasePath = h.getBasePath(c)
 
 	username := c.PostForm("username")
@@ -177,7 +306,9 @@ func (h *HandlerContext) handleLoginPost(c *gin.Context) {
 		return
 	}
 
-	err := h.auth.Authenticate(username, password)
+	state, release := h.useAuth()
+	err := state.auth.Authenticate(username, password)
+	release()
 	if err != nil {
 		tmplCtx["alert"] = ui.Alert{Level: ui.AlertDanger, Heading: "login failed", Message: err.Error()}
 		c.HTML(http.StatusBadRequest, "login.htmpl", tmplCtx)
@@ -185,14 +316,14 @@ func (h *HandlerContext) handleLoginPost(c *gin.Context) {
 		return
 	}
 
-	value, opts, err := h.cookies.New(username, getAgentInfo(c))
+	value, opts, err := h.cookies.New(username, getAgentInfo(c), getClientInfo(c))
 	if err != nil {
 		tmplCtx["alert"] = ui.Alert{Level: ui.AlertDanger, Heading: "failed to generate cookie", Message: err.Error()}
 		c.HTML(http.StatusBadRequest, "login.htmpl", tmplCtx)
 		logTemplateErrors(c)
 		return
 	}
-	c.SetCookie(opts.Name, value, opts.MaxAge, "/", opts.Domain, opts.Secure, true)
+	setSessionCookie(c, value, opts)
 
 	if redirect == "" {
 		redirect = path.Join(h.getBasePath(c), "login")
@@ -226,7 +357,8 @@ func (h *HandlerContext) handleLogout(c *gin.Context) {
 		}
 	}
 	opts := h.cookies.Options()
-	c.SetCookie(opts.Name, "invalid", -1, "/", opts.Domain, opts.Secure, true)
+	opts.MaxAge = -1
+	setSessionCookie(c, "invalid", opts)
 	redirect, _ := c.GetQuery("redir")
 	if redirect == "" {
 		redirect = path.Join(h.getBasePath(c), "login")
@@ -240,7 +372,7 @@ func (h *HandlerContext) handleSessions(c *gin.Context) {
 		c.JSON(http.StatusUnauthorized, WebError{err.Error()})
 		return
 	}
-	sessions, err := h.cookies.ListUser(session.Username)
+	sessions, err := h.listSessions(session.Username)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, WebError{err.Error()})
 		return
@@ -248,26 +380,46 @@ func (h *HandlerContext) handleSessions(c *gin.Context) {
 	c.JSON(http.StatusOK, sessions)
 }
 
-func (h *HandlerContext) handleRevocations(c *gin.Context) {
+func getBearerToken(c *gin.Context) (string, bool) {
 	auth_header := c.GetHeader("Authorization")
 	if auth_header == "" {
 		c.JSON(http.StatusUnauthorized, WebError{"no authorization header found"})
-		return
+		return "", false
 	}
 	auth_parts := strings.SplitN(auth_header, " ", 2)
 	if len(auth_parts) != 2 || auth_parts[0] != "Bearer" {
 		c.JSON(http.StatusUnauthorized, WebError{"authorization header is invalid"})
-		return
+		return "", false
 	}
-	authenticated := false
-	for _, token := range h.conf.Revocations.Tokens {
-		if token == auth_parts[1] {
-			authenticated = true
-			break
+	return auth_parts[1], true
+}
+
+func (h *HandlerContext) checkSyncToken(c *gin.Context) bool {
+	bearer, ok := getBearerToken(c)
+	if !ok {
+		return false
+	}
+	for _, token := range h.conf().Revocations.Tokens {
+		if token == bearer {
+			return true
 		}
 	}
-	if !authenticated {
-		c.JSON(http.StatusUnauthorized, WebError{"unauthorized token"})
+	c.JSON(http.StatusUnauthorized, WebError{"unauthorized token"})
+	return false
+}
+
+func (h *HandlerContext) handleRevocations(c *gin.Context) {
+	if !h.checkSyncToken(c) {
+		return
+	}
+
+	if since, ok := c.GetQuery("since"); ok {
+		update, err := h.cookies.RevocationsSince(since)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, WebError{err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, update)
 		return
 	}
 
@@ -279,12 +431,114 @@ func (h *HandlerContext) handleRevocations(c *gin.Context) {
 	c.JSON(http.StatusOK, revocations)
 }
 
-func runWeb(config *WebConfig, prom *MetricsHandler, cookies *cookie.Store, auth auth.Backend) (err error) {
-	if config.Listen == "" {
-		config.Listen = ":http"
+func (h *HandlerContext) handleRevocationStream(c *gin.Context) {
+	if !h.checkSyncToken(c) {
+		return
 	}
-	if config.Login.Title == "" {
-		config.Login.Title = "whawty.nginx-sso Login"
+
+	// the stream stays open for much longer than the write timeout of the server
+	if err := http.NewResponseController(c.Writer).SetWriteDeadline(time.Time{}); err != nil {
+		c.JSON(http.StatusInternalServerError, WebError{err.Error()})
+		return
+	}
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+	c.Header("X-Accel-Buffering", "no")
+	c.Status(http.StatusOK)
+	err := h.cookies.WatchRevocations(c.Request.Context(), c.Query("since"), cookie.RevocationStreamKeepAlive, func(update *cookie.SignedRevocationUpdate) (err error) {
+		var data []byte
+		if data, err = json.Marshal(update); err != nil {
+			return
+		}
+		_, err = fmt.Fprintf(c.Writer, "event: update\ndata: %s\n\n", data)
+		c.Writer.Flush()
+		return
+	})
+	if err != nil && !errors.Is(err, context.Canceled) {
+		wl.Printf("revocation stream for %s failed: %v", c.ClientIP(), err)
+	}
+}
+
+func (h *HandlerContext) handleActivity(c *gin.Context) {
+	if !h.checkSyncToken(c) {
+		return
+	}
+
+	var cursor int64
+	if sinceParam, _ := c.GetQuery("since"); sinceParam != "" {
+		var err error
+		if cursor, err = strconv.ParseInt(sinceParam, 10, 64); err != nil {
+			c.JSON(http.StatusBadRequest, WebError{"invalid cursor: " + err.Error()})
+			return
+		}
+	}
+	var list cookie.SessionActivityList
+	if err := c.ShouldBindJSON(&list); err != nil {
+		c.JSON(http.StatusBadRequest, WebError{err.Error()})
+		return
+	}
+	result, err := h.cookies.SyncActivity(list, cursor)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, WebError{err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, result)
+}
+
+// handleReplication deliberately doesn't accept the tokens of the verify-only instances, replication peers
+// have their own tokens.
+func (h *HandlerContext) handleReplication(c *gin.Context) {
+	token, ok := getBearerToken(c)
+	if !ok {
+		return
+	}
+	if !h.cookies.CheckReplicationToken(token) {
+		c.JSON(http.StatusUnauthorized, WebError{"unauthorized token"})
+		return
+	}
+
+	var req cookie.ReplicationRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, WebError{err.Error()})
+		return
+	}
+	result, err := h.cookies.Replicate(token, req)
+	if errors.Is(err, cookie.ErrReplicationUnauthorized) {
+		c.JSON(http.StatusUnauthorized, WebError{err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, WebError{err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, result)
+}
+
+func (h *HandlerContext) handleJWKS(c *gin.Context) {
+	keys, err := h.cookies.ListKeys()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, WebError{err.Error()})
+		return
+	}
+	if hdr := keys.SignatureHeader(); hdr != "" {
+		c.Header(cookie.KeySetSignatureHeader, hdr)
+	}
+	c.Data(http.StatusOK, "application/jwk-set+json", keys.KeySet)
+}
+
+func (h *HandlerContext) handleSyncHealth(c *gin.Context) {
+	health := h.cookies.SyncHealth()
+	if health.Stale {
+		c.JSON(http.StatusServiceUnavailable, health)
+		return
+	}
+	c.JSON(http.StatusOK, health)
+}
+
+func runWeb(config *WebConfig, prom *MetricsHandler, h *HandlerContext) (err error) {
+	listen := config.Listen
+	if listen == "" {
+		listen = ":http"
 	}
 
 	gin.SetMode(gin.ReleaseMode)
@@ -292,21 +546,11 @@ func runWeb(config *WebConfig, prom *MetricsHandler, cookies *cookie.Store, auth
 	r := gin.New()
 	r.Use(gin.Recovery())
 	r.HandleMethodNotAllowed = true
-
-	var htmlTmplLoader pongo2.TemplateLoader
-	if config.Login.TemplatesPath != "" {
-		htmlTmplLoader, err = pongo2.NewLocalFileSystemLoader(config.Login.TemplatesPath)
-		if err != nil {
-			return
-		}
-	} else {
-		htmlTmplLoader = pongo2.NewFSLoader(ui.Assets)
+	r.HTMLRender = h
+	if err = r.SetTrustedProxies(config.TrustedProxies); err != nil {
+		return
 	}
-	r.HTMLRender = pongo2gin.New(pongo2gin.RenderOptions{
-		TemplateSet: pongo2.NewSet("html", htmlTmplLoader),
-		ContentType: "text/html; charset=utf-8"})
 
-	h := &HandlerContext{conf: config, cookies: cookies, auth: auth}
 	r.GET("/", func(c *gin.Context) { c.Redirect(http.StatusSeeOther, path.Join(h.getBasePath(c), "login")) })
 	r.StaticFS("/ui/", http.FS(ui.StaticAssets))
 	prom.install(r)
@@ -326,8 +570,19 @@ func runWeb(config *WebConfig, prom *MetricsHandler, cookies *cookie.Store, auth
 	g.GET("/logout", h.handleLogout)
 	g.GET("/sessions", h.handleSessions)
 	g.GET("/revocations", h.handleRevocations)
-
-	listener, err := net.Listen("tcp", config.Listen)
+	g.GET("/revocations/stream", h.handleRevocationStream)
+	g.POST("/activity", h.handleActivity)
+	g.POST("/replication", h.handleReplication)
+	g.GET("/jwks", h.handleJWKS)
+	g.GET("/health/sync", h.handleSyncHealth)
+	g.GET("/admin", h.handleAdminGet)
+	g.POST("/admin", h.handleAdminPost)
+	g.GET("/admin/api/users", h.handleAdminAPIUsers)
+	g.GET("/admin/api/sessions", h.handleAdminAPISessions)
+	g.POST("/admin/api/revoke", h.handleAdminAPIRevoke)
+	g.GET("/admin/api/watermarks", h.handleAdminAPIWatermarks)
+
+	listener, err := net.Listen("tcp", listen)
 	if err != nil {
 		return err
 	}
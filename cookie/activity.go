@@ -0,0 +1,351 @@
+//
+// Copyright (c) 2023 whawty contributors (see AUTHORS file)
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// * Neither the name of whawty.nginx-sso nor the names of its
+//   contributors may be used to endorse or promote products derived from
+//   this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+//
+
+package cookie
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/oklog/ulid/v2"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	DefaultIdleTimeoutUpdateInterval = time.Minute
+
+	// activityTrackerMaxEntries limits the memory used for sessions which are active at the same time.
+	activityTrackerMaxEntries = 100000
+)
+
+var (
+	activitySyncRequests        = prometheus.NewCounterVec(prometheus.CounterOpts{Subsystem: metricsSubsystem, Name: "activity_sync_requests_total"}, []string{"result"})
+	activitySyncRequestsSuccess = activitySyncRequests.MustCurryWith(prometheus.Labels{"result": "success"})
+	activitySyncRequestsFailed  = activitySyncRequests.MustCurryWith(prometheus.Labels{"result": "failed"})
+)
+
+type IdleTimeoutConfig struct {
+	Timeout        time.Duration `yaml:"timeout"`
+	UpdateInterval time.Duration `yaml:"update-interval"`
+}
+
+type SessionActivity struct {
+	ID       ulid.ULID `json:"id"`
+	Username string    `json:"u"`
+	LastSeen int64     `json:"l"`
+	IP       string    `json:"ip,omitempty"`
+}
+
+type SessionActivityList []SessionActivity
+
+func (l SessionActivityList) MarshalJSON() ([]byte, error) {
+	if len(l) == 0 {
+		return []byte("[]"), nil
+	}
+	var tmp []SessionActivity = l
+	return json.Marshal(tmp)
+}
+
+type SessionActivitySync struct {
+	Cursor   int64               `json:"cursor"`
+	Activity SessionActivityList `json:"activity"`
+}
+
+type activityEntry struct {
+	SessionActivity
+	updated int64
+	dirty   bool
+}
+
+// activityTracker keeps the last activity of sessions in memory. Changes are written to the
+// backend, or reported to the sync upstream, every 'update-interval'.
+type activityTracker struct {
+	mutex     sync.Mutex
+	entries   map[ulid.ULID]*activityEntry
+	cursor    int64
+	retention time.Duration
+}
+
+// update returns false if the activity has been dropped because the tracker is full.
+func (a *activityTracker) update(activity SessionActivity, now int64, dirty bool) bool {
+	// sessions must not be kept active forever using a timestamp from the future
+	if limit := now / int64(time.Second); activity.LastSeen > limit {
+		activity.LastSeen = limit
+	}
+	entry, exists := a.entries[activity.ID]
+	if !exists {
+		if len(a.entries) >= activityTrackerMaxEntries {
+			return false
+		}
+		a.entries[activity.ID] = &activityEntry{SessionActivity: activity, updated: now, dirty: dirty}
+		return true
+	}
+	if activity.LastSeen > entry.LastSeen {
+		entry.LastSeen = activity.LastSeen
+		if activity.IP != "" {
+			entry.IP = activity.IP
+		}
+		entry.updated = now
+		entry.dirty = entry.dirty || dirty
+	}
+	return true
+}
+
+func (a *activityTracker) dirty() (list SessionActivityList) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	for _, entry := range a.entries {
+		if entry.dirty {
+			list = append(list, entry.SessionActivity)
+		}
+	}
+	return
+}
+
+func (a *activityTracker) clean(list SessionActivityList) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	for _, activity := range list {
+		if entry, exists := a.entries[activity.ID]; exists && entry.LastSeen == activity.LastSeen {
+			entry.dirty = false
+		}
+	}
+}
+
+// expire removes all entries which are idle anyway. Any session not found in memory will
+// fall back to the last-seen value stored in the backend or the time the session was created.
+func (a *activityTracker) expire() {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	limit := time.Now().Add(-a.retention).Unix()
+	for id, entry := range a.entries {
+		if !entry.dirty && entry.LastSeen < limit {
+			delete(a.entries, id)
+		}
+	}
+}
+
+func (st *Store) initActivity(conf *Config) error {
+	interval := DefaultIdleTimeoutUpdateInterval
+	retention := interval
+	if conf.IdleTimeout != nil {
+		if conf.IdleTimeout.Timeout <= 0 {
+			return fmt.Errorf("idle-timeout: 'timeout' must be > 0")
+		}
+		if conf.IdleTimeout.UpdateInterval <= 0 {
+			conf.IdleTimeout.UpdateInterval = DefaultIdleTimeoutUpdateInterval
+		}
+		if conf.IdleTimeout.UpdateInterval >= conf.IdleTimeout.Timeout {
+			return fmt.Errorf("idle-timeout: 'update-interval' must be shorter than 'timeout'")
+		}
+		interval = conf.IdleTimeout.UpdateInterval
+		retention = conf.IdleTimeout.Timeout
+	}
+	st.activity = &activityTracker{entries: make(map[ulid.ULID]*activityEntry), retention: retention}
+	go st.runActivityUpdates(interval)
+	return nil
+}
+
+// Touch marks the session as active and records the IP address the session has last been used from.
+func (st *Store) Touch(s Session, ip string) {
+	now := time.Now()
+	st.activity.mutex.Lock()
+	defer st.activity.mutex.Unlock()
+	if !st.activity.update(SessionActivity{ID: s.ID, Username: s.Username, LastSeen: now.Unix(), IP: ip}, now.UnixNano(), true) {
+		st.infoLog.Printf("cookie-store: too many active sessions, dropping activity of session('%v')", s.ID)
+	}
+}
+
+func (st *Store) lastSeen(s Session) (time.Time, error) {
+	st.activity.mutex.Lock()
+	entry, exists := st.activity.entries[s.ID]
+	var lastSeen int64
+	if exists {
+		lastSeen = entry.LastSeen
+	}
+	st.activity.mutex.Unlock()
+
+	if !exists {
+		var err error
+		if lastSeen, err = st.backend.LastSeen(s.Username, s.ID); err != nil {
+			return time.Time{}, err
+		}
+	}
+	if lastSeen == 0 {
+		return s.CreatedAt(), nil
+	}
+	return time.Unix(lastSeen, 0), nil
+}
+
+func (st *Store) checkIdle(s Session) error {
+	if st.conf.IdleTimeout == nil {
+		return nil
+	}
+	lastSeen, err := st.lastSeen(s)
+	if err != nil {
+		return fmt.Errorf("failed to fetch last activity of session: %v", err)
+	}
+	if time.Since(lastSeen) > st.conf.IdleTimeout.Timeout {
+		return fmt.Errorf("session is idle")
+	}
+	return nil
+}
+
+// knownSessions returns the IDs of all sessions of the users in list which exist in the backend.
+func (st *Store) knownSessions(list SessionActivityList) (map[ulid.ULID]bool, error) {
+	known := make(map[ulid.ULID]bool)
+	users := make(map[string]bool)
+	for _, activity := range list {
+		if users[activity.Username] {
+			continue
+		}
+		users[activity.Username] = true
+		sessions, err := st.backend.ListUser(activity.Username)
+		if err != nil {
+			return nil, err
+		}
+		for _, s := range sessions {
+			known[s.ID] = true
+		}
+	}
+	return known, nil
+}
+
+// SyncActivity merges the activity reported by a verify-only instance and returns all activity
+// which has been updated after cursor. Activity of sessions which are unknown to the backend, or
+// have been revoked already, is ignored.
+func (st *Store) SyncActivity(list SessionActivityList, cursor int64) (result SessionActivitySync, err error) {
+	var known map[ulid.ULID]bool
+	if known, err = st.knownSessions(list); err != nil {
+		return
+	}
+
+	st.activity.mutex.Lock()
+	defer st.activity.mutex.Unlock()
+
+	now := time.Now().UnixNano()
+	dropped := 0
+	for _, activity := range list {
+		if !known[activity.ID] || !st.activity.update(activity, now, true) {
+			dropped++
+		}
+	}
+	if dropped > 0 {
+		st.dbgLog.Printf("cookie-store: ignoring reported activity of %d sessions which are unknown, revoked or don't fit into the tracker", dropped)
+	}
+	for _, entry := range st.activity.entries {
+		if entry.updated > cursor {
+			result.Activity = append(result.Activity, entry.SessionActivity)
+		}
+	}
+	result.Cursor = now
+	return
+}
+
+func (st *Store) syncActivity(c *syncClient) bool {
+	list := st.activity.dirty()
+	body, err := json.Marshal(list)
+	if err != nil {
+		st.infoLog.Printf("sync-store: error encoding activity: %v", err)
+		return false
+	}
+	st.activity.mutex.Lock()
+	cursor := st.activity.cursor
+	st.activity.mutex.Unlock()
+
+	resp, err := c.post("activity", url.Values{"since": []string{strconv.FormatInt(cursor, 10)}}, body)
+	if err != nil {
+		st.infoLog.Printf("sync-store: error sending activity sync request: %v", err)
+		return false
+	}
+	defer resp.Body.Close() //nolint:errcheck
+
+	var result SessionActivitySync
+	if err = json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		st.infoLog.Printf("sync-store: error parsing activity sync response: %v", err)
+		return false
+	}
+	st.activity.clean(list)
+
+	st.activity.mutex.Lock()
+	defer st.activity.mutex.Unlock()
+	now := time.Now().UnixNano()
+	for _, activity := range result.Activity {
+		st.activity.update(activity, now, false)
+	}
+	st.activity.cursor = result.Cursor
+	return true
+}
+
+func (st *Store) saveActivity() bool {
+	list := st.activity.dirty()
+	if len(list) == 0 {
+		return true
+	}
+	if err := st.backend.SaveActivity(list); err != nil {
+		st.infoLog.Printf("cookie-store: failed to save session activity: %v", err)
+		return false
+	}
+	st.activity.clean(list)
+	return true
+}
+
+func (st *Store) updateActivity() {
+	if len(st.syncClients) > 0 {
+		if st.syncFailover(st.syncActivity) {
+			activitySyncRequestsSuccess.WithLabelValues().Inc()
+		} else {
+			activitySyncRequestsFailed.WithLabelValues().Inc()
+		}
+	} else {
+		st.saveActivity()
+	}
+	st.activity.expire()
+}
+
+func (st *Store) runActivityUpdates(interval time.Duration) {
+	t := time.NewTicker(interval)
+	st.dbgLog.Printf("cookie-store: updating session activity every %v", interval)
+	st.updateActivity()
+	for {
+		if _, ok := <-t.C; !ok {
+			st.infoLog.Printf("cookie-store: stopping activity updates because ticker-channel is closed")
+			return
+		}
+		st.updateActivity()
+	}
+}
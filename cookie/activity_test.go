@@ -0,0 +1,265 @@
+//
+// Copyright (c) 2023 whawty contributors (see AUTHORS file)
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// * Neither the name of whawty.nginx-sso nor the names of its
+//   contributors may be used to endorse or promote products derived from
+//   this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+//
+
+package cookie
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/oklog/ulid/v2"
+)
+
+func TestIdleTimeoutConfig(t *testing.T) {
+	conf := &Config{IdleTimeout: &IdleTimeoutConfig{}}
+	conf.Keys = []SignerVerifierConfig{
+		SignerVerifierConfig{Name: "sign-and-verify", Ed25519: &Ed25519Config{PrivKeyData: &testPrivKeyEd25519Pem}},
+	}
+	conf.Backend = StoreBackendConfig{InMemory: &InMemoryBackendConfig{}}
+	if _, err := NewStore(conf, nil, nil, nil); err == nil {
+		t.Fatal("initializing store with empty idle-timeout should fail")
+	}
+	conf.IdleTimeout = &IdleTimeoutConfig{Timeout: 30 * time.Second}
+	if _, err := NewStore(conf, nil, nil, nil); err == nil {
+		t.Fatal("initializing store with update-interval longer than idle-timeout should fail")
+	}
+	conf.IdleTimeout = &IdleTimeoutConfig{Timeout: 30 * time.Minute}
+	if _, err := NewStore(conf, nil, nil, nil); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if conf.IdleTimeout.UpdateInterval != DefaultIdleTimeoutUpdateInterval {
+		t.Fatalf("unset update-interval should be overriden to %v, got %v", DefaultIdleTimeoutUpdateInterval, conf.IdleTimeout.UpdateInterval)
+	}
+}
+
+func TestIdleTimeout(t *testing.T) {
+	conf := &Config{IdleTimeout: &IdleTimeoutConfig{Timeout: 30 * time.Minute, UpdateInterval: 10 * time.Minute}}
+	conf.Keys = []SignerVerifierConfig{
+		SignerVerifierConfig{Name: "sign-and-verify", Ed25519: &Ed25519Config{PrivKeyData: &testPrivKeyEd25519Pem}},
+	}
+	conf.Backend = StoreBackendConfig{InMemory: &InMemoryBackendConfig{}}
+	st, err := NewStore(conf, nil, nil, nil)
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+
+	testUser := "test-user"
+	value, _, err := st.New(testUser, AgentInfo{}, ClientInfo{})
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if _, err = st.Verify(value, ClientInfo{}); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+
+	old := Session{ID: ulid.MustNew(ulid.Timestamp(time.Now().Add(-time.Hour)), rand.Reader), SessionBase: SessionBase{Username: testUser}}
+	old.SetExpiry(time.Hour)
+	if err = st.backend.Save(SessionFull{Session: old}); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if err = st.checkIdle(old); err == nil {
+		t.Fatal("session without any activity since creation should be idle")
+	}
+	st.Touch(old, "192.0.2.1")
+	if err = st.checkIdle(old); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+
+	if !st.saveActivity() {
+		t.Fatal("saving activity failed")
+	}
+	if list := st.activity.dirty(); len(list) != 0 {
+		t.Fatalf("all activity should have been saved: %+v", list)
+	}
+	lastSeen, err := st.backend.LastSeen(testUser, old.ID)
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if time.Since(time.Unix(lastSeen, 0)) > 5*time.Second {
+		t.Fatalf("backend contains wrong last-seen value: %v", time.Unix(lastSeen, 0))
+	}
+
+	st.activity.mutex.Lock()
+	st.activity.entries[old.ID].LastSeen = time.Now().Add(-time.Hour).Unix()
+	st.activity.mutex.Unlock()
+	st.activity.expire()
+	st.activity.mutex.Lock()
+	_, exists := st.activity.entries[old.ID]
+	st.activity.mutex.Unlock()
+	if exists {
+		t.Fatal("idle entries should be removed from memory")
+	}
+	if err = st.checkIdle(old); err != nil {
+		t.Fatal("last-seen value from backend should be used:", err)
+	}
+
+	list, err := st.ListUser(testUser)
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	for _, s := range list {
+		if s.ID == old.ID && s.LastSeen != lastSeen {
+			t.Fatalf("ListUser() returned wrong last-seen value: expected %d, got %d", lastSeen, s.LastSeen)
+		}
+		if s.ID == old.ID && s.LastIP != "192.0.2.1" {
+			t.Fatalf("ListUser() returned wrong last IP: expected '192.0.2.1', got '%s'", s.LastIP)
+		}
+	}
+}
+
+func TestSyncActivity(t *testing.T) {
+	conf := &Config{IdleTimeout: &IdleTimeoutConfig{Timeout: 30 * time.Minute, UpdateInterval: 10 * time.Minute}}
+	conf.Keys = []SignerVerifierConfig{
+		SignerVerifierConfig{Name: "sign-and-verify", Ed25519: &Ed25519Config{PrivKeyData: &testPrivKeyEd25519Pem}},
+	}
+	conf.Backend = StoreBackendConfig{InMemory: &InMemoryBackendConfig{}}
+	signing, err := NewStore(conf, nil, nil, nil)
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/activity" || r.Method != "POST" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		cursor, _ := strconv.ParseInt(r.URL.Query().Get("since"), 10, 64)
+		var list SessionActivityList
+		if err := json.NewDecoder(r.Body).Decode(&list); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		result, err := signing.SyncActivity(list, cursor)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		json.NewEncoder(w).Encode(result) //nolint:errcheck
+	}))
+	defer srv.Close()
+
+	conf = &Config{IdleTimeout: &IdleTimeoutConfig{Timeout: 30 * time.Minute, UpdateInterval: 10 * time.Minute}}
+	conf.Keys = []SignerVerifierConfig{
+		SignerVerifierConfig{Name: "sign-and-verify", Ed25519: &Ed25519Config{PubKeyData: &testPubKeyEd25519Pem}},
+	}
+	conf.Backend = StoreBackendConfig{InMemory: &InMemoryBackendConfig{}}
+	conf.Backend.Sync = &StoreSyncConfig{BaseURL: srv.URL, Interval: time.Hour}
+	verifier, err := NewStore(conf, nil, nil, nil)
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	baseURL, _ := url.Parse(srv.URL)
+	c := verifier.newSyncClient(baseURL, "", nil, "")
+
+	testUser := "test-user"
+	old := Session{ID: ulid.MustNew(ulid.Timestamp(time.Now().Add(-time.Hour)), rand.Reader), SessionBase: SessionBase{Username: testUser}}
+	old.SetExpiry(time.Hour)
+	if err = signing.backend.Save(SessionFull{Session: old}); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	other := Session{ID: ulid.MustNew(ulid.Timestamp(time.Now().Add(-time.Hour)), rand.Reader), SessionBase: SessionBase{Username: testUser}}
+	other.SetExpiry(time.Hour)
+
+	verifier.Touch(old, "192.0.2.1")
+	signing.Touch(other, "192.0.2.2")
+	if !verifier.syncActivity(c) {
+		t.Fatal("syncing activity failed")
+	}
+	if list := verifier.activity.dirty(); len(list) != 0 {
+		t.Fatalf("all activity should have been reported: %+v", list)
+	}
+	if err = signing.checkIdle(old); err != nil {
+		t.Fatal("activity reported by verifier should have been merged:", err)
+	}
+	if err = verifier.checkIdle(other); err != nil {
+		t.Fatal("activity from signing instance should have been merged:", err)
+	}
+	if !signing.saveActivity() {
+		t.Fatal("saving activity failed")
+	}
+	if lastSeen, _ := signing.backend.LastSeen(testUser, old.ID); lastSeen == 0 {
+		t.Fatal("activity reported by verifier should have been saved to the backend")
+	}
+
+	cursor := verifier.activity.cursor
+	if !verifier.syncActivity(c) {
+		t.Fatal("syncing activity failed")
+	}
+	if verifier.activity.cursor <= cursor {
+		t.Fatal("sync cursor has not been advanced")
+	}
+
+	unknown := Session{ID: ulid.Make(), SessionBase: SessionBase{Username: testUser}}
+	unknown.SetExpiry(time.Hour)
+	future := time.Now().Add(24 * time.Hour).Unix()
+	report := SessionActivityList{
+		{ID: old.ID, Username: testUser, LastSeen: future},
+		{ID: unknown.ID, Username: testUser, LastSeen: time.Now().Unix()},
+	}
+	if _, err = signing.SyncActivity(report, 0); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if entry := signing.activity.entries[old.ID]; entry == nil || entry.LastSeen > time.Now().Unix() {
+		t.Fatalf("activity from the future should have been clamped: %+v", entry)
+	}
+	if _, exists := signing.activity.entries[unknown.ID]; exists {
+		t.Fatal("activity of unknown sessions should be ignored")
+	}
+
+	if err = signing.backend.Save(SessionFull{Session: unknown}); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	verifier.Touch(unknown, "192.0.2.3")
+	if err = verifier.Close(); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if _, exists := signing.activity.entries[unknown.ID]; !exists {
+		t.Fatal("pending activity should have been reported when closing the store")
+	}
+}
+
+func TestActivityTrackerLimit(t *testing.T) {
+	a := &activityTracker{entries: make(map[ulid.ULID]*activityEntry)}
+	now := time.Now()
+	for range activityTrackerMaxEntries {
+		if !a.update(SessionActivity{ID: ulid.Make(), LastSeen: now.Unix()}, now.UnixNano(), true) {
+			t.Fatal("activity should have been tracked")
+		}
+	}
+	if a.update(SessionActivity{ID: ulid.Make(), LastSeen: now.Unix()}, now.UnixNano(), true) {
+		t.Fatal("activity should have been dropped once the tracker is full")
+	}
+}
@@ -0,0 +1,143 @@
+//
+// Copyright (c) 2023 whawty contributors (see AUTHORS file)
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// * Neither the name of whawty.nginx-sso nor the names of its
+//   contributors may be used to endorse or promote products derived from
+//   this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+//
+
+package cookie
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+type UserSessions struct {
+	Username string `json:"username"`
+	Sessions uint   `json:"sessions"`
+	LastSeen int64  `json:"last-seen,omitempty"`
+}
+
+func (u UserSessions) LastSeenAt() time.Time {
+	if u.LastSeen == 0 {
+		return time.Time{}
+	}
+	return time.Unix(u.LastSeen, 0)
+}
+
+// ListAll returns the active sessions of all users sorted by username and creation time.
+func (st *Store) ListAll() (SessionFullList, error) {
+	list, err := st.backend.ListAll()
+	if err != nil {
+		return nil, err
+	}
+	st.mergeActivity(list)
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Username != list[j].Username {
+			return list[i].Username < list[j].Username
+		}
+		return list[i].ID.Compare(list[j].ID) < 0
+	})
+	return list, nil
+}
+
+// ListUsers returns all users with active sessions whose name contains search (case-insensitive).
+func (st *Store) ListUsers(search string) ([]UserSessions, error) {
+	list, err := st.ListAll()
+	if err != nil {
+		return nil, err
+	}
+	search = strings.ToLower(search)
+	users := []UserSessions{}
+	for _, s := range list {
+		if !strings.Contains(strings.ToLower(s.Username), search) {
+			continue
+		}
+		if len(users) == 0 || users[len(users)-1].Username != s.Username {
+			users = append(users, UserSessions{Username: s.Username})
+		}
+		u := &users[len(users)-1]
+		u.Sessions++
+		if s.LastSeen > u.LastSeen {
+			u.LastSeen = s.LastSeen
+		}
+	}
+	return users, nil
+}
+
+// RevokeUser revokes all sessions of the user. This includes sessions which are not stored in the
+// backend (e.g. sessions created by other signing instances).
+func (st *Store) RevokeUser(username string) (cnt uint, err error) {
+	if username == "" {
+		err = fmt.Errorf("username must not be empty")
+		return
+	}
+	if err = st.SetWatermark(username, time.Now()); err != nil {
+		return
+	}
+	var list SessionFullList
+	if list, err = st.listUser(username); err != nil {
+		return
+	}
+	for _, s := range list {
+		if err = st.RevokeID(s.Username, s.ID); err != nil {
+			return
+		}
+		cnt++
+	}
+	st.infoLog.Printf("cookie-store: revoked all %d sessions of user '%s'", cnt, username)
+	return
+}
+
+// RevokeIssuedBefore revokes all sessions of all users which have been created before t. This includes
+// sessions which are not stored in the backend (e.g. sessions created by other signing instances).
+func (st *Store) RevokeIssuedBefore(t time.Time) (cnt uint, err error) {
+	if t.After(time.Now()) {
+		err = fmt.Errorf("the time must not be in the future")
+		return
+	}
+	if err = st.SetWatermark("", t); err != nil {
+		return
+	}
+	// the watermark already invalidates these sessions but this way they are also gone from the session lists
+	var list SessionFullList
+	if list, err = st.backend.ListAll(); err != nil {
+		return
+	}
+	for _, s := range list {
+		if !s.CreatedAt().Before(t) {
+			continue
+		}
+		if err = st.RevokeID(s.Username, s.ID); err != nil {
+			return
+		}
+		cnt++
+	}
+	st.infoLog.Printf("cookie-store: revoked %d sessions issued before %v", cnt, t)
+	return
+}
@@ -0,0 +1,140 @@
+//
+// Copyright (c) 2023 whawty contributors (see AUTHORS file)
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// * Neither the name of whawty.nginx-sso nor the names of its
+//   contributors may be used to endorse or promote products derived from
+//   this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+//
+
+package cookie
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+)
+
+func TestAdmin(t *testing.T) {
+	backends := map[string]StoreBackendConfig{
+		"in-memory": StoreBackendConfig{InMemory: &InMemoryBackendConfig{}},
+		"bolt":      StoreBackendConfig{Bolt: &BoltBackendConfig{Path: filepath.Join(t.TempDir(), "sessions.db")}},
+		"redis":     StoreBackendConfig{Redis: &RedisBackendConfig{Addr: miniredis.RunT(t).Addr()}},
+	}
+	for name, backend := range backends {
+		t.Run(name, func(t *testing.T) {
+			conf := &Config{Expire: time.Hour}
+			conf.Keys = []SignerVerifierConfig{
+				SignerVerifierConfig{Name: "sign-and-verify", Ed25519: &Ed25519Config{PrivKeyData: &testPrivKeyEd25519Pem}},
+			}
+			conf.Backend = backend
+			st, err := NewStore(conf, nil, nil, nil)
+			if err != nil {
+				t.Fatal("unexpected error:", err)
+			}
+
+			values := make(map[string][]string)
+			for _, username := range []string{"alice", "bob", "Alice2", "bob"} {
+				value, _, err := st.New(username, AgentInfo{}, ClientInfo{})
+				if err != nil {
+					t.Fatal("unexpected error:", err)
+				}
+				values[username] = append(values[username], value)
+			}
+
+			list, err := st.ListAll()
+			if err != nil {
+				t.Fatal("unexpected error:", err)
+			}
+			if len(list) != 4 {
+				t.Fatalf("unexpected session list length: expected 4, got %d", len(list))
+			}
+			if list[0].Username != "Alice2" || list[3].Username != "bob" || list[2].ID.Compare(list[3].ID) >= 0 {
+				t.Fatalf("session list is not sorted: %+v", list)
+			}
+
+			users, err := st.ListUsers("ALI")
+			if err != nil {
+				t.Fatal("unexpected error:", err)
+			}
+			if len(users) != 2 || users[0].Username != "Alice2" || users[1].Username != "alice" {
+				t.Fatalf("unexpected search result: %+v", users)
+			}
+			if users, err = st.ListUsers(""); err != nil {
+				t.Fatal("unexpected error:", err)
+			}
+			if len(users) != 3 || users[2].Username != "bob" || users[2].Sessions != 2 {
+				t.Fatalf("unexpected user list: %+v", users)
+			}
+
+			cnt, err := st.RevokeUser("bob")
+			if err != nil {
+				t.Fatal("unexpected error:", err)
+			}
+			if cnt != 2 {
+				t.Fatalf("expected 2 sessions to be revoked, got %d", cnt)
+			}
+			for _, value := range values["bob"] {
+				if _, err = st.Verify(value, ClientInfo{}); err == nil {
+					t.Fatal("sessions of revoked user should be rejected")
+				}
+			}
+			if _, err = st.Verify(values["alice"][0], ClientInfo{}); err != nil {
+				t.Fatal("sessions of other users should still be valid:", err)
+			}
+
+			if cnt, err = st.RevokeIssuedBefore(time.Now().Add(-time.Minute)); err != nil {
+				t.Fatal("unexpected error:", err)
+			}
+			if cnt != 0 {
+				t.Fatalf("expected no sessions to be revoked, got %d", cnt)
+			}
+			if _, err = st.RevokeIssuedBefore(time.Now().Add(time.Hour)); err == nil {
+				t.Fatal("revoking sessions issued before a time in the future should fail")
+			}
+			time.Sleep(2 * time.Millisecond)
+			if cnt, err = st.RevokeIssuedBefore(time.Now()); err != nil {
+				t.Fatal("unexpected error:", err)
+			}
+			if cnt != 2 {
+				t.Fatalf("expected 2 sessions to be revoked, got %d", cnt)
+			}
+			if list, err = st.ListAll(); err != nil {
+				t.Fatal("unexpected error:", err)
+			}
+			if len(list) != 0 {
+				t.Fatalf("unexpected session list length: expected 0, got %d", len(list))
+			}
+			revoked, err := st.backend.ListRevoked()
+			if err != nil {
+				t.Fatal("unexpected error:", err)
+			}
+			if len(revoked) != 4 {
+				t.Fatalf("revocation list should contain 4 entries but has %d", len(revoked))
+			}
+		})
+	}
+}
@@ -31,6 +31,8 @@
 package cookie
 
 import (
+	"bytes"
+	"encoding/binary"
 	"encoding/json"
 	"fmt"
 	"time"
@@ -42,21 +44,40 @@ import (
 )
 
 const (
-	BoltSessionsBucket = "sessions"
-	BoltRevokedBucket  = "revoked"
+	BoltSessionsBucket   = "sessions"
+	BoltRevokedBucket    = "revoked"
+	BoltRevokedLogBucket = "revoked-log"
+	BoltWatermarksBucket = "watermarks"
+	BoltMetaBucket       = "meta"
+	BoltExpiryBucket     = "expiry"
+
+	boltRevocationEpochKey = "revocation-epoch"
 )
 
 type BoltBackendConfig struct {
-	Path string `yaml:"path"`
+	Path       string               `yaml:"path"`
+	Migrations BoltMigrationsConfig `yaml:"migrations"`
 }
 
 type BoltSession struct {
 	SessionBase
-	Agent AgentInfo `json:"agent"`
+	Agent    AgentInfo `json:"agent"`
+	LoginIP  string    `json:"login-ip,omitempty"`
+	LastSeen int64     `json:"last-seen,omitempty"`
+	LastIP   string    `json:"last-ip,omitempty"`
+}
+
+func newBoltSession(session SessionFull) BoltSession {
+	return BoltSession{SessionBase: session.SessionBase, Agent: session.Agent, LoginIP: session.LoginIP, LastSeen: session.LastSeen, LastIP: session.LastIP}
+}
+
+func (s BoltSession) full(id ulid.ULID) SessionFull {
+	return SessionFull{Session: Session{ID: id, SessionBase: s.SessionBase}, Agent: s.Agent, LoginIP: s.LoginIP, LastSeen: s.LastSeen, LastIP: s.LastIP}
 }
 
 type BoltBackend struct {
-	db *bolt.DB
+	db    *bolt.DB
+	epoch string
 }
 
 func NewBoltBackend(conf *BoltBackendConfig, prom prometheus.Registerer) (*BoltBackend, error) {
@@ -68,19 +89,25 @@ func NewBoltBackend(conf *BoltBackendConfig, prom prometheus.Registerer) (*BoltB
 		return nil, err
 	}
 
-	err = db.Update(func(tx *bolt.Tx) error {
-		if _, err = tx.CreateBucketIfNotExists([]byte(BoltSessionsBucket)); err != nil {
-			return err
-		}
-		if _, err = tx.CreateBucketIfNotExists([]byte(BoltRevokedBucket)); err != nil {
-			return err
-		}
+	if err = migrateBolt(db, &conf.Migrations); err != nil {
+		db.Close() //nolint:errcheck
+		return nil, err
+	}
+
+	var epoch []byte
+	err = db.View(func(tx *bolt.Tx) error {
+		epoch = bytes.Clone(tx.Bucket([]byte(BoltMetaBucket)).Get([]byte(boltRevocationEpochKey)))
 		return nil
 	})
+	if err != nil {
+		db.Close() //nolint:errcheck
+		return nil, err
+	}
 
-	b := &BoltBackend{db: db}
+	b := &BoltBackend{db: db, epoch: string(epoch)}
 	if prom != nil {
 		if err := b.initPrometheus(prom); err != nil {
+			db.Close() //nolint:errcheck
 			return nil, err
 		}
 	}
@@ -88,10 +115,59 @@ func NewBoltBackend(conf *BoltBackendConfig, prom prometheus.Registerer) (*BoltB
 }
 
 func (b *BoltBackend) initPrometheus(prom prometheus.Registerer) error {
-	// TODO: implement this!
+	if err := prom.Register(newBackendStatsCollector(b.stats, backendStatsCacheDuration)); err != nil {
+		return err
+	}
+
+	gauges := map[string]func() float64{
+		"bolt_db_size_bytes": func() float64 {
+			var size int64
+			b.db.View(func(tx *bolt.Tx) error { //nolint:errcheck
+				size = tx.Size()
+				return nil
+			})
+			return float64(size)
+		},
+		"bolt_freelist_free_pages":    func() float64 { return float64(b.db.Stats().FreePageN) },
+		"bolt_freelist_pending_pages": func() float64 { return float64(b.db.Stats().PendingPageN) },
+		"bolt_freelist_free_bytes":    func() float64 { return float64(b.db.Stats().FreeAlloc) },
+		"bolt_freelist_inuse_bytes":   func() float64 { return float64(b.db.Stats().FreelistInuse) },
+	}
+	for name, fn := range gauges {
+		if err := prom.Register(prometheus.NewGaugeFunc(prometheus.GaugeOpts{Subsystem: metricsSubsystem, Name: name}, fn)); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
+// stats only looks at the entries of the expiry index which have not expired yet.
+func (b *BoltBackend) stats() (stats backendStats, err error) {
+	err = b.db.View(func(tx *bolt.Tx) error {
+		expiry := tx.Bucket([]byte(BoltExpiryBucket))
+		if expiry == nil {
+			return fmt.Errorf("database is corrupt: 'expiry' bucket does not exist")
+		}
+		users := make(map[string]struct{})
+		c := expiry.Cursor()
+		for key, value := c.Seek(binary.BigEndian.AppendUint64(nil, uint64(time.Now().Unix()))); key != nil; key, value = c.Next() {
+			if len(key) != 25 {
+				continue
+			}
+			switch key[8] {
+			case boltExpirySession:
+				stats.Sessions = stats.Sessions + 1
+				users[string(value)] = struct{}{}
+			case boltExpiryRevoked:
+				stats.Revoked = stats.Revoked + 1
+			}
+		}
+		stats.Users = uint64(len(users))
+		return nil
+	})
+	return
+}
+
 func (b *BoltBackend) Name() string {
 	return fmt.Sprintf("bolt(%s)", b.db.Path())
 }
@@ -112,12 +188,15 @@ func (b *BoltBackend) Save(session SessionFull) error {
 			return fmt.Errorf("session '%v' already exists", session.ID)
 		}
 
-		value, err := json.Marshal(BoltSession{SessionBase: session.SessionBase, Agent: session.Agent})
+		value, err := json.Marshal(newBoltSession(session))
 		if err != nil {
 			return err
 		}
 
-		return user.Put(session.ID.Bytes(), value)
+		if err = user.Put(session.ID.Bytes(), value); err != nil {
+			return err
+		}
+		return boltIndexSession(tx, session.ID, session.SessionBase)
 	})
 }
 
@@ -131,26 +210,75 @@ func (b *BoltBackend) ListUser(username string) (list SessionFullList, err error
 		if user == nil {
 			return nil
 		}
+		return listUserBucket(user, &list)
+	})
+	return
+}
 
-		c := user.Cursor()
-		for key, value := c.First(); key != nil; key, value = c.Next() {
-			var id ulid.ULID
-			if err := id.UnmarshalBinary(key); err != nil {
-				return err
-			}
-			var session BoltSession
-			if err := json.Unmarshal(value, &session); err != nil {
-				return err
-			}
-			if !session.IsExpired() {
-				list = append(list, SessionFull{Session: Session{ID: id, SessionBase: session.SessionBase}, Agent: session.Agent})
-			}
+func listUserBucket(user *bolt.Bucket, list *SessionFullList) error {
+	c := user.Cursor()
+	for key, value := c.First(); key != nil; key, value = c.Next() {
+		var id ulid.ULID
+		if err := id.UnmarshalBinary(key); err != nil {
+			return err
 		}
-		return nil
+		var session BoltSession
+		if err := json.Unmarshal(value, &session); err != nil {
+			return err
+		}
+		if !session.IsExpired() {
+			*list = append(*list, session.full(id))
+		}
+	}
+	return nil
+}
+
+func (b *BoltBackend) ListAll() (list SessionFullList, err error) {
+	err = b.db.View(func(tx *bolt.Tx) error {
+		sessions := tx.Bucket([]byte(BoltSessionsBucket))
+		if sessions == nil {
+			return fmt.Errorf("database is corrupt: 'sessions' bucket does not exist")
+		}
+		return sessions.ForEachBucket(func(username []byte) error {
+			return listUserBucket(sessions.Bucket(username), &list)
+		})
 	})
 	return
 }
 
+func (b *BoltBackend) Renew(session Session) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		sessions := tx.Bucket([]byte(BoltSessionsBucket))
+		if sessions == nil {
+			return fmt.Errorf("database is corrupt: 'sessions' bucket does not exist")
+		}
+		user := sessions.Bucket([]byte(session.Username))
+		if user == nil {
+			return fmt.Errorf("session '%v' does not exist", session.ID)
+		}
+		value := user.Get(session.ID.Bytes())
+		if value == nil {
+			return fmt.Errorf("session '%v' does not exist", session.ID)
+		}
+		var s BoltSession
+		err := json.Unmarshal(value, &s)
+		if err != nil {
+			return err
+		}
+		if err = boltUnindexSession(tx, session.ID, s.Expires); err != nil {
+			return err
+		}
+		s.Expires = session.Expires
+		if value, err = json.Marshal(s); err != nil {
+			return err
+		}
+		if err = user.Put(session.ID.Bytes(), value); err != nil {
+			return err
+		}
+		return boltIndexSession(tx, session.ID, s.SessionBase)
+	})
+}
+
 func (b *BoltBackend) Revoke(session Session) error {
 	return b.db.Update(func(tx *bolt.Tx) error {
 		sessions := tx.Bucket([]byte(BoltSessionsBucket))
@@ -169,11 +297,20 @@ func (b *BoltBackend) Revoke(session Session) error {
 		}
 
 		if user := sessions.Bucket([]byte(session.Username)); user != nil {
+			if current := user.Get(session.ID.Bytes()); current != nil {
+				var s SessionBase
+				if err = json.Unmarshal(current, &s); err != nil {
+					return err
+				}
+				if err = boltUnindexSession(tx, session.ID, s.Expires); err != nil {
+					return err
+				}
+			}
 			if err := user.Delete(session.ID.Bytes()); err != nil {
 				return err
 			}
 		}
-		return revoked.Put(session.ID.Bytes(), value)
+		return boltPutRevoked(tx, revoked, session.ID, session.Expires, value)
 	})
 }
 
@@ -198,6 +335,7 @@ func (b *BoltBackend) RevokeID(username string, id ulid.ULID) error {
 		if err != nil {
 			return err
 		}
+		session.Binding = nil
 		if value, err = json.Marshal(session); err != nil {
 			return err
 		}
@@ -210,8 +348,73 @@ func (b *BoltBackend) RevokeID(username string, id ulid.ULID) error {
 		if err := user.Delete(id.Bytes()); err != nil {
 			return err
 		}
-		return revoked.Put(id.Bytes(), value)
+		if err = boltUnindexSession(tx, id, session.Expires); err != nil {
+			return err
+		}
+		return boltPutRevoked(tx, revoked, id, session.Expires, value)
+	})
+}
+
+func (b *BoltBackend) SaveActivity(list SessionActivityList) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		sessions := tx.Bucket([]byte(BoltSessionsBucket))
+		if sessions == nil {
+			return fmt.Errorf("database is corrupt: 'sessions' bucket does not exist")
+		}
+		for _, activity := range list {
+			user := sessions.Bucket([]byte(activity.Username))
+			if user == nil {
+				continue
+			}
+			value := user.Get(activity.ID.Bytes())
+			if value == nil {
+				continue
+			}
+			var session BoltSession
+			err := json.Unmarshal(value, &session)
+			if err != nil {
+				return err
+			}
+			if session.LastSeen >= activity.LastSeen {
+				continue
+			}
+			session.LastSeen = activity.LastSeen
+			if activity.IP != "" {
+				session.LastIP = activity.IP
+			}
+			if value, err = json.Marshal(session); err != nil {
+				return err
+			}
+			if err = user.Put(activity.ID.Bytes(), value); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (b *BoltBackend) LastSeen(username string, id ulid.ULID) (lastSeen int64, err error) {
+	err = b.db.View(func(tx *bolt.Tx) error {
+		sessions := tx.Bucket([]byte(BoltSessionsBucket))
+		if sessions == nil {
+			return fmt.Errorf("database is corrupt: 'sessions' bucket does not exist")
+		}
+		user := sessions.Bucket([]byte(username))
+		if user == nil {
+			return nil
+		}
+		value := user.Get(id.Bytes())
+		if value == nil {
+			return nil
+		}
+		var session BoltSession
+		if err := json.Unmarshal(value, &session); err != nil {
+			return err
+		}
+		lastSeen = session.LastSeen
+		return nil
 	})
+	return
 }
 
 func (b *BoltBackend) IsRevoked(session Session) (isRevoked bool, err error) {
@@ -256,6 +459,94 @@ func (b *BoltBackend) ListRevoked() (list SessionList, err error) {
 	return
 }
 
+// boltPutRevoked stores the revoked session and appends it to the revocation log. If the session
+// has been revoked before, the previous log and expiry index entries are replaced.
+func boltPutRevoked(tx *bolt.Tx, revoked *bolt.Bucket, id ulid.ULID, expires int64, value []byte) error {
+	log := tx.Bucket([]byte(BoltRevokedLogBucket))
+	if log == nil {
+		return fmt.Errorf("database is corrupt: 'revoked-log' bucket does not exist")
+	}
+	expiry := tx.Bucket([]byte(BoltExpiryBucket))
+	if expiry == nil {
+		return fmt.Errorf("database is corrupt: 'expiry' bucket does not exist")
+	}
+	if current := revoked.Get(id.Bytes()); current != nil {
+		var session SessionBase
+		if err := json.Unmarshal(current, &session); err != nil {
+			return err
+		}
+		key := boltExpiryKey(session.Expires, boltExpiryRevoked, id)
+		if seq := expiry.Get(key); len(seq) > 0 {
+			if err := log.Delete(seq); err != nil {
+				return err
+			}
+		}
+		if err := expiry.Delete(key); err != nil {
+			return err
+		}
+	}
+	if err := revoked.Put(id.Bytes(), value); err != nil {
+		return err
+	}
+	seq, err := log.NextSequence()
+	if err != nil {
+		return err
+	}
+	seqKey := binary.BigEndian.AppendUint64(nil, seq)
+	if err = log.Put(seqKey, id.Bytes()); err != nil {
+		return err
+	}
+	return expiry.Put(boltExpiryKey(expires, boltExpiryRevoked, id), seqKey)
+}
+
+func (b *BoltBackend) RevocationEpoch() (string, error) {
+	return b.epoch, nil
+}
+
+func (b *BoltBackend) ListRevokedSince(seq uint64) (list SessionList, last uint64, err error) {
+	err = b.db.View(func(tx *bolt.Tx) error {
+		revoked := tx.Bucket([]byte(BoltRevokedBucket))
+		if revoked == nil {
+			return fmt.Errorf("database is corrupt: 'revoked' bucket does not exist")
+		}
+		log := tx.Bucket([]byte(BoltRevokedLogBucket))
+		if log == nil {
+			return fmt.Errorf("database is corrupt: 'revoked-log' bucket does not exist")
+		}
+		last = log.Sequence()
+
+		appendRevoked := func(key, value []byte) error {
+			var id ulid.ULID
+			if err := id.UnmarshalBinary(key); err != nil {
+				return err
+			}
+			var session SessionBase
+			if err := json.Unmarshal(value, &session); err != nil {
+				return err
+			}
+			if !session.IsExpired() {
+				list = append(list, Session{ID: id, SessionBase: session})
+			}
+			return nil
+		}
+
+		if seq == 0 {
+			// revocations which have been stored before the log existed are only part of the full list
+			return revoked.ForEach(appendRevoked)
+		}
+		c := log.Cursor()
+		for key, id := c.Seek(binary.BigEndian.AppendUint64(nil, seq+1)); key != nil; key, id = c.Next() {
+			if value := revoked.Get(id); value != nil {
+				if err := appendRevoked(id, value); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+	return
+}
+
 func (b *BoltBackend) LoadRevocations(list SessionList) (cnt uint, err error) {
 	cnt = 0
 	err = b.db.Update(func(tx *bolt.Tx) error {
@@ -270,7 +561,7 @@ func (b *BoltBackend) LoadRevocations(list SessionList) (cnt uint, err error) {
 				if err != nil {
 					return err
 				}
-				if err = revoked.Put(session.ID.Bytes(), value); err != nil {
+				if err = boltPutRevoked(tx, revoked, session.ID, session.Expires, value); err != nil {
 					return err
 				}
 				cnt = cnt + 1
@@ -281,62 +572,110 @@ func (b *BoltBackend) LoadRevocations(list SessionList) (cnt uint, err error) {
 	return
 }
 
-func deleteExpired(tx *bolt.Tx, c *bolt.Cursor) (cnt uint, err error) {
-	cnt = 0
-	// https://github.com/etcd-io/bbolt/issues/146#issuecomment-919299859
-	for key, value := c.First(); key != nil; {
-		// depending on the bucket this cursor is coming from, value might contain a
-		// BoltSession or just a SessionBase. But since BoltSession nests SessionBase
-		// and we are only interested in expiry anyway we can get away with just
-		// unmarshalling SessionBase.
-		var session SessionBase
-		if err = json.Unmarshal(value, &session); err != nil {
-			return
+// bolt does not allow empty keys so the global watermark and the ones of the users get different prefixes
+func boltWatermarkKey(username string) []byte {
+	if username == "" {
+		return []byte("g")
+	}
+	return []byte("u" + username)
+}
+
+func boltWatermarkUsername(key []byte) string {
+	return string(key[1:])
+}
+
+func boltGetWatermark(watermarks *bolt.Bucket, username string) (notBefore int64, err error) {
+	if value := watermarks.Get(boltWatermarkKey(username)); value != nil {
+		err = json.Unmarshal(value, &notBefore)
+	}
+	return
+}
+
+func (b *BoltBackend) Watermark(username string) (notBefore int64, err error) {
+	err = b.db.View(func(tx *bolt.Tx) error {
+		watermarks := tx.Bucket([]byte(BoltWatermarksBucket))
+		if watermarks == nil {
+			return fmt.Errorf("database is corrupt: 'watermarks' bucket does not exist")
 		}
-		if session.IsExpired() {
-			if err = c.Delete(); err != nil {
-				return
-			}
-			cnt = cnt + 1
-			key, value = c.Seek(key)
-		} else {
-			key, value = c.Next()
+		global, err := boltGetWatermark(watermarks, "")
+		if err != nil {
+			return err
 		}
-	}
+		user, err := boltGetWatermark(watermarks, username)
+		if err != nil {
+			return err
+		}
+		notBefore = max(global, user)
+		return nil
+	})
 	return
 }
 
-func (b *BoltBackend) CollectGarbage() (cnt uint, err error) {
+func (b *BoltBackend) ListWatermarks() (list Watermarks, err error) {
+	list = make(Watermarks)
+	err = b.db.View(func(tx *bolt.Tx) error {
+		watermarks := tx.Bucket([]byte(BoltWatermarksBucket))
+		if watermarks == nil {
+			return fmt.Errorf("database is corrupt: 'watermarks' bucket does not exist")
+		}
+		return watermarks.ForEach(func(key, value []byte) error {
+			var notBefore int64
+			if err := json.Unmarshal(value, &notBefore); err != nil {
+				return err
+			}
+			list[boltWatermarkUsername(key)] = notBefore
+			return nil
+		})
+	})
+	return
+}
+
+func (b *BoltBackend) LoadWatermarks(list Watermarks) (cnt uint, err error) {
 	cnt = 0
 	err = b.db.Update(func(tx *bolt.Tx) error {
-		sessions := tx.Bucket([]byte(BoltSessionsBucket))
-		if sessions == nil {
-			return fmt.Errorf("database is corrupt: 'sessions' bucket does not exist")
+		watermarks := tx.Bucket([]byte(BoltWatermarksBucket))
+		if watermarks == nil {
+			return fmt.Errorf("database is corrupt: 'watermarks' bucket does not exist")
 		}
-
-		err := sessions.ForEachBucket(func(username []byte) error {
-			user := sessions.Bucket(username)
-			if user == nil {
-				return nil
+		for username, notBefore := range list {
+			current, err := boltGetWatermark(watermarks, username)
+			if err != nil {
+				return err
+			}
+			if notBefore <= current {
+				continue
 			}
-			tmp, err := deleteExpired(tx, user.Cursor())
+			value, err := json.Marshal(notBefore)
 			if err != nil {
 				return err
 			}
-			cnt = cnt + tmp
-			return nil
+			if err = watermarks.Put(boltWatermarkKey(username), value); err != nil {
+				return err
+			}
+			cnt = cnt + 1
+		}
+		return nil
+	})
+	return
+}
+
+func (b *BoltBackend) CollectGarbage() (cnt uint, err error) {
+	cnt = 0
+	now := time.Now().Unix()
+	// every batch gets its own transaction so that other writers are not blocked for too long
+	for {
+		var removed uint
+		done := false
+		err = b.db.Update(func(tx *bolt.Tx) (err error) {
+			removed, done, err = boltCollectGarbageBatch(tx, now, boltGCBatchSize)
+			return
 		})
 		if err != nil {
-			return err
+			return
 		}
-
-		revoked := tx.Bucket([]byte(BoltRevokedBucket))
-		if revoked == nil {
-			return fmt.Errorf("database is corrupt: 'revoked' bucket does not exist")
+		cnt = cnt + removed
+		if done {
+			return
 		}
-
-		_, err = deleteExpired(tx, revoked.Cursor())
-		return err
-	})
-	return
+	}
 }
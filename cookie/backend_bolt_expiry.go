@@ -0,0 +1,232 @@
+//
+// Copyright (c) 2023 whawty contributors (see AUTHORS file)
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// * Neither the name of whawty.nginx-sso nor the names of its
+//   contributors may be used to endorse or promote products derived from
+//   this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+//
+
+package cookie
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+
+	"github.com/oklog/ulid/v2"
+	bolt "go.etcd.io/bbolt"
+)
+
+const (
+	boltExpirySession = 's'
+	boltExpiryRevoked = 'r'
+)
+
+// boltGCBatchSize limits the number of expiry index entries processed within a single transaction.
+var boltGCBatchSize = 1000
+
+// The expiry index contains an entry for every session and revocation. The keys are ordered by expiry
+// time, this way the garbage collector only needs to look at entries which have actually expired.
+// The value of session entries is the username, the one of revocations is the key of the
+// corresponding entry in the revocation log.
+func boltExpiryKey(expires int64, kind byte, id ulid.ULID) []byte {
+	key := binary.BigEndian.AppendUint64(make([]byte, 0, 25), uint64(max(expires, 0)))
+	key = append(key, kind)
+	return append(key, id.Bytes()...)
+}
+
+func boltIndexSession(tx *bolt.Tx, id ulid.ULID, session SessionBase) error {
+	expiry := tx.Bucket([]byte(BoltExpiryBucket))
+	if expiry == nil {
+		return fmt.Errorf("database is corrupt: 'expiry' bucket does not exist")
+	}
+	return expiry.Put(boltExpiryKey(session.Expires, boltExpirySession, id), []byte(session.Username))
+}
+
+func boltUnindexSession(tx *bolt.Tx, id ulid.ULID, expires int64) error {
+	expiry := tx.Bucket([]byte(BoltExpiryBucket))
+	if expiry == nil {
+		return fmt.Errorf("database is corrupt: 'expiry' bucket does not exist")
+	}
+	return expiry.Delete(boltExpiryKey(expires, boltExpirySession, id))
+}
+
+// boltDeleteIfExpired removes the entry for id from bucket if it has expired. If the entry does not
+// exist it counts as removed.
+func boltDeleteIfExpired(bucket *bolt.Bucket, id []byte) (bool, error) {
+	if bucket == nil {
+		return true, nil
+	}
+	value := bucket.Get(id)
+	if value == nil {
+		return true, nil
+	}
+	// value contains either a BoltSession or just a SessionBase, we are only interested in expiry anyway
+	var session SessionBase
+	if err := json.Unmarshal(value, &session); err != nil {
+		return false, err
+	}
+	if !session.IsExpired() {
+		return false, nil
+	}
+	return true, bucket.Delete(id)
+}
+
+// boltCollectGarbageBatch processes up to limit entries of the expiry index which have expired
+// before now. done is true if there are no more expired entries left.
+func boltCollectGarbageBatch(tx *bolt.Tx, now int64, limit int) (cnt uint, done bool, err error) {
+	sessions := tx.Bucket([]byte(BoltSessionsBucket))
+	if sessions == nil {
+		return 0, false, fmt.Errorf("database is corrupt: 'sessions' bucket does not exist")
+	}
+	revoked := tx.Bucket([]byte(BoltRevokedBucket))
+	if revoked == nil {
+		return 0, false, fmt.Errorf("database is corrupt: 'revoked' bucket does not exist")
+	}
+	log := tx.Bucket([]byte(BoltRevokedLogBucket))
+	if log == nil {
+		return 0, false, fmt.Errorf("database is corrupt: 'revoked-log' bucket does not exist")
+	}
+	expiry := tx.Bucket([]byte(BoltExpiryBucket))
+	if expiry == nil {
+		return 0, false, fmt.Errorf("database is corrupt: 'expiry' bucket does not exist")
+	}
+
+	end := binary.BigEndian.AppendUint64(nil, uint64(max(now, 0)))
+	c := expiry.Cursor()
+	// every entry we look at gets deleted, so the next one is always the first one
+	for key, value := c.First(); key != nil && bytes.Compare(key, end) < 0; key, value = c.First() {
+		if limit <= 0 {
+			return
+		}
+		limit = limit - 1
+		if len(key) != 25 {
+			return 0, false, fmt.Errorf("database is corrupt: invalid key in 'expiry' bucket")
+		}
+		id := key[9:]
+		switch key[8] {
+		case boltExpirySession:
+			user := sessions.Bucket(value)
+			exists := user != nil && user.Get(id) != nil
+			removed, err := boltDeleteIfExpired(user, id)
+			if err != nil {
+				return 0, false, err
+			}
+			if exists && removed {
+				cnt = cnt + 1
+			}
+		case boltExpiryRevoked:
+			removed, err := boltDeleteIfExpired(revoked, id)
+			if err != nil {
+				return 0, false, err
+			}
+			if removed && len(value) > 0 {
+				if err = log.Delete(value); err != nil {
+					return 0, false, err
+				}
+			}
+		}
+		if err = c.Delete(); err != nil {
+			return
+		}
+	}
+	done = true
+	return
+}
+
+// boltBuildExpiryIndex adds all sessions and revocations to the expiry index. While at it, all
+// entries of the revocation log except the latest one for every revoked session are removed.
+func boltBuildExpiryIndex(tx *bolt.Tx) error {
+	expiry, err := tx.CreateBucketIfNotExists([]byte(BoltExpiryBucket))
+	if err != nil {
+		return err
+	}
+	sessions := tx.Bucket([]byte(BoltSessionsBucket))
+	revoked := tx.Bucket([]byte(BoltRevokedBucket))
+	log := tx.Bucket([]byte(BoltRevokedLogBucket))
+
+	err = sessions.ForEachBucket(func(username []byte) error {
+		return sessions.Bucket(username).ForEach(func(key, value []byte) error {
+			var id ulid.ULID
+			if err := id.UnmarshalBinary(key); err != nil {
+				return err
+			}
+			var session SessionBase
+			if err := json.Unmarshal(value, &session); err != nil {
+				return err
+			}
+			return expiry.Put(boltExpiryKey(session.Expires, boltExpirySession, id), bytes.Clone(username))
+		})
+	})
+	if err != nil {
+		return err
+	}
+
+	latest := make(map[ulid.ULID][]byte)
+	err = log.ForEach(func(seq, id []byte) error {
+		var tmp ulid.ULID
+		if err := tmp.UnmarshalBinary(id); err != nil {
+			return err
+		}
+		latest[tmp] = bytes.Clone(seq)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	c := log.Cursor()
+	for seq, id := c.First(); seq != nil; {
+		var tmp ulid.ULID
+		if err = tmp.UnmarshalBinary(id); err != nil {
+			return err
+		}
+		if revoked.Get(id) == nil || !bytes.Equal(latest[tmp], seq) {
+			if err = c.Delete(); err != nil {
+				return err
+			}
+			seq, id = c.Seek(seq)
+		} else {
+			seq, id = c.Next()
+		}
+	}
+
+	return revoked.ForEach(func(key, value []byte) error {
+		var id ulid.ULID
+		if err := id.UnmarshalBinary(key); err != nil {
+			return err
+		}
+		var session SessionBase
+		if err := json.Unmarshal(value, &session); err != nil {
+			return err
+		}
+		// revocations which have been stored before the log existed have no log entry
+		seq := latest[id]
+		if seq == nil {
+			seq = []byte{}
+		}
+		return expiry.Put(boltExpiryKey(session.Expires, boltExpiryRevoked, id), seq)
+	})
+}
@@ -0,0 +1,133 @@
+//
+// Copyright (c) 2023 whawty contributors (see AUTHORS file)
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// * Neither the name of whawty.nginx-sso nor the names of its
+//   contributors may be used to endorse or promote products derived from
+//   this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+//
+
+package cookie
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/oklog/ulid/v2"
+	bolt "go.etcd.io/bbolt"
+)
+
+func boltTestBucketSize(t *testing.T, b *BoltBackend, name string) (n int) {
+	err := b.db.View(func(tx *bolt.Tx) error {
+		n = tx.Bucket([]byte(name)).Stats().KeyN
+		return nil
+	})
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	return
+}
+
+func TestBoltExpiryIndex(t *testing.T) {
+	b, err := NewBoltBackend(&BoltBackendConfig{Path: filepath.Join(t.TempDir(), "sessions.db")}, nil)
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	defer b.db.Close() //nolint:errcheck
+
+	oldBatchSize := boltGCBatchSize
+	boltGCBatchSize = 2
+	defer func() { boltGCBatchSize = oldBatchSize }()
+
+	testUser := "test-user"
+	newSession := func(lifetime time.Duration) SessionFull {
+		s := SessionFull{Session: Session{ID: ulid.Make(), SessionBase: SessionBase{Username: testUser}}}
+		s.SetExpiry(lifetime)
+		return s
+	}
+
+	for range 5 {
+		if err = b.Save(newSession(-time.Minute)); err != nil {
+			t.Fatal("unexpected error:", err)
+		}
+	}
+	valid := newSession(time.Hour)
+	if err = b.Save(valid); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	renewed := newSession(-time.Minute)
+	if err = b.Save(renewed); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	renewed.SetExpiry(time.Hour)
+	if err = b.Renew(renewed.Session); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+
+	revoked := newSession(time.Hour)
+	if err = b.Save(revoked); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if err = b.RevokeID(testUser, revoked.ID); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if err = b.Revoke(revoked.Session); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	expiredRevoked := newSession(-time.Minute)
+	if _, err = b.LoadRevocations(SessionList{expiredRevoked.Session}); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if n := boltTestBucketSize(t, b, BoltRevokedLogBucket); n != 2 {
+		t.Fatalf("revoking a session twice should replace the log entry, got %d entries", n)
+	}
+
+	cnt, err := b.CollectGarbage()
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if cnt != 5 {
+		t.Fatalf("GC should have removed 5 sessions, got %d", cnt)
+	}
+	list, _ := b.ListAll()
+	if len(list) != 2 {
+		t.Fatalf("unexpected sessions after GC: %+v", list)
+	}
+	if isRevoked, _ := b.IsRevoked(revoked.Session); !isRevoked {
+		t.Fatal("session should still be revoked")
+	}
+	if n := boltTestBucketSize(t, b, BoltRevokedBucket); n != 1 {
+		t.Fatalf("expired revocation should have been removed, %d revocations left", n)
+	}
+	if n := boltTestBucketSize(t, b, BoltRevokedLogBucket); n != 1 {
+		t.Fatalf("expired revocation should have been removed from the log, %d entries left", n)
+	}
+	if n := boltTestBucketSize(t, b, BoltExpiryBucket); n != 3 {
+		t.Fatalf("expiry index should contain 2 sessions and 1 revocation, got %d entries", n)
+	}
+	if revokedList, last, _ := b.ListRevokedSince(1); last != 3 || len(revokedList) != 1 || revokedList[0].ID != revoked.ID {
+		t.Fatalf("unexpected revocations since 1 (last: %d): %+v", last, revokedList)
+	}
+}
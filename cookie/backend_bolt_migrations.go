@@ -0,0 +1,158 @@
+//
+// Copyright (c) 2023 whawty contributors (see AUTHORS file)
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// * Neither the name of whawty.nginx-sso nor the names of its
+//   contributors may be used to endorse or promote products derived from
+//   this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+//
+
+package cookie
+
+import (
+	"encoding/binary"
+	"fmt"
+	"time"
+
+	"github.com/oklog/ulid/v2"
+	bolt "go.etcd.io/bbolt"
+)
+
+const (
+	boltSchemaVersionKey = "schema-version"
+)
+
+type BoltMigrationsConfig struct {
+	DryRun   bool `yaml:"dry-run"`
+	NoBackup bool `yaml:"no-backup"`
+}
+
+type boltMigration struct {
+	description string
+	migrate     func(tx *bolt.Tx) error
+}
+
+// boltMigrations contains all schema changes of the bolt backend. Entry i migrates the database
+// from schema version i to i+1. Migrations must never be changed once released, add a new one instead.
+var boltMigrations = []boltMigration{
+	{"create session, revocation and watermark buckets", func(tx *bolt.Tx) error {
+		for _, name := range []string{BoltSessionsBucket, BoltRevokedBucket, BoltRevokedLogBucket, BoltWatermarksBucket} {
+			if _, err := tx.CreateBucketIfNotExists([]byte(name)); err != nil {
+				return err
+			}
+		}
+		// the epoch identifies the revocation log so that sync clients can detect if it has been reset
+		meta := tx.Bucket([]byte(BoltMetaBucket))
+		if meta.Get([]byte(boltRevocationEpochKey)) == nil {
+			return meta.Put([]byte(boltRevocationEpochKey), []byte(ulid.Make().String()))
+		}
+		return nil
+	}},
+	{"add expiry index", boltBuildExpiryIndex},
+}
+
+// boltSchemaVersion returns the schema version stored in the meta bucket. Databases created
+// before schema versions have been introduced have version 0.
+func boltSchemaVersion(tx *bolt.Tx) (uint64, error) {
+	meta := tx.Bucket([]byte(BoltMetaBucket))
+	if meta == nil {
+		return 0, nil
+	}
+	value := meta.Get([]byte(boltSchemaVersionKey))
+	if value == nil {
+		return 0, nil
+	}
+	if len(value) != 8 {
+		return 0, fmt.Errorf("bolt: invalid schema version in meta bucket")
+	}
+	return binary.BigEndian.Uint64(value), nil
+}
+
+func boltIsEmpty(tx *bolt.Tx) bool {
+	return tx.ForEach(func(name []byte, b *bolt.Bucket) error {
+		return fmt.Errorf("database is not empty")
+	}) == nil
+}
+
+func runBoltMigrations(tx *bolt.Tx, from uint64) error {
+	meta, err := tx.CreateBucketIfNotExists([]byte(BoltMetaBucket))
+	if err != nil {
+		return err
+	}
+	for version := from; version < uint64(len(boltMigrations)); version++ {
+		if err = boltMigrations[version].migrate(tx); err != nil {
+			return fmt.Errorf("bolt: migration to schema version %d (%s) failed: %v", version+1, boltMigrations[version].description, err)
+		}
+	}
+	return meta.Put([]byte(boltSchemaVersionKey), binary.BigEndian.AppendUint64(nil, uint64(len(boltMigrations))))
+}
+
+// migrateBolt brings the database up to the current schema version. All pending migrations are
+// run within a single transaction. Unless disabled a copy of the database is written next to it
+// before any changes are made. In dry-run mode the migrations are rolled back and an error is
+// returned if there have been any, this way the database will never be used with an old schema.
+func migrateBolt(db *bolt.DB, conf *BoltMigrationsConfig) error {
+	var version uint64
+	empty := false
+	err := db.View(func(tx *bolt.Tx) (err error) {
+		version, err = boltSchemaVersion(tx)
+		empty = boltIsEmpty(tx)
+		return
+	})
+	if err != nil {
+		return err
+	}
+	latest := uint64(len(boltMigrations))
+	if version > latest {
+		return fmt.Errorf("bolt: database schema version %d is newer than the latest supported version %d", version, latest)
+	}
+	if version == latest {
+		return nil
+	}
+
+	if conf.DryRun {
+		tx, err := db.Begin(true)
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback() //nolint:errcheck
+		if err = runBoltMigrations(tx, version); err != nil {
+			return err
+		}
+		return fmt.Errorf("bolt: dry-run: migrating '%s' from schema version %d to %d would succeed, the database has not been changed", db.Path(), version, latest)
+	}
+
+	if !empty && !conf.NoBackup {
+		backup := fmt.Sprintf("%s.v%d-%s.bak", db.Path(), version, time.Now().Format("20060102T150405"))
+		err = db.View(func(tx *bolt.Tx) error {
+			return tx.CopyFile(backup, 0600)
+		})
+		if err != nil {
+			return fmt.Errorf("bolt: failed to backup database before migrating: %v", err)
+		}
+	}
+	return db.Update(func(tx *bolt.Tx) error {
+		return runBoltMigrations(tx, version)
+	})
+}
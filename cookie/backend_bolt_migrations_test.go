@@ -0,0 +1,139 @@
+//
+// Copyright (c) 2023 whawty contributors (see AUTHORS file)
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// * Neither the name of whawty.nginx-sso nor the names of its
+//   contributors may be used to endorse or promote products derived from
+//   this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+//
+
+package cookie
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/oklog/ulid/v2"
+	bolt "go.etcd.io/bbolt"
+)
+
+func boltTestSchemaVersion(t *testing.T, path string) (version uint64) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	defer db.Close() //nolint:errcheck
+	err = db.View(func(tx *bolt.Tx) (err error) {
+		version, err = boltSchemaVersion(tx)
+		return
+	})
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	return
+}
+
+func TestBoltMigrations(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "sessions.db")
+
+	b, err := NewBoltBackend(&BoltBackendConfig{Path: path}, nil)
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	b.db.Close() //nolint:errcheck
+	if version := boltTestSchemaVersion(t, path); version != uint64(len(boltMigrations)) {
+		t.Fatalf("new database should have the latest schema version, got %d", version)
+	}
+	if backups, _ := filepath.Glob(path + ".*.bak"); len(backups) != 0 {
+		t.Fatalf("empty database should not be backed up: %v", backups)
+	}
+
+	// databases created before schema versions have been introduced
+	legacy := filepath.Join(dir, "legacy.db")
+	db, err := bolt.Open(legacy, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	s := SessionFull{Session: Session{ID: ulid.Make(), SessionBase: SessionBase{Username: "test-user"}}}
+	s.SetExpiry(time.Hour)
+	err = db.Update(func(tx *bolt.Tx) error {
+		sessions, err := tx.CreateBucket([]byte(BoltSessionsBucket))
+		if err != nil {
+			return err
+		}
+		user, err := sessions.CreateBucket([]byte(s.Username))
+		if err != nil {
+			return err
+		}
+		value, _ := json.Marshal(newBoltSession(s))
+		return user.Put(s.ID.Bytes(), value)
+	})
+	db.Close() //nolint:errcheck
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+
+	if _, err = NewBoltBackend(&BoltBackendConfig{Path: legacy, Migrations: BoltMigrationsConfig{DryRun: true}}, nil); err == nil {
+		t.Fatal("dry-run with pending migrations should fail")
+	}
+	if version := boltTestSchemaVersion(t, legacy); version != 0 {
+		t.Fatalf("dry-run must not change the database, got schema version %d", version)
+	}
+
+	if b, err = NewBoltBackend(&BoltBackendConfig{Path: legacy}, nil); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if list, _ := b.ListUser(s.Username); len(list) != 1 || list[0].ID != s.ID {
+		t.Fatalf("sessions have been lost during migration: %+v", list)
+	}
+	if b.epoch == "" {
+		t.Fatal("revocation epoch has not been created")
+	}
+	if n := boltTestBucketSize(t, b, BoltExpiryBucket); n != 1 {
+		t.Fatalf("existing sessions have not been added to the expiry index, got %d entries", n)
+	}
+	b.db.Close() //nolint:errcheck
+	if backups, _ := filepath.Glob(legacy + ".v0-*.bak"); len(backups) != 1 {
+		t.Fatalf("expected exactly one backup, got: %v", backups)
+	}
+
+	// dry-run is a no-op if there are no pending migrations
+	if b, err = NewBoltBackend(&BoltBackendConfig{Path: legacy, Migrations: BoltMigrationsConfig{DryRun: true}}, nil); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	err = b.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(BoltMetaBucket)).Put([]byte(boltSchemaVersionKey), binary.BigEndian.AppendUint64(nil, uint64(len(boltMigrations)+1)))
+	})
+	b.db.Close() //nolint:errcheck
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if _, err = NewBoltBackend(&BoltBackendConfig{Path: legacy}, nil); err == nil {
+		t.Fatal("opening a database with a newer schema version should fail")
+	}
+}
@@ -32,6 +32,7 @@ package cookie
 
 import (
 	"fmt"
+	"sort"
 	"sync"
 
 	"github.com/oklog/ulid/v2"
@@ -39,25 +40,54 @@ import (
 )
 
 type InMemoryBackendConfig struct {
+	Snapshot *InMemorySnapshotConfig `yaml:"snapshot"`
 }
 
 type InMemorySession struct {
 	SessionBase
-	Agent AgentInfo `json:"agent"`
+	Agent    AgentInfo `json:"agent"`
+	LoginIP  string    `json:"login-ip,omitempty"`
+	LastSeen int64     `json:"last-seen,omitempty"`
+	LastIP   string    `json:"last-ip,omitempty"`
+}
+
+func newInMemorySession(session SessionFull) InMemorySession {
+	return InMemorySession{SessionBase: session.SessionBase, Agent: session.Agent, LoginIP: session.LoginIP, LastSeen: session.LastSeen, LastIP: session.LastIP}
+}
+
+func (s InMemorySession) full(id ulid.ULID) SessionFull {
+	return SessionFull{Session: Session{ID: id, SessionBase: s.SessionBase}, Agent: s.Agent, LoginIP: s.LoginIP, LastSeen: s.LastSeen, LastIP: s.LastIP}
 }
 
 type InMemorySessionMap map[ulid.ULID]InMemorySession
 
+type inMemoryRevocationLogEntry struct {
+	seq uint64
+	id  ulid.ULID
+}
+
 type InMemoryBackend struct {
-	mutex    sync.RWMutex
-	sessions map[string]InMemorySessionMap
-	revoked  map[ulid.ULID]SessionBase
+	mutex      sync.RWMutex
+	sessions   map[string]InMemorySessionMap
+	revoked    map[ulid.ULID]SessionBase
+	revokedLog []inMemoryRevocationLogEntry
+	revokedSeq uint64
+	epoch      string
+	watermarks Watermarks
+	snapshot   *InMemorySnapshotConfig
 }
 
 func NewInMemoryBackend(conf *InMemoryBackendConfig, prom prometheus.Registerer) (*InMemoryBackend, error) {
 	m := &InMemoryBackend{}
 	m.sessions = make(map[string]InMemorySessionMap)
 	m.revoked = make(map[ulid.ULID]SessionBase)
+	m.watermarks = make(Watermarks)
+	m.epoch = ulid.Make().String()
+	if conf.Snapshot != nil {
+		if err := m.initSnapshot(conf.Snapshot); err != nil {
+			return nil, err
+		}
+	}
 	if prom != nil {
 		if err := m.initPrometheus(prom); err != nil {
 			return nil, err
@@ -67,8 +97,36 @@ func NewInMemoryBackend(conf *InMemoryBackendConfig, prom prometheus.Registerer)
 }
 
 func (b *InMemoryBackend) initPrometheus(prom prometheus.Registerer) error {
-	// TODO: implement this!
-	return nil
+	if b.snapshot != nil {
+		if err := prom.Register(inMemorySnapshots); err != nil {
+			return err
+		}
+	}
+	return prom.Register(newBackendStatsCollector(b.stats, 0))
+}
+
+func (b *InMemoryBackend) stats() (stats backendStats, err error) {
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+
+	for _, sessions := range b.sessions {
+		active := uint64(0)
+		for _, session := range sessions {
+			if !session.IsExpired() {
+				active = active + 1
+			}
+		}
+		stats.Sessions = stats.Sessions + active
+		if active > 0 {
+			stats.Users = stats.Users + 1
+		}
+	}
+	for _, session := range b.revoked {
+		if !session.IsExpired() {
+			stats.Revoked = stats.Revoked + 1
+		}
+	}
+	return
 }
 
 func (b *InMemoryBackend) Name() string {
@@ -87,7 +145,7 @@ func (b *InMemoryBackend) Save(session SessionFull) error {
 	if _, exists = sessions[session.ID]; exists {
 		return fmt.Errorf("session '%v' already exists", session.ID)
 	}
-	sessions[session.ID] = InMemorySession{SessionBase: session.SessionBase, Agent: session.Agent}
+	sessions[session.ID] = newInMemorySession(session)
 	return nil
 }
 
@@ -101,12 +159,50 @@ func (b *InMemoryBackend) ListUser(username string) (list SessionFullList, err e
 	}
 	for id, session := range sessions {
 		if !session.IsExpired() {
-			list = append(list, SessionFull{Session: Session{ID: id, SessionBase: session.SessionBase}, Agent: session.Agent})
+			list = append(list, session.full(id))
 		}
 	}
 	return
 }
 
+func (b *InMemoryBackend) ListAll() (list SessionFullList, err error) {
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+
+	for _, sessions := range b.sessions {
+		for id, session := range sessions {
+			if !session.IsExpired() {
+				list = append(list, session.full(id))
+			}
+		}
+	}
+	return
+}
+
+func (b *InMemoryBackend) Renew(session Session) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	sessions, exists := b.sessions[session.Username]
+	if !exists {
+		return fmt.Errorf("session '%v' does not exist", session.ID)
+	}
+	s, exists := sessions[session.ID]
+	if !exists {
+		return fmt.Errorf("session '%v' does not exist", session.ID)
+	}
+	s.Expires = session.Expires
+	sessions[session.ID] = s
+	return nil
+}
+
+// addRevoked must be called with the mutex held.
+func (b *InMemoryBackend) addRevoked(id ulid.ULID, session SessionBase) {
+	b.revoked[id] = session
+	b.revokedSeq = b.revokedSeq + 1
+	b.revokedLog = append(b.revokedLog, inMemoryRevocationLogEntry{seq: b.revokedSeq, id: id})
+}
+
 func (b *InMemoryBackend) Revoke(session Session) error {
 	b.mutex.Lock()
 	defer b.mutex.Unlock()
@@ -114,7 +210,7 @@ func (b *InMemoryBackend) Revoke(session Session) error {
 	if sessions, exists := b.sessions[session.Username]; exists {
 		delete(sessions, session.ID)
 	}
-	b.revoked[session.ID] = session.SessionBase
+	b.addRevoked(session.ID, session.SessionBase)
 	return nil
 }
 
@@ -131,10 +227,45 @@ func (b *InMemoryBackend) RevokeID(username string, id ulid.ULID) error {
 		return nil
 	}
 	delete(sessions, id)
-	b.revoked[id] = session.SessionBase
+	revoked := session.SessionBase
+	revoked.Binding = nil
+	b.addRevoked(id, revoked)
 	return nil
 }
 
+func (b *InMemoryBackend) SaveActivity(list SessionActivityList) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	for _, activity := range list {
+		sessions, exists := b.sessions[activity.Username]
+		if !exists {
+			continue
+		}
+		session, exists := sessions[activity.ID]
+		if !exists || session.LastSeen >= activity.LastSeen {
+			continue
+		}
+		session.LastSeen = activity.LastSeen
+		if activity.IP != "" {
+			session.LastIP = activity.IP
+		}
+		sessions[activity.ID] = session
+	}
+	return nil
+}
+
+func (b *InMemoryBackend) LastSeen(username string, id ulid.ULID) (int64, error) {
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+
+	sessions, exists := b.sessions[username]
+	if !exists {
+		return 0, nil
+	}
+	return sessions[id].LastSeen, nil
+}
+
 func (b *InMemoryBackend) IsRevoked(session Session) (bool, error) {
 	b.mutex.RLock()
 	defer b.mutex.RUnlock()
@@ -155,6 +286,33 @@ func (b *InMemoryBackend) ListRevoked() (list SessionList, err error) {
 	return
 }
 
+func (b *InMemoryBackend) RevocationEpoch() (string, error) {
+	return b.epoch, nil
+}
+
+func (b *InMemoryBackend) ListRevokedSince(seq uint64) (list SessionList, last uint64, err error) {
+	if seq == 0 {
+		// entries added after reading the sequence will be part of the next update as well, which is harmless
+		b.mutex.RLock()
+		last = b.revokedSeq
+		b.mutex.RUnlock()
+		list, err = b.ListRevoked()
+		return
+	}
+
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+
+	last = b.revokedSeq
+	start := sort.Search(len(b.revokedLog), func(i int) bool { return b.revokedLog[i].seq > seq })
+	for _, entry := range b.revokedLog[start:] {
+		if session, exists := b.revoked[entry.id]; exists && !session.IsExpired() {
+			list = append(list, Session{ID: entry.id, SessionBase: session})
+		}
+	}
+	return
+}
+
 func (b *InMemoryBackend) LoadRevocations(list SessionList) (cnt uint, err error) {
 	b.mutex.Lock()
 	defer b.mutex.Unlock()
@@ -162,7 +320,38 @@ func (b *InMemoryBackend) LoadRevocations(list SessionList) (cnt uint, err error
 	cnt = 0
 	for _, session := range list {
 		if _, exists := b.revoked[session.ID]; !exists {
-			b.revoked[session.ID] = session.SessionBase
+			b.addRevoked(session.ID, session.SessionBase)
+			cnt = cnt + 1
+		}
+	}
+	return
+}
+
+func (b *InMemoryBackend) Watermark(username string) (int64, error) {
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+
+	return max(b.watermarks[""], b.watermarks[username]), nil
+}
+
+func (b *InMemoryBackend) ListWatermarks() (Watermarks, error) {
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+
+	list := make(Watermarks)
+	for username, notBefore := range b.watermarks {
+		list[username] = notBefore
+	}
+	return list, nil
+}
+
+func (b *InMemoryBackend) LoadWatermarks(list Watermarks) (cnt uint, err error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	for username, notBefore := range list {
+		if notBefore > b.watermarks[username] {
+			b.watermarks[username] = notBefore
 			cnt = cnt + 1
 		}
 	}
@@ -187,6 +376,13 @@ func (b *InMemoryBackend) CollectGarbage() (uint, error) {
 			delete(b.revoked, id)
 		}
 	}
+	log := b.revokedLog[:0]
+	for _, entry := range b.revokedLog {
+		if _, exists := b.revoked[entry.id]; exists {
+			log = append(log, entry)
+		}
+	}
+	b.revokedLog = log
 
 	return cnt, nil
 }
@@ -0,0 +1,218 @@
+//
+// Copyright (c) 2023 whawty contributors (see AUTHORS file)
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// * Neither the name of whawty.nginx-sso nor the names of its
+//   contributors may be used to endorse or promote products derived from
+//   this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+//
+
+package cookie
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/oklog/ulid/v2"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	DefaultInMemorySnapshotInterval = time.Minute
+
+	inMemorySnapshotVersion = 1
+)
+
+var (
+	inMemorySnapshots        = prometheus.NewCounterVec(prometheus.CounterOpts{Subsystem: metricsSubsystem, Name: "inmemory_snapshots_total"}, []string{"result"})
+	inMemorySnapshotsSuccess = inMemorySnapshots.MustCurryWith(prometheus.Labels{"result": "success"})
+	inMemorySnapshotsFailed  = inMemorySnapshots.MustCurryWith(prometheus.Labels{"result": "failed"})
+)
+
+type InMemorySnapshotConfig struct {
+	Path     string        `yaml:"path"`
+	Interval time.Duration `yaml:"interval"`
+}
+
+type inMemorySnapshotRevocation struct {
+	SessionBase
+	ID  ulid.ULID `json:"id"`
+	Seq uint64    `json:"seq"`
+}
+
+type inMemorySnapshot struct {
+	Version    int                           `json:"version"`
+	Epoch      string                        `json:"epoch"`
+	Sessions   map[string]InMemorySessionMap `json:"sessions"`
+	Revoked    []inMemorySnapshotRevocation  `json:"revoked"`
+	RevokedSeq uint64                        `json:"revoked-seq"`
+	Watermarks Watermarks                    `json:"watermarks"`
+}
+
+func (b *InMemoryBackend) initSnapshot(conf *InMemorySnapshotConfig) error {
+	if conf.Path == "" {
+		return fmt.Errorf("in-memory: snapshot 'path' must not be empty")
+	}
+	if conf.Interval <= 0 {
+		conf.Interval = DefaultInMemorySnapshotInterval
+	}
+	b.snapshot = conf
+	return b.restoreSnapshot()
+}
+
+// restoreSnapshot must be called before the backend is used. If the snapshot file does not exist
+// the backend starts empty.
+func (b *InMemoryBackend) restoreSnapshot() error {
+	data, err := os.ReadFile(b.snapshot.Path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("in-memory: failed to read snapshot: %v", err)
+	}
+	var snapshot inMemorySnapshot
+	if err = json.Unmarshal(data, &snapshot); err != nil {
+		return fmt.Errorf("in-memory: failed to parse snapshot '%s': %v", b.snapshot.Path, err)
+	}
+	if snapshot.Version != inMemorySnapshotVersion {
+		return fmt.Errorf("in-memory: snapshot '%s' has unsupported version %d", b.snapshot.Path, snapshot.Version)
+	}
+
+	if snapshot.Epoch != "" {
+		b.epoch = snapshot.Epoch
+	}
+	for username, sessions := range snapshot.Sessions {
+		for id, session := range sessions {
+			if session.IsExpired() {
+				delete(sessions, id)
+			}
+		}
+		if len(sessions) > 0 {
+			b.sessions[username] = sessions
+		}
+	}
+	sort.Slice(snapshot.Revoked, func(i, j int) bool { return snapshot.Revoked[i].Seq < snapshot.Revoked[j].Seq })
+	for _, entry := range snapshot.Revoked {
+		if entry.IsExpired() {
+			continue
+		}
+		b.revoked[entry.ID] = entry.SessionBase
+		b.revokedLog = append(b.revokedLog, inMemoryRevocationLogEntry{seq: entry.Seq, id: entry.ID})
+	}
+	b.revokedSeq = snapshot.RevokedSeq
+	for username, notBefore := range snapshot.Watermarks {
+		b.watermarks[username] = notBefore
+	}
+	return nil
+}
+
+// Snapshot writes the current state of the backend to the snapshot file. The file is replaced
+// atomically so a crash while writing the snapshot leaves the previous one intact.
+func (b *InMemoryBackend) Snapshot() (err error) {
+	if b.snapshot == nil {
+		return fmt.Errorf("in-memory: snapshots are not enabled")
+	}
+	defer func() {
+		if err != nil {
+			inMemorySnapshotsFailed.WithLabelValues().Inc()
+		} else {
+			inMemorySnapshotsSuccess.WithLabelValues().Inc()
+		}
+	}()
+
+	var data []byte
+	if data, err = b.encodeSnapshot(); err != nil {
+		return fmt.Errorf("in-memory: failed to encode snapshot: %v", err)
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(b.snapshot.Path), "."+filepath.Base(b.snapshot.Path)+".*")
+	if err != nil {
+		return fmt.Errorf("in-memory: failed to create snapshot file: %v", err)
+	}
+	defer os.Remove(tmp.Name()) //nolint:errcheck
+
+	if _, err = tmp.Write(data); err == nil {
+		err = tmp.Sync()
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return fmt.Errorf("in-memory: failed to write snapshot file: %v", err)
+	}
+	if err = os.Rename(tmp.Name(), b.snapshot.Path); err != nil {
+		return fmt.Errorf("in-memory: failed to replace snapshot file: %v", err)
+	}
+	return nil
+}
+
+func (b *InMemoryBackend) encodeSnapshot() ([]byte, error) {
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+
+	snapshot := inMemorySnapshot{Version: inMemorySnapshotVersion, Epoch: b.epoch, RevokedSeq: b.revokedSeq, Watermarks: b.watermarks}
+	snapshot.Sessions = make(map[string]InMemorySessionMap)
+	for username, sessions := range b.sessions {
+		if len(sessions) > 0 {
+			snapshot.Sessions[username] = sessions
+		}
+	}
+	// sessions may have been revoked more than once, only the latest entry of the log is needed
+	seqs := make(map[ulid.ULID]uint64)
+	for _, entry := range b.revokedLog {
+		seqs[entry.id] = entry.seq
+	}
+	for id, session := range b.revoked {
+		snapshot.Revoked = append(snapshot.Revoked, inMemorySnapshotRevocation{SessionBase: session, ID: id, Seq: seqs[id]})
+	}
+	return json.Marshal(snapshot)
+}
+
+// Close writes a final snapshot if snapshots are enabled.
+func (b *InMemoryBackend) Close() error {
+	if b.snapshot == nil {
+		return nil
+	}
+	return b.Snapshot()
+}
+
+func (st *Store) runInMemorySnapshots(b *InMemoryBackend) {
+	t := time.NewTicker(b.snapshot.Interval)
+	st.dbgLog.Printf("cookie-store: writing snapshots of in-memory backend to '%s' every %v", b.snapshot.Path, b.snapshot.Interval)
+	for {
+		if _, ok := <-t.C; !ok {
+			st.infoLog.Printf("cookie-store: stopping in-memory snapshots because ticker-channel is closed")
+			return
+		}
+		if err := b.Snapshot(); err != nil {
+			st.infoLog.Printf("cookie-store: %v", err)
+		}
+	}
+}
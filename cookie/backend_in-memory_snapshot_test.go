@@ -0,0 +1,116 @@
+//
+// Copyright (c) 2023 whawty contributors (see AUTHORS file)
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// * Neither the name of whawty.nginx-sso nor the names of its
+//   contributors may be used to endorse or promote products derived from
+//   this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+//
+
+package cookie
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/oklog/ulid/v2"
+)
+
+func TestInMemorySnapshot(t *testing.T) {
+	if _, err := NewInMemoryBackend(&InMemoryBackendConfig{Snapshot: &InMemorySnapshotConfig{}}, nil); err == nil {
+		t.Fatal("snapshots without a path should fail")
+	}
+
+	path := filepath.Join(t.TempDir(), "sessions.snapshot")
+	conf := &InMemoryBackendConfig{Snapshot: &InMemorySnapshotConfig{Path: path}}
+	b, err := NewInMemoryBackend(conf, nil)
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if conf.Snapshot.Interval != DefaultInMemorySnapshotInterval {
+		t.Fatalf("snapshot interval should default to %v", DefaultInMemorySnapshotInterval)
+	}
+
+	testUser := "test-user"
+	s := SessionFull{Session: Session{ID: ulid.Make(), SessionBase: SessionBase{Username: testUser}}, Agent: AgentInfo{Name: "test-agent"}, LoginIP: "192.0.2.1"}
+	s.SetExpiry(time.Hour)
+	if err = b.Save(s); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	revoked := Session{ID: ulid.Make(), SessionBase: SessionBase{Username: testUser}}
+	revoked.SetExpiry(time.Hour)
+	for range 2 {
+		if err = b.Revoke(revoked); err != nil {
+			t.Fatal("unexpected error:", err)
+		}
+	}
+	expired := Session{ID: ulid.Make(), SessionBase: SessionBase{Username: testUser}}
+	expired.SetExpiry(-time.Minute)
+	if err = b.Revoke(expired); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if _, err = b.LoadWatermarks(Watermarks{testUser: 1000}); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if err = b.Close(); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if entries, _ := os.ReadDir(filepath.Dir(path)); len(entries) != 1 {
+		t.Fatalf("temporary snapshot files have not been cleaned up: %v", entries)
+	}
+
+	restored, err := NewInMemoryBackend(conf, nil)
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if restored.epoch != b.epoch {
+		t.Fatal("revocation epoch has not been restored")
+	}
+	list, _ := restored.ListUser(testUser)
+	if len(list) != 1 || list[0].ID != s.ID || list[0].Agent.Name != "test-agent" || list[0].LoginIP != "192.0.2.1" {
+		t.Fatalf("unexpected sessions after restore: %+v", list)
+	}
+	if isRevoked, _ := restored.IsRevoked(revoked); !isRevoked {
+		t.Fatal("revocation has not been restored")
+	}
+	if isRevoked, _ := restored.IsRevoked(expired); isRevoked {
+		t.Fatal("expired revocation should not be restored")
+	}
+	revokedList, last, _ := restored.ListRevokedSince(1)
+	if last != 3 || len(revokedList) != 1 || revokedList[0].ID != revoked.ID {
+		t.Fatalf("unexpected revocations since 1 (last: %d): %+v", last, revokedList)
+	}
+	if notBefore, _ := restored.Watermark(testUser); notBefore != 1000 {
+		t.Fatalf("watermark has not been restored: %d", notBefore)
+	}
+
+	if err = os.WriteFile(path, []byte("{invalid"), 0600); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if _, err = NewInMemoryBackend(conf, nil); err == nil {
+		t.Fatal("restoring a corrupt snapshot should fail")
+	}
+}
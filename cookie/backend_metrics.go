@@ -0,0 +1,166 @@
+//
+// Copyright (c) 2023 whawty contributors (see AUTHORS file)
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// * Neither the name of whawty.nginx-sso nor the names of its
+//   contributors may be used to endorse or promote products derived from
+//   this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+//
+
+package cookie
+
+import (
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	backendOperationDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Subsystem: metricsSubsystem, Name: "backend_operation_duration_seconds",
+		Buckets: prometheus.ExponentialBuckets(0.0001, 4, 8)}, []string{"operation"})
+	backendSaveDuration      = backendOperationDuration.MustCurryWith(prometheus.Labels{"operation": "save"})
+	backendIsRevokedDuration = backendOperationDuration.MustCurryWith(prometheus.Labels{"operation": "is-revoked"})
+	backendListUserDuration  = backendOperationDuration.MustCurryWith(prometheus.Labels{"operation": "list-user"})
+
+	gcRuns             = prometheus.NewCounterVec(prometheus.CounterOpts{Subsystem: metricsSubsystem, Name: "gc_runs_total"}, []string{"result"})
+	gcRunsSuccess      = gcRuns.MustCurryWith(prometheus.Labels{"result": "success"})
+	gcRunsFailed       = gcRuns.MustCurryWith(prometheus.Labels{"result": "failed"})
+	gcDuration         = prometheus.NewHistogram(prometheus.HistogramOpts{Subsystem: metricsSubsystem, Name: "gc_duration_seconds"})
+	gcSessionsRemoved  = prometheus.NewCounter(prometheus.CounterOpts{Subsystem: metricsSubsystem, Name: "gc_removed_sessions_total"})
+	backendSessionDesc = prometheus.NewDesc(prometheus.BuildFQName("", metricsSubsystem, "backend_sessions"), "number of active sessions", nil, nil)
+	backendRevokedDesc = prometheus.NewDesc(prometheus.BuildFQName("", metricsSubsystem, "backend_revoked"), "number of revoked sessions which have not expired yet", nil, nil)
+	backendUsersDesc   = prometheus.NewDesc(prometheus.BuildFQName("", metricsSubsystem, "backend_users"), "number of users with active sessions", nil, nil)
+)
+
+type backendStats struct {
+	Sessions uint64
+	Revoked  uint64
+	Users    uint64
+}
+
+// backendStatsCacheDuration is used for backends which need to look at every session to compute
+// their statistics.
+const backendStatsCacheDuration = time.Minute
+
+// backendStatsCollector fetches the statistics of a backend at most once per cache duration. If the
+// backend fails to provide them, the metrics are left out rather than failing the whole scrape.
+type backendStatsCollector struct {
+	stats   func() (backendStats, error)
+	cache   time.Duration
+	mutex   sync.Mutex
+	cached  backendStats
+	fetched time.Time
+}
+
+func newBackendStatsCollector(stats func() (backendStats, error), cache time.Duration) *backendStatsCollector {
+	return &backendStatsCollector{stats: stats, cache: cache}
+}
+
+func (c *backendStatsCollector) get() (backendStats, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if !c.fetched.IsZero() && time.Since(c.fetched) < c.cache {
+		return c.cached, nil
+	}
+	stats, err := c.stats()
+	if err != nil {
+		return stats, err
+	}
+	c.cached = stats
+	c.fetched = time.Now()
+	return stats, nil
+}
+
+func (c *backendStatsCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- backendSessionDesc
+	ch <- backendRevokedDesc
+	ch <- backendUsersDesc
+}
+
+func (c *backendStatsCollector) Collect(ch chan<- prometheus.Metric) {
+	stats, err := c.get()
+	if err != nil {
+		return
+	}
+	ch <- prometheus.MustNewConstMetric(backendSessionDesc, prometheus.GaugeValue, float64(stats.Sessions))
+	ch <- prometheus.MustNewConstMetric(backendRevokedDesc, prometheus.GaugeValue, float64(stats.Revoked))
+	ch <- prometheus.MustNewConstMetric(backendUsersDesc, prometheus.GaugeValue, float64(stats.Users))
+}
+
+func initBackendPrometheus(prom prometheus.Registerer) (err error) {
+	if err = prom.Register(backendOperationDuration); err != nil {
+		return
+	}
+	backendSaveDuration.WithLabelValues()
+	backendIsRevokedDuration.WithLabelValues()
+	backendListUserDuration.WithLabelValues()
+
+	if err = prom.Register(gcRuns); err != nil {
+		return
+	}
+	gcRunsSuccess.WithLabelValues()
+	gcRunsFailed.WithLabelValues()
+	if err = prom.Register(gcDuration); err != nil {
+		return
+	}
+	return prom.Register(gcSessionsRemoved)
+}
+
+func (st *Store) saveSession(session SessionFull) error {
+	defer observeDuration(backendSaveDuration, time.Now())
+	return st.backend.Save(session)
+}
+
+func (st *Store) isRevoked(session Session) (bool, error) {
+	defer observeDuration(backendIsRevokedDuration, time.Now())
+	return st.backend.IsRevoked(session)
+}
+
+func (st *Store) listUser(username string) (SessionFullList, error) {
+	defer observeDuration(backendListUserDuration, time.Now())
+	return st.backend.ListUser(username)
+}
+
+func observeDuration(o prometheus.ObserverVec, start time.Time) {
+	o.WithLabelValues().Observe(time.Since(start).Seconds())
+}
+
+func (st *Store) collectGarbage() {
+	start := time.Now()
+	cnt, err := st.backend.CollectGarbage()
+	gcDuration.Observe(time.Since(start).Seconds())
+	gcSessionsRemoved.Add(float64(cnt))
+	if err != nil {
+		gcRunsFailed.WithLabelValues().Inc()
+		st.infoLog.Printf("cookie-store: failed to collect garbage: %v", err)
+	} else {
+		gcRunsSuccess.WithLabelValues().Inc()
+	}
+	if cnt > 0 {
+		st.dbgLog.Printf("cookie-store: GC removed %d expired sessions", cnt)
+	}
+}
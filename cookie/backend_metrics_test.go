@@ -0,0 +1,174 @@
+//
+// Copyright (c) 2023 whawty contributors (see AUTHORS file)
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// * Neither the name of whawty.nginx-sso nor the names of its
+//   contributors may be used to endorse or promote products derived from
+//   this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+//
+
+package cookie
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/oklog/ulid/v2"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+func gatherMetrics(t *testing.T, reg *prometheus.Registry) map[string]*dto.MetricFamily {
+	families, err := reg.Gather()
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	result := make(map[string]*dto.MetricFamily)
+	for _, family := range families {
+		result[family.GetName()] = family
+	}
+	return result
+}
+
+func TestBackendMetrics(t *testing.T) {
+	backends := map[string]StoreBackendConfig{
+		"in-memory": StoreBackendConfig{InMemory: &InMemoryBackendConfig{}},
+		"bolt":      StoreBackendConfig{Bolt: &BoltBackendConfig{Path: filepath.Join(t.TempDir(), "sessions.db")}},
+		"redis":     StoreBackendConfig{Redis: &RedisBackendConfig{Addr: miniredis.RunT(t).Addr()}},
+	}
+	for name, backend := range backends {
+		t.Run(name, func(t *testing.T) {
+			conf := &Config{Expire: time.Hour}
+			conf.Keys = []SignerVerifierConfig{
+				SignerVerifierConfig{Name: "sign-and-verify", Ed25519: &Ed25519Config{PrivKeyData: &testPrivKeyEd25519Pem}},
+			}
+			conf.Backend = backend
+			reg := prometheus.NewRegistry()
+			st, err := NewStore(conf, reg, nil, nil)
+			if err != nil {
+				t.Fatal("unexpected error:", err)
+			}
+
+			for _, username := range []string{"alice", "bob", "alice"} {
+				if _, _, err = st.New(username, AgentInfo{}, ClientInfo{}); err != nil {
+					t.Fatal("unexpected error:", err)
+				}
+			}
+			value, _, err := st.New("bob", AgentInfo{}, ClientInfo{})
+			if err != nil {
+				t.Fatal("unexpected error:", err)
+			}
+			s, err := st.Verify(value, ClientInfo{})
+			if err != nil {
+				t.Fatal("unexpected error:", err)
+			}
+			if err = st.Revoke(s); err != nil {
+				t.Fatal("unexpected error:", err)
+			}
+			if _, err = st.ListUser("alice"); err != nil {
+				t.Fatal("unexpected error:", err)
+			}
+			st.collectGarbage()
+
+			metrics := gatherMetrics(t, reg)
+			expected := map[string]float64{
+				"cookie_backend_sessions": 3,
+				"cookie_backend_users":    2,
+				"cookie_backend_revoked":  1,
+			}
+			for metric, value := range expected {
+				family, exists := metrics[metric]
+				if !exists {
+					t.Fatalf("metric '%s' does not exist", metric)
+				}
+				if got := family.GetMetric()[0].GetGauge().GetValue(); got != value {
+					t.Fatalf("unexpected value of '%s': expected %v, got %v", metric, value, got)
+				}
+			}
+			// the histograms are shared by all stores, so we can only check whether they have been updated at all
+			for _, metric := range family(t, metrics, "cookie_backend_operation_duration_seconds").GetMetric() {
+				if metric.GetHistogram().GetSampleCount() == 0 {
+					t.Fatalf("backend operation '%s' has not been observed", metric.GetLabel()[0].GetValue())
+				}
+			}
+			if cnt := family(t, metrics, "cookie_gc_duration_seconds").GetMetric()[0].GetHistogram().GetSampleCount(); cnt == 0 {
+				t.Fatal("GC run has not been observed")
+			}
+			if name == "bolt" {
+				if size := family(t, metrics, "cookie_bolt_db_size_bytes").GetMetric()[0].GetGauge().GetValue(); size <= 0 {
+					t.Fatalf("unexpected bolt database size: %v", size)
+				}
+			}
+		})
+	}
+}
+
+func family(t *testing.T, metrics map[string]*dto.MetricFamily, name string) *dto.MetricFamily {
+	family, exists := metrics[name]
+	if !exists {
+		t.Fatalf("metric '%s' does not exist", name)
+	}
+	return family
+}
+
+func TestBackendStatsCache(t *testing.T) {
+	calls := 0
+	c := newBackendStatsCollector(func() (backendStats, error) {
+		calls++
+		return backendStats{Sessions: uint64(calls)}, nil
+	}, time.Hour)
+	for range 3 {
+		if stats, err := c.get(); err != nil || stats.Sessions != 1 {
+			t.Fatalf("unexpected result: %+v, %v", stats, err)
+		}
+	}
+	if calls != 1 {
+		t.Fatalf("stats should have been fetched once, got %d", calls)
+	}
+	c.fetched = time.Now().Add(-2 * time.Hour)
+	if stats, _ := c.get(); stats.Sessions != 2 {
+		t.Fatalf("stats should have been fetched again after the cache expired: %+v", stats)
+	}
+}
+
+func TestRedisBackendStatsExpired(t *testing.T) {
+	mr := miniredis.RunT(t)
+	b, err := NewRedisBackend(&RedisBackendConfig{Addr: mr.Addr()}, nil)
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	s := SessionFull{Session: Session{ID: ulid.Make(), SessionBase: SessionBase{Username: "alice", Expires: time.Now().Add(time.Minute).Unix()}}}
+	if err = b.Save(s); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if stats, err := b.stats(); err != nil || stats.Sessions != 1 || stats.Users != 1 {
+		t.Fatalf("unexpected stats: %+v, %v", stats, err)
+	}
+	mr.FastForward(2 * time.Minute)
+	if stats, err := b.stats(); err != nil || stats.Sessions != 0 || stats.Users != 0 {
+		t.Fatalf("expired sessions should not be counted: %+v, %v", stats, err)
+	}
+}
@@ -0,0 +1,634 @@
+//
+// Copyright (c) 2023 whawty contributors (see AUTHORS file)
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// * Neither the name of whawty.nginx-sso nor the names of its
+//   contributors may be used to endorse or promote products derived from
+//   this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+//
+
+package cookie
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/oklog/ulid/v2"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/redis/go-redis/v9"
+	"github.com/spreadspace/tlsconfig"
+)
+
+const (
+	DefaultRedisPrefix = "whawty-nginx-sso:"
+)
+
+// Sessions are stored as one key per session which expires together with the session. The IDs of the
+// sessions of a user are kept in a set which is cleaned up by CollectGarbage. Revocations are kept in a
+// hash together with two sorted sets, one ordered by expiry and one by the revocation sequence number.
+const (
+	redisSessionKey         = "session:"
+	redisUserKey            = "user:"
+	redisRevokedKey         = "revoked"
+	redisRevokedExpiryKey   = "revoked-expiry"
+	redisRevokedLogKey      = "revoked-log"
+	redisRevokedSeqKey      = "revoked-seq"
+	redisWatermarksKey      = "watermarks"
+	redisRevocationEpochKey = "revocation-epoch"
+)
+
+var (
+	// KEYS: revoked, revoked-log, revoked-expiry, revoked-seq
+	// ARGV: id, session, expires, only-if-new
+	redisAddRevokedScript = redis.NewScript(`
+if ARGV[4] == "1" and redis.call("HEXISTS", KEYS[1], ARGV[1]) == 1 then
+  return 0
+end
+redis.call("HSET", KEYS[1], ARGV[1], ARGV[2])
+local seq = redis.call("INCR", KEYS[4])
+redis.call("ZADD", KEYS[2], seq, ARGV[1])
+redis.call("ZADD", KEYS[3], ARGV[3], ARGV[1])
+return 1
+`)
+	// KEYS: watermarks
+	// ARGV: field, not-before
+	redisLoadWatermarkScript = redis.NewScript(`
+local current = tonumber(redis.call("HGET", KEYS[1], ARGV[1]) or "0")
+if tonumber(ARGV[2]) > current then
+  redis.call("HSET", KEYS[1], ARGV[1], ARGV[2])
+  return 1
+end
+return 0
+`)
+)
+
+type RedisBackendConfig struct {
+	Addr      string               `yaml:"addr"`
+	Username  string               `yaml:"username"`
+	Password  string               `yaml:"password"`
+	DB        int                  `yaml:"db"`
+	Prefix    string               `yaml:"prefix"`
+	TLSConfig *tlsconfig.TLSConfig `yaml:"tls"`
+}
+
+type RedisSession struct {
+	SessionBase
+	Agent    AgentInfo `json:"agent"`
+	LoginIP  string    `json:"login-ip,omitempty"`
+	LastSeen int64     `json:"last-seen,omitempty"`
+	LastIP   string    `json:"last-ip,omitempty"`
+}
+
+func newRedisSession(session SessionFull) RedisSession {
+	return RedisSession{SessionBase: session.SessionBase, Agent: session.Agent, LoginIP: session.LoginIP, LastSeen: session.LastSeen, LastIP: session.LastIP}
+}
+
+func (s RedisSession) full(id ulid.ULID) SessionFull {
+	return SessionFull{Session: Session{ID: id, SessionBase: s.SessionBase}, Agent: s.Agent, LoginIP: s.LoginIP, LastSeen: s.LastSeen, LastIP: s.LastIP}
+}
+
+type RedisBackend struct {
+	client *redis.Client
+	addr   string
+	prefix string
+	epoch  string
+}
+
+func NewRedisBackend(conf *RedisBackendConfig, prom prometheus.Registerer) (*RedisBackend, error) {
+	if conf.Addr == "" {
+		return nil, fmt.Errorf("redis: 'addr' must not be empty")
+	}
+	if conf.Prefix == "" {
+		conf.Prefix = DefaultRedisPrefix
+	}
+	opts := &redis.Options{Addr: conf.Addr, Username: conf.Username, Password: conf.Password, DB: conf.DB}
+	if conf.TLSConfig != nil {
+		var err error
+		if opts.TLSConfig, err = conf.TLSConfig.ToGoTLSConfig(); err != nil {
+			return nil, err
+		}
+	}
+
+	b := &RedisBackend{client: redis.NewClient(opts), addr: conf.Addr, prefix: conf.Prefix}
+	ctx := context.Background()
+	// the epoch identifies the revocation log so that sync clients can detect if it has been reset
+	if err := b.client.SetNX(ctx, b.key(redisRevocationEpochKey), ulid.Make().String(), 0).Err(); err != nil {
+		b.client.Close() //nolint:errcheck
+		return nil, fmt.Errorf("redis: failed to initialize database: %v", err)
+	}
+	epoch, err := b.client.Get(ctx, b.key(redisRevocationEpochKey)).Result()
+	if err != nil {
+		b.client.Close() //nolint:errcheck
+		return nil, fmt.Errorf("redis: failed to initialize database: %v", err)
+	}
+	b.epoch = epoch
+
+	if prom != nil {
+		if err := b.initPrometheus(prom); err != nil {
+			b.client.Close() //nolint:errcheck
+			return nil, err
+		}
+	}
+	return b, nil
+}
+
+func (b *RedisBackend) initPrometheus(prom prometheus.Registerer) error {
+	return prom.Register(newBackendStatsCollector(b.stats, backendStatsCacheDuration))
+}
+
+// stats only counts sessions which have not expired yet, the user sets might still contain sessions
+// which have expired since the last GC run.
+func (b *RedisBackend) stats() (stats backendStats, err error) {
+	ctx := context.Background()
+	now := strconv.FormatInt(time.Now().Unix(), 10)
+	if stats.Revoked, err = b.client.ZCount(ctx, b.key(redisRevokedExpiryKey), now, "+inf").Uint64(); err != nil {
+		return
+	}
+	iter := b.client.Scan(ctx, 0, b.prefix+redisUserKey+"*", 1000).Iterator()
+	for iter.Next(ctx) {
+		username := strings.TrimPrefix(iter.Val(), b.prefix+redisUserKey)
+		var ids []string
+		if ids, err = b.client.SMembers(ctx, iter.Val()).Result(); err != nil {
+			return
+		}
+		if len(ids) == 0 {
+			continue
+		}
+		keys := make([]string, 0, len(ids))
+		for _, id := range ids {
+			keys = append(keys, b.prefix+redisSessionKey+username+":"+id)
+		}
+		var cnt int64
+		if cnt, err = b.client.Exists(ctx, keys...).Result(); err != nil {
+			return
+		}
+		stats.Sessions = stats.Sessions + uint64(cnt)
+		if cnt > 0 {
+			stats.Users = stats.Users + 1
+		}
+	}
+	err = iter.Err()
+	return
+}
+
+func (b *RedisBackend) Name() string {
+	return fmt.Sprintf("redis(%s)", b.addr)
+}
+
+func (b *RedisBackend) key(name string) string {
+	return b.prefix + name
+}
+
+func (b *RedisBackend) sessionKey(username string, id ulid.ULID) string {
+	return b.prefix + redisSessionKey + username + ":" + id.String()
+}
+
+func (b *RedisBackend) userKey(username string) string {
+	return b.prefix + redisUserKey + username
+}
+
+func (b *RedisBackend) Save(session SessionFull) error {
+	value, err := json.Marshal(newRedisSession(session))
+	if err != nil {
+		return err
+	}
+	ctx := context.Background()
+	args := redis.SetArgs{Mode: "NX", ExpireAt: session.ExpiresAt()}
+	if err = b.client.SetArgs(ctx, b.sessionKey(session.Username, session.ID), value, args).Err(); err != nil {
+		if errors.Is(err, redis.Nil) {
+			return fmt.Errorf("session '%v' already exists", session.ID)
+		}
+		return err
+	}
+	return b.client.SAdd(ctx, b.userKey(session.Username), session.ID.String()).Err()
+}
+
+// getSessions returns the sessions stored in keys while silently skipping sessions which are gone.
+func (b *RedisBackend) getSessions(ctx context.Context, keys []string) (list SessionFullList, err error) {
+	if len(keys) == 0 {
+		return
+	}
+	var values []interface{}
+	if values, err = b.client.MGet(ctx, keys...).Result(); err != nil {
+		return
+	}
+	for i, value := range values {
+		str, ok := value.(string)
+		if !ok {
+			continue
+		}
+		var id ulid.ULID
+		if id, err = ulid.ParseStrict(keys[i][strings.LastIndexByte(keys[i], ':')+1:]); err != nil {
+			return
+		}
+		var session RedisSession
+		if err = json.Unmarshal([]byte(str), &session); err != nil {
+			return
+		}
+		if !session.IsExpired() {
+			list = append(list, session.full(id))
+		}
+	}
+	return
+}
+
+func (b *RedisBackend) ListUser(username string) (SessionFullList, error) {
+	ctx := context.Background()
+	ids, err := b.client.SMembers(ctx, b.userKey(username)).Result()
+	if err != nil {
+		return nil, err
+	}
+	keys := make([]string, 0, len(ids))
+	for _, id := range ids {
+		keys = append(keys, b.prefix+redisSessionKey+username+":"+id)
+	}
+	return b.getSessions(ctx, keys)
+}
+
+func (b *RedisBackend) ListAll() (list SessionFullList, err error) {
+	ctx := context.Background()
+	iter := b.client.Scan(ctx, 0, b.prefix+redisSessionKey+"*", 1000).Iterator()
+	var keys []string
+	for iter.Next(ctx) {
+		keys = append(keys, iter.Val())
+		if len(keys) >= 1000 {
+			var sessions SessionFullList
+			if sessions, err = b.getSessions(ctx, keys); err != nil {
+				return
+			}
+			list = append(list, sessions...)
+			keys = keys[:0]
+		}
+	}
+	if err = iter.Err(); err != nil {
+		return
+	}
+	var sessions SessionFullList
+	if sessions, err = b.getSessions(ctx, keys); err != nil {
+		return
+	}
+	list = append(list, sessions...)
+	return
+}
+
+// update runs fn on the stored session inside an optimistic transaction. fn returns false if nothing
+// needs to be changed.
+func (b *RedisBackend) update(key string, fn func(session *RedisSession) (bool, error)) (exists bool, err error) {
+	ctx := context.Background()
+	for range 10 {
+		err = b.client.Watch(ctx, func(tx *redis.Tx) error {
+			value, err := tx.Get(ctx, key).Bytes()
+			if err != nil {
+				if errors.Is(err, redis.Nil) {
+					exists = false
+					return nil
+				}
+				return err
+			}
+			exists = true
+			var session RedisSession
+			if err = json.Unmarshal(value, &session); err != nil {
+				return err
+			}
+			changed, err := fn(&session)
+			if err != nil || !changed {
+				return err
+			}
+			if value, err = json.Marshal(session); err != nil {
+				return err
+			}
+			_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+				pipe.SetArgs(ctx, key, value, redis.SetArgs{ExpireAt: time.Unix(session.Expires, 0)})
+				return nil
+			})
+			return err
+		}, key)
+		if !errors.Is(err, redis.TxFailedErr) {
+			return
+		}
+	}
+	return
+}
+
+func (b *RedisBackend) Renew(session Session) error {
+	exists, err := b.update(b.sessionKey(session.Username, session.ID), func(s *RedisSession) (bool, error) {
+		s.Expires = session.Expires
+		return true, nil
+	})
+	if err == nil && !exists {
+		err = fmt.Errorf("session '%v' does not exist", session.ID)
+	}
+	return err
+}
+
+func (b *RedisBackend) addRevoked(ctx context.Context, c redis.Scripter, id ulid.ULID, session SessionBase, onlyIfNew bool) (*redis.Cmd, error) {
+	value, err := json.Marshal(session)
+	if err != nil {
+		return nil, err
+	}
+	keys := []string{b.key(redisRevokedKey), b.key(redisRevokedLogKey), b.key(redisRevokedExpiryKey), b.key(redisRevokedSeqKey)}
+	onlyIfNewArg := "0"
+	if onlyIfNew {
+		onlyIfNewArg = "1"
+	}
+	return redisAddRevokedScript.Eval(ctx, c, keys, id.String(), value, session.Expires, onlyIfNewArg), nil
+}
+
+func (b *RedisBackend) revoke(id ulid.ULID, session SessionBase) error {
+	ctx := context.Background()
+	_, err := b.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Del(ctx, b.sessionKey(session.Username, id))
+		pipe.SRem(ctx, b.userKey(session.Username), id.String())
+		_, err := b.addRevoked(ctx, pipe, id, session, false)
+		return err
+	})
+	return err
+}
+
+func (b *RedisBackend) Revoke(session Session) error {
+	return b.revoke(session.ID, session.SessionBase)
+}
+
+func (b *RedisBackend) RevokeID(username string, id ulid.ULID) error {
+	value, err := b.client.Get(context.Background(), b.sessionKey(username, id)).Bytes()
+	if err != nil {
+		if errors.Is(err, redis.Nil) {
+			return nil
+		}
+		return err
+	}
+	// value actually contains an encoded RedisSession, we deliberately unmarshal
+	// a SessionBase to strip the AgentInfo from it
+	var session SessionBase
+	if err = json.Unmarshal(value, &session); err != nil {
+		return err
+	}
+	session.Binding = nil
+	return b.revoke(id, session)
+}
+
+func (b *RedisBackend) SaveActivity(list SessionActivityList) error {
+	for _, activity := range list {
+		_, err := b.update(b.sessionKey(activity.Username, activity.ID), func(s *RedisSession) (bool, error) {
+			if s.LastSeen >= activity.LastSeen {
+				return false, nil
+			}
+			s.LastSeen = activity.LastSeen
+			if activity.IP != "" {
+				s.LastIP = activity.IP
+			}
+			return true, nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (b *RedisBackend) LastSeen(username string, id ulid.ULID) (int64, error) {
+	value, err := b.client.Get(context.Background(), b.sessionKey(username, id)).Bytes()
+	if err != nil {
+		if errors.Is(err, redis.Nil) {
+			return 0, nil
+		}
+		return 0, err
+	}
+	var session RedisSession
+	if err = json.Unmarshal(value, &session); err != nil {
+		return 0, err
+	}
+	return session.LastSeen, nil
+}
+
+func (b *RedisBackend) IsRevoked(session Session) (bool, error) {
+	return b.client.HExists(context.Background(), b.key(redisRevokedKey), session.ID.String()).Result()
+}
+
+func (b *RedisBackend) decodeRevoked(id string, value string) (session Session, err error) {
+	if session.ID, err = ulid.ParseStrict(id); err != nil {
+		return
+	}
+	err = json.Unmarshal([]byte(value), &session.SessionBase)
+	return
+}
+
+func (b *RedisBackend) ListRevoked() (list SessionList, err error) {
+	var revoked map[string]string
+	if revoked, err = b.client.HGetAll(context.Background(), b.key(redisRevokedKey)).Result(); err != nil {
+		return
+	}
+	for id, value := range revoked {
+		var session Session
+		if session, err = b.decodeRevoked(id, value); err != nil {
+			return
+		}
+		if !session.IsExpired() {
+			list = append(list, session)
+		}
+	}
+	return
+}
+
+func (b *RedisBackend) RevocationEpoch() (string, error) {
+	return b.epoch, nil
+}
+
+func (b *RedisBackend) ListRevokedSince(seq uint64) (list SessionList, last uint64, err error) {
+	ctx := context.Background()
+	// entries added after reading the sequence will be part of the next update as well, which is harmless
+	if last, err = b.client.Get(ctx, b.key(redisRevokedSeqKey)).Uint64(); err != nil {
+		if !errors.Is(err, redis.Nil) {
+			return
+		}
+		err = nil
+	}
+	if seq == 0 {
+		list, err = b.ListRevoked()
+		return
+	}
+
+	var ids []string
+	rangeBy := &redis.ZRangeBy{Min: "(" + strconv.FormatUint(seq, 10), Max: "+inf"}
+	if ids, err = b.client.ZRangeByScore(ctx, b.key(redisRevokedLogKey), rangeBy).Result(); err != nil || len(ids) == 0 {
+		return
+	}
+	var values []interface{}
+	if values, err = b.client.HMGet(ctx, b.key(redisRevokedKey), ids...).Result(); err != nil {
+		return
+	}
+	for i, value := range values {
+		str, ok := value.(string)
+		if !ok {
+			continue
+		}
+		var session Session
+		if session, err = b.decodeRevoked(ids[i], str); err != nil {
+			return
+		}
+		if !session.IsExpired() {
+			list = append(list, session)
+		}
+	}
+	return
+}
+
+func (b *RedisBackend) LoadRevocations(list SessionList) (cnt uint, err error) {
+	ctx := context.Background()
+	for _, session := range list {
+		var cmd *redis.Cmd
+		if cmd, err = b.addRevoked(ctx, b.client, session.ID, session.SessionBase, true); err != nil {
+			return
+		}
+		var added int64
+		if added, err = cmd.Int64(); err != nil {
+			return
+		}
+		cnt += uint(added)
+	}
+	return
+}
+
+func redisWatermarkField(username string) string {
+	if username == "" {
+		return "g"
+	}
+	return "u" + username
+}
+
+func (b *RedisBackend) Watermark(username string) (int64, error) {
+	values, err := b.client.HMGet(context.Background(), b.key(redisWatermarksKey), redisWatermarkField(""), redisWatermarkField(username)).Result()
+	if err != nil {
+		return 0, err
+	}
+	var notBefore int64
+	for _, value := range values {
+		str, ok := value.(string)
+		if !ok {
+			continue
+		}
+		v, err := strconv.ParseInt(str, 10, 64)
+		if err != nil {
+			return 0, err
+		}
+		notBefore = max(notBefore, v)
+	}
+	return notBefore, nil
+}
+
+func (b *RedisBackend) ListWatermarks() (Watermarks, error) {
+	values, err := b.client.HGetAll(context.Background(), b.key(redisWatermarksKey)).Result()
+	if err != nil {
+		return nil, err
+	}
+	list := make(Watermarks)
+	for field, value := range values {
+		notBefore, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		if field == "g" {
+			list[""] = notBefore
+		} else {
+			list[strings.TrimPrefix(field, "u")] = notBefore
+		}
+	}
+	return list, nil
+}
+
+func (b *RedisBackend) LoadWatermarks(list Watermarks) (cnt uint, err error) {
+	ctx := context.Background()
+	for username, notBefore := range list {
+		var updated int64
+		keys := []string{b.key(redisWatermarksKey)}
+		if updated, err = redisLoadWatermarkScript.Run(ctx, b.client, keys, redisWatermarkField(username), notBefore).Int64(); err != nil {
+			return
+		}
+		cnt += uint(updated)
+	}
+	return
+}
+
+// CollectGarbage removes expired revocations as well as sessions which have expired from the per-user
+// session sets. The sessions themselves are removed by redis once they expire.
+func (b *RedisBackend) CollectGarbage() (uint, error) {
+	ctx := context.Background()
+	now := strconv.FormatInt(time.Now().Unix(), 10)
+	ids, err := b.client.ZRangeByScore(ctx, b.key(redisRevokedExpiryKey), &redis.ZRangeBy{Min: "-inf", Max: "(" + now}).Result()
+	if err != nil {
+		return 0, err
+	}
+	if len(ids) > 0 {
+		members := make([]interface{}, 0, len(ids))
+		for _, id := range ids {
+			members = append(members, id)
+		}
+		_, err = b.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.HDel(ctx, b.key(redisRevokedKey), ids...)
+			pipe.ZRem(ctx, b.key(redisRevokedLogKey), members...)
+			pipe.ZRem(ctx, b.key(redisRevokedExpiryKey), members...)
+			return nil
+		})
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	cnt := uint(0)
+	iter := b.client.Scan(ctx, 0, b.prefix+redisUserKey+"*", 1000).Iterator()
+	for iter.Next(ctx) {
+		userKey := iter.Val()
+		username := strings.TrimPrefix(userKey, b.prefix+redisUserKey)
+		ids, err := b.client.SMembers(ctx, userKey).Result()
+		if err != nil {
+			return cnt, err
+		}
+		pipe := b.client.Pipeline()
+		exists := make([]*redis.IntCmd, 0, len(ids))
+		for _, id := range ids {
+			exists = append(exists, pipe.Exists(ctx, b.prefix+redisSessionKey+username+":"+id))
+		}
+		if _, err = pipe.Exec(ctx); err != nil {
+			return cnt, err
+		}
+		var gone []interface{}
+		for i, cmd := range exists {
+			if cmd.Val() == 0 {
+				gone = append(gone, ids[i])
+			}
+		}
+		if len(gone) > 0 {
+			if err = b.client.SRem(ctx, userKey, gone...).Err(); err != nil {
+				return cnt, err
+			}
+			cnt += uint(len(gone))
+		}
+	}
+	return cnt, iter.Err()
+}
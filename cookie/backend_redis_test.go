@@ -0,0 +1,162 @@
+//
+// Copyright (c) 2023 whawty contributors (see AUTHORS file)
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// * Neither the name of whawty.nginx-sso nor the names of its
+//   contributors may be used to endorse or promote products derived from
+//   this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+//
+
+package cookie
+
+import (
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/oklog/ulid/v2"
+)
+
+func TestRedisBackend(t *testing.T) {
+	m := miniredis.RunT(t)
+	conf := &RedisBackendConfig{Addr: m.Addr()}
+	b, err := NewRedisBackend(conf, nil)
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if conf.Prefix != DefaultRedisPrefix {
+		t.Fatalf("unset prefix should be overriden to '%s', got '%s'", DefaultRedisPrefix, conf.Prefix)
+	}
+	if b.Name() != "redis("+m.Addr()+")" {
+		t.Fatalf("unexpected backend name: %s", b.Name())
+	}
+
+	testUser := "test:user"
+	s := SessionFull{Session: Session{ID: ulid.Make(), SessionBase: SessionBase{Username: testUser}}, Agent: AgentInfo{Name: "test-agent"}}
+	s.SetExpiry(time.Hour)
+	if err = b.Save(s); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if err = b.Save(s); err == nil {
+		t.Fatal("saving the same session twice should fail")
+	}
+	key := b.sessionKey(testUser, s.ID)
+	if ttl := m.TTL(key); ttl <= 59*time.Minute || ttl > time.Hour {
+		t.Fatalf("session key has wrong TTL: %v", ttl)
+	}
+
+	s.Expires = s.Expires + 3600
+	if err = b.Renew(s.Session); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if ttl := m.TTL(key); ttl <= 119*time.Minute {
+		t.Fatalf("renewing the session should have extended the TTL: %v", ttl)
+	}
+	lastSeen := time.Now().Unix()
+	if err = b.SaveActivity(SessionActivityList{{ID: s.ID, Username: testUser, LastSeen: lastSeen, IP: "192.0.2.1"}}); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	list, err := b.ListAll()
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if len(list) != 1 || list[0].ID != s.ID || list[0].Username != testUser || list[0].Agent.Name != "test-agent" ||
+		list[0].Expires != s.Expires || list[0].LastSeen != lastSeen || list[0].LastIP != "192.0.2.1" {
+		t.Fatalf("unexpected session list: %+v", list)
+	}
+	if err = b.Renew(Session{ID: ulid.Make(), SessionBase: SessionBase{Username: testUser}}); err == nil {
+		t.Fatal("renewing an unknown session should fail")
+	}
+
+	m.FastForward(3 * time.Hour)
+	if list, err = b.ListUser(testUser); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if len(list) != 0 {
+		t.Fatalf("session should have been expired by redis: %+v", list)
+	}
+	cnt, err := b.CollectGarbage()
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if cnt != 1 {
+		t.Fatalf("GC should have removed 1 session, got %d", cnt)
+	}
+	if m.Exists(b.userKey(testUser)) {
+		t.Fatal("empty session set of the user should be gone")
+	}
+
+	expired := Session{ID: ulid.Make(), SessionBase: SessionBase{Username: testUser, Expires: time.Now().Add(-time.Minute).Unix()}}
+	valid := Session{ID: ulid.Make(), SessionBase: SessionBase{Username: testUser, Expires: time.Now().Add(time.Hour).Unix()}}
+	if cnt, err = b.LoadRevocations(SessionList{expired, valid}); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if cnt != 2 {
+		t.Fatalf("expected 2 revocations to be loaded, got %d", cnt)
+	}
+	if cnt, err = b.LoadRevocations(SessionList{valid}); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if cnt != 0 {
+		t.Fatalf("already known revocations should not be loaded again, got %d", cnt)
+	}
+	if _, err = b.CollectGarbage(); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	for _, s := range []Session{expired, valid} {
+		revoked, err := b.IsRevoked(s)
+		if err != nil {
+			t.Fatal("unexpected error:", err)
+		}
+		if revoked != (s.ID == valid.ID) {
+			t.Fatalf("expired revocations should have been removed by the GC, valid ones should be kept")
+		}
+	}
+	revoked, last, err := b.ListRevokedSince(1)
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if last != 2 || len(revoked) != 1 || revoked[0].ID != valid.ID {
+		t.Fatalf("unexpected revocations since 1 (last: %d): %+v", last, revoked)
+	}
+
+	other, err := NewRedisBackend(&RedisBackendConfig{Addr: m.Addr()}, nil)
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if other.epoch != b.epoch {
+		t.Fatal("instances using the same database should share the revocation epoch")
+	}
+	separate, err := NewRedisBackend(&RedisBackendConfig{Addr: m.Addr(), Prefix: "other:"}, nil)
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if revoked, _ := separate.IsRevoked(valid); revoked || separate.epoch == b.epoch {
+		t.Fatal("instances using a different prefix should not share any data")
+	}
+
+	if _, err = NewRedisBackend(&RedisBackendConfig{}, nil); err == nil {
+		t.Fatal("initializing redis backend without address should fail")
+	}
+}
@@ -0,0 +1,515 @@
+//
+// Copyright (c) 2023 whawty contributors (see AUTHORS file)
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// * Neither the name of whawty.nginx-sso nor the names of its
+//   contributors may be used to endorse or promote products derived from
+//   this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+//
+
+package cookie
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	_ "github.com/lib/pq"
+	"github.com/oklog/ulid/v2"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	SQLDriverSQLite   = "sqlite3"
+	SQLDriverPostgres = "postgres"
+
+	sqlRevocationEpochKey = "revocation-epoch"
+	sqlRevokedSeqCounter  = "revoked-seq"
+)
+
+// sqlMigrations contains the statements needed to upgrade the schema from one version to the next,
+// the schema version equals the number of migrations which have been applied.
+var sqlMigrations = [][]string{
+	{
+		`CREATE TABLE sessions (id TEXT PRIMARY KEY, username TEXT NOT NULL, expires BIGINT NOT NULL, data TEXT NOT NULL,
+			last_seen BIGINT NOT NULL DEFAULT 0, last_ip TEXT NOT NULL DEFAULT '')`,
+		`CREATE INDEX sessions_username_idx ON sessions (username)`,
+		`CREATE INDEX sessions_expires_idx ON sessions (expires)`,
+		`CREATE TABLE revoked (id TEXT PRIMARY KEY, expires BIGINT NOT NULL, data TEXT NOT NULL, seq BIGINT NOT NULL)`,
+		`CREATE INDEX revoked_expires_idx ON revoked (expires)`,
+		`CREATE INDEX revoked_seq_idx ON revoked (seq)`,
+		`CREATE TABLE watermarks (username TEXT PRIMARY KEY, not_before BIGINT NOT NULL)`,
+		`CREATE TABLE counters (name TEXT PRIMARY KEY, value BIGINT NOT NULL)`,
+		`INSERT INTO counters (name, value) VALUES ('` + sqlRevokedSeqCounter + `', 0)`,
+		`CREATE TABLE meta (name TEXT PRIMARY KEY, value TEXT NOT NULL)`,
+	},
+}
+
+type SQLBackendConfig struct {
+	Driver string `yaml:"driver"`
+	DSN    string `yaml:"dsn"`
+}
+
+type SQLSession struct {
+	SessionBase
+	Agent   AgentInfo `json:"agent"`
+	LoginIP string    `json:"login-ip,omitempty"`
+}
+
+type SQLBackend struct {
+	db     *sql.DB
+	driver string
+	epoch  string
+}
+
+func NewSQLBackend(conf *SQLBackendConfig, prom prometheus.Registerer) (*SQLBackend, error) {
+	switch conf.Driver {
+	case SQLDriverSQLite, SQLDriverPostgres:
+	default:
+		return nil, fmt.Errorf("sql: unsupported driver '%s'", conf.Driver)
+	}
+	if !slices.Contains(sql.Drivers(), conf.Driver) {
+		return nil, fmt.Errorf("sql: driver '%s' is not available since this binary was built without cgo", conf.Driver)
+	}
+	db, err := sql.Open(conf.Driver, conf.DSN)
+	if err != nil {
+		return nil, err
+	}
+	if conf.Driver == SQLDriverSQLite {
+		// sqlite only allows one writer anyway
+		db.SetMaxOpenConns(1)
+	}
+
+	b := &SQLBackend{db: db, driver: conf.Driver}
+	if err = b.migrate(); err != nil {
+		db.Close() //nolint:errcheck
+		return nil, fmt.Errorf("sql: failed to migrate database schema: %v", err)
+	}
+	// the epoch identifies the revocation log so that sync clients can detect if it has been reset
+	if _, err = b.exec(`INSERT INTO meta (name, value) VALUES (?, ?) ON CONFLICT (name) DO NOTHING`, sqlRevocationEpochKey, ulid.Make().String()); err != nil {
+		db.Close() //nolint:errcheck
+		return nil, err
+	}
+	if err = b.queryRow(`SELECT value FROM meta WHERE name = ?`, sqlRevocationEpochKey).Scan(&b.epoch); err != nil {
+		db.Close() //nolint:errcheck
+		return nil, err
+	}
+
+	if prom != nil {
+		if err := b.initPrometheus(prom); err != nil {
+			db.Close() //nolint:errcheck
+			return nil, err
+		}
+	}
+	return b, nil
+}
+
+func (b *SQLBackend) initPrometheus(prom prometheus.Registerer) error {
+	return prom.Register(newBackendStatsCollector(b.stats, 0))
+}
+
+func (b *SQLBackend) stats() (stats backendStats, err error) {
+	now := time.Now().Unix()
+	err = b.queryRow(`SELECT COUNT(*), COUNT(DISTINCT username) FROM sessions WHERE expires >= ?`, now).Scan(&stats.Sessions, &stats.Users)
+	if err != nil {
+		return
+	}
+	err = b.queryRow(`SELECT COUNT(*) FROM revoked WHERE expires >= ?`, now).Scan(&stats.Revoked)
+	return
+}
+
+func (b *SQLBackend) Name() string {
+	return fmt.Sprintf("sql(%s)", b.driver)
+}
+
+// rebind converts the ?-placeholders used by all queries to the syntax of the driver.
+func (b *SQLBackend) rebind(query string) string {
+	if b.driver != SQLDriverPostgres {
+		return query
+	}
+	var out strings.Builder
+	n := 0
+	for _, c := range query {
+		if c == '?' {
+			n++
+			out.WriteString("$" + strconv.Itoa(n))
+			continue
+		}
+		out.WriteRune(c)
+	}
+	return out.String()
+}
+
+func (b *SQLBackend) exec(query string, args ...any) (sql.Result, error) {
+	return b.db.Exec(b.rebind(query), args...)
+}
+
+func (b *SQLBackend) queryRow(query string, args ...any) *sql.Row {
+	return b.db.QueryRow(b.rebind(query), args...)
+}
+
+func (b *SQLBackend) transaction(fn func(tx *sql.Tx) error) error {
+	tx, err := b.db.Begin()
+	if err != nil {
+		return err
+	}
+	if err = fn(tx); err != nil {
+		tx.Rollback() //nolint:errcheck
+		return err
+	}
+	return tx.Commit()
+}
+
+func (b *SQLBackend) migrate() error {
+	if _, err := b.exec(`CREATE TABLE IF NOT EXISTS schema_version (version INTEGER NOT NULL)`); err != nil {
+		return err
+	}
+	return b.transaction(func(tx *sql.Tx) error {
+		if b.driver == SQLDriverPostgres {
+			// make sure only one instance at a time runs the migrations
+			if _, err := tx.Exec(`LOCK TABLE schema_version IN ACCESS EXCLUSIVE MODE`); err != nil {
+				return err
+			}
+		}
+		var version int
+		err := tx.QueryRow(`SELECT version FROM schema_version`).Scan(&version)
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			if _, err = tx.Exec(`INSERT INTO schema_version (version) VALUES (0)`); err != nil {
+				return err
+			}
+		case err != nil:
+			return err
+		}
+		if version > len(sqlMigrations) {
+			return fmt.Errorf("database schema version %d is newer than the latest supported version %d", version, len(sqlMigrations))
+		}
+		for _, migration := range sqlMigrations[version:] {
+			for _, stmt := range migration {
+				if _, err = tx.Exec(stmt); err != nil {
+					return err
+				}
+			}
+		}
+		_, err = tx.Exec(b.rebind(`UPDATE schema_version SET version = ?`), len(sqlMigrations))
+		return err
+	})
+}
+
+func (b *SQLBackend) Save(session SessionFull) error {
+	data, err := json.Marshal(SQLSession{SessionBase: session.SessionBase, Agent: session.Agent, LoginIP: session.LoginIP})
+	if err != nil {
+		return err
+	}
+	result, err := b.exec(`INSERT INTO sessions (id, username, expires, data, last_seen, last_ip) VALUES (?, ?, ?, ?, ?, ?) ON CONFLICT (id) DO NOTHING`,
+		session.ID.String(), session.Username, session.Expires, string(data), session.LastSeen, session.LastIP)
+	if err != nil {
+		return err
+	}
+	if cnt, err := result.RowsAffected(); err != nil {
+		return err
+	} else if cnt == 0 {
+		return fmt.Errorf("session '%v' already exists", session.ID)
+	}
+	return nil
+}
+
+func (b *SQLBackend) listSessions(where string, args ...any) (list SessionFullList, err error) {
+	var rows *sql.Rows
+	query := `SELECT id, expires, data, last_seen, last_ip FROM sessions WHERE expires >= ?` + where
+	if rows, err = b.db.Query(b.rebind(query), append([]any{time.Now().Unix()}, args...)...); err != nil {
+		return
+	}
+	defer rows.Close() //nolint:errcheck
+
+	for rows.Next() {
+		var id, data string
+		var session SessionFull
+		var stored SQLSession
+		if err = rows.Scan(&id, &session.Expires, &data, &session.LastSeen, &session.LastIP); err != nil {
+			return
+		}
+		if session.ID, err = ulid.ParseStrict(id); err != nil {
+			return
+		}
+		if err = json.Unmarshal([]byte(data), &stored); err != nil {
+			return
+		}
+		session.Username = stored.Username
+		session.Binding = stored.Binding
+		session.Agent = stored.Agent
+		session.LoginIP = stored.LoginIP
+		if !session.IsExpired() {
+			list = append(list, session)
+		}
+	}
+	err = rows.Err()
+	return
+}
+
+func (b *SQLBackend) ListUser(username string) (SessionFullList, error) {
+	return b.listSessions(` AND username = ?`, username)
+}
+
+func (b *SQLBackend) ListAll() (SessionFullList, error) {
+	return b.listSessions(``)
+}
+
+func (b *SQLBackend) Renew(session Session) error {
+	result, err := b.exec(`UPDATE sessions SET expires = ? WHERE id = ? AND username = ?`, session.Expires, session.ID.String(), session.Username)
+	if err != nil {
+		return err
+	}
+	if cnt, err := result.RowsAffected(); err != nil {
+		return err
+	} else if cnt == 0 {
+		return fmt.Errorf("session '%v' does not exist", session.ID)
+	}
+	return nil
+}
+
+func (b *SQLBackend) addRevoked(tx *sql.Tx, id ulid.ULID, session SessionBase) error {
+	data, err := json.Marshal(session)
+	if err != nil {
+		return err
+	}
+	var seq int64
+	if err = tx.QueryRow(b.rebind(`UPDATE counters SET value = value + 1 WHERE name = ? RETURNING value`), sqlRevokedSeqCounter).Scan(&seq); err != nil {
+		return err
+	}
+	_, err = tx.Exec(b.rebind(`INSERT INTO revoked (id, expires, data, seq) VALUES (?, ?, ?, ?)
+		ON CONFLICT (id) DO UPDATE SET expires = excluded.expires, data = excluded.data, seq = excluded.seq`),
+		id.String(), session.Expires, string(data), seq)
+	return err
+}
+
+func (b *SQLBackend) Revoke(session Session) error {
+	return b.transaction(func(tx *sql.Tx) error {
+		if _, err := tx.Exec(b.rebind(`DELETE FROM sessions WHERE id = ?`), session.ID.String()); err != nil {
+			return err
+		}
+		return b.addRevoked(tx, session.ID, session.SessionBase)
+	})
+}
+
+func (b *SQLBackend) RevokeID(username string, id ulid.ULID) error {
+	return b.transaction(func(tx *sql.Tx) error {
+		var expires int64
+		var data string
+		err := tx.QueryRow(b.rebind(`SELECT expires, data FROM sessions WHERE id = ? AND username = ?`), id.String(), username).Scan(&expires, &data)
+		if err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				return nil
+			}
+			return err
+		}
+		// data actually contains an encoded SQLSession, we deliberately unmarshal
+		// a SessionBase to strip the AgentInfo from it
+		var session SessionBase
+		if err = json.Unmarshal([]byte(data), &session); err != nil {
+			return err
+		}
+		session.Expires = expires
+		session.Binding = nil
+		if _, err = tx.Exec(b.rebind(`DELETE FROM sessions WHERE id = ?`), id.String()); err != nil {
+			return err
+		}
+		return b.addRevoked(tx, id, session)
+	})
+}
+
+func (b *SQLBackend) SaveActivity(list SessionActivityList) error {
+	return b.transaction(func(tx *sql.Tx) error {
+		for _, activity := range list {
+			var err error
+			if activity.IP != "" {
+				_, err = tx.Exec(b.rebind(`UPDATE sessions SET last_seen = ?, last_ip = ? WHERE id = ? AND username = ? AND last_seen < ?`),
+					activity.LastSeen, activity.IP, activity.ID.String(), activity.Username, activity.LastSeen)
+			} else {
+				_, err = tx.Exec(b.rebind(`UPDATE sessions SET last_seen = ? WHERE id = ? AND username = ? AND last_seen < ?`),
+					activity.LastSeen, activity.ID.String(), activity.Username, activity.LastSeen)
+			}
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (b *SQLBackend) LastSeen(username string, id ulid.ULID) (lastSeen int64, err error) {
+	err = b.queryRow(`SELECT last_seen FROM sessions WHERE id = ? AND username = ?`, id.String(), username).Scan(&lastSeen)
+	if errors.Is(err, sql.ErrNoRows) {
+		err = nil
+	}
+	return
+}
+
+func (b *SQLBackend) IsRevoked(session Session) (bool, error) {
+	var one int
+	err := b.queryRow(`SELECT 1 FROM revoked WHERE id = ?`, session.ID.String()).Scan(&one)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (b *SQLBackend) listRevoked(where string, args ...any) (list SessionList, err error) {
+	var rows *sql.Rows
+	query := `SELECT id, expires, data FROM revoked WHERE expires >= ?` + where
+	if rows, err = b.db.Query(b.rebind(query), append([]any{time.Now().Unix()}, args...)...); err != nil {
+		return
+	}
+	defer rows.Close() //nolint:errcheck
+
+	for rows.Next() {
+		var id, data string
+		var session Session
+		var expires int64
+		if err = rows.Scan(&id, &expires, &data); err != nil {
+			return
+		}
+		if session.ID, err = ulid.ParseStrict(id); err != nil {
+			return
+		}
+		if err = json.Unmarshal([]byte(data), &session.SessionBase); err != nil {
+			return
+		}
+		session.Expires = expires
+		if !session.IsExpired() {
+			list = append(list, session)
+		}
+	}
+	err = rows.Err()
+	return
+}
+
+func (b *SQLBackend) ListRevoked() (SessionList, error) {
+	return b.listRevoked(``)
+}
+
+func (b *SQLBackend) RevocationEpoch() (string, error) {
+	return b.epoch, nil
+}
+
+func (b *SQLBackend) ListRevokedSince(seq uint64) (list SessionList, last uint64, err error) {
+	// entries added after reading the sequence will be part of the next update as well, which is harmless
+	if err = b.queryRow(`SELECT value FROM counters WHERE name = ?`, sqlRevokedSeqCounter).Scan(&last); err != nil {
+		return
+	}
+	if seq == 0 {
+		list, err = b.ListRevoked()
+		return
+	}
+	list, err = b.listRevoked(` AND seq > ? ORDER BY seq`, seq)
+	return
+}
+
+func (b *SQLBackend) LoadRevocations(list SessionList) (cnt uint, err error) {
+	err = b.transaction(func(tx *sql.Tx) error {
+		cnt = 0
+		for _, session := range list {
+			var one int
+			err := tx.QueryRow(b.rebind(`SELECT 1 FROM revoked WHERE id = ?`), session.ID.String()).Scan(&one)
+			if err == nil {
+				continue
+			}
+			if !errors.Is(err, sql.ErrNoRows) {
+				return err
+			}
+			if err = b.addRevoked(tx, session.ID, session.SessionBase); err != nil {
+				return err
+			}
+			cnt = cnt + 1
+		}
+		return nil
+	})
+	return
+}
+
+func (b *SQLBackend) Watermark(username string) (notBefore int64, err error) {
+	err = b.queryRow(`SELECT COALESCE(MAX(not_before), 0) FROM watermarks WHERE username IN ('', ?)`, username).Scan(&notBefore)
+	return
+}
+
+func (b *SQLBackend) ListWatermarks() (Watermarks, error) {
+	rows, err := b.db.Query(`SELECT username, not_before FROM watermarks`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close() //nolint:errcheck
+
+	list := make(Watermarks)
+	for rows.Next() {
+		var username string
+		var notBefore int64
+		if err = rows.Scan(&username, &notBefore); err != nil {
+			return nil, err
+		}
+		list[username] = notBefore
+	}
+	return list, rows.Err()
+}
+
+func (b *SQLBackend) LoadWatermarks(list Watermarks) (cnt uint, err error) {
+	err = b.transaction(func(tx *sql.Tx) error {
+		cnt = 0
+		for username, notBefore := range list {
+			result, err := tx.Exec(b.rebind(`INSERT INTO watermarks (username, not_before) VALUES (?, ?)
+				ON CONFLICT (username) DO UPDATE SET not_before = excluded.not_before WHERE watermarks.not_before < excluded.not_before`),
+				username, notBefore)
+			if err != nil {
+				return err
+			}
+			n, err := result.RowsAffected()
+			if err != nil {
+				return err
+			}
+			cnt = cnt + uint(n)
+		}
+		return nil
+	})
+	return
+}
+
+func (b *SQLBackend) CollectGarbage() (uint, error) {
+	now := time.Now().Unix()
+	result, err := b.exec(`DELETE FROM sessions WHERE expires < ?`, now)
+	if err != nil {
+		return 0, err
+	}
+	cnt, err := result.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+	if _, err = b.exec(`DELETE FROM revoked WHERE expires < ?`, now); err != nil {
+		return 0, err
+	}
+	return uint(cnt), nil
+}
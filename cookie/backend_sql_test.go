@@ -0,0 +1,194 @@
+//
+// Copyright (c) 2023 whawty contributors (see AUTHORS file)
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// * Neither the name of whawty.nginx-sso nor the names of its
+//   contributors may be used to endorse or promote products derived from
+//   this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+//
+
+//go:build cgo
+
+package cookie
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/oklog/ulid/v2"
+)
+
+func TestSQLBackend(t *testing.T) {
+	if _, err := NewSQLBackend(&SQLBackendConfig{Driver: "mysql"}, nil); err == nil {
+		t.Fatal("initializing sql backend with unsupported driver should fail")
+	}
+	if (&SQLBackend{driver: SQLDriverPostgres}).rebind("a = ? AND b = ?") != "a = $1 AND b = $2" {
+		t.Fatal("placeholders have not been converted for postgres")
+	}
+
+	conf := &SQLBackendConfig{Driver: SQLDriverSQLite, DSN: filepath.Join(t.TempDir(), "sessions.sqlite")}
+	b, err := NewSQLBackend(conf, nil)
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if b.Name() != "sql(sqlite3)" {
+		t.Fatalf("unexpected backend name: %s", b.Name())
+	}
+
+	testUser := "test-user"
+	s := SessionFull{Session: Session{ID: ulid.Make(), SessionBase: SessionBase{Username: testUser}}, Agent: AgentInfo{Name: "test-agent"}, LoginIP: "192.0.2.1"}
+	s.SetExpiry(time.Hour)
+	if err = b.Save(s); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if err = b.Save(s); err == nil {
+		t.Fatal("saving the same session twice should fail")
+	}
+	expired := SessionFull{Session: Session{ID: ulid.Make(), SessionBase: SessionBase{Username: testUser}}}
+	expired.SetExpiry(-time.Minute)
+	if err = b.Save(expired); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+
+	s.Expires = s.Expires + 3600
+	if err = b.Renew(s.Session); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if err = b.Renew(Session{ID: ulid.Make(), SessionBase: SessionBase{Username: testUser}}); err == nil {
+		t.Fatal("renewing an unknown session should fail")
+	}
+	lastSeen := time.Now().Unix()
+	if err = b.SaveActivity(SessionActivityList{{ID: s.ID, Username: testUser, LastSeen: lastSeen, IP: "192.0.2.2"}}); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if err = b.SaveActivity(SessionActivityList{{ID: s.ID, Username: testUser, LastSeen: lastSeen - 10, IP: "192.0.2.3"}}); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	list, err := b.ListUser(testUser)
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if len(list) != 1 || list[0].ID != s.ID || list[0].Username != testUser || list[0].Agent.Name != "test-agent" || list[0].LoginIP != "192.0.2.1" ||
+		list[0].Expires != s.Expires || list[0].LastSeen != lastSeen || list[0].LastIP != "192.0.2.2" {
+		t.Fatalf("unexpected session list: %+v", list)
+	}
+	if seen, _ := b.LastSeen(testUser, s.ID); seen != lastSeen {
+		t.Fatalf("unexpected last-seen value: expected %d, got %d", lastSeen, seen)
+	}
+
+	cnt, err := b.CollectGarbage()
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if cnt != 1 {
+		t.Fatalf("GC should have removed 1 session, got %d", cnt)
+	}
+
+	if err = b.RevokeID(testUser, s.ID); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if revoked, _ := b.IsRevoked(s.Session); !revoked {
+		t.Fatal("session should be revoked")
+	}
+	if list, _ = b.ListAll(); len(list) != 0 {
+		t.Fatalf("revoked session should be gone: %+v", list)
+	}
+	other := Session{ID: ulid.Make(), SessionBase: SessionBase{Username: testUser, Expires: time.Now().Add(time.Hour).Unix()}}
+	if cnt, err = b.LoadRevocations(SessionList{s.Session, other}); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if cnt != 1 {
+		t.Fatalf("only unknown revocations should be loaded, got %d", cnt)
+	}
+	revoked, last, err := b.ListRevokedSince(1)
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if last != 2 || len(revoked) != 1 || revoked[0].ID != other.ID {
+		t.Fatalf("unexpected revocations since 1 (last: %d): %+v", last, revoked)
+	}
+
+	if cnt, err = b.LoadWatermarks(Watermarks{"": 100, testUser: 200}); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if cnt != 2 {
+		t.Fatalf("expected 2 watermarks to be loaded, got %d", cnt)
+	}
+	if cnt, err = b.LoadWatermarks(Watermarks{"": 50, testUser: 300}); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if cnt != 1 {
+		t.Fatalf("watermarks must only move forward, got %d updates", cnt)
+	}
+	if notBefore, _ := b.Watermark("other-user"); notBefore != 100 {
+		t.Fatalf("unexpected watermark: %d", notBefore)
+	}
+	if notBefore, _ := b.Watermark(testUser); notBefore != 300 {
+		t.Fatalf("unexpected watermark: %d", notBefore)
+	}
+
+	// opening the database again must not re-run the migrations or reset the epoch
+	epoch := b.epoch
+	b.db.Close() //nolint:errcheck
+	if b, err = NewSQLBackend(conf, nil); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if b.epoch != epoch {
+		t.Fatal("revocation epoch has changed")
+	}
+	if _, err = b.exec(`UPDATE schema_version SET version = ?`, len(sqlMigrations)+1); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	b.db.Close() //nolint:errcheck
+	if _, err = NewSQLBackend(conf, nil); err == nil {
+		t.Fatal("opening a database with a newer schema version should fail")
+	}
+}
+
+func TestSQLBackendStore(t *testing.T) {
+	conf := &Config{Expire: time.Hour}
+	conf.Keys = []SignerVerifierConfig{
+		SignerVerifierConfig{Name: "sign-and-verify", Ed25519: &Ed25519Config{PrivKeyData: &testPrivKeyEd25519Pem}},
+	}
+	conf.Backend = StoreBackendConfig{SQL: &SQLBackendConfig{Driver: SQLDriverSQLite, DSN: ":memory:"}}
+	st, err := NewStore(conf, nil, nil, nil)
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	value, _, err := st.New("test-user", AgentInfo{}, ClientInfo{})
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	s, err := st.Verify(value, ClientInfo{})
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if err = st.Revoke(s); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if _, err = st.Verify(value, ClientInfo{}); err == nil {
+		t.Fatal("verifying a revoked session should fail")
+	}
+}
@@ -0,0 +1,183 @@
+//
+// Copyright (c) 2023 whawty contributors (see AUTHORS file)
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// * Neither the name of whawty.nginx-sso nor the names of its
+//   contributors may be used to endorse or promote products derived from
+//   this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+//
+
+package cookie
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"net/netip"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	BindingPolicyLog    = "log"
+	BindingPolicyReject = "reject"
+	BindingPolicyReauth = "reauth"
+
+	DefaultBindingIPv4Prefix = 24
+	DefaultBindingIPv6Prefix = 64
+)
+
+var (
+	bindingMismatches = prometheus.NewCounterVec(prometheus.CounterOpts{Subsystem: metricsSubsystem, Name: "binding_mismatches_total"}, []string{"policy"})
+)
+
+type BindingConfig struct {
+	IP         bool   `yaml:"ip"`
+	IPv4Prefix int    `yaml:"ipv4-prefix"`
+	IPv6Prefix int    `yaml:"ipv6-prefix"`
+	UserAgent  bool   `yaml:"user-agent"`
+	Policy     string `yaml:"policy"`
+}
+
+// ClientInfo contains the properties of the client which are used to bind sessions.
+type ClientInfo struct {
+	IP        string
+	UserAgent string
+}
+
+type SessionBinding struct {
+	IPPrefix  string `json:"ip,omitempty"`
+	UserAgent string `json:"ua,omitempty"`
+}
+
+func (st *Store) initBinding(conf *Config) error {
+	switch conf.Binding.Policy {
+	case "":
+		conf.Binding.Policy = BindingPolicyReject
+	case BindingPolicyLog, BindingPolicyReject, BindingPolicyReauth:
+	default:
+		return fmt.Errorf("binding: invalid policy '%s'", conf.Binding.Policy)
+	}
+	// revocations are only synced from signing to verify-only instances, a session revoked by a
+	// verify-only instance would still be accepted everywhere else
+	if conf.Binding.Policy == BindingPolicyReauth && st.signer == nil {
+		return fmt.Errorf("binding: policy '%s' is only supported by instances which are able to sign", BindingPolicyReauth)
+	}
+	if conf.Binding.IPv4Prefix <= 0 || conf.Binding.IPv4Prefix > 32 {
+		conf.Binding.IPv4Prefix = DefaultBindingIPv4Prefix
+	}
+	if conf.Binding.IPv6Prefix <= 0 || conf.Binding.IPv6Prefix > 128 {
+		conf.Binding.IPv6Prefix = DefaultBindingIPv6Prefix
+	}
+	if !conf.Binding.IP && !conf.Binding.UserAgent {
+		st.infoLog.Printf("cookie-store: binding is configured but neither 'ip' nor 'user-agent' is enabled")
+	}
+	return nil
+}
+
+func userAgentHash(ua string) string {
+	sum := sha256.Sum256([]byte(ua))
+	return base64.RawURLEncoding.EncodeToString(sum[:12])
+}
+
+func (st *Store) makeBinding(client ClientInfo) (*SessionBinding, error) {
+	if st.conf.Binding == nil {
+		return nil, nil
+	}
+	b := &SessionBinding{}
+	if st.conf.Binding.IP {
+		addr, err := netip.ParseAddr(client.IP)
+		if err != nil {
+			return nil, fmt.Errorf("unable to bind session to client IP: %v", err)
+		}
+		addr = addr.Unmap()
+		bits := st.conf.Binding.IPv6Prefix
+		if addr.Is4() {
+			bits = st.conf.Binding.IPv4Prefix
+		}
+		prefix, err := addr.Prefix(bits)
+		if err != nil {
+			return nil, fmt.Errorf("unable to bind session to client IP: %v", err)
+		}
+		b.IPPrefix = prefix.String()
+	}
+	if st.conf.Binding.UserAgent {
+		b.UserAgent = userAgentHash(client.UserAgent)
+	}
+	if *b == (SessionBinding{}) {
+		return nil, nil
+	}
+	return b, nil
+}
+
+func (b *SessionBinding) matches(client ClientInfo) error {
+	if b.IPPrefix != "" {
+		prefix, err := netip.ParsePrefix(b.IPPrefix)
+		if err != nil {
+			return fmt.Errorf("session has invalid IP binding: %v", err)
+		}
+		addr, err := netip.ParseAddr(client.IP)
+		if err != nil || !prefix.Contains(addr.Unmap()) {
+			return fmt.Errorf("client IP '%s' is not within %s", client.IP, b.IPPrefix)
+		}
+	}
+	if b.UserAgent != "" {
+		if subtle.ConstantTimeCompare([]byte(b.UserAgent), []byte(userAgentHash(client.UserAgent))) != 1 {
+			return fmt.Errorf("user-agent has changed")
+		}
+	}
+	return nil
+}
+
+// checkBinding verifies that the session is used by the same client it has been issued to.
+// Sessions created without a binding are always accepted.
+func (st *Store) checkBinding(s Session, client ClientInfo) error {
+	if s.Binding == nil {
+		return nil
+	}
+	err := s.Binding.matches(client)
+	if err == nil {
+		return nil
+	}
+	policy := BindingPolicyReject
+	if st.conf.Binding != nil {
+		policy = st.conf.Binding.Policy
+	}
+	bindingMismatches.WithLabelValues(policy).Inc()
+	st.infoLog.Printf("cookie-store: binding mismatch for session('%v') of user '%s': %v (policy: %s)", s.ID, s.Username, err, policy)
+
+	switch policy {
+	case BindingPolicyLog:
+		return nil
+	case BindingPolicyReauth:
+		// the cookie might have been stolen, the user needs to login again on all clients
+		if st.currentSigner() == nil {
+			st.infoLog.Printf("cookie-store: not revoking session('%v') since this instance is no longer able to sign", s.ID)
+		} else if rerr := st.Revoke(s); rerr != nil {
+			st.infoLog.Printf("cookie-store: failed to revoke session('%v'): %v", s.ID, rerr)
+		}
+	}
+	return fmt.Errorf("session binding mismatch: %v", err)
+}
@@ -0,0 +1,150 @@
+//
+// Copyright (c) 2023 whawty contributors (see AUTHORS file)
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// * Neither the name of whawty.nginx-sso nor the names of its
+//   contributors may be used to endorse or promote products derived from
+//   this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+//
+
+package cookie
+
+import (
+	"testing"
+)
+
+func TestBindingConfig(t *testing.T) {
+	conf := &Config{Binding: &BindingConfig{IP: true, IPv4Prefix: 33}}
+	conf.Keys = []SignerVerifierConfig{
+		SignerVerifierConfig{Name: "sign-and-verify", Ed25519: &Ed25519Config{PrivKeyData: &testPrivKeyEd25519Pem}},
+	}
+	conf.Backend = StoreBackendConfig{InMemory: &InMemoryBackendConfig{}}
+	if _, err := NewStore(conf, nil, nil, nil); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if conf.Binding.Policy != BindingPolicyReject {
+		t.Fatalf("unset policy should be overriden to '%s', got '%s'", BindingPolicyReject, conf.Binding.Policy)
+	}
+	if conf.Binding.IPv4Prefix != DefaultBindingIPv4Prefix || conf.Binding.IPv6Prefix != DefaultBindingIPv6Prefix {
+		t.Fatalf("invalid prefix lengths should be overriden, got %d/%d", conf.Binding.IPv4Prefix, conf.Binding.IPv6Prefix)
+	}
+
+	conf.Binding = &BindingConfig{IP: true, Policy: "invalid"}
+	if _, err := NewStore(conf, nil, nil, nil); err == nil {
+		t.Fatal("initializing store with invalid binding policy should fail")
+	}
+
+	conf.Binding = &BindingConfig{IP: true, Policy: BindingPolicyReauth}
+	if _, err := NewStore(conf, nil, nil, nil); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	conf.Keys = []SignerVerifierConfig{
+		SignerVerifierConfig{Name: "verify-only", Ed25519: &Ed25519Config{PubKeyData: &testPubKeyEd25519Pem}},
+	}
+	if _, err := NewStore(conf, nil, nil, nil); err == nil {
+		t.Fatal("initializing verify-only store with binding policy reauth should fail")
+	}
+}
+
+func TestBinding(t *testing.T) {
+	conf := &Config{Binding: &BindingConfig{IP: true, UserAgent: true}}
+	conf.Keys = []SignerVerifierConfig{
+		SignerVerifierConfig{Name: "sign-and-verify", Ed25519: &Ed25519Config{PrivKeyData: &testPrivKeyEd25519Pem}},
+	}
+	conf.Backend = StoreBackendConfig{InMemory: &InMemoryBackendConfig{}}
+	st, err := NewStore(conf, nil, nil, nil)
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+
+	if _, _, err = st.New("test-user", AgentInfo{}, ClientInfo{IP: "invalid"}); err == nil {
+		t.Fatal("creating a session bound to an invalid IP should fail")
+	}
+
+	client := ClientInfo{IP: "192.0.2.1", UserAgent: "test-agent/1.0"}
+	value, _, err := st.New("test-user", AgentInfo{}, client)
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	s, err := st.Verify(value, client)
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if s.Binding == nil || s.Binding.IPPrefix != "192.0.2.0/24" || s.Binding.UserAgent == "" {
+		t.Fatalf("session has wrong binding: %+v", s.Binding)
+	}
+	if _, err = st.Verify(value, ClientInfo{IP: "192.0.2.200", UserAgent: client.UserAgent}); err != nil {
+		t.Fatal("client within the same prefix should be accepted:", err)
+	}
+	if _, err = st.Verify(value, ClientInfo{IP: "::ffff:192.0.2.7", UserAgent: client.UserAgent}); err != nil {
+		t.Fatal("IPv4-mapped IPv6 address within the same prefix should be accepted:", err)
+	}
+	if _, err = st.Verify(value, ClientInfo{IP: "198.51.100.1", UserAgent: client.UserAgent}); err == nil {
+		t.Fatal("client from other prefix should be rejected")
+	}
+	if _, err = st.Verify(value, ClientInfo{IP: client.IP, UserAgent: "other-agent/2.0"}); err == nil {
+		t.Fatal("client with other user-agent should be rejected")
+	}
+
+	conf.Binding.Policy = BindingPolicyLog
+	if _, err = st.Verify(value, ClientInfo{IP: "198.51.100.1"}); err != nil {
+		t.Fatal("binding mismatch should only be logged:", err)
+	}
+
+	conf.Binding.Policy = BindingPolicyReauth
+	if _, err = st.Verify(value, ClientInfo{IP: "198.51.100.1"}); err == nil {
+		t.Fatal("client from other prefix should be rejected")
+	}
+	if _, err = st.Verify(value, client); err == nil {
+		t.Fatal("session should have been revoked after binding mismatch")
+	}
+	revoked, err := st.backend.ListRevoked()
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if len(revoked) != 1 || revoked[0].Binding != nil {
+		t.Fatalf("revocation list should contain the session without binding: %+v", revoked)
+	}
+
+	conf.Binding = &BindingConfig{IP: true, IPv6Prefix: 48, Policy: BindingPolicyReject}
+	value, _, err = st.New("test-user", AgentInfo{}, ClientInfo{IP: "2001:db8:1:2::1"})
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if _, err = st.Verify(value, ClientInfo{IP: "2001:db8:1:ffff::1"}); err != nil {
+		t.Fatal("client within the same prefix should be accepted:", err)
+	}
+	if _, err = st.Verify(value, ClientInfo{IP: "2001:db8:2::1"}); err == nil {
+		t.Fatal("client from other prefix should be rejected")
+	}
+
+	conf.Binding = nil
+	value, _, err = st.New("test-user", AgentInfo{}, ClientInfo{})
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if _, err = st.Verify(value, client); err != nil {
+		t.Fatal("session without binding should be accepted:", err)
+	}
+}
@@ -31,6 +31,7 @@
 package cookie
 
 import (
+	"crypto"
 	"crypto/ed25519"
 	"crypto/x509"
 	"encoding/pem"
@@ -150,6 +151,10 @@ func (s Ed25519SignerVerifier) CanSign() bool {
 	return s.priv != nil
 }
 
+func (s Ed25519SignerVerifier) PublicKey() crypto.PublicKey {
+	return s.pub
+}
+
 func (s Ed25519SignerVerifier) Sign(payload []byte) ([]byte, error) {
 	if s.priv == nil {
 		return nil, fmt.Errorf("")
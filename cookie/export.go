@@ -0,0 +1,226 @@
+//
+// Copyright (c) 2023 whawty contributors (see AUTHORS file)
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// * Neither the name of whawty.nginx-sso nor the names of its
+//   contributors may be used to endorse or promote products derived from
+//   this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+//
+
+package cookie
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/oklog/ulid/v2"
+)
+
+const (
+	StoreExportVersion = 1
+
+	StoreExportHeader     = "header"
+	StoreExportSession    = "session"
+	StoreExportRevoked    = "revoked"
+	StoreExportWatermarks = "watermarks"
+
+	storeExportMaxLineLength = 1024 * 1024
+	storeImportBatchSize     = 1000
+)
+
+// StoreExportRecord is a single line of an export. Every export starts with a header, followed by
+// any number of sessions, revocations and watermarks.
+type StoreExportRecord struct {
+	Type       string       `json:"type"`
+	Version    int          `json:"version,omitempty"`
+	Created    int64        `json:"created,omitempty"`
+	Session    *SessionFull `json:"session,omitempty"`
+	Revoked    *Session     `json:"revoked,omitempty"`
+	Watermarks Watermarks   `json:"watermarks,omitempty"`
+}
+
+type StoreExportStats struct {
+	Sessions   uint
+	Revoked    uint
+	Watermarks uint
+}
+
+func (s StoreExportStats) String() string {
+	return fmt.Sprintf("%d sessions, %d revocations, %d watermarks", s.Sessions, s.Revoked, s.Watermarks)
+}
+
+// ExportBackend writes all sessions, revocations and watermarks of the backend as JSON Lines to w.
+func ExportBackend(b StoreBackend, w io.Writer) (stats StoreExportStats, err error) {
+	enc := json.NewEncoder(w)
+	if err = enc.Encode(StoreExportRecord{Type: StoreExportHeader, Version: StoreExportVersion, Created: time.Now().Unix()}); err != nil {
+		return
+	}
+
+	sessions, err := b.ListAll()
+	if err != nil {
+		return stats, fmt.Errorf("failed to list sessions: %v", err)
+	}
+	for _, session := range sessions {
+		if err = enc.Encode(StoreExportRecord{Type: StoreExportSession, Session: &session}); err != nil {
+			return
+		}
+		stats.Sessions = stats.Sessions + 1
+	}
+
+	revoked, err := b.ListRevoked()
+	if err != nil {
+		return stats, fmt.Errorf("failed to list revocations: %v", err)
+	}
+	for _, session := range revoked {
+		if err = enc.Encode(StoreExportRecord{Type: StoreExportRevoked, Revoked: &session}); err != nil {
+			return
+		}
+		stats.Revoked = stats.Revoked + 1
+	}
+
+	watermarks, err := b.ListWatermarks()
+	if err != nil {
+		return stats, fmt.Errorf("failed to list watermarks: %v", err)
+	}
+	if len(watermarks) > 0 {
+		if err = enc.Encode(StoreExportRecord{Type: StoreExportWatermarks, Watermarks: watermarks}); err != nil {
+			return
+		}
+		stats.Watermarks = uint(len(watermarks))
+	}
+	return
+}
+
+// ImportBackend reads an export created by ExportBackend and adds its contents to the backend.
+// Sessions which already exist, are revoked or have expired are skipped, this way an import can
+// safely be repeated. The stats only count entries which have actually been added.
+func ImportBackend(b StoreBackend, r io.Reader) (stats StoreExportStats, err error) {
+	existing := make(map[ulid.ULID]bool)
+	var sessions SessionFullList
+	if sessions, err = b.ListAll(); err != nil {
+		return stats, fmt.Errorf("failed to list existing sessions: %v", err)
+	}
+	for _, session := range sessions {
+		existing[session.ID] = true
+	}
+
+	var revoked SessionList
+	flushRevoked := func() error {
+		if len(revoked) == 0 {
+			return nil
+		}
+		cnt, err := b.LoadRevocations(revoked)
+		if err != nil {
+			return fmt.Errorf("failed to import revocations: %v", err)
+		}
+		stats.Revoked = stats.Revoked + cnt
+		revoked = revoked[:0]
+		return nil
+	}
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), storeExportMaxLineLength)
+	line := 0
+	for scanner.Scan() {
+		line = line + 1
+		var record StoreExportRecord
+		if err = json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			return stats, fmt.Errorf("line %d: %v", line, err)
+		}
+		if line == 1 {
+			if record.Type != StoreExportHeader {
+				return stats, fmt.Errorf("line 1: export header is missing")
+			}
+			if record.Version < 1 || record.Version > StoreExportVersion {
+				return stats, fmt.Errorf("line 1: unsupported export version %d", record.Version)
+			}
+			continue
+		}
+
+		switch record.Type {
+		case StoreExportSession:
+			if record.Session == nil {
+				return stats, fmt.Errorf("line %d: session is missing", line)
+			}
+			session := *record.Session
+			if existing[session.ID] || session.IsExpired() {
+				continue
+			}
+			var isRevoked bool
+			if isRevoked, err = b.IsRevoked(session.Session); err != nil {
+				return stats, fmt.Errorf("line %d: %v", line, err)
+			}
+			if isRevoked {
+				continue
+			}
+			if err = b.Save(session); err != nil {
+				return stats, fmt.Errorf("line %d: failed to import session: %v", line, err)
+			}
+			existing[session.ID] = true
+			stats.Sessions = stats.Sessions + 1
+		case StoreExportRevoked:
+			if record.Revoked == nil {
+				return stats, fmt.Errorf("line %d: revocation is missing", line)
+			}
+			if record.Revoked.IsExpired() {
+				continue
+			}
+			// the session either already existed in this backend or it has been revoked while the
+			// export was running, sessions are exported before the revocations
+			if existing[record.Revoked.ID] {
+				if err = b.RevokeID(record.Revoked.Username, record.Revoked.ID); err != nil {
+					return stats, fmt.Errorf("line %d: %v", line, err)
+				}
+				delete(existing, record.Revoked.ID)
+				stats.Revoked = stats.Revoked + 1
+				continue
+			}
+			revoked = append(revoked, *record.Revoked)
+			if len(revoked) >= storeImportBatchSize {
+				if err = flushRevoked(); err != nil {
+					return
+				}
+			}
+		case StoreExportWatermarks:
+			var cnt uint
+			if cnt, err = b.LoadWatermarks(record.Watermarks); err != nil {
+				return stats, fmt.Errorf("line %d: failed to import watermarks: %v", line, err)
+			}
+			stats.Watermarks = stats.Watermarks + cnt
+		default:
+			return stats, fmt.Errorf("line %d: unknown record type '%s'", line, record.Type)
+		}
+	}
+	if err = scanner.Err(); err != nil {
+		return
+	}
+	if line == 0 {
+		return stats, fmt.Errorf("export is empty")
+	}
+	err = flushRevoked()
+	return
+}
@@ -0,0 +1,124 @@
+//
+// Copyright (c) 2023 whawty contributors (see AUTHORS file)
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// * Neither the name of whawty.nginx-sso nor the names of its
+//   contributors may be used to endorse or promote products derived from
+//   this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+//
+
+package cookie
+
+import (
+	"bytes"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/oklog/ulid/v2"
+)
+
+func TestExportImport(t *testing.T) {
+	src, err := NewInMemoryBackend(&InMemoryBackendConfig{}, nil)
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	testUser := "test-user"
+	sessions := []SessionFull{}
+	for range 3 {
+		s := SessionFull{Session: Session{ID: ulid.Make(), SessionBase: SessionBase{Username: testUser}}, Agent: AgentInfo{Name: "test-agent"}, LastSeen: 42}
+		s.SetExpiry(time.Hour)
+		if err = src.Save(s); err != nil {
+			t.Fatal("unexpected error:", err)
+		}
+		sessions = append(sessions, s)
+	}
+	if err = src.RevokeID(testUser, sessions[2].ID); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if _, err = src.LoadWatermarks(Watermarks{"": 100, testUser: 200}); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+
+	var export bytes.Buffer
+	stats, err := ExportBackend(src, &export)
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if stats != (StoreExportStats{Sessions: 2, Revoked: 1, Watermarks: 2}) {
+		t.Fatalf("unexpected export stats: %v", stats)
+	}
+
+	dst, err := NewBoltBackend(&BoltBackendConfig{Path: filepath.Join(t.TempDir(), "sessions.db")}, nil)
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	// the target knows the session which has been revoked in the meantime
+	if err = dst.Save(sessions[2]); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if stats, err = ImportBackend(dst, bytes.NewReader(export.Bytes())); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if stats != (StoreExportStats{Sessions: 2, Revoked: 1, Watermarks: 2}) {
+		t.Fatalf("unexpected import stats: %v", stats)
+	}
+	list, _ := dst.ListUser(testUser)
+	if len(list) != 2 {
+		t.Fatalf("unexpected sessions after import: %+v", list)
+	}
+	for _, s := range list {
+		if s.Agent.Name != "test-agent" || s.LastSeen != 42 {
+			t.Fatalf("session has not been imported completely: %+v", s)
+		}
+	}
+	if revoked, _ := dst.IsRevoked(sessions[2].Session); !revoked {
+		t.Fatal("session should be revoked")
+	}
+	if notBefore, _ := dst.Watermark(testUser); notBefore != 200 {
+		t.Fatalf("unexpected watermark: %d", notBefore)
+	}
+
+	// importing the same export again must not change anything
+	if stats, err = ImportBackend(dst, bytes.NewReader(export.Bytes())); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if stats != (StoreExportStats{}) {
+		t.Fatalf("repeated import should be a no-op, got: %v", stats)
+	}
+
+	invalid := []string{
+		"",
+		`{"type":"session"}`,
+		`{"type":"header","version":2}`,
+		"{\"type\":\"header\",\"version\":1}\n{\"type\":\"unknown\"}",
+		"{\"type\":\"header\",\"version\":1}\n{invalid",
+	}
+	for _, data := range invalid {
+		if _, err = ImportBackend(dst, strings.NewReader(data)); err == nil {
+			t.Fatalf("importing '%s' should fail", data)
+		}
+	}
+}
@@ -0,0 +1,245 @@
+//
+// Copyright (c) 2023 whawty contributors (see AUTHORS file)
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// * Neither the name of whawty.nginx-sso nor the names of its
+//   contributors may be used to endorse or promote products derived from
+//   this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+//
+
+package cookie
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	// KeySetSignatureHeader contains the signature over "whawty-nginx-sso:key-set\x00" followed by the key-set.
+	KeySetSignatureHeader = "X-Key-Set-Signature"
+)
+
+var (
+	keyDiscoveryRequests        = prometheus.NewCounterVec(prometheus.CounterOpts{Subsystem: metricsSubsystem, Name: "key_discovery_requests_total"}, []string{"result"})
+	keyDiscoveryRequestsSuccess = keyDiscoveryRequests.MustCurryWith(prometheus.Labels{"result": "success"})
+	keyDiscoveryRequestsFailed  = keyDiscoveryRequests.MustCurryWith(prometheus.Labels{"result": "failed"})
+)
+
+// JSONWebKey only supports the parameters needed for Ed25519 public keys, see RFC 8037
+type JSONWebKey struct {
+	KeyType   string `json:"kty"`
+	Curve     string `json:"crv,omitempty"`
+	X         string `json:"x,omitempty"`
+	KeyID     string `json:"kid"`
+	Use       string `json:"use,omitempty"`
+	Algorithm string `json:"alg,omitempty"`
+}
+
+func (k JSONWebKey) Ed25519PublicKey() (ed25519.PublicKey, error) {
+	if k.KeyType != "OKP" || k.Curve != "Ed25519" {
+		return nil, fmt.Errorf("unsupported key type '%s' (curve: '%s')", k.KeyType, k.Curve)
+	}
+	pub, err := base64.RawURLEncoding.DecodeString(k.X)
+	if err != nil {
+		return nil, err
+	}
+	if len(pub) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("key is not a valid Ed25519 public key")
+	}
+	return ed25519.PublicKey(pub), nil
+}
+
+type JSONWebKeySet struct {
+	Keys []JSONWebKey `json:"keys"`
+}
+
+type SignedKeySet struct {
+	KeySet    json.RawMessage
+	KeyID     string
+	Signature []byte
+}
+
+func (s SignedKeySet) SignatureHeader() string {
+	if s.Signature == nil {
+		return ""
+	}
+	return base64.RawURLEncoding.EncodeToString([]byte(s.KeyID)) + "." + base64.RawURLEncoding.EncodeToString(s.Signature)
+}
+
+func (s *SignedKeySet) ParseSignatureHeader(hdr string) error {
+	parts := strings.SplitN(hdr, ".", 3)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return fmt.Errorf("invalid key-set signature")
+	}
+	keyID, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return fmt.Errorf("invalid key-set signature: %v", err)
+	}
+	if s.Signature, err = base64.RawURLEncoding.DecodeString(parts[1]); err != nil {
+		return fmt.Errorf("invalid key-set signature: %v", err)
+	}
+	s.KeyID = string(keyID)
+	return nil
+}
+
+func (st *Store) ListKeys() (result SignedKeySet, err error) {
+	var set JSONWebKeySet
+	st.keysMutex.RLock()
+	for _, key := range st.keys {
+		pub, ok := key.PublicKey().(ed25519.PublicKey)
+		if !ok {
+			continue
+		}
+		set.Keys = append(set.Keys, JSONWebKey{
+			KeyType: "OKP", Curve: "Ed25519", X: base64.RawURLEncoding.EncodeToString(pub),
+			KeyID: key.id, Use: "sig", Algorithm: "EdDSA"})
+	}
+	st.keysMutex.RUnlock()
+
+	if result.KeySet, err = json.Marshal(set); err != nil {
+		return
+	}
+	if signer := st.currentSigner(); signer != nil {
+		result.KeyID = signer.id
+		if result.Signature, err = signTyped(signer, signedTypeKeySet, result.KeySet); err != nil {
+			return
+		}
+	}
+	return
+}
+
+// loadKeySet only accepts key sets that are signed by a key which is already trusted. Statically configured
+// keys act as trust anchor: they will never be replaced or removed by discovered keys.
+func (st *Store) loadKeySet(signed SignedKeySet) (added, retired uint, err error) {
+	if signed.KeyID == "" {
+		err = fmt.Errorf("key-set signature has no key-id")
+		return
+	}
+	if _, err = st.verifyTypedSignature(signed.KeyID, signedTypeKeySet, signed.KeySet, signed.Signature); err != nil {
+		err = fmt.Errorf("key-set signature is invalid: %v", err)
+		return
+	}
+	var set JSONWebKeySet
+	if err = json.Unmarshal(signed.KeySet, &set); err != nil {
+		return
+	}
+
+	discovered := make(map[string]ed25519.PublicKey)
+	for _, jwk := range set.Keys {
+		if jwk.KeyID == "" {
+			continue
+		}
+		pub, err := jwk.Ed25519PublicKey()
+		if err != nil {
+			st.infoLog.Printf("key-discovery: ignoring key '%s': %v", jwk.KeyID, err)
+			continue
+		}
+		discovered[jwk.KeyID] = pub
+	}
+	if len(discovered) == 0 {
+		// a valid key-set contains at least the key it has been signed with
+		err = fmt.Errorf("key-set contains no usable keys")
+		return
+	}
+
+	st.keysMutex.Lock()
+	defer st.keysMutex.Unlock()
+
+	var keys []*storeKey
+	for _, key := range st.keys {
+		pub, exists := discovered[key.id]
+		if key.discovered && !exists {
+			delete(st.keysByID, key.id)
+			st.infoLog.Printf("key-discovery: retired key '%s'", key.id)
+			retired = retired + 1
+			continue
+		}
+		if exists && !pub.Equal(key.PublicKey()) {
+			st.infoLog.Printf("key-discovery: ignoring key '%s' because its public key does not match the already loaded key", key.id)
+		}
+		delete(discovered, key.id)
+		keys = append(keys, key)
+	}
+	for id, pub := range discovered {
+		k := &storeKey{SignerVerifier: &Ed25519SignerVerifier{context: st.conf.Name + "_" + id, pub: pub}, id: id, discovered: true}
+		keys = append(keys, k)
+		st.keysByID[id] = k
+		st.infoLog.Printf("key-discovery: added key '%s'", id)
+		added = added + 1
+	}
+	st.keys = keys
+	return
+}
+
+func (st *Store) discoverKeys(c *syncClient) bool {
+	resp, err := c.get("jwks")
+	if err != nil {
+		st.infoLog.Printf("key-discovery: error sending request: %v", err)
+		return false
+	}
+	defer resp.Body.Close() //nolint:errcheck
+
+	var signed SignedKeySet
+	if err = signed.ParseSignatureHeader(resp.Header.Get(KeySetSignatureHeader)); err != nil {
+		st.infoLog.Printf("key-discovery: %v", err)
+		return false
+	}
+	if signed.KeySet, err = io.ReadAll(resp.Body); err != nil {
+		st.infoLog.Printf("key-discovery: error reading response: %v", err)
+		return false
+	}
+
+	added, retired, err := st.loadKeySet(signed)
+	if err != nil {
+		st.infoLog.Printf("key-discovery: %v", err)
+		return false
+	}
+	if added > 0 || retired > 0 {
+		st.dbgLog.Printf("key-discovery: successfully added %d and retired %d keys", added, retired)
+	}
+	return true
+}
+
+func (st *Store) runKeyDiscovery(interval time.Duration) {
+	t := time.NewTicker(interval)
+	st.dbgLog.Printf("cookie-store: running key-discovery every %v", interval)
+	for {
+		if st.syncFailover(st.discoverKeys) {
+			keyDiscoveryRequestsSuccess.WithLabelValues().Inc()
+		} else {
+			keyDiscoveryRequestsFailed.WithLabelValues().Inc()
+		}
+		if _, ok := <-t.C; !ok {
+			st.infoLog.Printf("cookie-store: stopping key-discovery because ticker-channel is closed")
+			return
+		}
+	}
+}
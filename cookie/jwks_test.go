@@ -0,0 +1,322 @@
+//
+// Copyright (c) 2023 whawty contributors (see AUTHORS file)
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// * Neither the name of whawty.nginx-sso nor the names of its
+//   contributors may be used to endorse or promote products derived from
+//   this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+//
+
+package cookie
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/oklog/ulid/v2"
+)
+
+func TestListKeys(t *testing.T) {
+	conf := &Config{}
+	conf.Keys = []SignerVerifierConfig{
+		SignerVerifierConfig{Name: "sign-and-verify", Ed25519: &Ed25519Config{PrivKeyData: &testPrivKeyEd25519Pem}},
+	}
+	conf.Backend = StoreBackendConfig{InMemory: &InMemoryBackendConfig{}}
+	st, err := NewStore(conf, nil, nil, nil)
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+
+	signed, err := st.ListKeys()
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if signed.KeyID != "sign-and-verify" {
+		t.Fatalf("unexpected key-set key-id: expected 'sign-and-verify', got '%s'", signed.KeyID)
+	}
+	if err = st.keys[0].Verify(typedPayload(signedTypeKeySet, signed.KeySet), signed.Signature); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if err = st.keys[0].Verify(signed.KeySet, signed.Signature); err == nil {
+		t.Fatal("key-set signature must not be valid for other types of payloads")
+	}
+	if err = st.keys[0].Verify(typedPayload(signedTypeWatermarks, signed.KeySet), signed.Signature); err == nil {
+		t.Fatal("key-set signature must not be valid for other types of payloads")
+	}
+
+	var set JSONWebKeySet
+	if err = json.Unmarshal(signed.KeySet, &set); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if len(set.Keys) != 1 {
+		t.Fatalf("unexpected key-set length: expected 1, got %d", len(set.Keys))
+	}
+	if set.Keys[0].KeyID != "sign-and-verify" {
+		t.Fatalf("unexpected key-id: expected 'sign-and-verify', got '%s'", set.Keys[0].KeyID)
+	}
+	pub, err := set.Keys[0].Ed25519PublicKey()
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if !pub.Equal(testPubKeyEd25519Bytes) {
+		t.Fatalf("unexpected public key: expected '%#v', got '%#v'", testPubKeyEd25519Bytes, pub)
+	}
+
+	var parsed SignedKeySet
+	if err = parsed.ParseSignatureHeader(signed.SignatureHeader()); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if parsed.KeyID != signed.KeyID {
+		t.Fatalf("unexpected key-id from signature header: expected '%s', got '%s'", signed.KeyID, parsed.KeyID)
+	}
+	for _, hdr := range []string{"", ".", "foo", "Zm9v.", ".YmFy", "Zm9v.YmFy.YmF6", "Zm9v=.YmFy"} {
+		if err = parsed.ParseSignatureHeader(hdr); err == nil {
+			t.Fatalf("parsing invalid signature header '%s' should fail", hdr)
+		}
+	}
+}
+
+func TestJSONWebKeyEd25519PublicKey(t *testing.T) {
+	x := base64.RawURLEncoding.EncodeToString(testPubKeyEd25519Bytes)
+	vectors := []struct {
+		jwk   JSONWebKey
+		valid bool
+	}{
+		{JSONWebKey{}, false},
+		{JSONWebKey{KeyType: "EC", Curve: "P-256", X: x}, false},
+		{JSONWebKey{KeyType: "OKP", Curve: "X25519", X: x}, false},
+		{JSONWebKey{KeyType: "OKP", Curve: "Ed25519", X: "not base64!"}, false},
+		{JSONWebKey{KeyType: "OKP", Curve: "Ed25519", X: "Zm9v"}, false},
+		{JSONWebKey{KeyType: "OKP", Curve: "Ed25519", X: x}, true},
+	}
+	for _, vector := range vectors {
+		_, err := vector.jwk.Ed25519PublicKey()
+		if vector.valid && err != nil {
+			t.Fatal("unexpected error:", err)
+		}
+		if !vector.valid && err == nil {
+			t.Fatalf("parsing invalid JWK should fail: %+v", vector.jwk)
+		}
+	}
+}
+
+func testMakeSignedValue(t *testing.T, key *storeKey) string {
+	v, err := MakeValue(ulid.Make(), SessionBase{Username: "test-user", Expires: time.Now().Add(time.Hour).Unix()})
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	v.keyID = key.id
+	if v.signature, err = key.Sign(v.payload); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	return v.String()
+}
+
+func TestLoadKeySet(t *testing.T) {
+	conf := &Config{}
+	conf.Keys = []SignerVerifierConfig{
+		SignerVerifierConfig{Name: "sign-and-verify", Ed25519: &Ed25519Config{PrivKeyData: &testPrivKeyEd25519Pem}},
+	}
+	conf.Backend = StoreBackendConfig{InMemory: &InMemoryBackendConfig{}}
+	signing, err := NewStore(conf, nil, nil, nil)
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	pub, priv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	secondary, err := signing.addKey("secondary", &Ed25519SignerVerifier{context: DefaultCookieName + "_secondary", priv: priv, pub: pub})
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+
+	conf = &Config{}
+	conf.Keys = []SignerVerifierConfig{
+		SignerVerifierConfig{Name: "sign-and-verify", Ed25519: &Ed25519Config{PubKeyData: &testPubKeyEd25519Pem}},
+	}
+	conf.Backend = StoreBackendConfig{InMemory: &InMemoryBackendConfig{}}
+	verifier, err := NewStore(conf, nil, nil, nil)
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+
+	value := testMakeSignedValue(t, secondary)
+	if _, err = verifier.Verify(value, ClientInfo{}); err == nil {
+		t.Fatal("value signed by not yet discovered key should not verify")
+	}
+
+	signed, err := signing.ListKeys()
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	added, retired, err := verifier.loadKeySet(signed)
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if added != 1 || retired != 0 {
+		t.Fatalf("unexpected number of added/retired keys: expected 1/0, got %d/%d", added, retired)
+	}
+	if _, err = verifier.Verify(value, ClientInfo{}); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+
+	// the discovered key is now trusted and can be used to sign the next key-set
+	signing.keysMutex.Lock()
+	signing.signer = secondary
+	signing.keys = []*storeKey{secondary}
+	delete(signing.keysByID, "sign-and-verify")
+	signing.keysMutex.Unlock()
+	signed, err = signing.ListKeys()
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	added, retired, err = verifier.loadKeySet(signed)
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if added != 0 || retired != 0 {
+		t.Fatalf("unexpected number of added/retired keys: expected 0/0, got %d/%d", added, retired)
+	}
+	if len(verifier.keys) != 2 {
+		t.Fatalf("statically configured keys must not be retired, expected 2 keys got %d", len(verifier.keys))
+	}
+
+	signed.KeySet = []byte(`{"keys":[]}`)
+	if _, _, err = verifier.loadKeySet(signed); err == nil {
+		t.Fatal("loading key-set with invalid signature should fail")
+	}
+	if signed.Signature, err = signTyped(secondary, signedTypeKeySet, signed.KeySet); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if _, _, err = verifier.loadKeySet(signed); err == nil {
+		t.Fatal("loading an empty key-set should fail")
+	}
+	// other signed payloads, like watermarks, must not be accepted as key-set
+	signed.KeySet = []byte(`{}`)
+	if signed.Signature, err = signTyped(secondary, signedTypeWatermarks, signed.KeySet); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if _, _, err = verifier.loadKeySet(signed); err == nil {
+		t.Fatal("loading a key-set signed as watermarks should fail")
+	}
+
+	static := verifier.keysByID["sign-and-verify"].PublicKey().(ed25519.PublicKey)
+	signed.KeySet = []byte(`{"keys":[{"kty":"OKP","crv":"Ed25519","kid":"sign-and-verify","x":"` + base64.RawURLEncoding.EncodeToString(static) + `"}]}`)
+	if signed.Signature, err = signTyped(secondary, signedTypeKeySet, signed.KeySet); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	signed.KeyID = ""
+	if _, _, err = verifier.loadKeySet(signed); err == nil {
+		t.Fatal("loading key-set without key-id should fail")
+	}
+	signed.KeyID = secondary.id
+	added, retired, err = verifier.loadKeySet(signed)
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if added != 0 || retired != 1 {
+		t.Fatalf("unexpected number of added/retired keys: expected 0/1, got %d/%d", added, retired)
+	}
+	if _, err = verifier.Verify(value, ClientInfo{}); err == nil {
+		t.Fatal("value signed by retired key should not verify")
+	}
+
+	pub, priv, err = ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	untrusted := &storeKey{SignerVerifier: &Ed25519SignerVerifier{context: DefaultCookieName + "_untrusted", priv: priv, pub: pub}, id: "untrusted"}
+	signed.KeySet = []byte(`{"keys":[{"kty":"OKP","crv":"Ed25519","kid":"untrusted","x":"` + base64.RawURLEncoding.EncodeToString(pub) + `"}]}`)
+	signed.KeyID = untrusted.id
+	if signed.Signature, err = signTyped(untrusted, signedTypeKeySet, signed.KeySet); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if _, _, err = verifier.loadKeySet(signed); err == nil {
+		t.Fatal("loading key-set signed by untrusted key should fail")
+	}
+}
+
+func TestDiscoverKeys(t *testing.T) {
+	conf := &Config{}
+	conf.Keys = []SignerVerifierConfig{
+		SignerVerifierConfig{Name: "sign-and-verify", Ed25519: &Ed25519Config{PrivKeyData: &testPrivKeyEd25519Pem}},
+	}
+	conf.Backend = StoreBackendConfig{InMemory: &InMemoryBackendConfig{}}
+	signing, err := NewStore(conf, nil, nil, nil)
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	pub, priv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if _, err = signing.addKey("secondary", &Ed25519SignerVerifier{context: DefaultCookieName + "_secondary", priv: priv, pub: pub}); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/jwks" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		signed, err := signing.ListKeys()
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set(KeySetSignatureHeader, signed.SignatureHeader())
+		w.Write(signed.KeySet) //nolint:errcheck
+	}))
+	defer srv.Close()
+
+	conf = &Config{}
+	conf.Keys = []SignerVerifierConfig{
+		SignerVerifierConfig{Name: "sign-and-verify", Ed25519: &Ed25519Config{PubKeyData: &testPubKeyEd25519Pem}},
+	}
+	conf.Backend = StoreBackendConfig{InMemory: &InMemoryBackendConfig{}}
+	verifier, err := NewStore(conf, nil, nil, nil)
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+
+	baseURL, _ := url.Parse(srv.URL)
+	if !verifier.discoverKeys(verifier.newSyncClient(baseURL, "", nil, "")) {
+		t.Fatal("key-discovery failed")
+	}
+	if _, exists := verifier.keysByID["secondary"]; !exists {
+		t.Fatal("key-discovery did not add key 'secondary'")
+	}
+
+	baseURL, _ = url.Parse(srv.URL + "/not-found")
+	if verifier.discoverKeys(verifier.newSyncClient(baseURL, "", nil, "")) {
+		t.Fatal("key-discovery using invalid url should fail")
+	}
+}
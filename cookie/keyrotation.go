@@ -0,0 +1,269 @@
+//
+// Copyright (c) 2023 whawty contributors (see AUTHORS file)
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// * Neither the name of whawty.nginx-sso nor the names of its
+//   contributors may be used to endorse or promote products derived from
+//   this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+//
+
+package cookie
+
+import (
+	"crypto/ed25519"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/oklog/ulid/v2"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	DefaultKeyRotationInterval    = 30 * 24 * time.Hour
+	DefaultKeyRotationGracePeriod = 24 * time.Hour
+	keyRotationCheckInterval      = time.Minute
+)
+
+var (
+	keyRotationFailed = prometheus.NewGauge(prometheus.GaugeOpts{Subsystem: metricsSubsystem, Name: "key_rotation_failed"})
+	keyRotationLast   = prometheus.NewGauge(prometheus.GaugeOpts{Subsystem: metricsSubsystem, Name: "key_rotation_last_timestamp_seconds"})
+)
+
+type KeyRotationConfig struct {
+	Directory   string        `yaml:"directory"`
+	Interval    time.Duration `yaml:"interval"`
+	GracePeriod time.Duration `yaml:"grace-period"`
+}
+
+func (st *Store) managedKeyPath(id string) string {
+	return filepath.Join(st.conf.KeyRotation.Directory, id+".pem")
+}
+
+func (st *Store) newManagedKey(id string, priv ed25519.PrivateKey) (*storeKey, error) {
+	created, err := ulid.ParseStrict(id)
+	if err != nil {
+		return nil, err
+	}
+	s := &Ed25519SignerVerifier{context: st.conf.Name + "_" + id, priv: priv, pub: priv.Public().(ed25519.PublicKey)}
+	return &storeKey{SignerVerifier: s, id: id, managed: true, created: ulid.Time(created.Time())}, nil
+}
+
+func (st *Store) loadManagedKeys() error {
+	entries, err := os.ReadDir(st.conf.KeyRotation.Directory)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), ".pem") {
+			continue
+		}
+		id := strings.TrimSuffix(entry.Name(), ".pem")
+		path := st.managedKeyPath(id)
+		priv, _, err := loadEd25519Keys(&Ed25519Config{PrivKeyFile: &path})
+		if err != nil || priv == nil {
+			st.infoLog.Printf("key-rotation: ignoring file '%s': no valid Ed25519 private key found", path)
+			continue
+		}
+		k, err := st.newManagedKey(id, priv)
+		if err != nil {
+			st.infoLog.Printf("key-rotation: ignoring file '%s': %v", path, err)
+			continue
+		}
+		if _, exists := st.keysByID[k.id]; exists {
+			return fmt.Errorf("failed to load managed key '%s': a key with this name already exists", k.id)
+		}
+		st.keys = append(st.keys, k)
+		st.keysByID[k.id] = k
+		st.dbgLog.Printf("cookie-store: loaded managed key '%s' (created: %v)", k.id, k.created)
+	}
+	return nil
+}
+
+func (st *Store) generateManagedKey(now time.Time) (*storeKey, error) {
+	_, priv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		return nil, err
+	}
+	k, err := st.newManagedKey(ulid.MustNew(ulid.Timestamp(now), ulid.DefaultEntropy()).String(), priv)
+	if err != nil {
+		return nil, err
+	}
+
+	der, err := x509.MarshalPKCS8PrivateKey(priv)
+	if err != nil {
+		return nil, err
+	}
+	tmp, err := os.CreateTemp(st.conf.KeyRotation.Directory, ".new-key-*")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(tmp.Name()) //nolint:errcheck
+	if err = pem.Encode(tmp, &pem.Block{Type: "PRIVATE KEY", Bytes: der}); err != nil {
+		tmp.Close() //nolint:errcheck
+		return nil, err
+	}
+	if err = tmp.Sync(); err != nil {
+		tmp.Close() //nolint:errcheck
+		return nil, err
+	}
+	if err = tmp.Close(); err != nil {
+		return nil, err
+	}
+	if err = os.Rename(tmp.Name(), st.managedKeyPath(k.id)); err != nil {
+		return nil, err
+	}
+	return k, nil
+}
+
+func (st *Store) managedKeys() (keys []*storeKey) {
+	for _, key := range st.keys {
+		if key.managed {
+			keys = append(keys, key)
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i].created.Before(keys[j].created) })
+	return
+}
+
+// rotateKeys manages keys which are stored as PKCS#8 encoded PEM files named <ULID>.pem inside the key
+// directory. The time encoded into the ULID is the creation time of the key which is all the state needed:
+//   - a new key gets generated once the newest key is older than the rotation interval
+//   - a key gets promoted to be the signer once it is older than the grace period. During the grace
+//     period the key is only published so that verify-only instances can learn about it.
+//   - a key is removed once the key that replaced it has been the signer for longer than the cookie
+//     expiry since by then all cookies signed by it have expired.
+func (st *Store) rotateKeys(now time.Time) error {
+	st.keysMutex.Lock()
+	defer st.keysMutex.Unlock()
+
+	conf := st.conf.KeyRotation
+	managed := st.managedKeys()
+	if len(managed) == 0 || !managed[len(managed)-1].created.Add(conf.Interval).After(now) {
+		k, err := st.generateManagedKey(now)
+		if err != nil {
+			return fmt.Errorf("failed to generate new key: %v", err)
+		}
+		st.keys = append(st.keys, k)
+		st.keysByID[k.id] = k
+		managed = append(managed, k)
+		st.infoLog.Printf("key-rotation: generated new key '%s'", k.id)
+	}
+
+	signer := st.staticSigner
+	for _, key := range managed {
+		if !key.created.Add(conf.GracePeriod).After(now) {
+			signer = key
+		}
+	}
+	if signer == nil {
+		// there is no key that could be used instead so there is no point in waiting for the grace period
+		signer = managed[0]
+	}
+	if signer != st.signer {
+		st.infoLog.Printf("key-rotation: promoted key '%s' to be the signer", signer.id)
+		st.signer = signer
+	}
+
+	retired := make(map[*storeKey]bool)
+	for i := 0; i < len(managed)-1; i++ {
+		if managed[i] == st.signer {
+			continue
+		}
+		replacedAt := managed[i+1].created.Add(conf.GracePeriod)
+		if replacedAt.After(now) || replacedAt.Add(st.conf.Expire).After(now) {
+			continue
+		}
+		if err := os.Remove(st.managedKeyPath(managed[i].id)); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to remove key '%s': %v", managed[i].id, err)
+		}
+		retired[managed[i]] = true
+		delete(st.keysByID, managed[i].id)
+		st.infoLog.Printf("key-rotation: removed key '%s' since all cookies signed by it have expired", managed[i].id)
+	}
+	if len(retired) > 0 {
+		var keys []*storeKey
+		for _, key := range st.keys {
+			if !retired[key] {
+				keys = append(keys, key)
+			}
+		}
+		st.keys = keys
+	}
+	return nil
+}
+
+func (st *Store) runKeyRotation(interval time.Duration) {
+	t := time.NewTicker(interval)
+	st.dbgLog.Printf("cookie-store: checking for key-rotation every %v", interval)
+	for {
+		if _, ok := <-t.C; !ok {
+			st.infoLog.Printf("cookie-store: stopping key-rotation because ticker-channel is closed")
+			return
+		}
+		if err := st.rotateKeys(time.Now()); err != nil {
+			keyRotationFailed.Set(1)
+			st.infoLog.Printf("key-rotation: %v", err)
+			continue
+		}
+		keyRotationFailed.Set(0)
+		keyRotationLast.SetToCurrentTime()
+	}
+}
+
+func (st *Store) initKeyRotation(conf *Config) error {
+	if conf.KeyRotation.Directory == "" {
+		return fmt.Errorf("key-rotation: 'directory' must not be empty")
+	}
+	if conf.KeyRotation.Interval <= 0 {
+		conf.KeyRotation.Interval = DefaultKeyRotationInterval
+	}
+	if conf.KeyRotation.GracePeriod <= 0 {
+		conf.KeyRotation.GracePeriod = DefaultKeyRotationGracePeriod
+	}
+	if conf.KeyRotation.GracePeriod >= conf.KeyRotation.Interval {
+		return fmt.Errorf("key-rotation: 'grace-period' must be shorter than 'interval'")
+	}
+	if err := os.MkdirAll(conf.KeyRotation.Directory, 0700); err != nil {
+		return err
+	}
+
+	st.keysMutex.Lock()
+	err := st.loadManagedKeys()
+	st.keysMutex.Unlock()
+	if err != nil {
+		return err
+	}
+	if err = st.rotateKeys(time.Now()); err != nil {
+		return err
+	}
+	keyRotationLast.SetToCurrentTime()
+	go st.runKeyRotation(keyRotationCheckInterval)
+	return nil
+}
@@ -0,0 +1,174 @@
+//
+// Copyright (c) 2023 whawty contributors (see AUTHORS file)
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// * Neither the name of whawty.nginx-sso nor the names of its
+//   contributors may be used to endorse or promote products derived from
+//   this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+//
+
+package cookie
+
+import (
+	"os"
+	"testing"
+	"time"
+)
+
+func TestKeyRotationConfig(t *testing.T) {
+	conf := &Config{}
+	conf.Backend = StoreBackendConfig{InMemory: &InMemoryBackendConfig{}}
+	conf.KeyRotation = &KeyRotationConfig{}
+	if _, err := NewStore(conf, nil, nil, nil); err == nil {
+		t.Fatal("initializing store with empty key-rotation directory should fail")
+	}
+
+	conf.KeyRotation = &KeyRotationConfig{Directory: t.TempDir(), Interval: time.Hour, GracePeriod: 2 * time.Hour}
+	if _, err := NewStore(conf, nil, nil, nil); err == nil {
+		t.Fatal("initializing store with grace-period longer than the rotation interval should fail")
+	}
+
+	conf.KeyRotation = &KeyRotationConfig{Directory: t.TempDir()}
+	st, err := NewStore(conf, nil, nil, nil)
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if conf.KeyRotation.Interval != DefaultKeyRotationInterval {
+		t.Fatal("initializing store default value for key-rotation interval does not work")
+	}
+	if conf.KeyRotation.GracePeriod != DefaultKeyRotationGracePeriod {
+		t.Fatal("initializing store default value for key-rotation grace-period does not work")
+	}
+	if st.signer == nil || !st.signer.managed {
+		t.Fatal("initializing store without static keys must promote the generated key immediately")
+	}
+	if _, err = os.Stat(st.managedKeyPath(st.signer.id)); err != nil {
+		t.Fatal("generated key has not been persisted:", err)
+	}
+	value, _, err := st.New("test-user", AgentInfo{}, ClientInfo{})
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if _, err = st.Verify(value, ClientInfo{}); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+
+	st2, err := NewStore(conf, nil, nil, nil)
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if len(st2.keys) != 1 || st2.signer.id != st.signer.id {
+		t.Fatal("re-initializing store must load the previously generated key")
+	}
+	if _, err = st2.Verify(value, ClientInfo{}); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+}
+
+func TestKeyRotation(t *testing.T) {
+	conf := &Config{}
+	conf.Expire = time.Hour
+	conf.Keys = []SignerVerifierConfig{
+		SignerVerifierConfig{Name: "static", Ed25519: &Ed25519Config{PrivKeyData: &testPrivKeyEd25519Pem}},
+	}
+	conf.Backend = StoreBackendConfig{InMemory: &InMemoryBackendConfig{}}
+	conf.KeyRotation = &KeyRotationConfig{Directory: t.TempDir(), Interval: 30 * 24 * time.Hour, GracePeriod: 24 * time.Hour}
+	st, err := NewStore(conf, nil, nil, nil)
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+
+	managed := st.managedKeys()
+	if len(managed) != 1 {
+		t.Fatalf("unexpected number of managed keys: expected 1, got %d", len(managed))
+	}
+	first := managed[0]
+	if st.signer.id != "static" {
+		t.Fatalf("generated key must not be promoted before the grace period is over, signer is '%s'", st.signer.id)
+	}
+	oldValue, _, err := st.New("test-user", AgentInfo{}, ClientInfo{})
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+
+	now := first.created.Add(conf.KeyRotation.GracePeriod)
+	if err = st.rotateKeys(now); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if st.signer != first {
+		t.Fatalf("generated key must be promoted after the grace period, signer is '%s'", st.signer.id)
+	}
+	firstValue, _, err := st.New("test-user", AgentInfo{}, ClientInfo{})
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if _, err = st.Verify(oldValue, ClientInfo{}); err != nil {
+		t.Fatal("static keys must never be removed:", err)
+	}
+
+	now = first.created.Add(conf.KeyRotation.Interval)
+	if err = st.rotateKeys(now); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	managed = st.managedKeys()
+	if len(managed) != 2 {
+		t.Fatalf("unexpected number of managed keys: expected 2, got %d", len(managed))
+	}
+	second := managed[1]
+	if st.signer != first {
+		t.Fatalf("new key must not be promoted before the grace period is over, signer is '%s'", st.signer.id)
+	}
+
+	now = second.created.Add(conf.KeyRotation.GracePeriod)
+	if err = st.rotateKeys(now); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if st.signer != second {
+		t.Fatalf("new key must be promoted after the grace period, signer is '%s'", st.signer.id)
+	}
+	if len(st.managedKeys()) != 2 {
+		t.Fatal("replaced key must not be removed before all cookies signed by it have expired")
+	}
+	if _, err = st.Verify(firstValue, ClientInfo{}); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+
+	now = now.Add(conf.Expire)
+	if err = st.rotateKeys(now); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	managed = st.managedKeys()
+	if len(managed) != 1 || managed[0] != second {
+		t.Fatal("replaced key must be removed once all cookies signed by it have expired")
+	}
+	if _, exists := st.keysByID[first.id]; exists {
+		t.Fatal("removed key must not be used for verification anymore")
+	}
+	if _, err = os.Stat(st.managedKeyPath(first.id)); !os.IsNotExist(err) {
+		t.Fatal("removed key must be deleted from the key directory")
+	}
+	if _, exists := st.keysByID["static"]; !exists {
+		t.Fatal("static keys must never be removed")
+	}
+}
@@ -0,0 +1,71 @@
+//
+// Copyright (c) 2023 whawty contributors (see AUTHORS file)
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// * Neither the name of whawty.nginx-sso nor the names of its
+//   contributors may be used to endorse or promote products derived from
+//   this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+//
+
+package cookie
+
+import (
+	"fmt"
+	"strings"
+)
+
+type PKCS11Config struct {
+	Module   string  `yaml:"module"`
+	Slot     uint    `yaml:"slot"`
+	KeyLabel string  `yaml:"key-label"`
+	PIN      *string `yaml:"pin"`
+	PINFile  *string `yaml:"pin-file"`
+}
+
+func (conf *PKCS11Config) loadPIN() (string, error) {
+	if conf.PIN != nil && conf.PINFile != nil {
+		return "", fmt.Errorf("'pin' and 'pin-file' are mutually exclusive")
+	}
+	if conf.PINFile != nil {
+		pin, err := loadFile(*conf.PINFile)
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimSpace(string(pin)), nil
+	}
+	if conf.PIN != nil {
+		return *conf.PIN, nil
+	}
+	return "", nil
+}
+
+func (conf *PKCS11Config) check() error {
+	if conf.Module == "" {
+		return fmt.Errorf("'module' must not be empty")
+	}
+	if conf.KeyLabel == "" {
+		return fmt.Errorf("'key-label' must not be empty")
+	}
+	return nil
+}
@@ -0,0 +1,248 @@
+//
+// Copyright (c) 2023 whawty contributors (see AUTHORS file)
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// * Neither the name of whawty.nginx-sso nor the names of its
+//   contributors may be used to endorse or promote products derived from
+//   this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+//
+
+//go:build cgo
+
+package cookie
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ed25519"
+	"errors"
+	"fmt"
+	"runtime"
+	"sync"
+	"unsafe"
+
+	"github.com/miekg/pkcs11"
+)
+
+// these are defined by PKCS#11 v3.0 and are not (yet) exported by github.com/miekg/pkcs11
+const (
+	pkcs11CKK_EC_EDWARDS = 0x00000040
+	pkcs11CKM_EDDSA      = 0x00001057
+)
+
+// this mirrors CK_EDDSA_PARAMS, CK_ULONG is an unsigned long which has the same size as uint
+// on all platforms supported by cgo except windows.
+type pkcs11EdDSAParams struct {
+	phFlag         byte
+	contextDataLen uint
+	pContextData   *byte
+}
+
+type PKCS11SignerVerifier struct {
+	context string
+	ctx     *pkcs11.Ctx
+	session pkcs11.SessionHandle
+	priv    pkcs11.ObjectHandle
+	pub     ed25519.PublicKey
+	params  []byte
+	pinner  runtime.Pinner
+	mutex   sync.Mutex
+}
+
+func pkcs11FindObject(ctx *pkcs11.Ctx, session pkcs11.SessionHandle, class uint, label string) (pkcs11.ObjectHandle, error) {
+	template := []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_CLASS, class),
+		pkcs11.NewAttribute(pkcs11.CKA_KEY_TYPE, pkcs11CKK_EC_EDWARDS),
+		pkcs11.NewAttribute(pkcs11.CKA_LABEL, label),
+	}
+	if err := ctx.FindObjectsInit(session, template); err != nil {
+		return 0, err
+	}
+	objects, _, err := ctx.FindObjects(session, 2)
+	if ferr := ctx.FindObjectsFinal(session); err == nil {
+		err = ferr
+	}
+	if err != nil {
+		return 0, err
+	}
+	switch len(objects) {
+	case 0:
+		return 0, fmt.Errorf("no Ed25519 key with label '%s' found", label)
+	case 1:
+		return objects[0], nil
+	}
+	return 0, fmt.Errorf("found more than one Ed25519 key with label '%s'", label)
+}
+
+func pkcs11LoadPublicKey(ctx *pkcs11.Ctx, session pkcs11.SessionHandle, label string) (ed25519.PublicKey, error) {
+	obj, err := pkcs11FindObject(ctx, session, pkcs11.CKO_PUBLIC_KEY, label)
+	if err != nil {
+		return nil, err
+	}
+	attrs, err := ctx.GetAttributeValue(session, obj, []*pkcs11.Attribute{pkcs11.NewAttribute(pkcs11.CKA_EC_POINT, nil)})
+	if err != nil {
+		return nil, err
+	}
+	point := attrs[0].Value
+	// CKA_EC_POINT is supposed to be a DER encoded OCTET STRING but some tokens return the raw point
+	if len(point) == ed25519.PublicKeySize+2 && point[0] == 0x04 && point[1] == ed25519.PublicKeySize {
+		point = point[2:]
+	}
+	if len(point) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("public key '%s' is not a valid Ed25519 public key", label)
+	}
+	return ed25519.PublicKey(bytes.Clone(point)), nil
+}
+
+func pkcs11CheckNonExportable(ctx *pkcs11.Ctx, session pkcs11.SessionHandle, priv pkcs11.ObjectHandle, label string) error {
+	attrs, err := ctx.GetAttributeValue(session, priv, []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_SENSITIVE, nil),
+		pkcs11.NewAttribute(pkcs11.CKA_EXTRACTABLE, nil),
+	})
+	if err != nil {
+		return err
+	}
+	if len(attrs[0].Value) != 1 || attrs[0].Value[0] == 0 {
+		return fmt.Errorf("private key '%s' is not marked as sensitive", label)
+	}
+	if len(attrs[1].Value) != 1 || attrs[1].Value[0] != 0 {
+		return fmt.Errorf("private key '%s' is extractable", label)
+	}
+	return nil
+}
+
+func NewPKCS11SignerVerifier(context string, conf *PKCS11Config) (SignerVerifier, error) {
+	if context == "" {
+		return nil, fmt.Errorf("context must not be empty")
+	}
+	if err := conf.check(); err != nil {
+		return nil, err
+	}
+	pin, err := conf.loadPIN()
+	if err != nil {
+		return nil, err
+	}
+
+	ctx := pkcs11.New(conf.Module)
+	if ctx == nil {
+		return nil, fmt.Errorf("failed to load PKCS#11 module '%s'", conf.Module)
+	}
+	if err = ctx.Initialize(); err != nil && !errors.Is(err, pkcs11.Error(pkcs11.CKR_CRYPTOKI_ALREADY_INITIALIZED)) {
+		ctx.Destroy()
+		return nil, fmt.Errorf("failed to initialize PKCS#11 module '%s': %v", conf.Module, err)
+	}
+
+	s := &PKCS11SignerVerifier{context: context, ctx: ctx}
+	if err = s.open(conf, pin); err != nil {
+		ctx.Destroy()
+		return nil, err
+	}
+
+	params := &pkcs11EdDSAParams{contextDataLen: uint(len(context))}
+	contextData := []byte(context)
+	params.pContextData = &contextData[0]
+	// the parameters get copied to C memory by the pkcs11 package, the context data it
+	// points to must therefore stay pinned for as long as this signer is in use.
+	s.pinner.Pin(params.pContextData)
+	s.params = unsafe.Slice((*byte)(unsafe.Pointer(params)), unsafe.Sizeof(*params))
+
+	// make sure the token actually creates Ed25519ctx signatures which verify using the public key
+	probe := []byte("whawty-nginx-sso PKCS#11 self-test")
+	sig, err := s.Sign(probe)
+	if err != nil {
+		s.Close() //nolint:errcheck
+		return nil, fmt.Errorf("PKCS#11 self-test failed: %v", err)
+	}
+	if err = s.Verify(probe, sig); err != nil {
+		s.Close() //nolint:errcheck
+		return nil, fmt.Errorf("PKCS#11 self-test failed: token does not seem to support Ed25519ctx signatures")
+	}
+	return s, nil
+}
+
+func (s *PKCS11SignerVerifier) open(conf *PKCS11Config, pin string) (err error) {
+	if s.session, err = s.ctx.OpenSession(conf.Slot, pkcs11.CKF_SERIAL_SESSION); err != nil {
+		return fmt.Errorf("failed to open PKCS#11 session on slot %d: %v", conf.Slot, err)
+	}
+	if pin != "" {
+		if err = s.ctx.Login(s.session, pkcs11.CKU_USER, pin); err != nil && !errors.Is(err, pkcs11.Error(pkcs11.CKR_USER_ALREADY_LOGGED_IN)) {
+			s.ctx.CloseSession(s.session) //nolint:errcheck
+			return fmt.Errorf("PKCS#11 login failed: %v", err)
+		}
+	}
+	if s.priv, err = pkcs11FindObject(s.ctx, s.session, pkcs11.CKO_PRIVATE_KEY, conf.KeyLabel); err == nil {
+		if err = pkcs11CheckNonExportable(s.ctx, s.session, s.priv, conf.KeyLabel); err == nil {
+			s.pub, err = pkcs11LoadPublicKey(s.ctx, s.session, conf.KeyLabel)
+		}
+	}
+	if err != nil {
+		s.ctx.CloseSession(s.session) //nolint:errcheck
+		return err
+	}
+	return nil
+}
+
+// Close releases the PKCS#11 session, signing will fail afterwards.
+func (s *PKCS11SignerVerifier) Close() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.ctx == nil {
+		return nil
+	}
+	err := s.ctx.CloseSession(s.session)
+	s.ctx.Destroy()
+	s.ctx = nil
+	s.pinner.Unpin()
+	return err
+}
+
+func (s *PKCS11SignerVerifier) Algo() string {
+	return "Ed25519 (PKCS#11)"
+}
+
+func (s *PKCS11SignerVerifier) CanSign() bool {
+	return true
+}
+
+func (s *PKCS11SignerVerifier) PublicKey() crypto.PublicKey {
+	return s.pub
+}
+
+func (s *PKCS11SignerVerifier) Sign(payload []byte) ([]byte, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.ctx == nil {
+		return nil, fmt.Errorf("PKCS#11 session has been closed")
+	}
+	if err := s.ctx.SignInit(s.session, []*pkcs11.Mechanism{pkcs11.NewMechanism(pkcs11CKM_EDDSA, s.params)}, s.priv); err != nil {
+		return nil, err
+	}
+	return s.ctx.Sign(s.session, payload)
+}
+
+func (s *PKCS11SignerVerifier) Verify(payload, signature []byte) error {
+	return ed25519.VerifyWithOptions(s.pub, payload, signature, &ed25519.Options{Context: s.context})
+}
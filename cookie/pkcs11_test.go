@@ -0,0 +1,163 @@
+//
+// Copyright (c) 2023 whawty contributors (see AUTHORS file)
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// * Neither the name of whawty.nginx-sso nor the names of its
+//   contributors may be used to endorse or promote products derived from
+//   this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+//
+//go:build cgo
+
+package cookie
+
+import (
+	"os"
+	"strconv"
+	"testing"
+
+	"github.com/miekg/pkcs11"
+)
+
+// To run the tests against a real token initialize one using SoftHSM, e.g.:
+//   softhsm2-util --init-token --free --label test --so-pin 1234 --pin 1234
+// and export WHAWTY_NGINX_SSO_TEST_PKCS11_MODULE, WHAWTY_NGINX_SSO_TEST_PKCS11_SLOT and
+// WHAWTY_NGINX_SSO_TEST_PKCS11_PIN accordingly.
+
+func testPKCS11Config(t *testing.T) *PKCS11Config {
+	module := os.Getenv("WHAWTY_NGINX_SSO_TEST_PKCS11_MODULE")
+	if module == "" {
+		t.Skip("WHAWTY_NGINX_SSO_TEST_PKCS11_MODULE is not set")
+	}
+	slot, err := strconv.ParseUint(os.Getenv("WHAWTY_NGINX_SSO_TEST_PKCS11_SLOT"), 10, 0)
+	if err != nil {
+		t.Fatal("WHAWTY_NGINX_SSO_TEST_PKCS11_SLOT is invalid:", err)
+	}
+	pin := os.Getenv("WHAWTY_NGINX_SSO_TEST_PKCS11_PIN")
+	return &PKCS11Config{Module: module, Slot: uint(slot), PIN: &pin}
+}
+
+func testPKCS11GenerateKey(t *testing.T, conf *PKCS11Config, label string, extractable bool) {
+	ctx := pkcs11.New(conf.Module)
+	if ctx == nil {
+		t.Fatal("failed to load PKCS#11 module")
+	}
+	defer ctx.Destroy()
+	if err := ctx.Initialize(); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	defer ctx.Finalize() //nolint:errcheck
+
+	session, err := ctx.OpenSession(conf.Slot, pkcs11.CKF_SERIAL_SESSION|pkcs11.CKF_RW_SESSION)
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	defer ctx.CloseSession(session) //nolint:errcheck
+	if err = ctx.Login(session, pkcs11.CKU_USER, *conf.PIN); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+
+	ed25519Params := []byte{0x06, 0x03, 0x2b, 0x65, 0x70} // OID 1.3.101.112
+	pub := []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_TOKEN, true),
+		pkcs11.NewAttribute(pkcs11.CKA_VERIFY, true),
+		pkcs11.NewAttribute(pkcs11.CKA_EC_PARAMS, ed25519Params),
+		pkcs11.NewAttribute(pkcs11.CKA_LABEL, label),
+	}
+	priv := []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_TOKEN, true),
+		pkcs11.NewAttribute(pkcs11.CKA_SIGN, true),
+		pkcs11.NewAttribute(pkcs11.CKA_SENSITIVE, true),
+		pkcs11.NewAttribute(pkcs11.CKA_EXTRACTABLE, extractable),
+		pkcs11.NewAttribute(pkcs11.CKA_LABEL, label),
+	}
+	mech := []*pkcs11.Mechanism{pkcs11.NewMechanism(0x00001055, nil)} // CKM_EC_EDWARDS_KEY_PAIR_GEN
+	if _, _, err = ctx.GenerateKeyPair(session, mech, pub, priv); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+}
+
+func TestNewPKCS11SignerVerifierConfig(t *testing.T) {
+	conf := &PKCS11Config{}
+	if _, err := NewPKCS11SignerVerifier("test", conf); err == nil {
+		t.Fatal("creating PKCS#11 signer from empty config should fail")
+	}
+	conf.Module = "/nonexistent/libpkcs11.so"
+	if _, err := NewPKCS11SignerVerifier("test", conf); err == nil {
+		t.Fatal("creating PKCS#11 signer without key label should fail")
+	}
+	conf.KeyLabel = "test"
+	if _, err := NewPKCS11SignerVerifier("", conf); err == nil {
+		t.Fatal("creating PKCS#11 signer with empty context should fail")
+	}
+	pin := "1234"
+	pinFile := "/nonexistent/pin"
+	conf.PIN = &pin
+	conf.PINFile = &pinFile
+	if _, err := NewPKCS11SignerVerifier("test", conf); err == nil {
+		t.Fatal("creating PKCS#11 signer with 'pin' and 'pin-file' should fail")
+	}
+	conf.PINFile = nil
+	if _, err := NewPKCS11SignerVerifier("test", conf); err == nil {
+		t.Fatal("creating PKCS#11 signer using non-existing module should fail")
+	}
+}
+
+func TestPKCS11SignThenVerify(t *testing.T) {
+	conf := testPKCS11Config(t)
+	conf.KeyLabel = "whawty-nginx-sso-test-" + strconv.FormatInt(int64(os.Getpid()), 10)
+	testPKCS11GenerateKey(t, conf, conf.KeyLabel, false)
+
+	s, err := NewPKCS11SignerVerifier(testContext, conf)
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if !s.CanSign() {
+		t.Fatal("PKCS#11 signer must be able to sign")
+	}
+	signature, err := s.Sign(testMessage)
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if err = s.Verify(testMessage, signature); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+
+	verifier := &Ed25519SignerVerifier{context: testContext, pub: s.(*PKCS11SignerVerifier).pub}
+	if err = verifier.Verify(testMessage, signature); err != nil {
+		t.Fatal("PKCS#11 signatures must verify using the plain Ed25519 public key:", err)
+	}
+	if err = verifier.Verify([]byte("other message"), signature); err == nil {
+		t.Fatal("verifying signature for wrong message should fail")
+	}
+}
+
+func TestPKCS11RejectExtractableKey(t *testing.T) {
+	conf := testPKCS11Config(t)
+	conf.KeyLabel = "whawty-nginx-sso-test-extractable-" + strconv.FormatInt(int64(os.Getpid()), 10)
+	testPKCS11GenerateKey(t, conf, conf.KeyLabel, true)
+
+	if _, err := NewPKCS11SignerVerifier(testContext, conf); err == nil {
+		t.Fatal("loading an extractable private key should fail")
+	}
+}
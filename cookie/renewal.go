@@ -0,0 +1,118 @@
+//
+// Copyright (c) 2023 whawty contributors (see AUTHORS file)
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// * Neither the name of whawty.nginx-sso nor the names of its
+//   contributors may be used to endorse or promote products derived from
+//   this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+//
+
+package cookie
+
+import (
+	"fmt"
+	"time"
+)
+
+const (
+	DefaultRenewalThreshold   = 0.5
+	DefaultRenewalMaxLifetime = 7 * 24 * time.Hour
+)
+
+type RenewalConfig struct {
+	Threshold   float64       `yaml:"threshold"`
+	MaxLifetime time.Duration `yaml:"max-lifetime"`
+}
+
+func (st *Store) initRenewal(conf *Config) error {
+	if conf.Renewal.Threshold <= 0 || conf.Renewal.Threshold >= 1 {
+		if conf.Renewal.Threshold != 0 {
+			st.infoLog.Printf("cookie-store: overriding invalid renewal threshold %v to %v", conf.Renewal.Threshold, DefaultRenewalThreshold)
+		}
+		conf.Renewal.Threshold = DefaultRenewalThreshold
+	}
+	if conf.Renewal.MaxLifetime <= 0 {
+		conf.Renewal.MaxLifetime = DefaultRenewalMaxLifetime
+	}
+	if conf.Renewal.MaxLifetime < conf.Expire {
+		return fmt.Errorf("renewal: 'max-lifetime' must not be shorter than 'expire'")
+	}
+	return nil
+}
+
+// maxExpiry returns the latest possible expiry time of the session. Without renewal this is the
+// expiry time signed into the cookie.
+func (st *Store) maxExpiry(s Session) int64 {
+	if st.conf.Renewal == nil {
+		return s.Expires
+	}
+	return s.CreatedAt().Add(st.conf.Renewal.MaxLifetime).Unix()
+}
+
+// Renew issues a new cookie for the session if more than the configured fraction of its lifetime
+// has passed. The new cookie uses the same session ID but will never be valid for longer than
+// the maximum lifetime of the session. If no renewal is needed the returned value will be empty.
+func (st *Store) Renew(s *Session) (value string, opts Options, err error) {
+	if st.conf.Renewal == nil {
+		return
+	}
+	signer := st.currentSigner()
+	if signer == nil {
+		return
+	}
+	threshold := time.Duration(float64(st.conf.Expire) * (1 - st.conf.Renewal.Threshold))
+	if time.Until(s.ExpiresAt()) > threshold {
+		return
+	}
+
+	renewed := *s
+	renewed.SetExpiry(st.conf.Expire)
+	if maxExpires := st.maxExpiry(renewed); renewed.Expires > maxExpires {
+		renewed.Expires = maxExpires
+	}
+	if renewed.Expires <= s.Expires {
+		return
+	}
+
+	var v *Value
+	if v, err = MakeValue(renewed.ID, renewed.SessionBase); err != nil {
+		return
+	}
+	v.keyID = signer.id
+	if v.signature, err = signer.Sign(v.payload); err != nil {
+		return
+	}
+	if err = st.backend.Renew(renewed); err != nil {
+		return
+	}
+	st.trackReplication(renewed)
+	st.dbgLog.Printf("successfully renewed session('%v'): %+v", renewed.ID, renewed.SessionBase)
+
+	cookiesRenewed.WithLabelValues(signer.id).Inc()
+	opts.fromConfig(st.conf)
+	opts.MaxAge = int(time.Until(renewed.ExpiresAt()).Seconds())
+	*s = renewed
+	value = v.String()
+	return
+}
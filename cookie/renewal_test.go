@@ -0,0 +1,156 @@
+//
+// Copyright (c) 2023 whawty contributors (see AUTHORS file)
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// * Neither the name of whawty.nginx-sso nor the names of its
+//   contributors may be used to endorse or promote products derived from
+//   this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+//
+
+package cookie
+
+import (
+	"crypto/rand"
+	"testing"
+	"time"
+
+	"github.com/oklog/ulid/v2"
+)
+
+func TestRenewalConfig(t *testing.T) {
+	conf := &Config{Expire: time.Hour, Renewal: &RenewalConfig{Threshold: 1.5}}
+	conf.Keys = []SignerVerifierConfig{
+		SignerVerifierConfig{Name: "sign-and-verify", Ed25519: &Ed25519Config{PrivKeyData: &testPrivKeyEd25519Pem}},
+	}
+	conf.Backend = StoreBackendConfig{InMemory: &InMemoryBackendConfig{}}
+	_, err := NewStore(conf, nil, nil, nil)
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if conf.Renewal.Threshold != DefaultRenewalThreshold {
+		t.Fatalf("invalid threshold should be overriden to %v, got %v", DefaultRenewalThreshold, conf.Renewal.Threshold)
+	}
+	if conf.Renewal.MaxLifetime != DefaultRenewalMaxLifetime {
+		t.Fatalf("unset max-lifetime should be overriden to %v, got %v", DefaultRenewalMaxLifetime, conf.Renewal.MaxLifetime)
+	}
+
+	conf.Renewal = &RenewalConfig{MaxLifetime: time.Minute}
+	if _, err = NewStore(conf, nil, nil, nil); err == nil {
+		t.Fatal("initializing store with max-lifetime shorter than expire should fail")
+	}
+}
+
+func TestRenew(t *testing.T) {
+	conf := &Config{Expire: time.Hour}
+	conf.Keys = []SignerVerifierConfig{
+		SignerVerifierConfig{Name: "sign-and-verify", Ed25519: &Ed25519Config{PrivKeyData: &testPrivKeyEd25519Pem}},
+	}
+	conf.Backend = StoreBackendConfig{InMemory: &InMemoryBackendConfig{}}
+	st, err := NewStore(conf, nil, nil, nil)
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+
+	testUser := "test-user"
+	value, _, err := st.New(testUser, AgentInfo{}, ClientInfo{})
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	session, err := st.Verify(value, ClientInfo{})
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	session.Expires = time.Now().Add(10 * time.Minute).Unix()
+	if value, _, err = st.Renew(&session); err != nil || value != "" {
+		t.Fatalf("renewing a session without renewal config must be a noop, got value '%s', err: %v", value, err)
+	}
+
+	conf.Renewal = &RenewalConfig{Threshold: 0.5, MaxLifetime: 90 * time.Minute}
+	fresh := Session{ID: session.ID, SessionBase: SessionBase{Username: testUser}}
+	fresh.SetExpiry(40 * time.Minute)
+	if value, _, err = st.Renew(&fresh); err != nil || value != "" {
+		t.Fatalf("session has not reached the renewal threshold, got value '%s', err: %v", value, err)
+	}
+
+	value, opts, err := st.Renew(&session)
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if value == "" {
+		t.Fatal("session should have been renewed")
+	}
+	expiresDiff := time.Hour - time.Until(session.ExpiresAt())
+	if expiresDiff < 0 || expiresDiff > 5*time.Second {
+		t.Fatalf("renewed session has wrong expiry: %v", session.ExpiresAt())
+	}
+	if opts.MaxAge <= 0 || opts.MaxAge > int(time.Hour.Seconds()) {
+		t.Fatalf("renewed cookie has wrong max-age: %d", opts.MaxAge)
+	}
+	renewed, err := st.Verify(value, ClientInfo{})
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if renewed.ID != session.ID || renewed.Expires != session.Expires {
+		t.Fatalf("renewed cookie contains wrong session, expected: %+v, got %+v", session, renewed)
+	}
+	list, err := st.ListUser(testUser)
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if len(list) != 1 || list[0].Expires != session.Expires {
+		t.Fatalf("backend has not been updated: %+v", list)
+	}
+
+	old := Session{ID: ulid.MustNew(ulid.Timestamp(time.Now().Add(-80*time.Minute)), rand.Reader), SessionBase: SessionBase{Username: testUser}}
+	old.SetExpiry(5 * time.Minute)
+	if err = st.backend.Save(SessionFull{Session: old}); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if value, _, err = st.Renew(&old); err != nil || value == "" {
+		t.Fatalf("session should have been renewed, got value '%s', err: %v", value, err)
+	}
+	if maxExpires := old.CreatedAt().Add(90 * time.Minute); old.ExpiresAt().After(maxExpires) {
+		t.Fatalf("renewed session expires after max-lifetime: %v > %v", old.ExpiresAt(), maxExpires)
+	}
+	if value, _, err = st.Renew(&old); err != nil || value != "" {
+		t.Fatalf("session must not be renewed beyond max-lifetime, got value '%s', err: %v", value, err)
+	}
+
+	unknown := Session{ID: ulid.Make(), SessionBase: SessionBase{Username: testUser}}
+	unknown.SetExpiry(time.Minute)
+	if _, _, err = st.Renew(&unknown); err == nil {
+		t.Fatal("renewing a session unknown to the backend should fail")
+	}
+
+	if err = st.Revoke(renewed); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	revoked, err := st.backend.ListRevoked()
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if len(revoked) != 1 || revoked[0].Expires != renewed.CreatedAt().Add(90*time.Minute).Unix() {
+		t.Fatalf("revocation must be kept until the max-lifetime of the session: %+v", revoked)
+	}
+}
@@ -0,0 +1,472 @@
+//
+// Copyright (c) 2023 whawty contributors (see AUTHORS file)
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// * Neither the name of whawty.nginx-sso nor the names of its
+//   contributors may be used to endorse or promote products derived from
+//   this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+//
+
+package cookie
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/oklog/ulid/v2"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	DefaultReplicationInterval = 10 * time.Second
+)
+
+var (
+	replicationRequests        = prometheus.NewCounterVec(prometheus.CounterOpts{Subsystem: metricsSubsystem, Name: "replication_requests_total"}, []string{"result"})
+	replicationRequestsSuccess = replicationRequests.MustCurryWith(prometheus.Labels{"result": "success"})
+	replicationRequestsFailed  = replicationRequests.MustCurryWith(prometheus.Labels{"result": "failed"})
+)
+
+var ErrReplicationUnauthorized = errors.New("unauthorized replication token")
+
+// ReplicationConfig uses its own credentials since peers are able to read and modify all sessions. Tokens
+// are the ones peers must use to talk to this instance. Batches sent by peers must be signed by one of the
+// keys listed in PeerKeys, if it is empty any key which has been configured statically may be used.
+type ReplicationConfig struct {
+	Interval time.Duration        `yaml:"interval"`
+	Tokens   []string             `yaml:"tokens"`
+	PeerKeys []string             `yaml:"peer-keys"`
+	Peers    []SyncUpstreamConfig `yaml:"peers"`
+}
+
+// ReplicationBatch contains all sessions and revocations which have been changed since the cursors
+// sent by the peer as well as the cursors to use for the next request.
+type ReplicationBatch struct {
+	Issuer            string          `json:"issuer"`
+	IssuedAt          int64           `json:"issued-at"`
+	SessionsCursor    int64           `json:"sessions-cursor"`
+	RevocationsCursor string          `json:"revocations-cursor"`
+	Sessions          SessionFullList `json:"sessions"`
+	Revoked           SessionList     `json:"revoked"`
+	Watermarks        Watermarks      `json:"watermarks"`
+}
+
+type SignedReplicationBatch struct {
+	KeyID     string `json:"key-id"`
+	Batch     []byte `json:"batch"`
+	Signature []byte `json:"signature"`
+}
+
+type ReplicationRequest struct {
+	SessionsSince    int64                  `json:"sessions-since"`
+	RevocationsSince string                 `json:"revocations-since"`
+	Changes          SignedReplicationBatch `json:"changes"`
+}
+
+type replicationEntry struct {
+	username string
+	expires  int64
+	updated  int64
+}
+
+// replicationTracker remembers which sessions have been created or renewed. Revocations don't need
+// to be tracked since the backend keeps a log of them anyway.
+type replicationTracker struct {
+	mutex   sync.Mutex
+	merge   sync.Mutex
+	entries map[ulid.ULID]*replicationEntry
+	started int64
+	last    int64
+}
+
+func newReplicationTracker() *replicationTracker {
+	now := time.Now().UnixNano()
+	return &replicationTracker{entries: make(map[ulid.ULID]*replicationEntry), started: now, last: now}
+}
+
+// next must be called with the mutex held. The cursor is strictly monotonic.
+func (r *replicationTracker) next() int64 {
+	r.last = max(time.Now().UnixNano(), r.last+1)
+	return r.last
+}
+
+func (r *replicationTracker) track(s Session) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.entries[s.ID] = &replicationEntry{username: s.Username, expires: s.Expires, updated: r.next()}
+}
+
+// since returns the IDs, grouped by user, of all sessions changed after cursor. If the cursor has not
+// been created by this tracker the whole list of sessions is needed.
+func (r *replicationTracker) since(cursor int64) (changed map[string]map[ulid.ULID]bool, last int64, full bool) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	last = r.next()
+	if cursor < r.started || cursor > last {
+		full = true
+		return
+	}
+	changed = make(map[string]map[ulid.ULID]bool)
+	for id, entry := range r.entries {
+		if entry.updated <= cursor {
+			continue
+		}
+		if changed[entry.username] == nil {
+			changed[entry.username] = make(map[ulid.ULID]bool)
+		}
+		changed[entry.username][id] = true
+	}
+	return
+}
+
+func (r *replicationTracker) expire() {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	now := time.Now().Unix()
+	for id, entry := range r.entries {
+		if entry.expires < now {
+			delete(r.entries, id)
+		}
+	}
+}
+
+type replicationPeer struct {
+	c                 *syncClient
+	sessionsSince     int64
+	revocationsSince  string
+	pushedSessions    int64
+	pushedRevocations string
+}
+
+func (st *Store) initReplication(conf *ReplicationConfig) error {
+	if conf.Interval <= time.Second {
+		st.infoLog.Printf("cookie-store: overriding invalid/unset replication interval to %v", DefaultReplicationInterval)
+		conf.Interval = DefaultReplicationInterval
+	}
+	for _, name := range conf.PeerKeys {
+		if _, exists := st.keysByID[name]; !exists {
+			return fmt.Errorf("replication: peer key '%s' does not exist", name)
+		}
+	}
+	for _, peer := range conf.Peers {
+		c, err := st.newSyncClientFromConfig(peer)
+		if err != nil {
+			return fmt.Errorf("replication: %v", err)
+		}
+		st.replicationPeers = append(st.replicationPeers, &replicationPeer{c: c})
+	}
+	st.replication = newReplicationTracker()
+	return nil
+}
+
+func (st *Store) trackReplication(s Session) {
+	if st.replication != nil {
+		st.replication.track(s)
+	}
+}
+
+func (st *Store) replicationChanges(sessionsSince int64, revocationsSince string) (batch ReplicationBatch, err error) {
+	changed, last, full := st.replication.since(sessionsSince)
+	batch.SessionsCursor = last
+	if full {
+		if batch.Sessions, err = st.backend.ListAll(); err != nil {
+			return
+		}
+	}
+	for username, ids := range changed {
+		var list SessionFullList
+		if list, err = st.listUser(username); err != nil {
+			return
+		}
+		for _, s := range list {
+			if ids[s.ID] {
+				batch.Sessions = append(batch.Sessions, s)
+			}
+		}
+	}
+
+	var update RevocationUpdate
+	if update, err = st.revocationUpdate(revocationsSince); err != nil {
+		return
+	}
+	batch.RevocationsCursor = update.Cursor
+	batch.Revoked = update.Revoked
+	batch.Watermarks = update.Watermarks
+	return
+}
+
+func (st *Store) signReplicationBatch(batch ReplicationBatch) (result SignedReplicationBatch, err error) {
+	signer := st.currentSigner()
+	if signer == nil {
+		err = fmt.Errorf("replication needs a key which is able to sign")
+		return
+	}
+	batch.Issuer = st.conf.Issuer
+	batch.IssuedAt = time.Now().UnixMilli()
+	if result.Batch, err = json.Marshal(batch); err != nil {
+		return
+	}
+	result.KeyID = signer.id
+	result.Signature, err = signTyped(signer, signedTypeReplication, result.Batch)
+	return
+}
+
+func (st *Store) isReplicationPeerKey(keyID string) bool {
+	if len(st.conf.Backend.Replication.PeerKeys) == 0 {
+		st.keysMutex.RLock()
+		defer st.keysMutex.RUnlock()
+		key, exists := st.keysByID[keyID]
+		return exists && !key.discovered
+	}
+	for _, name := range st.conf.Backend.Replication.PeerKeys {
+		if name == keyID {
+			return true
+		}
+	}
+	return false
+}
+
+// verifyReplicationBatch only accepts batches which have been signed recently by one of the peer keys.
+func (st *Store) verifyReplicationBatch(signed SignedReplicationBatch) (batch ReplicationBatch, err error) {
+	if signed.KeyID == "" || !st.isReplicationPeerKey(signed.KeyID) {
+		err = fmt.Errorf("replication batch is not signed by a peer key")
+		return
+	}
+	if _, err = st.verifyTypedSignature(signed.KeyID, signedTypeReplication, signed.Batch, signed.Signature); err != nil {
+		err = fmt.Errorf("replication batch signature is invalid: %v", err)
+		return
+	}
+	if err = json.Unmarshal(signed.Batch, &batch); err != nil {
+		err = fmt.Errorf("error parsing replication batch: %v", err)
+		return
+	}
+	if age := time.Since(time.UnixMilli(batch.IssuedAt)); age > RevocationListMaxAge || age < -RevocationListMaxAge {
+		err = fmt.Errorf("replication batch from '%s' has been issued %v ago", batch.Issuer, age.Round(time.Second))
+	}
+	return
+}
+
+// mergeReplication applies the changes made by a peer. This is not last-writer-wins: sessions don't record
+// when and where they have been changed, instead conflicts are resolved per field so that the result does not
+// depend on the order in which changes arrive. Revocations and watermarks are only ever added and always win
+// over sessions. Since renewals only move the expiry forward, the copy which expires later wins. Copies which
+// expire at the same time or earlier, e.g. because they arrived late, are ignored. The latest activity wins.
+func (st *Store) mergeReplication(batch ReplicationBatch) error {
+	st.replication.merge.Lock()
+	defer st.replication.merge.Unlock()
+
+	local := make(map[string]map[ulid.ULID]SessionFull)
+	localSessions := func(username string) (map[ulid.ULID]SessionFull, error) {
+		if sessions, exists := local[username]; exists {
+			return sessions, nil
+		}
+		list, err := st.listUser(username)
+		if err != nil {
+			return nil, err
+		}
+		sessions := make(map[ulid.ULID]SessionFull)
+		for _, s := range list {
+			sessions[s.ID] = s
+		}
+		local[username] = sessions
+		return sessions, nil
+	}
+
+	notify := false
+	for _, s := range batch.Revoked {
+		sessions, err := localSessions(s.Username)
+		if err != nil {
+			return err
+		}
+		l, exists := sessions[s.ID]
+		if !exists {
+			continue
+		}
+		s.Expires = max(s.Expires, l.Expires)
+		s.Binding = nil
+		if err = st.backend.Revoke(s); err != nil {
+			return err
+		}
+		delete(sessions, s.ID)
+		notify = true
+	}
+	cnt, err := st.backend.LoadRevocations(batch.Revoked)
+	if err != nil {
+		return err
+	}
+	if cnt, err = st.backend.LoadWatermarks(batch.Watermarks); err != nil {
+		return err
+	}
+	notify = notify || cnt > 0
+
+	for _, s := range batch.Sessions {
+		sessions, err := localSessions(s.Username)
+		if err != nil {
+			return err
+		}
+		l, exists := sessions[s.ID]
+		if !exists {
+			var revoked bool
+			if revoked, err = st.isRevoked(s.Session); err != nil {
+				return err
+			}
+			if revoked || s.IsExpired() {
+				continue
+			}
+			if err = st.saveSession(s); err != nil {
+				return err
+			}
+			sessions[s.ID] = s
+			st.replication.track(s.Session)
+			continue
+		}
+		if s.Expires > l.Expires {
+			if err = st.backend.Renew(s.Session); err != nil {
+				return err
+			}
+			st.replication.track(s.Session)
+		}
+		if s.LastSeen > l.LastSeen {
+			if err = st.backend.SaveActivity(SessionActivityList{{ID: s.ID, Username: s.Username, LastSeen: s.LastSeen, IP: s.LastIP}}); err != nil {
+				return err
+			}
+		}
+	}
+	if notify {
+		st.revocations.notify()
+	}
+	return nil
+}
+
+// CheckReplicationToken returns true if token is one of the tokens peers use to authenticate.
+func (st *Store) CheckReplicationToken(token string) bool {
+	if st.replication == nil || token == "" {
+		return false
+	}
+	for _, t := range st.conf.Backend.Replication.Tokens {
+		if subtle.ConstantTimeCompare([]byte(t), []byte(token)) == 1 {
+			return true
+		}
+	}
+	return false
+}
+
+// Replicate merges the changes sent by a peer and returns all changes since the cursors of the peer.
+// It returns ErrReplicationUnauthorized if token is not one of the replication tokens.
+func (st *Store) Replicate(token string, req ReplicationRequest) (result SignedReplicationBatch, err error) {
+	if st.replication == nil {
+		err = fmt.Errorf("replication is not enabled")
+		return
+	}
+	if !st.CheckReplicationToken(token) {
+		err = ErrReplicationUnauthorized
+		return
+	}
+	var changes ReplicationBatch
+	if changes, err = st.verifyReplicationBatch(req.Changes); err != nil {
+		return
+	}
+	var batch ReplicationBatch
+	if batch, err = st.replicationChanges(req.SessionsSince, req.RevocationsSince); err != nil {
+		return
+	}
+	if result, err = st.signReplicationBatch(batch); err != nil {
+		return
+	}
+	err = st.mergeReplication(changes)
+	return
+}
+
+func (st *Store) replicate(p *replicationPeer) bool {
+	changes, err := st.replicationChanges(p.pushedSessions, p.pushedRevocations)
+	if err != nil {
+		st.infoLog.Printf("cookie-store: error collecting changes for replication: %v", err)
+		return false
+	}
+	signed, err := st.signReplicationBatch(changes)
+	if err != nil {
+		st.infoLog.Printf("cookie-store: error signing replication request: %v", err)
+		return false
+	}
+	body, err := json.Marshal(ReplicationRequest{SessionsSince: p.sessionsSince, RevocationsSince: p.revocationsSince, Changes: signed})
+	if err != nil {
+		st.infoLog.Printf("cookie-store: error encoding replication request: %v", err)
+		return false
+	}
+
+	resp, err := p.c.post("replication", nil, body)
+	if err != nil {
+		st.infoLog.Printf("cookie-store: error sending replication request to %s: %v", p.c.name, err)
+		return false
+	}
+	defer resp.Body.Close() //nolint:errcheck
+
+	var signedResult SignedReplicationBatch
+	if err = json.NewDecoder(resp.Body).Decode(&signedResult); err != nil {
+		st.infoLog.Printf("cookie-store: error parsing replication response from %s: %v", p.c.name, err)
+		return false
+	}
+	result, err := st.verifyReplicationBatch(signedResult)
+	if err != nil {
+		st.infoLog.Printf("cookie-store: rejecting replication response from %s: %v", p.c.name, err)
+		return false
+	}
+	if err = st.mergeReplication(result); err != nil {
+		st.infoLog.Printf("cookie-store: error merging changes from %s: %v", p.c.name, err)
+		return false
+	}
+	if len(result.Sessions)+len(result.Revoked) > 0 {
+		st.dbgLog.Printf("cookie-store: got %d sessions and %d revocations from %s", len(result.Sessions), len(result.Revoked), p.c.name)
+	}
+	p.sessionsSince = result.SessionsCursor
+	p.revocationsSince = result.RevocationsCursor
+	p.pushedSessions = changes.SessionsCursor
+	p.pushedRevocations = changes.RevocationsCursor
+	return true
+}
+
+func (st *Store) runReplication(interval time.Duration) {
+	t := time.NewTicker(interval)
+	st.dbgLog.Printf("cookie-store: replicating with %d peers every %v", len(st.replicationPeers), interval)
+	for {
+		if _, ok := <-t.C; !ok {
+			st.infoLog.Printf("cookie-store: stopping replication because ticker-channel is closed")
+			return
+		}
+		st.replication.expire()
+		for _, p := range st.replicationPeers {
+			if st.replicate(p) {
+				replicationRequestsSuccess.WithLabelValues().Inc()
+			} else {
+				replicationRequestsFailed.WithLabelValues().Inc()
+			}
+		}
+	}
+}
@@ -0,0 +1,355 @@
+//
+// Copyright (c) 2023 whawty contributors (see AUTHORS file)
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// * Neither the name of whawty.nginx-sso nor the names of its
+//   contributors may be used to endorse or promote products derived from
+//   this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+//
+
+package cookie
+
+import (
+	"crypto/ed25519"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+const (
+	testReplicationToken = "replication-token"
+	testVerifyOnlyToken  = "verify-only-token"
+)
+
+func newTestReplicationStore(t *testing.T, backend StoreBackendConfig, token string, peers ...string) *Store {
+	conf := &Config{Expire: time.Hour}
+	conf.Keys = []SignerVerifierConfig{
+		SignerVerifierConfig{Name: "sign-and-verify", Ed25519: &Ed25519Config{PrivKeyData: &testPrivKeyEd25519Pem}},
+	}
+	conf.Backend = backend
+	conf.Backend.Replication = &ReplicationConfig{Interval: time.Hour, Tokens: []string{testReplicationToken}}
+	for _, peer := range peers {
+		conf.Backend.Replication.Peers = append(conf.Backend.Replication.Peers, SyncUpstreamConfig{BaseURL: peer, Token: token})
+	}
+	st, err := NewStore(conf, nil, nil, nil)
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	return st
+}
+
+// newTestReplicationServer mimics the /replication endpoint of the web handler.
+func newTestReplicationServer(st *Store) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req ReplicationRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		result, err := st.Replicate(strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer "), req)
+		if errors.Is(err, ErrReplicationUnauthorized) {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		json.NewEncoder(w).Encode(result) //nolint:errcheck
+	}))
+}
+
+func TestReplication(t *testing.T) {
+	passive := newTestReplicationStore(t, StoreBackendConfig{Bolt: &BoltBackendConfig{Path: filepath.Join(t.TempDir(), "sessions.db")}}, "")
+	srv := newTestReplicationServer(passive)
+	defer srv.Close()
+	active := newTestReplicationStore(t, StoreBackendConfig{InMemory: &InMemoryBackendConfig{}}, testReplicationToken, srv.URL)
+	peer := active.replicationPeers[0]
+
+	sessionIDs := func(st *Store) map[string]bool {
+		list, err := st.ListUser("test-user")
+		if err != nil {
+			t.Fatal("unexpected error:", err)
+		}
+		ids := make(map[string]bool)
+		for _, s := range list {
+			ids[s.ID.String()] = true
+		}
+		return ids
+	}
+	newSession := func(st *Store) Session {
+		value, _, err := st.New("test-user", AgentInfo{Name: "test-agent"}, ClientInfo{})
+		if err != nil {
+			t.Fatal("unexpected error:", err)
+		}
+		s, err := st.Verify(value, ClientInfo{})
+		if err != nil {
+			t.Fatal("unexpected error:", err)
+		}
+		return s
+	}
+
+	existing := newSession(passive)
+	onActive := newSession(active)
+	if !active.replicate(peer) {
+		t.Fatal("replication failed")
+	}
+	onPassive := newSession(passive)
+	if !active.replicate(peer) {
+		t.Fatal("replication failed")
+	}
+	for name, st := range map[string]*Store{"active": active, "passive": passive} {
+		ids := sessionIDs(st)
+		for _, s := range []Session{existing, onActive, onPassive} {
+			if !ids[s.ID.String()] {
+				t.Fatalf("session %v is missing on the %s instance", s.ID, name)
+			}
+		}
+	}
+
+	if err := passive.RevokeID(onActive.Username, onActive.ID); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	renewed := onPassive
+	renewed.Expires = renewed.Expires + 60
+	if err := active.backend.Renew(renewed); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	active.trackReplication(renewed)
+	if !active.replicate(peer) {
+		t.Fatal("replication failed")
+	}
+	if revoked, _ := active.backend.IsRevoked(onActive); !revoked {
+		t.Fatal("revocation on the passive instance should have been replicated")
+	}
+	if sessionIDs(active)[onActive.ID.String()] {
+		t.Fatal("revoked session should have been removed on the active instance")
+	}
+	list, err := passive.ListUser("test-user")
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	for _, s := range list {
+		if s.ID == onPassive.ID && s.Expires != renewed.Expires {
+			t.Fatalf("renewal should have been replicated: expected expiry %d, got %d", renewed.Expires, s.Expires)
+		}
+	}
+
+	// the changes made by the peer are sent back once, after that both instances are in sync
+	for range 2 {
+		if !active.replicate(peer) {
+			t.Fatal("replication failed")
+		}
+	}
+	changes, err := active.replicationChanges(peer.pushedSessions, peer.pushedRevocations)
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if len(changes.Sessions) != 0 || len(changes.Revoked) != 0 {
+		t.Fatalf("instances should be in sync, got %d sessions and %d revocations", len(changes.Sessions), len(changes.Revoked))
+	}
+	empty, err := active.signReplicationBatch(ReplicationBatch{})
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	signed, err := passive.Replicate(testReplicationToken, ReplicationRequest{SessionsSince: peer.sessionsSince, RevocationsSince: peer.revocationsSince, Changes: empty})
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	result, err := active.verifyReplicationBatch(signed)
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if len(result.Sessions) != 0 || len(result.Revoked) != 0 {
+		t.Fatalf("instances should be in sync, got %d sessions and %d revocations", len(result.Sessions), len(result.Revoked))
+	}
+
+	if _, err = active.Replicate(testReplicationToken, ReplicationRequest{Changes: empty}); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	conf := &Config{Expire: time.Hour}
+	conf.Keys = []SignerVerifierConfig{
+		SignerVerifierConfig{Name: "sign-and-verify", Ed25519: &Ed25519Config{PrivKeyData: &testPrivKeyEd25519Pem}},
+	}
+	conf.Backend = StoreBackendConfig{InMemory: &InMemoryBackendConfig{}}
+	disabled, err := NewStore(conf, nil, nil, nil)
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if _, err = disabled.Replicate(testReplicationToken, ReplicationRequest{Changes: empty}); err == nil {
+		t.Fatal("replication request should fail if replication is not enabled")
+	}
+}
+
+func TestReplicationMerge(t *testing.T) {
+	st := newTestReplicationStore(t, StoreBackendConfig{InMemory: &InMemoryBackendConfig{}}, "")
+	value, _, err := st.New("test-user", AgentInfo{Name: "test-agent"}, ClientInfo{})
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	s, err := st.Verify(value, ClientInfo{})
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	local := func() SessionFull {
+		list, err := st.ListUser("test-user")
+		if err != nil {
+			t.Fatal("unexpected error:", err)
+		}
+		for _, l := range list {
+			if l.ID == s.ID {
+				return l
+			}
+		}
+		t.Fatalf("session %v is missing", s.ID)
+		return SessionFull{}
+	}
+	merge := func(c SessionFull) {
+		if err := st.mergeReplication(ReplicationBatch{Sessions: SessionFullList{c}}); err != nil {
+			t.Fatal("unexpected error:", err)
+		}
+	}
+
+	renewed := local()
+	renewed.Expires += 60
+	merge(renewed)
+	if got := local().Expires; got != renewed.Expires {
+		t.Fatalf("the copy which expires later should win: expected expiry %d, got %d", renewed.Expires, got)
+	}
+
+	// a copy which arrives late must not undo the renewal, even if it has been seen more recently
+	late := renewed
+	late.Expires -= 30
+	late.LastSeen = time.Now().Unix()
+	late.LastIP = "192.0.2.1"
+	merge(late)
+	if got := local(); got.Expires != renewed.Expires || got.LastSeen != late.LastSeen {
+		t.Fatalf("late copy should only update the activity: expected expiry %d and last-seen %d, got %d and %d", renewed.Expires, late.LastSeen, got.Expires, got.LastSeen)
+	}
+
+	tie := renewed
+	tie.Agent = AgentInfo{Name: "other-agent"}
+	merge(tie)
+	if got := local(); got.Agent.Name != "test-agent" {
+		t.Fatalf("local copy should be kept if both expire at the same time, got agent '%s'", got.Agent.Name)
+	}
+
+	if err = st.mergeReplication(ReplicationBatch{Revoked: SessionList{s}}); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	renewed.Expires += 60
+	merge(renewed)
+	if revoked, _ := st.backend.IsRevoked(s); !revoked {
+		t.Fatal("revocation should win over sessions")
+	}
+	list, err := st.ListUser("test-user")
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if len(list) != 0 {
+		t.Fatalf("revoked session should not be added again, got %d sessions", len(list))
+	}
+}
+
+func TestReplicationAuthentication(t *testing.T) {
+	passive := newTestReplicationStore(t, StoreBackendConfig{InMemory: &InMemoryBackendConfig{}}, "")
+	srv := newTestReplicationServer(passive)
+	defer srv.Close()
+
+	// the tokens of the verify-only instances must not grant access to the replication endpoint
+	intruder := newTestReplicationStore(t, StoreBackendConfig{InMemory: &InMemoryBackendConfig{}}, testVerifyOnlyToken, srv.URL)
+	if intruder.replicate(intruder.replicationPeers[0]) {
+		t.Fatal("replication using a verify-only token should fail")
+	}
+	var statusErr *syncStatusError
+	if _, err := intruder.replicationPeers[0].c.post("replication", nil, []byte("{}")); !errors.As(err, &statusErr) || statusErr.code != http.StatusUnauthorized {
+		t.Fatalf("replication endpoint should reject verify-only tokens with 401, got: %v", err)
+	}
+
+	active := newTestReplicationStore(t, StoreBackendConfig{InMemory: &InMemoryBackendConfig{}}, testReplicationToken, srv.URL)
+	if !active.replicate(active.replicationPeers[0]) {
+		t.Fatal("replication failed")
+	}
+
+	batch := ReplicationBatch{Watermarks: Watermarks{"": time.Now().Add(24 * time.Hour).UnixMilli()}}
+	signed, err := active.signReplicationBatch(batch)
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	tampered := signed
+	tampered.Batch = []byte(strings.Replace(string(signed.Batch), `"watermarks":{"":`, `"watermarks":{"":1`, 1))
+	if _, err = passive.Replicate(testReplicationToken, ReplicationRequest{Changes: tampered}); err == nil {
+		t.Fatal("replication batch with invalid signature should be rejected")
+	}
+	unsigned := signed
+	unsigned.KeyID = ""
+	unsigned.Signature = nil
+	if _, err = passive.Replicate(testReplicationToken, ReplicationRequest{Changes: unsigned}); err == nil {
+		t.Fatal("unsigned replication batch should be rejected")
+	}
+
+	stale := batch
+	stale.IssuedAt = time.Now().Add(-2 * RevocationListMaxAge).UnixMilli()
+	if signed.Batch, err = json.Marshal(stale); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if signed.Signature, err = signTyped(active.currentSigner(), signedTypeReplication, signed.Batch); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if _, err = passive.Replicate(testReplicationToken, ReplicationRequest{Changes: signed}); err == nil {
+		t.Fatal("stale replication batch should be rejected")
+	}
+
+	// with peer-keys set, batches signed by any other key are rejected
+	pub, priv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	other, err := active.addKey("other", &Ed25519SignerVerifier{context: DefaultCookieName + "_other", priv: priv, pub: pub})
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if _, err = passive.addKey("other", &Ed25519SignerVerifier{context: DefaultCookieName + "_other", pub: pub}); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	passive.conf.Backend.Replication.PeerKeys = []string{"sign-and-verify"}
+	active.keysMutex.Lock()
+	active.signer = other
+	active.keysMutex.Unlock()
+	if signed, err = active.signReplicationBatch(ReplicationBatch{}); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if _, err = passive.Replicate(testReplicationToken, ReplicationRequest{Changes: signed}); err == nil {
+		t.Fatal("replication batch signed by a key which is not a peer key should be rejected")
+	}
+
+	if notBefore, _ := passive.backend.Watermark(""); notBefore != 0 {
+		t.Fatalf("rejected batches must not change the watermarks, got %d", notBefore)
+	}
+}
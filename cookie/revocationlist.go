@@ -0,0 +1,130 @@
+//
+// Copyright (c) 2023 whawty contributors (see AUTHORS file)
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// * Neither the name of whawty.nginx-sso nor the names of its
+//   contributors may be used to endorse or promote products derived from
+//   this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+//
+
+package cookie
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+const (
+	// RevocationListMaxAge is the maximum age of revocation lists, this also limits the clock skew between instances.
+	RevocationListMaxAge = 5 * time.Minute
+)
+
+// RevocationListEnvelope binds a revocation list to the instance which issued it. Within one epoch the
+// sequence number never decreases which, together with the time the list has been issued at, allows
+// verify-only instances to detect replayed lists.
+type RevocationListEnvelope struct {
+	Issuer           string `json:"issuer"`
+	IssuedAt         int64  `json:"issued-at"`
+	Epoch            string `json:"epoch"`
+	Sequence         uint64 `json:"sequence"`
+	RevokedDigest    []byte `json:"revoked-digest"`
+	WatermarksDigest []byte `json:"watermarks-digest,omitempty"`
+}
+
+func revocationListDigest(data json.RawMessage) []byte {
+	if len(data) == 0 {
+		return nil
+	}
+	sum := sha256.Sum256(data)
+	return sum[:]
+}
+
+func (st *Store) signRevocationListEnvelope(result *SignedRevocationList, signer *storeKey, seq uint64) (err error) {
+	envelope := RevocationListEnvelope{
+		Issuer:           st.conf.Issuer,
+		IssuedAt:         time.Now().UnixMilli(),
+		Sequence:         seq,
+		RevokedDigest:    revocationListDigest(result.Revoked),
+		WatermarksDigest: revocationListDigest(result.Watermarks),
+	}
+	if envelope.Epoch, err = st.backend.RevocationEpoch(); err != nil {
+		return
+	}
+	if result.Envelope, err = json.Marshal(envelope); err != nil {
+		return
+	}
+	result.EnvelopeSignature, err = signTyped(signer, signedTypeEnvelope, result.Envelope)
+	return
+}
+
+// verifyRevocationListEnvelope checks that the list has been issued recently and is not older than the last
+// list we got from the same upstream.
+func (st *Store) verifyRevocationListEnvelope(signed SignedRevocationList, issuer string, last *RevocationListEnvelope) (envelope *RevocationListEnvelope, err error) {
+	if len(signed.Envelope) == 0 {
+		return nil, fmt.Errorf("revocation list has no envelope")
+	}
+	if _, err = st.verifyTypedSignature(signed.KeyID, signedTypeEnvelope, signed.Envelope, signed.EnvelopeSignature); err != nil {
+		return nil, fmt.Errorf("revocation list envelope signature is invalid: %v", err)
+	}
+	envelope = &RevocationListEnvelope{}
+	if err = json.Unmarshal(signed.Envelope, envelope); err != nil {
+		return nil, fmt.Errorf("error parsing revocation list envelope: %v", err)
+	}
+	if !bytes.Equal(envelope.RevokedDigest, revocationListDigest(signed.Revoked)) ||
+		!bytes.Equal(envelope.WatermarksDigest, revocationListDigest(signed.Watermarks)) {
+		return nil, fmt.Errorf("revocation list does not match its envelope")
+	}
+	if err = checkRevocationEnvelope(envelope, issuer, last); err != nil {
+		return nil, err
+	}
+	return
+}
+
+// checkRevocationEnvelope is used for full lists as well as incremental updates since both share the
+// same epoch and sequence numbers.
+func checkRevocationEnvelope(envelope *RevocationListEnvelope, issuer string, last *RevocationListEnvelope) error {
+	if envelope.Issuer == "" {
+		return fmt.Errorf("revocations have no issuer")
+	}
+	if issuer != "" && envelope.Issuer != issuer {
+		return fmt.Errorf("revocations have been issued by '%s' but we expected '%s'", envelope.Issuer, issuer)
+	}
+	issuedAt := time.UnixMilli(envelope.IssuedAt)
+	if age := time.Since(issuedAt); age > RevocationListMaxAge || age < -RevocationListMaxAge {
+		return fmt.Errorf("revocations have been issued at %v which is too far from now", issuedAt)
+	}
+	if last == nil || last.Issuer != envelope.Issuer {
+		return nil
+	}
+	if envelope.IssuedAt < last.IssuedAt {
+		return fmt.Errorf("revocations have been issued before the last ones we got (%v)", time.UnixMilli(last.IssuedAt))
+	}
+	if envelope.Epoch == last.Epoch && envelope.Sequence < last.Sequence {
+		return fmt.Errorf("revocation sequence %d is older than the last one we got (%d)", envelope.Sequence, last.Sequence)
+	}
+	return nil
+}
@@ -0,0 +1,162 @@
+//
+// Copyright (c) 2023 whawty contributors (see AUTHORS file)
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// * Neither the name of whawty.nginx-sso nor the names of its
+//   contributors may be used to endorse or promote products derived from
+//   this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+//
+
+package cookie
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestRevocationListEnvelope(t *testing.T) {
+	conf := &Config{Expire: time.Hour, Issuer: "test-issuer"}
+	conf.Keys = []SignerVerifierConfig{
+		SignerVerifierConfig{Name: "sign-and-verify", Ed25519: &Ed25519Config{PrivKeyData: &testPrivKeyEd25519Pem}},
+	}
+	conf.Backend = StoreBackendConfig{InMemory: &InMemoryBackendConfig{}}
+	signing, err := NewStore(conf, nil, nil, nil)
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+
+	var serve *SignedRevocationList
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if serve != nil {
+			json.NewEncoder(w).Encode(serve) //nolint:errcheck
+			return
+		}
+		signed, _ := signing.ListRevoked()
+		json.NewEncoder(w).Encode(signed) //nolint:errcheck
+	}))
+	defer srv.Close()
+
+	conf = &Config{Expire: time.Hour}
+	conf.Keys = []SignerVerifierConfig{
+		SignerVerifierConfig{Name: "sign-and-verify", Ed25519: &Ed25519Config{PubKeyData: &testPubKeyEd25519Pem}},
+	}
+	conf.Backend = StoreBackendConfig{InMemory: &InMemoryBackendConfig{}}
+	verifier, err := NewStore(conf, nil, nil, nil)
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	baseURL, _ := url.Parse(srv.URL)
+	c := verifier.newSyncClient(baseURL, "", nil, "")
+
+	revoke := func() {
+		value, _, err := signing.New("test-user", AgentInfo{}, ClientInfo{})
+		if err != nil {
+			t.Fatal("unexpected error:", err)
+		}
+		s, err := signing.Verify(value, ClientInfo{})
+		if err != nil {
+			t.Fatal("unexpected error:", err)
+		}
+		if err = signing.Revoke(s); err != nil {
+			t.Fatal("unexpected error:", err)
+		}
+	}
+
+	revoke()
+	old, err := signing.ListRevoked()
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	var envelope RevocationListEnvelope
+	if err = json.Unmarshal(old.Envelope, &envelope); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if envelope.Issuer != "test-issuer" || envelope.Sequence != 1 {
+		t.Fatalf("unexpected envelope: %+v", envelope)
+	}
+
+	c.issuer = "other-issuer"
+	if verifier.syncRevocations(c) {
+		t.Fatal("syncing a list from an unexpected issuer should fail")
+	}
+	c.issuer = "test-issuer"
+	if !verifier.syncRevocations(c) {
+		t.Fatal("syncing revocations failed")
+	}
+	revoke()
+	if !verifier.syncRevocations(c) {
+		t.Fatal("syncing revocations failed")
+	}
+
+	serve = &old
+	if verifier.syncRevocations(c) {
+		t.Fatal("syncing a replayed list should fail")
+	}
+
+	current, err := signing.ListRevoked()
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	mixed := current
+	mixed.Revoked = old.Revoked
+	mixed.Signature = old.Signature
+	mixed.TypedSignature = old.TypedSignature
+	serve = &mixed
+	if verifier.syncRevocations(c) {
+		t.Fatal("syncing a list which does not match its envelope should fail")
+	}
+
+	stripped := current
+	stripped.Envelope = nil
+	stripped.EnvelopeSignature = nil
+	serve = &stripped
+	if verifier.syncRevocations(c) {
+		t.Fatal("syncing a list without envelope should fail once we got a list with envelope")
+	}
+
+	if err = json.Unmarshal(current.Envelope, &envelope); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	envelope.IssuedAt = time.Now().Add(-2 * RevocationListMaxAge).UnixMilli()
+	stale := current
+	if stale.Envelope, err = json.Marshal(envelope); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if stale.EnvelopeSignature, err = signTyped(signing.currentSigner(), signedTypeEnvelope, stale.Envelope); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	serve = &stale
+	if verifier.syncRevocations(c) {
+		t.Fatal("syncing a stale list should fail")
+	}
+
+	serve = nil
+	if !verifier.syncRevocations(c) {
+		t.Fatal("syncing revocations failed")
+	}
+}
@@ -0,0 +1,231 @@
+//
+// Copyright (c) 2023 whawty contributors (see AUTHORS file)
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// * Neither the name of whawty.nginx-sso nor the names of its
+//   contributors may be used to endorse or promote products derived from
+//   this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+//
+
+package cookie
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultSyncStreamReconcileInterval = 2 * time.Minute
+	DefaultSyncStreamReconnectDelay    = time.Second
+	syncStreamMaxReconnectDelay        = time.Minute
+
+	// RevocationStreamKeepAlive is the interval in which the signing instance sends signed (empty)
+	// updates on idle streams. Clients reconnect if nothing was received for 3 times this interval.
+	RevocationStreamKeepAlive = 30 * time.Second
+
+	// syncStreamMaxInterval limits the keep-alive and reconcile intervals. Every update is checked against
+	// RevocationListMaxAge, if they get close to it idle streams would flap between stale and fresh.
+	syncStreamMaxInterval = RevocationListMaxAge / 2
+)
+
+var (
+	errSyncStreamUnsupported = errors.New("upstream does not support streaming revocations")
+	errSyncStreamReconcile   = errors.New("full reconciliation is due")
+	errSyncStreamIdle        = errors.New("stream is idle for too long")
+)
+
+type SyncStreamConfig struct {
+	ReconcileInterval time.Duration `yaml:"reconcile-interval"`
+	ReconnectDelay    time.Duration `yaml:"reconnect-delay"`
+}
+
+// revocationNotifier wakes up everybody waiting for new revocations or watermarks.
+type revocationNotifier struct {
+	mutex sync.Mutex
+	ch    chan struct{}
+}
+
+func (n *revocationNotifier) wait() <-chan struct{} {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	if n.ch == nil {
+		n.ch = make(chan struct{})
+	}
+	return n.ch
+}
+
+func (n *revocationNotifier) notify() {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	if n.ch != nil {
+		close(n.ch)
+		n.ch = nil
+	}
+}
+
+// WatchRevocations calls send with a signed update containing all revocations since the cursor and
+// then again whenever new revocations or watermarks got added. If nothing changes for the keep-alive
+// interval a new (empty) update is sent, this way clients can tell that they are still up to date.
+// This returns once ctx is done or send returns an error.
+func (st *Store) WatchRevocations(ctx context.Context, since string, keepalive time.Duration, send func(*SignedRevocationUpdate) error) error {
+	if keepalive <= 0 || keepalive > syncStreamMaxInterval {
+		return fmt.Errorf("keep-alive interval must be between 0 and %v", syncStreamMaxInterval)
+	}
+	t := time.NewTicker(keepalive)
+	defer t.Stop()
+	for {
+		changed := st.revocations.wait()
+		update, err := st.revocationUpdate(since)
+		if err != nil {
+			return err
+		}
+		signed, err := st.signRevocationUpdate(update)
+		if err != nil {
+			return err
+		}
+		if err = send(&signed); err != nil {
+			return err
+		}
+		since = update.Cursor
+		t.Reset(keepalive)
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-changed:
+		case <-t.C:
+		}
+	}
+}
+
+func (st *Store) initSyncStream(conf *SyncStreamConfig) error {
+	if conf.ReconcileInterval <= 0 {
+		conf.ReconcileInterval = DefaultSyncStreamReconcileInterval
+	}
+	if conf.ReconcileInterval > syncStreamMaxInterval {
+		return fmt.Errorf("sync: stream reconcile-interval must not be longer than %v", syncStreamMaxInterval)
+	}
+	// clients give up on streams which have been idle for 3 keep-alive intervals
+	if 3*RevocationStreamKeepAlive > syncStreamMaxInterval {
+		return fmt.Errorf("sync: stream keep-alive interval %v is too close to the maximum age of revocations", RevocationStreamKeepAlive)
+	}
+	if conf.ReconnectDelay <= 0 {
+		conf.ReconnectDelay = DefaultSyncStreamReconnectDelay
+	}
+	return nil
+}
+
+func (st *Store) consumeRevocationStream(c *syncClient, reconcile time.Duration) error {
+	ctx, cancelIdle := context.WithCancelCause(context.Background())
+	defer cancelIdle(nil)
+	ctx, cancel := context.WithTimeoutCause(ctx, reconcile, errSyncStreamReconcile)
+	defer cancel()
+	idle := time.AfterFunc(3*RevocationStreamKeepAlive, func() { cancelIdle(errSyncStreamIdle) })
+	defer idle.Stop()
+
+	resp, err := c.doContext(ctx, "GET", "revocations/stream", url.Values{"since": []string{c.cursor}}, nil)
+	if err != nil {
+		var statusErr *syncStatusError
+		if errors.As(err, &statusErr) && statusErr.code == http.StatusNotFound {
+			return errSyncStreamUnsupported
+		}
+		return err
+	}
+	defer resp.Body.Close() //nolint:errcheck
+
+	r := bufio.NewReader(resp.Body)
+	var data []byte
+	for {
+		line, err := r.ReadBytes('\n')
+		if err != nil {
+			if cause := context.Cause(ctx); cause != nil {
+				return cause
+			}
+			return err
+		}
+		idle.Reset(3 * RevocationStreamKeepAlive)
+
+		line = bytes.TrimRight(line, "\r\n")
+		if len(line) > 0 {
+			// comments and all other fields are ignored
+			if value, found := bytes.CutPrefix(line, []byte("data:")); found {
+				if len(data) > 0 {
+					data = append(data, '\n')
+				}
+				data = append(data, bytes.TrimPrefix(value, []byte(" "))...)
+			}
+			continue
+		}
+		if len(data) == 0 {
+			continue
+		}
+
+		var signed SignedRevocationUpdate
+		err = json.Unmarshal(data, &signed)
+		data = nil
+		if err != nil {
+			return fmt.Errorf("error parsing revocation update: %v", err)
+		}
+		if err = st.applyRevocationUpdate(c, signed); err != nil {
+			return err
+		}
+		cookieSyncRequestsSuccess.WithLabelValues().Inc()
+		st.syncSucceeded(c)
+	}
+}
+
+func (st *Store) runSyncStream(conf *StoreSyncConfig, c *syncClient) {
+	st.dbgLog.Printf("cookie-store: streaming revocations, doing a full reconciliation every %v", conf.Stream.ReconcileInterval)
+	delay := conf.Stream.ReconnectDelay
+	for {
+		connected := time.Now()
+		err := st.consumeRevocationStream(c, conf.Stream.ReconcileInterval)
+		switch {
+		case errors.Is(err, errSyncStreamReconcile):
+			c.cursor = ""
+			delay = conf.Stream.ReconnectDelay
+			continue
+		case errors.Is(err, errSyncStreamUnsupported):
+			st.infoLog.Printf("sync-store: %v, falling back to polling", err)
+			st.runSync(conf.Interval, c)
+			return
+		}
+		// this counts failed connection attempts as well as streams which broke down
+		cookieSyncRequestsFailed.WithLabelValues().Inc()
+		if time.Since(connected) > syncStreamMaxReconnectDelay {
+			delay = conf.Stream.ReconnectDelay
+		}
+		st.infoLog.Printf("sync-store: revocation stream failed: %v, reconnecting in %v", err, delay)
+		time.Sleep(delay)
+		delay = min(2*delay, syncStreamMaxReconnectDelay)
+	}
+}
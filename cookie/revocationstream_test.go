@@ -0,0 +1,243 @@
+//
+// Copyright (c) 2023 whawty contributors (see AUTHORS file)
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// * Neither the name of whawty.nginx-sso nor the names of its
+//   contributors may be used to endorse or promote products derived from
+//   this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+//
+
+package cookie
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func waitFor(t *testing.T, timeout time.Duration, cond func() bool) bool {
+	t.Helper()
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		if cond() {
+			return true
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return false
+}
+
+func TestRevocationStreamConfig(t *testing.T) {
+	conf := &Config{}
+	conf.Keys = []SignerVerifierConfig{
+		SignerVerifierConfig{Name: "verify-only", Ed25519: &Ed25519Config{PubKeyData: &testPubKeyEd25519Pem}},
+	}
+	conf.Backend = StoreBackendConfig{InMemory: &InMemoryBackendConfig{}}
+	conf.Backend.Sync = &StoreSyncConfig{BaseURL: "http://192.0.2.1", Interval: time.Minute, Stream: &SyncStreamConfig{ReconcileInterval: RevocationListMaxAge}}
+	if _, err := NewStore(conf, nil, nil, nil); err == nil {
+		t.Fatal("initializing store with a reconcile interval close to the maximum age of revocations should fail")
+	}
+	conf.Backend.Sync.Stream = &SyncStreamConfig{}
+	if _, err := NewStore(conf, nil, nil, nil); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if conf.Backend.Sync.Stream.ReconcileInterval != DefaultSyncStreamReconcileInterval {
+		t.Fatalf("unset reconcile interval should be overriden to %v, got %v", DefaultSyncStreamReconcileInterval, conf.Backend.Sync.Stream.ReconcileInterval)
+	}
+
+	st, err := NewStore(conf, nil, nil, nil)
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	send := func(*SignedRevocationUpdate) error { return nil }
+	if err = st.WatchRevocations(context.Background(), "", RevocationListMaxAge, send); err == nil {
+		t.Fatal("watching revocations with a keep-alive interval close to the maximum age of revocations should fail")
+	}
+}
+
+func TestRevocationStream(t *testing.T) {
+	conf := &Config{Expire: time.Hour}
+	conf.Keys = []SignerVerifierConfig{
+		SignerVerifierConfig{Name: "sign-and-verify", Ed25519: &Ed25519Config{PrivKeyData: &testPrivKeyEd25519Pem}},
+	}
+	conf.Backend = StoreBackendConfig{InMemory: &InMemoryBackendConfig{}}
+	signing, err := NewStore(conf, nil, nil, nil)
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+
+	var fullSyncs atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/revocations/stream" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		since := r.URL.Query().Get("since")
+		if since == "" {
+			fullSyncs.Add(1)
+		}
+		w.Header().Set("Content-Type", "text/event-stream")
+		signing.WatchRevocations(r.Context(), since, time.Second, func(update *SignedRevocationUpdate) error { //nolint:errcheck
+			data, _ := json.Marshal(update)
+			fmt.Fprintf(w, "event: update\ndata: %s\n\n", data)
+			w.(http.Flusher).Flush()
+			return nil
+		})
+	}))
+	defer srv.Close()
+
+	conf = &Config{Expire: time.Hour}
+	conf.Keys = []SignerVerifierConfig{
+		SignerVerifierConfig{Name: "sign-and-verify", Ed25519: &Ed25519Config{PubKeyData: &testPubKeyEd25519Pem}},
+	}
+	conf.Backend = StoreBackendConfig{InMemory: &InMemoryBackendConfig{}}
+	verifier, err := NewStore(conf, nil, nil, nil)
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	baseURL, _ := url.Parse(srv.URL)
+	syncConf := &StoreSyncConfig{Interval: time.Hour, Stream: &SyncStreamConfig{ReconcileInterval: 500 * time.Millisecond, ReconnectDelay: 10 * time.Millisecond}}
+	go verifier.runSyncStream(syncConf, verifier.newSyncClient(baseURL, "", nil, ""))
+
+	revoke := func() string {
+		value, _, err := signing.New("test-user", AgentInfo{}, ClientInfo{})
+		if err != nil {
+			t.Fatal("unexpected error:", err)
+		}
+		if _, err = verifier.Verify(value, ClientInfo{}); err != nil {
+			t.Fatal("unexpected error:", err)
+		}
+		s, _ := signing.Verify(value, ClientInfo{})
+		if err = signing.Revoke(s); err != nil {
+			t.Fatal("unexpected error:", err)
+		}
+		return value
+	}
+	isRevoked := func(value string) func() bool {
+		return func() bool {
+			_, err := verifier.Verify(value, ClientInfo{})
+			return err != nil
+		}
+	}
+
+	if !waitFor(t, time.Second, isRevoked(revoke())) {
+		t.Fatal("revocation has not been pushed to the verifier")
+	}
+	srv.CloseClientConnections()
+	if !waitFor(t, 2*time.Second, isRevoked(revoke())) {
+		t.Fatal("revocation has not been pushed to the verifier after reconnect")
+	}
+	if err = signing.SetWatermark("", time.Now()); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if !waitFor(t, time.Second, func() bool { n, _ := verifier.backend.Watermark(""); return n > 0 }) {
+		t.Fatal("watermark has not been pushed to the verifier")
+	}
+	if !waitFor(t, 2*time.Second, func() bool { return fullSyncs.Load() >= 3 }) {
+		t.Fatalf("expected periodic full reconciliations, got %d full syncs", fullSyncs.Load())
+	}
+
+	c := verifier.newSyncClient(baseURL.JoinPath("does-not-exist"), "", nil, "")
+	if err = verifier.consumeRevocationStream(c, time.Minute); err != errSyncStreamUnsupported {
+		t.Fatalf("expected '%v', got: %v", errSyncStreamUnsupported, err)
+	}
+}
+
+func TestRevocationStreamKeepAlive(t *testing.T) {
+	conf := &Config{Expire: time.Hour}
+	conf.Keys = []SignerVerifierConfig{
+		SignerVerifierConfig{Name: "sign-and-verify", Ed25519: &Ed25519Config{PrivKeyData: &testPrivKeyEd25519Pem}},
+	}
+	conf.Backend = StoreBackendConfig{InMemory: &InMemoryBackendConfig{}}
+	signing, err := NewStore(conf, nil, nil, nil)
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		if r.URL.Path == "/comments/revocations/stream" {
+			// only the first message is a signed update, everything after that are comments
+			signed, _ := signing.RevocationsSince(r.URL.Query().Get("since"))
+			data, _ := json.Marshal(signed)
+			fmt.Fprintf(w, "event: update\ndata: %s\n\n", data)
+			w.(http.Flusher).Flush()
+			for {
+				select {
+				case <-r.Context().Done():
+					return
+				case <-time.After(20 * time.Millisecond):
+				}
+				fmt.Fprint(w, ": keep-alive\n\n")
+				w.(http.Flusher).Flush()
+			}
+		}
+		signing.WatchRevocations(r.Context(), r.URL.Query().Get("since"), 50*time.Millisecond, func(update *SignedRevocationUpdate) error { //nolint:errcheck
+			data, _ := json.Marshal(update)
+			fmt.Fprintf(w, "event: update\ndata: %s\n\n", data)
+			w.(http.Flusher).Flush()
+			return nil
+		})
+	}))
+	defer srv.Close()
+	baseURL, _ := url.Parse(srv.URL)
+
+	conf = &Config{Expire: time.Hour}
+	conf.Keys = []SignerVerifierConfig{
+		SignerVerifierConfig{Name: "sign-and-verify", Ed25519: &Ed25519Config{PubKeyData: &testPubKeyEd25519Pem}},
+	}
+	conf.Backend = StoreBackendConfig{InMemory: &InMemoryBackendConfig{}}
+	verifier, err := NewStore(conf, nil, nil, nil)
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+
+	c := verifier.newSyncClient(baseURL.JoinPath("comments"), "", nil, "")
+	go verifier.consumeRevocationStream(c, 500*time.Millisecond) //nolint:errcheck
+	if !waitFor(t, time.Second, func() bool { return verifier.lastSync.Load() != 0 }) {
+		t.Fatal("the initial update has not been applied")
+	}
+	synced := verifier.lastSync.Load()
+	time.Sleep(200 * time.Millisecond)
+	if verifier.lastSync.Load() != synced {
+		t.Fatal("keep-alive comments must not count as successful sync")
+	}
+
+	c = verifier.newSyncClient(baseURL, "", nil, "")
+	go verifier.consumeRevocationStream(c, 500*time.Millisecond) //nolint:errcheck
+	synced = verifier.lastSync.Load()
+	if !waitFor(t, time.Second, func() bool { return verifier.lastSync.Load() > synced }) {
+		t.Fatal("the initial update has not been applied")
+	}
+	synced = verifier.lastSync.Load()
+	if !waitFor(t, time.Second, func() bool { return verifier.lastSync.Load() > synced }) {
+		t.Fatal("signed updates on idle streams should count as successful sync")
+	}
+}
@@ -0,0 +1,228 @@
+//
+// Copyright (c) 2023 whawty contributors (see AUTHORS file)
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// * Neither the name of whawty.nginx-sso nor the names of its
+//   contributors may be used to endorse or promote products derived from
+//   this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+//
+
+package cookie
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	RevocationSyncVersion = 2
+)
+
+// RevocationUpdate contains all revocations which have been added since the cursor the client
+// sent as well as the cursor to use for the next request. If the cursor is empty or unknown the
+// update contains the full list of revocations. Issuer, IssuedAt, Epoch and Sequence serve the same
+// purpose as the RevocationListEnvelope.
+type RevocationUpdate struct {
+	Version    int         `json:"version"`
+	Issuer     string      `json:"issuer"`
+	IssuedAt   int64       `json:"issued-at"`
+	Epoch      string      `json:"epoch"`
+	Sequence   uint64      `json:"sequence"`
+	Since      string      `json:"since"`
+	Cursor     string      `json:"cursor"`
+	Full       bool        `json:"full"`
+	Revoked    SessionList `json:"revoked"`
+	Watermarks Watermarks  `json:"watermarks"`
+}
+
+type SignedRevocationUpdate struct {
+	KeyID     string          `json:"key-id,omitempty"`
+	Update    json.RawMessage `json:"update"`
+	Signature []byte          `json:"signature"`
+}
+
+func makeRevocationCursor(epoch string, seq uint64) string {
+	return epoch + "." + strconv.FormatUint(seq, 10)
+}
+
+func parseRevocationCursor(cursor string) (epoch string, seq uint64, ok bool) {
+	epoch, seqStr, found := strings.Cut(cursor, ".")
+	if !found {
+		return
+	}
+	seq, err := strconv.ParseUint(seqStr, 10, 64)
+	if err != nil {
+		return
+	}
+	return epoch, seq, true
+}
+
+func (st *Store) revocationUpdate(cursor string) (update RevocationUpdate, err error) {
+	var epoch string
+	if epoch, err = st.backend.RevocationEpoch(); err != nil {
+		return
+	}
+	update = RevocationUpdate{Version: RevocationSyncVersion, Issuer: st.conf.Issuer, Epoch: epoch, Since: cursor}
+	var seq uint64
+	if cursorEpoch, cursorSeq, ok := parseRevocationCursor(cursor); ok && cursorEpoch == epoch {
+		seq = cursorSeq
+	}
+	var last uint64
+	if update.Revoked, last, err = st.backend.ListRevokedSince(seq); err != nil {
+		return
+	}
+	if last < seq {
+		// the cursor is from the future, the client should start over
+		if update.Revoked, last, err = st.backend.ListRevokedSince(0); err != nil {
+			return
+		}
+		seq = 0
+	}
+	update.Full = seq == 0
+	update.Sequence = last
+	update.Cursor = makeRevocationCursor(epoch, last)
+	update.Watermarks, err = st.backend.ListWatermarks()
+	update.IssuedAt = time.Now().UnixMilli()
+	return
+}
+
+func (st *Store) signRevocationUpdate(update RevocationUpdate) (result SignedRevocationUpdate, err error) {
+	if result.Update, err = json.Marshal(update); err != nil {
+		return
+	}
+	if signer := st.currentSigner(); signer != nil {
+		result.KeyID = signer.id
+		if result.Signature, err = signTyped(signer, signedTypeRevocationUpdate, result.Update); err != nil {
+			return
+		}
+	}
+	return
+}
+
+func (st *Store) RevocationsSince(cursor string) (SignedRevocationUpdate, error) {
+	update, err := st.revocationUpdate(cursor)
+	if err != nil {
+		return SignedRevocationUpdate{}, err
+	}
+	return st.signRevocationUpdate(update)
+}
+
+// verifyAndDecodeRevocationUpdate checks the signature of the update and that it is at least as recent as
+// the last list or update we got from the same upstream.
+func (st *Store) verifyAndDecodeRevocationUpdate(signed SignedRevocationUpdate, since, issuer string, last *RevocationListEnvelope) (update RevocationUpdate, envelope *RevocationListEnvelope, err error) {
+	if _, err = st.verifyTypedSignature(signed.KeyID, signedTypeRevocationUpdate, signed.Update, signed.Signature); err != nil {
+		err = fmt.Errorf("revocation update signature is invalid: %v", err)
+		return
+	}
+	if err = json.Unmarshal(signed.Update, &update); err != nil {
+		err = fmt.Errorf("error parsing revocation update: %v", err)
+		return
+	}
+	if update.Version != RevocationSyncVersion {
+		err = fmt.Errorf("revocation update has unsupported version %d", update.Version)
+		return
+	}
+	// this makes sure an update can't be replayed to a client which is at another cursor
+	if update.Since != since {
+		err = fmt.Errorf("revocation update is based on cursor '%s' but we requested '%s'", update.Since, since)
+		return
+	}
+	envelope = &RevocationListEnvelope{Issuer: update.Issuer, IssuedAt: update.IssuedAt, Epoch: update.Epoch, Sequence: update.Sequence}
+	if err = checkRevocationEnvelope(envelope, issuer, last); err != nil {
+		envelope = nil
+		return
+	}
+	if update.Cursor != makeRevocationCursor(update.Epoch, update.Sequence) {
+		err = fmt.Errorf("revocation update cursor '%s' does not match its sequence", update.Cursor)
+		envelope = nil
+	}
+	return
+}
+
+func (st *Store) syncRevocationUpdates(c *syncClient) bool {
+	resp, err := c.do("GET", "revocations", url.Values{"since": []string{c.cursor}}, nil)
+	if err != nil {
+		st.infoLog.Printf("sync-store: error sending sync request: %v", err)
+		return false
+	}
+	defer resp.Body.Close() //nolint:errcheck
+
+	var signed SignedRevocationUpdate
+	if err = json.NewDecoder(resp.Body).Decode(&signed); err != nil {
+		st.infoLog.Printf("sync-store: error parsing sync response: %v", err)
+		return false
+	}
+	if len(signed.Update) == 0 {
+		// the revocation lists of older versions are not accepted either, see verifyAndDecodeSignedRevocationList
+		st.infoLog.Printf("sync-store: upstream does not support incremental sync, it needs to be upgraded")
+		return false
+	}
+
+	if err = st.applyRevocationUpdate(c, signed); err != nil {
+		st.infoLog.Printf("sync-store: %v", err)
+		return false
+	}
+	return true
+}
+
+func (st *Store) applyRevocationUpdate(c *syncClient, signed SignedRevocationUpdate) error {
+	update, envelope, err := st.verifyAndDecodeRevocationUpdate(signed, c.cursor, c.issuer, c.list)
+	if err != nil {
+		// start over with a full resync
+		c.cursor = ""
+		return err
+	}
+
+	var cnt, total uint
+	if cnt, err = st.backend.LoadRevocations(update.Revoked); err != nil {
+		return fmt.Errorf("error loading revocations: %v", err)
+	}
+	if cnt > 0 {
+		st.dbgLog.Printf("sync-state: successfully synced %d revocations", cnt)
+	}
+	total = cnt
+	if cnt, err = st.backend.LoadWatermarks(update.Watermarks); err != nil {
+		return fmt.Errorf("error loading watermarks: %v", err)
+	}
+	if cnt > 0 {
+		st.dbgLog.Printf("sync-state: successfully synced %d watermarks", cnt)
+	}
+	if total+cnt > 0 {
+		st.revocations.notify()
+	}
+	if update.Full {
+		st.dbgLog.Printf("sync-state: got full revocation list (%d entries), cursor is now '%s'", len(update.Revoked), update.Cursor)
+	}
+	c.cursor = update.Cursor
+	c.list = envelope
+	return nil
+}
+
+func (st *Store) pullRevocations(c *syncClient) bool {
+	return st.syncRevocationUpdates(c)
+}
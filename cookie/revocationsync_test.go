@@ -0,0 +1,355 @@
+//
+// Copyright (c) 2023 whawty contributors (see AUTHORS file)
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// * Neither the name of whawty.nginx-sso nor the names of its
+//   contributors may be used to endorse or promote products derived from
+//   this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+//
+
+package cookie
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+)
+
+func TestRevocationsSince(t *testing.T) {
+	backends := map[string]StoreBackendConfig{
+		"in-memory": StoreBackendConfig{InMemory: &InMemoryBackendConfig{}},
+		"bolt":      StoreBackendConfig{Bolt: &BoltBackendConfig{Path: filepath.Join(t.TempDir(), "sessions.db")}},
+		"redis":     StoreBackendConfig{Redis: &RedisBackendConfig{Addr: miniredis.RunT(t).Addr()}},
+	}
+	for name, backend := range backends {
+		t.Run(name, func(t *testing.T) {
+			conf := &Config{Expire: time.Hour}
+			conf.Keys = []SignerVerifierConfig{
+				SignerVerifierConfig{Name: "sign-and-verify", Ed25519: &Ed25519Config{PrivKeyData: &testPrivKeyEd25519Pem}},
+			}
+			conf.Backend = backend
+			st, err := NewStore(conf, nil, nil, nil)
+			if err != nil {
+				t.Fatal("unexpected error:", err)
+			}
+
+			revoke := func() {
+				value, _, err := st.New("test-user", AgentInfo{}, ClientInfo{})
+				if err != nil {
+					t.Fatal("unexpected error:", err)
+				}
+				s, err := st.Verify(value, ClientInfo{})
+				if err != nil {
+					t.Fatal("unexpected error:", err)
+				}
+				if err = st.Revoke(s); err != nil {
+					t.Fatal("unexpected error:", err)
+				}
+			}
+			update := func(cursor string) RevocationUpdate {
+				signed, err := st.RevocationsSince(cursor)
+				if err != nil {
+					t.Fatal("unexpected error:", err)
+				}
+				u, _, err := st.verifyAndDecodeRevocationUpdate(signed, cursor, "", nil)
+				if err != nil {
+					t.Fatal("unexpected error:", err)
+				}
+				return u
+			}
+
+			revoke()
+			revoke()
+			u := update("")
+			if !u.Full || len(u.Revoked) != 2 || u.Cursor == "" {
+				t.Fatalf("unexpected update: %+v", u)
+			}
+			cursor := u.Cursor
+
+			if u = update(cursor); u.Full || len(u.Revoked) != 0 || u.Cursor != cursor {
+				t.Fatalf("unexpected update: %+v", u)
+			}
+			revoke()
+			if u = update(cursor); u.Full || len(u.Revoked) != 1 || u.Cursor == cursor {
+				t.Fatalf("unexpected update: %+v", u)
+			}
+
+			for _, invalid := range []string{"invalid", "other-epoch.1", cursor + "0000"} {
+				if u = update(invalid); !u.Full || len(u.Revoked) != 3 {
+					t.Fatalf("cursor '%s' should result in full update, got: %+v", invalid, u)
+				}
+			}
+
+			if _, err = st.backend.CollectGarbage(); err != nil {
+				t.Fatal("unexpected error:", err)
+			}
+			if u = update(""); len(u.Revoked) != 3 {
+				t.Fatalf("unexpected update: %+v", u)
+			}
+		})
+	}
+}
+
+func TestSyncRevocationUpdates(t *testing.T) {
+	conf := &Config{Expire: time.Hour}
+	conf.Keys = []SignerVerifierConfig{
+		SignerVerifierConfig{Name: "sign-and-verify", Ed25519: &Ed25519Config{PrivKeyData: &testPrivKeyEd25519Pem}},
+	}
+	conf.Backend = StoreBackendConfig{InMemory: &InMemoryBackendConfig{}}
+	signing, err := NewStore(conf, nil, nil, nil)
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+
+	legacy := false
+	var replay *SignedRevocationUpdate
+	requests := []string{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		since, ok := r.URL.Query()["since"]
+		if legacy || !ok {
+			// this is what older versions return
+			requests = append(requests, "full")
+			signed, _ := signing.ListRevoked()
+			json.NewEncoder(w).Encode(SignedRevocationList{KeyID: signed.KeyID, Revoked: signed.Revoked, Signature: signed.Signature}) //nolint:errcheck
+			return
+		}
+		requests = append(requests, since[0])
+		if replay != nil {
+			json.NewEncoder(w).Encode(replay) //nolint:errcheck
+			return
+		}
+		signed, _ := signing.RevocationsSince(since[0])
+		json.NewEncoder(w).Encode(signed) //nolint:errcheck
+	}))
+	defer srv.Close()
+
+	conf = &Config{Expire: time.Hour}
+	conf.Keys = []SignerVerifierConfig{
+		SignerVerifierConfig{Name: "sign-and-verify", Ed25519: &Ed25519Config{PubKeyData: &testPubKeyEd25519Pem}},
+	}
+	conf.Backend = StoreBackendConfig{InMemory: &InMemoryBackendConfig{}}
+	verifier, err := NewStore(conf, nil, nil, nil)
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	baseURL, _ := url.Parse(srv.URL)
+	c := verifier.newSyncClient(baseURL, "", nil, "")
+
+	values := []string{}
+	for i := 0; i < 2; i++ {
+		value, _, err := signing.New("test-user", AgentInfo{}, ClientInfo{})
+		if err != nil {
+			t.Fatal("unexpected error:", err)
+		}
+		values = append(values, value)
+	}
+	s, _ := signing.Verify(values[0], ClientInfo{})
+	if err = signing.Revoke(s); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+
+	if !verifier.pullRevocations(c) {
+		t.Fatal("syncing revocations failed")
+	}
+	if _, err = verifier.Verify(values[0], ClientInfo{}); err == nil {
+		t.Fatal("revoked session should be rejected")
+	}
+	cursor := c.cursor
+	if cursor == "" {
+		t.Fatal("sync cursor has not been set")
+	}
+
+	s, _ = signing.Verify(values[1], ClientInfo{})
+	if err = signing.Revoke(s); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if !verifier.pullRevocations(c) {
+		t.Fatal("syncing revocations failed")
+	}
+	if _, err = verifier.Verify(values[1], ClientInfo{}); err == nil {
+		t.Fatal("revoked session should be rejected")
+	}
+	if requests[1] != cursor || c.cursor == cursor {
+		t.Fatalf("sync did not use/advance the cursor: requests=%v, cursor='%s'", requests, c.cursor)
+	}
+
+	// an update for another cursor must not be accepted
+	old, _ := signing.RevocationsSince(cursor)
+	replay = &old
+	if verifier.pullRevocations(c) {
+		t.Fatal("replayed update should be rejected")
+	}
+	if c.cursor != "" {
+		t.Fatal("cursor should be reset after failed update")
+	}
+	replay = nil
+	if !verifier.pullRevocations(c) {
+		t.Fatal("syncing revocations failed")
+	}
+
+	// an update for the current cursor which is older than the last one we got must not be accepted either
+	old, _ = signing.RevocationsSince(c.cursor)
+	time.Sleep(2 * time.Millisecond)
+	if !verifier.pullRevocations(c) {
+		t.Fatal("syncing revocations failed")
+	}
+	replay = &old
+	if verifier.pullRevocations(c) {
+		t.Fatal("update issued before the last one should be rejected")
+	}
+	replay = nil
+	if !verifier.pullRevocations(c) {
+		t.Fatal("syncing revocations failed")
+	}
+
+	forge := func(modify func(u *RevocationUpdate)) *SignedRevocationUpdate {
+		u, err := signing.revocationUpdate(c.cursor)
+		if err != nil {
+			t.Fatal("unexpected error:", err)
+		}
+		modify(&u)
+		signed, err := signing.signRevocationUpdate(u)
+		if err != nil {
+			t.Fatal("unexpected error:", err)
+		}
+		return &signed
+	}
+	replay = forge(func(u *RevocationUpdate) { u.IssuedAt = time.Now().Add(-2 * RevocationListMaxAge).UnixMilli() })
+	if verifier.pullRevocations(c) {
+		t.Fatal("stale update should be rejected")
+	}
+	replay = forge(func(u *RevocationUpdate) { u.Issuer = "" })
+	if verifier.pullRevocations(c) {
+		t.Fatal("update without issuer should be rejected")
+	}
+	replay = forge(func(u *RevocationUpdate) { u.Sequence = 0 })
+	if verifier.pullRevocations(c) {
+		t.Fatal("update with a sequence that does not match the cursor should be rejected")
+	}
+	replay = nil
+	if !verifier.pullRevocations(c) {
+		t.Fatal("syncing revocations failed")
+	}
+
+	legacy = true
+	cursor = c.cursor
+	if verifier.pullRevocations(c) {
+		t.Fatal("syncing from an upstream which does not support incremental sync should fail")
+	}
+	if requests[len(requests)-1] != "full" || c.cursor != cursor {
+		t.Fatalf("unexpected requests: %v, cursor='%s'", requests, c.cursor)
+	}
+}
+
+func TestSyncUpstreams(t *testing.T) {
+	var servers []*httptest.Server
+	var signing []*Store
+	for range 2 {
+		conf := &Config{Expire: time.Hour}
+		conf.Keys = []SignerVerifierConfig{
+			SignerVerifierConfig{Name: "sign-and-verify", Ed25519: &Ed25519Config{PrivKeyData: &testPrivKeyEd25519Pem}},
+		}
+		conf.Backend = StoreBackendConfig{InMemory: &InMemoryBackendConfig{}}
+		st, err := NewStore(conf, nil, nil, nil)
+		if err != nil {
+			t.Fatal("unexpected error:", err)
+		}
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			signed, _ := st.RevocationsSince(r.URL.Query().Get("since"))
+			json.NewEncoder(w).Encode(signed) //nolint:errcheck
+		}))
+		defer srv.Close()
+		servers = append(servers, srv)
+		signing = append(signing, st)
+	}
+	down := httptest.NewServer(http.NotFoundHandler())
+	down.Close()
+
+	conf := &Config{Expire: time.Hour}
+	conf.Keys = []SignerVerifierConfig{
+		SignerVerifierConfig{Name: "sign-and-verify", Ed25519: &Ed25519Config{PubKeyData: &testPubKeyEd25519Pem}},
+	}
+	conf.Backend = StoreBackendConfig{InMemory: &InMemoryBackendConfig{}}
+	conf.Backend.Sync = &StoreSyncConfig{Upstreams: []SyncUpstreamConfig{{BaseURL: "file:///not/a/http/url"}}}
+	if _, err := NewStore(conf, nil, nil, nil); err == nil {
+		t.Fatal("initializing store with non-http(s) upstream base-url shoud fail")
+	}
+	conf.Backend.Sync = &StoreSyncConfig{Interval: time.Hour, BaseURL: down.URL, Upstreams: []SyncUpstreamConfig{{BaseURL: servers[0].URL}, {BaseURL: servers[1].URL}}}
+	verifier, err := NewStore(conf, nil, nil, nil)
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if len(verifier.syncClients) != 3 || verifier.syncClients[0].name != down.URL {
+		t.Fatalf("base-url should be used as first upstream, got %d upstreams", len(verifier.syncClients))
+	}
+
+	var sessions []Session
+	for _, st := range signing {
+		value, _, err := st.New("test-user", AgentInfo{}, ClientInfo{})
+		if err != nil {
+			t.Fatal("unexpected error:", err)
+		}
+		s, err := st.Verify(value, ClientInfo{})
+		if err != nil {
+			t.Fatal("unexpected error:", err)
+		}
+		if err = st.Revoke(s); err != nil {
+			t.Fatal("unexpected error:", err)
+		}
+		sessions = append(sessions, s)
+	}
+
+	verifier.lastSync.Store(time.Now().Add(-time.Hour).UnixNano())
+	for _, c := range verifier.syncClients {
+		if ok := verifier.pullRevocations(c); ok != (c.name != down.URL) {
+			t.Fatalf("unexpected result when syncing from %s: %t", c.name, ok)
+		}
+		if c.name != down.URL {
+			verifier.syncSucceeded(c)
+		}
+	}
+	for _, s := range sessions {
+		if revoked, _ := verifier.backend.IsRevoked(s); !revoked {
+			t.Fatalf("revocation of session %v should have been merged", s.ID)
+		}
+	}
+	if staleness := verifier.syncStaleness(); staleness > time.Minute {
+		t.Fatalf("staleness should have been reset, got %v", staleness)
+	}
+
+	var tried []string
+	ok := verifier.syncFailover(func(c *syncClient) bool {
+		tried = append(tried, c.name)
+		return verifier.pullRevocations(c)
+	})
+	if !ok || len(tried) != 2 || tried[1] != servers[0].URL {
+		t.Fatalf("failover should have moved on to the second upstream, tried: %v", tried)
+	}
+}
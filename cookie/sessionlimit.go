@@ -0,0 +1,97 @@
+//
+// Copyright (c) 2023 whawty contributors (see AUTHORS file)
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// * Neither the name of whawty.nginx-sso nor the names of its
+//   contributors may be used to endorse or promote products derived from
+//   this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+//
+
+package cookie
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	SessionLimitPolicyReject       = "reject"
+	SessionLimitPolicyRevokeOldest = "revoke-oldest"
+)
+
+var (
+	sessionLimitEnforced = prometheus.NewCounterVec(prometheus.CounterOpts{Subsystem: metricsSubsystem, Name: "session_limit_enforced_total"}, []string{"policy"})
+)
+
+type SessionLimitConfig struct {
+	Max    int    `yaml:"max"`
+	Policy string `yaml:"policy"`
+}
+
+func (st *Store) initSessionLimit(conf *Config) error {
+	if conf.MaxSessionsPerUser.Max <= 0 {
+		return fmt.Errorf("max-sessions-per-user: 'max' must be > 0")
+	}
+	switch conf.MaxSessionsPerUser.Policy {
+	case "":
+		conf.MaxSessionsPerUser.Policy = SessionLimitPolicyRevokeOldest
+	case SessionLimitPolicyReject, SessionLimitPolicyRevokeOldest:
+	default:
+		return fmt.Errorf("max-sessions-per-user: invalid policy '%s'", conf.MaxSessionsPerUser.Policy)
+	}
+	return nil
+}
+
+// enforceSessionLimit makes room for one more session of the user. Sessions are evicted using
+// RevokeID so the eviction gets propagated to verify-only instances like any other revocation.
+// The caller must hold st.limitMutex until the new session has been saved.
+func (st *Store) enforceSessionLimit(username string) error {
+	conf := st.conf.MaxSessionsPerUser
+	if conf == nil {
+		return nil
+	}
+	list, err := st.listUser(username)
+	if err != nil {
+		return fmt.Errorf("failed to list sessions: %v", err)
+	}
+	if len(list) < conf.Max {
+		return nil
+	}
+	sessionLimitEnforced.WithLabelValues(conf.Policy).Inc()
+	if conf.Policy == SessionLimitPolicyReject {
+		st.infoLog.Printf("cookie-store: rejecting new session for user '%s': maximum of %d sessions reached", username, conf.Max)
+		return fmt.Errorf("the maximum number of %d concurrent sessions is reached, please logout some of your other sessions first", conf.Max)
+	}
+
+	sort.Slice(list, func(i, j int) bool { return list[i].ID.Compare(list[j].ID) < 0 })
+	for _, s := range list[:len(list)-conf.Max+1] {
+		if err = st.RevokeID(username, s.ID); err != nil {
+			return fmt.Errorf("failed to revoke session: %v", err)
+		}
+		st.infoLog.Printf("cookie-store: revoked session('%v') of user '%s' since the maximum of %d sessions is reached", s.ID, username, conf.Max)
+	}
+	return nil
+}
@@ -0,0 +1,126 @@
+//
+// Copyright (c) 2023 whawty contributors (see AUTHORS file)
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// * Neither the name of whawty.nginx-sso nor the names of its
+//   contributors may be used to endorse or promote products derived from
+//   this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+//
+
+package cookie
+
+import (
+	"testing"
+)
+
+func TestSessionLimitConfig(t *testing.T) {
+	conf := &Config{MaxSessionsPerUser: &SessionLimitConfig{Max: 3}}
+	conf.Keys = []SignerVerifierConfig{
+		SignerVerifierConfig{Name: "sign-and-verify", Ed25519: &Ed25519Config{PrivKeyData: &testPrivKeyEd25519Pem}},
+	}
+	conf.Backend = StoreBackendConfig{InMemory: &InMemoryBackendConfig{}}
+	if _, err := NewStore(conf, nil, nil, nil); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if conf.MaxSessionsPerUser.Policy != SessionLimitPolicyRevokeOldest {
+		t.Fatalf("unset policy should be overriden to '%s', got '%s'", SessionLimitPolicyRevokeOldest, conf.MaxSessionsPerUser.Policy)
+	}
+
+	conf.MaxSessionsPerUser = &SessionLimitConfig{Max: 0}
+	if _, err := NewStore(conf, nil, nil, nil); err == nil {
+		t.Fatal("initializing store with a limit of 0 sessions should fail")
+	}
+	conf.MaxSessionsPerUser = &SessionLimitConfig{Max: 3, Policy: "invalid"}
+	if _, err := NewStore(conf, nil, nil, nil); err == nil {
+		t.Fatal("initializing store with invalid session limit policy should fail")
+	}
+}
+
+func TestSessionLimit(t *testing.T) {
+	conf := &Config{MaxSessionsPerUser: &SessionLimitConfig{Max: 2, Policy: SessionLimitPolicyReject}}
+	conf.Keys = []SignerVerifierConfig{
+		SignerVerifierConfig{Name: "sign-and-verify", Ed25519: &Ed25519Config{PrivKeyData: &testPrivKeyEd25519Pem}},
+	}
+	conf.Backend = StoreBackendConfig{InMemory: &InMemoryBackendConfig{}}
+	st, err := NewStore(conf, nil, nil, nil)
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+
+	var values []string
+	for i := 0; i < 2; i++ {
+		value, _, err := st.New("test-user", AgentInfo{}, ClientInfo{})
+		if err != nil {
+			t.Fatal("unexpected error:", err)
+		}
+		values = append(values, value)
+	}
+	if _, _, err = st.New("test-user", AgentInfo{}, ClientInfo{}); err == nil {
+		t.Fatal("creating more sessions than allowed should fail")
+	}
+	if _, _, err = st.New("other-user", AgentInfo{}, ClientInfo{}); err != nil {
+		t.Fatal("the limit should not affect other users:", err)
+	}
+
+	conf.MaxSessionsPerUser.Policy = SessionLimitPolicyRevokeOldest
+	value, _, err := st.New("test-user", AgentInfo{}, ClientInfo{})
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	values = append(values, value)
+
+	if _, err = st.Verify(values[0], ClientInfo{}); err == nil {
+		t.Fatal("the oldest session should have been revoked")
+	}
+	for _, value := range values[1:] {
+		if _, err = st.Verify(value, ClientInfo{}); err != nil {
+			t.Fatal("unexpected error:", err)
+		}
+	}
+	list, err := st.ListUser("test-user")
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if len(list) != 2 {
+		t.Fatalf("user should have 2 sessions but has %d", len(list))
+	}
+	revoked, err := st.backend.ListRevoked()
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if len(revoked) != 1 {
+		t.Fatalf("revocation list should contain 1 entry but has %d", len(revoked))
+	}
+
+	// lowering the limit evicts all sessions above it
+	conf.MaxSessionsPerUser.Max = 1
+	if _, _, err = st.New("test-user", AgentInfo{}, ClientInfo{}); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	for _, value := range values {
+		if _, err = st.Verify(value, ClientInfo{}); err == nil {
+			t.Fatal("all older sessions should have been revoked")
+		}
+	}
+}
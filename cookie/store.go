@@ -31,6 +31,9 @@
 package cookie
 
 import (
+	"bytes"
+	"context"
+	"crypto"
 	"crypto/tls"
 	"encoding/json"
 	"fmt"
@@ -38,6 +41,10 @@ import (
 	"log"
 	"net/http"
 	"net/url"
+	"os"
+	"reflect"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/oklog/ulid/v2"
@@ -52,14 +59,16 @@ const (
 )
 
 var (
-	cookiesCreated         = prometheus.NewCounter(prometheus.CounterOpts{Subsystem: metricsSubsystem, Name: "created_total"})
-	cookiesVerified        = prometheus.NewCounterVec(prometheus.CounterOpts{Subsystem: metricsSubsystem, Name: "verified_total"}, []string{"result"})
+	cookiesCreated         = prometheus.NewCounterVec(prometheus.CounterOpts{Subsystem: metricsSubsystem, Name: "created_total"}, []string{"key"})
+	cookiesRenewed         = prometheus.NewCounterVec(prometheus.CounterOpts{Subsystem: metricsSubsystem, Name: "renewed_total"}, []string{"key"})
+	cookiesVerified        = prometheus.NewCounterVec(prometheus.CounterOpts{Subsystem: metricsSubsystem, Name: "verified_total"}, []string{"result", "key"})
 	cookiesVerifiedSuccess = cookiesVerified.MustCurryWith(prometheus.Labels{"result": "success"})
 	cookiesVerifiedFailed  = cookiesVerified.MustCurryWith(prometheus.Labels{"result": "failed"})
 
 	cookieSyncRequests        = prometheus.NewCounterVec(prometheus.CounterOpts{Subsystem: metricsSubsystem, Name: "sync_requests_total"}, []string{"result"})
 	cookieSyncRequestsSuccess = cookieSyncRequests.MustCurryWith(prometheus.Labels{"result": "success"})
 	cookieSyncRequestsFailed  = cookieSyncRequests.MustCurryWith(prometheus.Labels{"result": "failed"})
+	syncUpstreamLastSuccess   = prometheus.NewGaugeVec(prometheus.GaugeOpts{Subsystem: metricsSubsystem, Name: "sync_upstream_last_success_timestamp_seconds"}, []string{"upstream"})
 	cookieSyncRequestDuration = prometheus.NewSummary(prometheus.SummaryOpts{
 		Subsystem: metricsSubsystem, Name: "sync_request_duration_seconds",
 		Objectives: map[float64]float64{0.5: 0.05, 0.9: 0.01, 0.99: 0.001}})
@@ -68,35 +77,73 @@ var (
 type SignerVerifierConfig struct {
 	Name    string         `yaml:"name"`
 	Ed25519 *Ed25519Config `yaml:"ed25519"`
+	PKCS11  *PKCS11Config  `yaml:"pkcs11"`
 }
 
-type StoreSyncConfig struct {
-	Interval  time.Duration        `yaml:"interval"`
+type KeyDiscoveryConfig struct {
+	Interval time.Duration `yaml:"interval"`
+}
+
+type SyncUpstreamConfig struct {
 	BaseURL   string               `yaml:"base-url"`
 	HTTPHost  string               `yaml:"http-host"`
 	TLSConfig *tlsconfig.TLSConfig `yaml:"tls"`
 	Token     string               `yaml:"token"`
+	Issuer    string               `yaml:"issuer"`
+}
+
+type StoreSyncConfig struct {
+	Interval     time.Duration        `yaml:"interval"`
+	BaseURL      string               `yaml:"base-url"`
+	HTTPHost     string               `yaml:"http-host"`
+	TLSConfig    *tlsconfig.TLSConfig `yaml:"tls"`
+	Token        string               `yaml:"token"`
+	Issuer       string               `yaml:"issuer"`
+	Upstreams    []SyncUpstreamConfig `yaml:"upstreams"`
+	MaxStaleness *SyncStalenessConfig `yaml:"max-staleness"`
+	Stream       *SyncStreamConfig    `yaml:"stream"`
+	KeyDiscovery *KeyDiscoveryConfig  `yaml:"key-discovery"`
+}
+
+// upstreams returns all configured upstreams. base-url, http-host, tls and token are a shorthand
+// for the first upstream.
+func (c *StoreSyncConfig) upstreams() []SyncUpstreamConfig {
+	if c.BaseURL == "" && len(c.Upstreams) > 0 {
+		return c.Upstreams
+	}
+	first := SyncUpstreamConfig{BaseURL: c.BaseURL, HTTPHost: c.HTTPHost, TLSConfig: c.TLSConfig, Token: c.Token, Issuer: c.Issuer}
+	return append([]SyncUpstreamConfig{first}, c.Upstreams...)
 }
 
 type StoreBackendConfig struct {
-	GCInterval time.Duration          `yaml:"gc-interval"`
-	Sync       *StoreSyncConfig       `yaml:"sync"`
-	InMemory   *InMemoryBackendConfig `yaml:"in-memory"`
-	Bolt       *BoltBackendConfig     `yaml:"bolt"`
+	GCInterval  time.Duration          `yaml:"gc-interval"`
+	Sync        *StoreSyncConfig       `yaml:"sync"`
+	Replication *ReplicationConfig     `yaml:"replication"`
+	InMemory    *InMemoryBackendConfig `yaml:"in-memory"`
+	Bolt        *BoltBackendConfig     `yaml:"bolt"`
+	Redis       *RedisBackendConfig    `yaml:"redis"`
+	SQL         *SQLBackendConfig      `yaml:"sql"`
 }
 
 type Config struct {
-	Name    string                 `yaml:"name"`
-	Domain  string                 `yaml:"domain"`
-	Secure  bool                   `yaml:"secure"`
-	Expire  time.Duration          `yaml:"expire"`
-	Keys    []SignerVerifierConfig `yaml:"keys"`
-	Backend StoreBackendConfig     `yaml:"backend"`
+	Name               string                 `yaml:"name"`
+	Issuer             string                 `yaml:"issuer"`
+	Domain             string                 `yaml:"domain"`
+	Secure             bool                   `yaml:"secure"`
+	Expire             time.Duration          `yaml:"expire"`
+	Keys               []SignerVerifierConfig `yaml:"keys"`
+	KeyRotation        *KeyRotationConfig     `yaml:"key-rotation"`
+	Renewal            *RenewalConfig         `yaml:"renewal"`
+	IdleTimeout        *IdleTimeoutConfig     `yaml:"idle-timeout"`
+	Binding            *BindingConfig         `yaml:"binding"`
+	MaxSessionsPerUser *SessionLimitConfig    `yaml:"max-sessions-per-user"`
+	Backend            StoreBackendConfig     `yaml:"backend"`
 }
 
 type SignerVerifier interface {
 	Algo() string
 	CanSign() bool
+	PublicKey() crypto.PublicKey
 	Sign(payload []byte) ([]byte, error)
 	Verify(payload, signature []byte) error
 }
@@ -126,7 +173,10 @@ const (
 
 type SessionFull struct {
 	Session
-	Agent AgentInfo `json:"agent"`
+	Agent    AgentInfo `json:"agent"`
+	LoginIP  string    `json:"login-ip,omitempty"`
+	LastSeen int64     `json:"last-seen,omitempty"`
+	LastIP   string    `json:"last-ip,omitempty"`
 }
 
 func (s SessionFull) CreatedAt() time.Time {
@@ -137,6 +187,13 @@ func (s SessionFull) ExpiresAt() time.Time {
 	return s.Session.ExpiresAt()
 }
 
+func (s SessionFull) LastSeenAt() time.Time {
+	if s.LastSeen == 0 {
+		return time.Time{}
+	}
+	return time.Unix(s.LastSeen, 0)
+}
+
 type SessionFullList []SessionFull
 
 func (l SessionFullList) MarshalJSON() ([]byte, error) {
@@ -148,19 +205,37 @@ func (l SessionFullList) MarshalJSON() ([]byte, error) {
 }
 
 type SignedRevocationList struct {
-	Revoked   json.RawMessage `json:"revoked"`
-	Signature []byte          `json:"signature"`
+	KeyID   string          `json:"key-id,omitempty"`
+	Revoked json.RawMessage `json:"revoked"`
+	// Signature is not typed so that older verify-only instances can still check it, this version only
+	// accepts lists which also carry the typed signature.
+	Signature      []byte `json:"signature"`
+	TypedSignature []byte `json:"typed-signature,omitempty"`
+	// watermarks are signed separately so that older verify-only instances can still check the signature of Revoked
+	Watermarks          json.RawMessage `json:"watermarks,omitempty"`
+	WatermarksSignature []byte          `json:"watermarks-signature,omitempty"`
+	Envelope            json.RawMessage `json:"envelope,omitempty"`
+	EnvelopeSignature   []byte          `json:"envelope-signature,omitempty"`
 }
 
 type StoreBackend interface {
 	Name() string
 	Save(session SessionFull) error
 	ListUser(username string) (SessionFullList, error)
+	ListAll() (SessionFullList, error)
+	Renew(session Session) error
 	Revoke(session Session) error
 	RevokeID(username string, id ulid.ULID) error
+	SaveActivity(list SessionActivityList) error
+	LastSeen(username string, id ulid.ULID) (int64, error)
 	IsRevoked(session Session) (bool, error)
 	ListRevoked() (SessionList, error)
+	ListRevokedSince(seq uint64) (SessionList, uint64, error)
+	RevocationEpoch() (string, error)
 	LoadRevocations(SessionList) (uint, error)
+	Watermark(username string) (int64, error)
+	ListWatermarks() (Watermarks, error)
+	LoadWatermarks(Watermarks) (uint, error)
 	CollectGarbage() (uint, error)
 }
 
@@ -178,13 +253,32 @@ func (opts *Options) fromConfig(conf *Config) {
 	opts.Secure = conf.Secure
 }
 
+type storeKey struct {
+	SignerVerifier
+	id         string
+	discovered bool
+	managed    bool
+	created    time.Time
+}
+
 type Store struct {
-	conf    *Config
-	keys    []SignerVerifier
-	signer  SignerVerifier
-	backend StoreBackend
-	infoLog *log.Logger
-	dbgLog  *log.Logger
+	conf             *Config
+	keysMutex        sync.RWMutex
+	keys             []*storeKey
+	keysByID         map[string]*storeKey
+	signer           *storeKey
+	staticSigner     *storeKey
+	backend          StoreBackend
+	syncClients      []*syncClient
+	lastSync         atomic.Int64
+	syncStarted      time.Time
+	replication      *replicationTracker
+	replicationPeers []*replicationPeer
+	activity         *activityTracker
+	revocations      revocationNotifier
+	limitMutex       sync.Mutex
+	infoLog          *log.Logger
+	dbgLog           *log.Logger
 }
 
 func NewStore(conf *Config, prom prometheus.Registerer, infoLog, dbgLog *log.Logger) (*Store, error) {
@@ -201,16 +295,47 @@ func NewStore(conf *Config, prom prometheus.Registerer, infoLog, dbgLog *log.Log
 	if conf.Expire <= 0 {
 		conf.Expire = DefaultExpire
 	}
+	if conf.Issuer == "" {
+		conf.Issuer, _ = os.Hostname()
+	}
 
-	st := &Store{conf: conf, infoLog: infoLog, dbgLog: dbgLog}
+	st := &Store{conf: conf, keysByID: make(map[string]*storeKey), infoLog: infoLog, dbgLog: dbgLog}
 	if err := st.initKeys(conf); err != nil {
 		st.infoLog.Printf("cookie-store: failed to initialize keys: %v", err)
 		return nil, err
 	}
+	if conf.Binding != nil {
+		if err := st.initBinding(conf); err != nil {
+			st.infoLog.Printf("cookie-store: failed to initialize session binding: %v", err)
+			return nil, err
+		}
+	}
+	if conf.MaxSessionsPerUser != nil {
+		if err := st.initSessionLimit(conf); err != nil {
+			st.infoLog.Printf("cookie-store: failed to initialize session limit: %v", err)
+			return nil, err
+		}
+	}
+	if conf.Renewal != nil {
+		if err := st.initRenewal(conf); err != nil {
+			st.infoLog.Printf("cookie-store: failed to initialize session renewal: %v", err)
+			return nil, err
+		}
+	}
+	if conf.KeyRotation != nil {
+		if err := st.initKeyRotation(conf); err != nil {
+			st.infoLog.Printf("cookie-store: failed to initialize key-rotation: %v", err)
+			return nil, err
+		}
+	}
 	if err := st.initBackend(conf, prom); err != nil {
 		st.infoLog.Printf("cookie-store: failed to initialize backend: %v", err)
 		return nil, err
 	}
+	if err := st.initActivity(conf); err != nil {
+		st.infoLog.Printf("cookie-store: failed to initialize activity tracking: %v", err)
+		return nil, err
+	}
 	if prom != nil {
 		if err := st.initPrometheus(prom); err != nil {
 			st.infoLog.Printf("cookie-store: failed to initialize prometheus metrics: %v", err)
@@ -225,33 +350,225 @@ func NewStore(conf *Config, prom prometheus.Registerer, infoLog, dbgLog *log.Log
 	return st, nil
 }
 
-func (st *Store) initKeys(conf *Config) (err error) {
-	for _, key := range conf.Keys {
-		var s SignerVerifier
-		if key.Ed25519 != nil {
-			s, err = NewEd25519SignerVerifier(conf.Name+"_"+key.Name, key.Ed25519)
-			if err != nil {
-				return fmt.Errorf("failed to load Ed25519 key '%s': %v", key.Name, err)
+func (st *Store) loadKey(key SignerVerifierConfig) (*storeKey, error) {
+	if key.Ed25519 != nil && key.PKCS11 != nil {
+		return nil, fmt.Errorf("failed to load key '%s': 'ed25519' and 'pkcs11' are mutually exclusive", key.Name)
+	}
+	var s SignerVerifier
+	var err error
+	if key.Ed25519 != nil {
+		s, err = NewEd25519SignerVerifier(st.conf.Name+"_"+key.Name, key.Ed25519)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load Ed25519 key '%s': %v", key.Name, err)
+		}
+	}
+	if key.PKCS11 != nil {
+		s, err = NewPKCS11SignerVerifier(st.conf.Name+"_"+key.Name, key.PKCS11)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load PKCS#11 key '%s': %v", key.Name, err)
+		}
+	}
+	if s == nil {
+		return nil, fmt.Errorf("failed to load key '%s': no valid type-specific config found", key.Name)
+	}
+	return &storeKey{SignerVerifier: s, id: key.Name}, nil
+}
+
+// closeKey releases resources held by keys such as PKCS#11 sessions.
+func (st *Store) closeKey(k *storeKey) {
+	if c, ok := k.SignerVerifier.(io.Closer); ok {
+		if err := c.Close(); err != nil {
+			st.infoLog.Printf("cookie-store: failed to close %s key '%s': %v", k.Algo(), k.id, err)
+		}
+	}
+}
+
+// loadStaticKeys loads all keys from the config. PKCS#11 keys whose config has not changed compared
+// to the currently loaded config will be reused in order to not open a new session to the token.
+func (st *Store) loadStaticKeys(conf *Config) (keys []*storeKey, signer *storeKey, err error) {
+	previous := make(map[string]SignerVerifierConfig)
+	if st.conf != conf {
+		for _, key := range st.conf.Keys {
+			previous[key.Name] = key
+		}
+	}
+	current := make(map[string]*storeKey)
+	st.keysMutex.RLock()
+	for _, key := range st.keys {
+		if !key.managed && !key.discovered {
+			current[key.id] = key
+		}
+	}
+	st.keysMutex.RUnlock()
+
+	var loaded []*storeKey
+	defer func() {
+		if err != nil {
+			for _, k := range loaded {
+				st.closeKey(k)
 			}
 		}
-		if s == nil {
-			return fmt.Errorf("failed to load key '%s': no valid type-specific config found", key.Name)
+	}()
+
+	ids := make(map[string]bool)
+	for _, key := range conf.Keys {
+		if ids[key.Name] {
+			return nil, nil, fmt.Errorf("failed to load key '%s': a key with this name already exists", key.Name)
+		}
+		ids[key.Name] = true
+
+		var k *storeKey
+		if prev, exists := previous[key.Name]; exists && key.PKCS11 != nil && current[key.Name] != nil && reflect.DeepEqual(prev, key) {
+			k = current[key.Name]
+		} else if k, err = st.loadKey(key); err != nil {
+			return nil, nil, err
+		} else {
+			loaded = append(loaded, k)
 		}
+		keys = append(keys, k)
 
-		st.keys = append(st.keys, s)
 		mode := "(verify-only)"
-		if s.CanSign() && st.signer == nil {
-			st.signer = s
+		if k.CanSign() && signer == nil {
+			signer = k
 			mode = "(*sign* and verify)"
 		}
-		st.dbgLog.Printf("cookie-store: loaded %s key '%s' %s", s.Algo(), key.Name, mode)
+		st.dbgLog.Printf("cookie-store: loaded %s key '%s' %s", k.Algo(), key.Name, mode)
 	}
-	if len(st.keys) < 1 {
+	return
+}
+
+func (st *Store) initKeys(conf *Config) (err error) {
+	var keys []*storeKey
+	if keys, st.signer, err = st.loadStaticKeys(conf); err != nil {
+		return
+	}
+	st.staticSigner = st.signer
+	for _, k := range keys {
+		st.keys = append(st.keys, k)
+		st.keysByID[k.id] = k
+	}
+	if len(st.keys) < 1 && conf.KeyRotation == nil {
 		return fmt.Errorf("at least one key must be configured")
 	}
 	return
 }
 
+// ReloadKeys replaces all statically configured keys. Any other setting of the cookie store can only
+// be changed using a restart. If loading the new keys fails the current keys will be kept.
+func (st *Store) ReloadKeys(conf *Config) error {
+	if len(conf.Keys) < 1 && st.conf.KeyRotation == nil {
+		return fmt.Errorf("at least one key must be configured")
+	}
+	keys, signer, err := st.loadStaticKeys(conf)
+	if err != nil {
+		return err
+	}
+
+	// keys which have been replaced are closed once nobody can pick them up anymore
+	var replaced []*storeKey
+	defer func() {
+		for _, k := range replaced {
+			st.closeKey(k)
+		}
+	}()
+
+	st.keysMutex.Lock()
+	defer st.keysMutex.Unlock()
+
+	st.keysByID = make(map[string]*storeKey)
+	for _, k := range keys {
+		st.keysByID[k.id] = k
+	}
+	for _, k := range st.keys {
+		if !k.managed && !k.discovered {
+			if st.keysByID[k.id] != k {
+				replaced = append(replaced, k)
+			}
+			continue
+		}
+		if _, exists := st.keysByID[k.id]; exists {
+			st.infoLog.Printf("cookie-store: dropping %s key '%s' since it has been replaced by a statically configured key", k.Algo(), k.id)
+			replaced = append(replaced, k)
+			continue
+		}
+		keys = append(keys, k)
+		st.keysByID[k.id] = k
+	}
+	st.keys = keys
+	if st.signer == nil || st.signer == st.staticSigner || st.keysByID[st.signer.id] != st.signer {
+		st.signer = signer
+	}
+	st.staticSigner = signer
+	st.conf.Keys = conf.Keys
+	if st.signer == nil {
+		st.infoLog.Printf("cookie-store: no signing key has been loaded - this instance can only verify cookies")
+	}
+	st.infoLog.Printf("cookie-store: successfully reloaded keys (%d keys loaded)", len(st.keys))
+	return nil
+}
+
+func (st *Store) currentSigner() *storeKey {
+	st.keysMutex.RLock()
+	defer st.keysMutex.RUnlock()
+	return st.signer
+}
+
+func (st *Store) addKey(id string, s SignerVerifier) (*storeKey, error) {
+	if _, exists := st.keysByID[id]; exists {
+		return nil, fmt.Errorf("failed to load key '%s': a key with this name already exists", id)
+	}
+	k := &storeKey{SignerVerifier: s, id: id}
+	st.keys = append(st.keys, k)
+	st.keysByID[id] = k
+	return k, nil
+}
+
+// Payloads other than cookie values are prefixed with their type before they are signed. This way
+// a signature made for one type of payload can never be used as a signature for another one. The only
+// exception is the untyped signature of revocation lists which is kept for older verify-only instances.
+const (
+	signedTypeKeySet           = "key-set"
+	signedTypeRevocationList   = "revocation-list"
+	signedTypeEnvelope         = "revocation-list-envelope"
+	signedTypeRevocationUpdate = "revocation-update"
+	signedTypeWatermarks       = "watermarks"
+	signedTypeReplication      = "replication-batch"
+)
+
+func typedPayload(kind string, payload []byte) []byte {
+	return append([]byte("whawty-nginx-sso:"+kind+"\x00"), payload...)
+}
+
+func signTyped(signer SignerVerifier, kind string, payload []byte) ([]byte, error) {
+	return signer.Sign(typedPayload(kind, payload))
+}
+
+func (st *Store) verifyTypedSignature(keyID, kind string, payload, signature []byte) (string, error) {
+	return st.verifySignature(keyID, typedPayload(kind, payload), signature)
+}
+
+// verifySignature returns the id of the key that has been used to verify the signature. If keyID is empty
+// all keys will be tried, this is needed to verify values generated by older versions.
+func (st *Store) verifySignature(keyID string, payload, signature []byte) (string, error) {
+	st.keysMutex.RLock()
+	defer st.keysMutex.RUnlock()
+
+	if keyID != "" {
+		key, exists := st.keysByID[keyID]
+		if !exists {
+			return "", fmt.Errorf("unknown key '%s'", keyID)
+		}
+		return key.id, key.Verify(payload, signature)
+	}
+
+	for _, key := range st.keys {
+		if err := key.Verify(payload, signature); err == nil {
+			return key.id, nil
+		}
+	}
+	return "", fmt.Errorf("no key found that is able to verify the signature")
+}
+
 func (st *Store) runGC(interval time.Duration) {
 	t := time.NewTicker(interval)
 	st.dbgLog.Printf("cookie-store: running GC every %v", interval)
@@ -260,24 +577,25 @@ func (st *Store) runGC(interval time.Duration) {
 			st.infoLog.Printf("cookie-store: stopping GC because ticker-channel is closed")
 			return
 		}
-		cnt, err := st.backend.CollectGarbage()
-		if err != nil {
-			st.infoLog.Printf("cookie-store: failed to collect garbage: %v", err)
-		}
-		if cnt > 0 {
-			st.dbgLog.Printf("cookie-store: GC removed %d expired sessions", cnt)
-		}
+		st.collectGarbage()
 	}
 }
 
-func (st *Store) verifyAndDecodeSignedRevocationList(signed SignedRevocationList) (list SessionList, err error) {
-	for _, key := range st.keys {
-		if err = key.Verify(signed.Revoked, signed.Signature); err == nil {
-			break
-		}
+// verifyAndDecodeSignedRevocationList checks the signature of the list, if c is not nil the list must also be at least
+// as recent as the last one we got from this upstream.
+func (st *Store) verifyAndDecodeSignedRevocationList(signed SignedRevocationList, c *syncClient) (list SessionList, envelope *RevocationListEnvelope, err error) {
+	if _, err = st.verifyTypedSignature(signed.KeyID, signedTypeRevocationList, signed.Revoked, signed.TypedSignature); err != nil {
+		st.infoLog.Printf("sync-store: revocation list signature is invalid: %v", err)
+		return
 	}
-	if err != nil {
-		st.infoLog.Printf("sync-store: revocation list signature is invalid")
+	var issuer string
+	var last *RevocationListEnvelope
+	if c != nil {
+		issuer = c.issuer
+		last = c.list
+	}
+	if envelope, err = st.verifyRevocationListEnvelope(signed, issuer, last); err != nil {
+		st.infoLog.Printf("sync-store: %v", err)
 		return
 	}
 
@@ -288,21 +606,124 @@ func (st *Store) verifyAndDecodeSignedRevocationList(signed SignedRevocationList
 	return
 }
 
-func (st *Store) syncRevocations(client *http.Client, baseURL *url.URL, host, token string) bool {
-	req, _ := http.NewRequest("GET", baseURL.JoinPath("revocations").String(), nil)
-	req.Host = host
-	req.Header.Set("Authorization", "Bearer "+token)
-	resp, err := client.Do(req)
+type syncStatusError struct {
+	code int
+}
+
+func (e *syncStatusError) Error() string {
+	return fmt.Sprintf("got HTTP status code %d", e.code)
+}
+
+type syncClient struct {
+	name    string
+	client  *http.Client
+	baseURL *url.URL
+	host    string
+	token   string
+	issuer  string
+	cursor  string
+	list    *RevocationListEnvelope
+}
+
+func (st *Store) newSyncClient(baseURL *url.URL, host string, tlsConfig *tls.Config, token string) *syncClient {
+	client := &http.Client{}
+	switch baseURL.Scheme {
+	case "http":
+		st.infoLog.Printf("sync-store: using insecure url for sync: %s", baseURL.String())
+	case "https":
+		if tlsConfig != nil {
+			client.Transport = &http.Transport{TLSClientConfig: tlsConfig}
+			if tlsConfig.InsecureSkipVerify {
+				st.infoLog.Printf("sync-store: certificate checks for sync are disabled!")
+			}
+		}
+	}
+	return &syncClient{name: baseURL.String(), client: client, baseURL: baseURL, host: host, token: token}
+}
+
+func (st *Store) newSyncClientFromConfig(conf SyncUpstreamConfig) (*syncClient, error) {
+	baseURL, err := url.Parse(conf.BaseURL)
 	if err != nil {
-		st.infoLog.Printf("sync-store: error sending sync request: %v", err)
-		return false
+		return nil, err
 	}
-	defer resp.Body.Close() //nolint:errcheck
+	if baseURL.Scheme != "http" && baseURL.Scheme != "https" {
+		return nil, fmt.Errorf("sync base-url '%s' is invalid", conf.BaseURL)
+	}
+	var tlsConfig *tls.Config
+	if conf.TLSConfig != nil {
+		if tlsConfig, err = conf.TLSConfig.ToGoTLSConfig(); err != nil {
+			return nil, err
+		}
+	}
+	c := st.newSyncClient(baseURL, conf.HTTPHost, tlsConfig, conf.Token)
+	c.issuer = conf.Issuer
+	return c, nil
+}
 
+// syncFailover calls fn for one upstream after the other until it succeeds.
+func (st *Store) syncFailover(fn func(c *syncClient) bool) bool {
+	for _, c := range st.syncClients {
+		if fn(c) {
+			return true
+		}
+	}
+	return false
+}
+
+func (st *Store) syncSucceeded(c *syncClient) {
+	st.lastSync.Store(time.Now().UnixNano())
+	syncUpstreamLastSuccess.WithLabelValues(c.name).SetToCurrentTime()
+}
+
+// syncStaleness returns the time since revocations have been synced successfully from any upstream. If
+// that never happened this is the time since the sync has been started.
+func (st *Store) syncStaleness() time.Duration {
+	last := st.lastSync.Load()
+	if last == 0 {
+		return time.Since(st.syncStarted)
+	}
+	return time.Since(time.Unix(0, last))
+}
+
+func (c *syncClient) do(method, path string, query url.Values, body []byte) (*http.Response, error) {
+	return c.doContext(context.Background(), method, path, query, body)
+}
+
+func (c *syncClient) doContext(ctx context.Context, method, path string, query url.Values, body []byte) (*http.Response, error) {
+	u := c.baseURL.JoinPath(path)
+	u.RawQuery = query.Encode()
+	req, _ := http.NewRequestWithContext(ctx, method, u.String(), bytes.NewReader(body))
+	req.Host = c.host
+	req.Header.Set("Authorization", "Bearer "+c.token)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
 	if resp.StatusCode != http.StatusOK {
-		st.infoLog.Printf("sync-store: error sending sync request: got HTTP status code %d", resp.StatusCode)
+		resp.Body.Close() //nolint:errcheck
+		return nil, &syncStatusError{code: resp.StatusCode}
+	}
+	return resp, nil
+}
+
+func (c *syncClient) get(path string) (*http.Response, error) {
+	return c.do("GET", path, nil, nil)
+}
+
+func (c *syncClient) post(path string, query url.Values, body []byte) (*http.Response, error) {
+	return c.do("POST", path, query, body)
+}
+
+func (st *Store) syncRevocations(c *syncClient) bool {
+	resp, err := c.get("revocations")
+	if err != nil {
+		st.infoLog.Printf("sync-store: error sending sync request: %v", err)
 		return false
 	}
+	defer resp.Body.Close() //nolint:errcheck
 
 	var signed SignedRevocationList
 	err = json.NewDecoder(resp.Body).Decode(&signed)
@@ -312,11 +733,17 @@ func (st *Store) syncRevocations(client *http.Client, baseURL *url.URL, host, to
 	}
 
 	var list SessionList
-	list, err = st.verifyAndDecodeSignedRevocationList(signed)
+	var envelope *RevocationListEnvelope
+	list, envelope, err = st.verifyAndDecodeSignedRevocationList(signed, c)
 	if err != nil {
 		return false
 	}
 
+	var watermarks Watermarks
+	if watermarks, err = st.verifyAndDecodeWatermarks(signed); err != nil {
+		return false
+	}
+
 	var cnt uint
 	if cnt, err = st.backend.LoadRevocations(list); err != nil {
 		st.infoLog.Printf("sync-state: error loading revocations: %v", err)
@@ -324,24 +751,23 @@ func (st *Store) syncRevocations(client *http.Client, baseURL *url.URL, host, to
 	}
 	if cnt > 0 {
 		st.dbgLog.Printf("sync-state: successfully synced %d revocations", cnt)
+		st.revocations.notify()
+	}
+	if cnt, err = st.backend.LoadWatermarks(watermarks); err != nil {
+		st.infoLog.Printf("sync-state: error loading watermarks: %v", err)
+		return false
+	}
+	if cnt > 0 {
+		st.dbgLog.Printf("sync-state: successfully synced %d watermarks", cnt)
+		st.revocations.notify()
+	}
+	if envelope != nil {
+		c.list = envelope
 	}
 	return true
 }
 
-func (st *Store) runSync(interval time.Duration, baseURL *url.URL, host string, tlsConfig *tls.Config, token string) {
-	client := &http.Client{}
-	switch baseURL.Scheme {
-	case "http":
-		st.infoLog.Printf("sync-store: using insecure url for sync: %s", baseURL.String())
-	case "https":
-		if tlsConfig != nil {
-			client.Transport = &http.Transport{TLSClientConfig: tlsConfig}
-			if tlsConfig.InsecureSkipVerify {
-				st.infoLog.Printf("sync-store: certificate checks for sync are disabled!")
-			}
-		}
-	}
-
+func (st *Store) runSync(interval time.Duration, c *syncClient) {
 	t := time.NewTicker(interval)
 	st.dbgLog.Printf("cookie-store: running sync every %v", interval)
 	for {
@@ -350,9 +776,10 @@ func (st *Store) runSync(interval time.Duration, baseURL *url.URL, host string,
 			return
 		}
 		now := time.Now()
-		ok := st.syncRevocations(client, baseURL, host, token)
+		ok := st.pullRevocations(c)
 		cookieSyncRequestDuration.Observe(time.Since(now).Seconds())
 		if ok {
+			st.syncSucceeded(c)
 			cookieSyncRequestsSuccess.WithLabelValues().Inc()
 		} else {
 			cookieSyncRequestsFailed.WithLabelValues().Inc()
@@ -360,65 +787,140 @@ func (st *Store) runSync(interval time.Duration, baseURL *url.URL, host string,
 	}
 }
 
+// NewStoreBackend opens the backend configured in conf. If more than one backend is configured the
+// last one in the order in-memory, bolt, redis and sql wins.
+func NewStoreBackend(conf *StoreBackendConfig, prom prometheus.Registerer) (backend StoreBackend, err error) {
+	if conf.InMemory != nil {
+		if backend, err = NewInMemoryBackend(conf.InMemory, prom); err != nil {
+			return
+		}
+	}
+	if conf.Bolt != nil {
+		if backend, err = NewBoltBackend(conf.Bolt, prom); err != nil {
+			return
+		}
+	}
+	if conf.Redis != nil {
+		if backend, err = NewRedisBackend(conf.Redis, prom); err != nil {
+			return
+		}
+	}
+	if conf.SQL != nil {
+		if backend, err = NewSQLBackend(conf.SQL, prom); err != nil {
+			return
+		}
+	}
+	if backend == nil {
+		err = fmt.Errorf("no valid backend configuration found")
+	}
+	return
+}
+
 func (st *Store) initBackend(conf *Config, prom prometheus.Registerer) (err error) {
 	if conf.Backend.GCInterval <= time.Second {
 		st.infoLog.Printf("cookie-store: overriding invalid/unset GC interval to 5 minutes")
 		conf.Backend.GCInterval = 5 * time.Minute
 	}
-	var syncBaseURL *url.URL
-	var syncTLSConfig *tls.Config
 	if conf.Backend.Sync != nil {
-		if syncBaseURL, err = url.Parse(conf.Backend.Sync.BaseURL); err != nil {
-			return
-		}
-		if syncBaseURL.Scheme != "http" && syncBaseURL.Scheme != "https" {
-			err = fmt.Errorf("sync base-url '%s' is invalid", conf.Backend.Sync.BaseURL)
-			return
+		for _, upstream := range conf.Backend.Sync.upstreams() {
+			var c *syncClient
+			if c, err = st.newSyncClientFromConfig(upstream); err != nil {
+				return
+			}
+			st.syncClients = append(st.syncClients, c)
 		}
 		if conf.Backend.Sync.Interval <= time.Second {
 			st.infoLog.Printf("cookie-store: overriding invalid/unset sync interval to 10 seconds")
 			conf.Backend.Sync.Interval = 10 * time.Second
 		}
-		if conf.Backend.Sync.TLSConfig != nil {
-			if syncTLSConfig, err = conf.Backend.Sync.TLSConfig.ToGoTLSConfig(); err != nil {
+		if conf.Backend.Sync.Stream != nil {
+			if err = st.initSyncStream(conf.Backend.Sync.Stream); err != nil {
 				return
 			}
 		}
-	}
-
-	if conf.Backend.InMemory != nil {
-		st.backend, err = NewInMemoryBackend(conf.Backend.InMemory, prom)
-		if err != nil {
-			return err
+		if conf.Backend.Sync.MaxStaleness != nil {
+			if err = st.initSyncStaleness(conf.Backend.Sync); err != nil {
+				return
+			}
+		}
+		if conf.Backend.Sync.KeyDiscovery != nil && conf.Backend.Sync.KeyDiscovery.Interval <= time.Second {
+			st.infoLog.Printf("cookie-store: overriding invalid/unset key-discovery interval to 5 minutes")
+			conf.Backend.Sync.KeyDiscovery.Interval = 5 * time.Minute
 		}
 	}
-	if conf.Backend.Bolt != nil {
-		st.backend, err = NewBoltBackend(conf.Backend.Bolt, prom)
-		if err != nil {
-			return err
+
+	if conf.Backend.Replication != nil {
+		if err = st.initReplication(conf.Backend.Replication); err != nil {
+			return
 		}
 	}
-	if st.backend == nil {
-		err = fmt.Errorf("no valid backend configuration found")
+
+	if st.backend, err = NewStoreBackend(&conf.Backend, prom); err != nil {
 		return
 	}
 
 	go st.runGC(conf.Backend.GCInterval)
+	if b, ok := st.backend.(*InMemoryBackend); ok && b.snapshot != nil {
+		go st.runInMemorySnapshots(b)
+	}
 	if conf.Backend.Sync != nil {
-		go st.runSync(conf.Backend.Sync.Interval, syncBaseURL, conf.Backend.Sync.HTTPHost, syncTLSConfig, conf.Backend.Sync.Token)
+		st.syncStarted = time.Now()
+		// every upstream is synced independently and the revocations are merged by the backend,
+		// this way an upstream which is down doesn't stop us from getting revocations from the others
+		for _, c := range st.syncClients {
+			if conf.Backend.Sync.Stream != nil {
+				go st.runSyncStream(conf.Backend.Sync, c)
+			} else {
+				go st.runSync(conf.Backend.Sync.Interval, c)
+			}
+		}
+		if conf.Backend.Sync.KeyDiscovery != nil {
+			go st.runKeyDiscovery(conf.Backend.Sync.KeyDiscovery.Interval)
+		}
+	}
+	if len(st.replicationPeers) > 0 {
+		go st.runReplication(conf.Backend.Replication.Interval)
 	}
 	return
 }
 
+// Close writes pending session activity to the backend, or reports it to the upstream, and closes the backend if it needs to be
+// closed, i.e. the in-memory backend writes its final snapshot. The store must not be used afterwards.
+func (st *Store) Close() error {
+	if len(st.syncClients) == 0 {
+		st.saveActivity()
+	} else if !st.syncFailover(st.syncActivity) {
+		st.infoLog.Printf("cookie-store: failed to report pending session activity to upstream")
+	}
+	if c, ok := st.backend.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
 func (st *Store) initPrometheus(prom prometheus.Registerer) (err error) {
 	if err = prom.Register(cookiesCreated); err != nil {
 		return
 	}
+	if err = prom.Register(cookiesRenewed); err != nil {
+		return
+	}
 	if err = prom.Register(cookiesVerified); err != nil {
 		return
 	}
-	cookiesVerifiedSuccess.WithLabelValues()
-	cookiesVerifiedFailed.WithLabelValues()
+	for _, key := range st.keys {
+		if key.CanSign() {
+			cookiesCreated.WithLabelValues(key.id)
+			cookiesRenewed.WithLabelValues(key.id)
+		}
+		cookiesVerifiedSuccess.WithLabelValues(key.id)
+		cookiesVerifiedFailed.WithLabelValues(key.id)
+	}
+	cookiesVerifiedFailed.WithLabelValues("")
+
+	if err = initBackendPrometheus(prom); err != nil {
+		return
+	}
 
 	if err = prom.Register(cookieSyncRequests); err != nil {
 		return
@@ -428,6 +930,72 @@ func (st *Store) initPrometheus(prom prometheus.Registerer) (err error) {
 	if err = prom.Register(cookieSyncRequestDuration); err != nil {
 		return
 	}
+	if err = prom.Register(keyDiscoveryRequests); err != nil {
+		return
+	}
+	keyDiscoveryRequestsSuccess.WithLabelValues()
+	keyDiscoveryRequestsFailed.WithLabelValues()
+	if st.conf.Binding != nil {
+		if err = prom.Register(bindingMismatches); err != nil {
+			return
+		}
+		bindingMismatches.WithLabelValues(st.conf.Binding.Policy)
+	}
+	if st.conf.MaxSessionsPerUser != nil {
+		if err = prom.Register(sessionLimitEnforced); err != nil {
+			return
+		}
+		sessionLimitEnforced.WithLabelValues(st.conf.MaxSessionsPerUser.Policy)
+	}
+	if len(st.syncClients) > 0 {
+		if err = prom.Register(activitySyncRequests); err != nil {
+			return
+		}
+		activitySyncRequestsSuccess.WithLabelValues()
+		activitySyncRequestsFailed.WithLabelValues()
+		if err = prom.Register(syncUpstreamLastSuccess); err != nil {
+			return
+		}
+		for _, c := range st.syncClients {
+			syncUpstreamLastSuccess.WithLabelValues(c.name)
+		}
+		staleness := prometheus.NewGaugeFunc(prometheus.GaugeOpts{Subsystem: metricsSubsystem, Name: "sync_staleness_seconds"}, func() float64 {
+			return st.syncStaleness().Seconds()
+		})
+		if err = prom.Register(staleness); err != nil {
+			return
+		}
+		if st.conf.Backend.Sync.MaxStaleness != nil {
+			stale := prometheus.NewGaugeFunc(prometheus.GaugeOpts{Subsystem: metricsSubsystem, Name: "sync_stale"}, func() float64 {
+				if st.isSyncStale() {
+					return 1
+				}
+				return 0
+			})
+			if err = prom.Register(stale); err != nil {
+				return
+			}
+			if err = prom.Register(staleVerifications); err != nil {
+				return
+			}
+			staleVerifications.WithLabelValues(st.conf.Backend.Sync.MaxStaleness.Policy)
+		}
+	}
+	if len(st.replicationPeers) > 0 {
+		if err = prom.Register(replicationRequests); err != nil {
+			return
+		}
+		replicationRequestsSuccess.WithLabelValues()
+		replicationRequestsFailed.WithLabelValues()
+	}
+	if st.conf.KeyRotation != nil {
+		if err = prom.Register(keyRotationFailed); err != nil {
+			return
+		}
+		if err = prom.Register(keyRotationLast); err != nil {
+			return
+		}
+	}
 	return nil
 }
 
@@ -436,46 +1004,54 @@ func (st *Store) Options() (opts Options) {
 	return
 }
 
-func (st *Store) New(username string, ai AgentInfo) (value string, opts Options, err error) {
-	if st.signer == nil {
+func (st *Store) New(username string, ai AgentInfo, client ClientInfo) (value string, opts Options, err error) {
+	signer := st.currentSigner()
+	if signer == nil {
 		err = fmt.Errorf("no signing key loaded")
 		return
 	}
 
 	s := SessionBase{Username: username}
+	if s.Binding, err = st.makeBinding(client); err != nil {
+		return
+	}
 	s.SetExpiry(st.conf.Expire)
+
+	st.limitMutex.Lock()
+	defer st.limitMutex.Unlock()
+	if err = st.enforceSessionLimit(username); err != nil {
+		return
+	}
+
 	id := ulid.Make()
 	var v *Value
 	if v, err = MakeValue(id, s); err != nil {
 		return
 	}
-	if v.signature, err = st.signer.Sign(v.payload); err != nil {
+	v.keyID = signer.id
+	if v.signature, err = signer.Sign(v.payload); err != nil {
 		return
 	}
 
-	if err = st.backend.Save(SessionFull{Session: Session{ID: id, SessionBase: s}, Agent: ai}); err != nil {
+	if err = st.saveSession(SessionFull{Session: Session{ID: id, SessionBase: s}, Agent: ai, LoginIP: client.IP}); err != nil {
 		return
 	}
+	st.trackReplication(Session{ID: id, SessionBase: s})
 	st.dbgLog.Printf("successfully generated new session('%v'): %+v", id, s)
 
-	cookiesCreated.Inc()
+	cookiesCreated.WithLabelValues(signer.id).Inc()
 	opts.fromConfig(st.conf)
 	value = v.String()
 	return
 }
 
-func (st *Store) verify(value string) (s Session, err error) {
+func (st *Store) verify(value string, client ClientInfo) (s Session, keyID string, err error) {
 	var v Value
 	if err = v.FromString(value); err != nil {
 		return
 	}
 
-	for _, key := range st.keys {
-		if err = key.Verify(v.payload, v.signature); err == nil {
-			break
-		}
-	}
-	if err != nil {
+	if keyID, err = st.verifySignature(v.keyID, v.payload, v.signature); err != nil {
 		err = fmt.Errorf("cookie signature is not valid")
 		return
 	}
@@ -490,7 +1066,7 @@ func (st *Store) verify(value string) (s Session, err error) {
 	}
 
 	var revoked bool
-	if revoked, err = st.backend.IsRevoked(s); err != nil {
+	if revoked, err = st.isRevoked(s); err != nil {
 		err = fmt.Errorf("failed to check for cookie revocation: %v", err)
 		return
 	}
@@ -498,29 +1074,63 @@ func (st *Store) verify(value string) (s Session, err error) {
 		err = fmt.Errorf("cookie is revoked")
 		return
 	}
+	if err = st.checkWatermark(s); err != nil {
+		return
+	}
+	if err = st.checkSyncStaleness(s); err != nil {
+		return
+	}
+	if err = st.checkIdle(s); err != nil {
+		return
+	}
+	if err = st.checkBinding(s, client); err != nil {
+		return
+	}
 
 	st.dbgLog.Printf("successfully verified session('%v'): %+v", s.ID, s.SessionBase)
 	return
 }
 
-func (st *Store) Verify(value string) (s Session, err error) {
-	s, err = st.verify(value)
+func (st *Store) Verify(value string, client ClientInfo) (s Session, err error) {
+	var keyID string
+	s, keyID, err = st.verify(value, client)
 	if err != nil {
-		cookiesVerifiedFailed.WithLabelValues().Inc()
+		cookiesVerifiedFailed.WithLabelValues(keyID).Inc()
 	} else {
-		cookiesVerifiedSuccess.WithLabelValues().Inc()
+		cookiesVerifiedSuccess.WithLabelValues(keyID).Inc()
 	}
 	return
 }
 
 func (st *Store) ListUser(username string) (SessionFullList, error) {
-	return st.backend.ListUser(username)
+	list, err := st.listUser(username)
+	if err != nil {
+		return nil, err
+	}
+	st.mergeActivity(list)
+	return list, nil
+}
+
+// mergeActivity updates the list with activity which has not yet been written to the backend.
+func (st *Store) mergeActivity(list SessionFullList) {
+	st.activity.mutex.Lock()
+	defer st.activity.mutex.Unlock()
+	for i := range list {
+		if entry, exists := st.activity.entries[list[i].ID]; exists && entry.LastSeen > list[i].LastSeen {
+			list[i].LastSeen = entry.LastSeen
+			list[i].LastIP = entry.IP
+		}
+	}
 }
 
 func (st *Store) Revoke(session Session) error {
+	// a renewed copy of this cookie might expire later than the one we have got
+	session.Expires = st.maxExpiry(session)
+	session.Binding = nil
 	if err := st.backend.Revoke(session); err != nil {
 		return err
 	}
+	st.revocations.notify()
 	st.dbgLog.Printf("successfully revoked session('%v')", session.ID)
 	return nil
 }
@@ -529,21 +1139,33 @@ func (st *Store) RevokeID(username string, id ulid.ULID) error {
 	if err := st.backend.RevokeID(username, id); err != nil {
 		return err
 	}
+	st.revocations.notify()
 	st.dbgLog.Printf("successfully revoked session('%v')", id)
 	return nil
 }
 
 func (st *Store) ListRevoked() (result SignedRevocationList, err error) {
 	var revoked SessionList
-	if revoked, err = st.backend.ListRevoked(); err != nil {
+	var seq uint64
+	if revoked, seq, err = st.backend.ListRevokedSince(0); err != nil {
 		return
 	}
 
 	if result.Revoked, err = json.Marshal(revoked); err != nil {
 		return
 	}
-	if st.signer != nil {
-		if result.Signature, err = st.signer.Sign(result.Revoked); err != nil {
+	if signer := st.currentSigner(); signer != nil {
+		result.KeyID = signer.id
+		if result.Signature, err = signer.Sign(result.Revoked); err != nil {
+			return
+		}
+		if result.TypedSignature, err = signTyped(signer, signedTypeRevocationList, result.Revoked); err != nil {
+			return
+		}
+		if err = st.signWatermarks(&result, signer); err != nil {
+			return
+		}
+		if err = st.signRevocationListEnvelope(&result, signer, seq); err != nil {
 			return
 		}
 	}
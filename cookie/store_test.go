@@ -33,6 +33,8 @@ package cookie
 import (
 	"bytes"
 	"crypto/ed25519"
+	"crypto/x509"
+	"encoding/pem"
 	"testing"
 	"time"
 
@@ -117,6 +119,15 @@ func TestNewStore(t *testing.T) {
 		t.Fatal("initializing store with sign-and-verify key must have signer attribute")
 	}
 
+	conf.Keys = []SignerVerifierConfig{
+		SignerVerifierConfig{Name: "test", Ed25519: ed25519Conf},
+		SignerVerifierConfig{Name: "test", Ed25519: &Ed25519Config{PubKeyData: &testPubKeyEd25519Pem}},
+	}
+	_, err = NewStore(conf, nil, nil, nil)
+	if err == nil {
+		t.Fatal("initializing store with duplicate key names should fail")
+	}
+
 	conf.Backend = StoreBackendConfig{}
 	_, err = NewStore(conf, nil, nil, nil)
 	if err == nil {
@@ -143,9 +154,9 @@ func TestMultipleKeys(t *testing.T) {
 	if st.signer == nil {
 		t.Fatal("initializing store with at least one sign-and-verify key must have signer attribute")
 	}
-	ed25519Signer, ok := st.signer.(*Ed25519SignerVerifier)
+	ed25519Signer, ok := st.signer.SignerVerifier.(*Ed25519SignerVerifier)
 	if !ok {
-		t.Fatalf("signer-verfier has wrong type: %T", st.signer)
+		t.Fatalf("signer-verfier has wrong type: %T", st.signer.SignerVerifier)
 	}
 	expectedContext := cookieName + "_sign-and-verify"
 	if ed25519Signer.context != expectedContext {
@@ -192,7 +203,7 @@ func TestNew(t *testing.T) {
 
 	testUser := "test-user"
 	testAgent := AgentInfo{Name: "test-agent", OS: "test-os"}
-	_, _, err = st.New(testUser, testAgent)
+	_, _, err = st.New(testUser, testAgent, ClientInfo{})
 	if err == nil {
 		t.Fatal("calling New() on verify-only store must return an error")
 	}
@@ -204,7 +215,7 @@ func TestNew(t *testing.T) {
 	if err != nil {
 		t.Fatal("unexpected error:", err)
 	}
-	value, opts, err := st.New(testUser, testAgent)
+	value, opts, err := st.New(testUser, testAgent, ClientInfo{})
 	if err != nil {
 		t.Fatal("unexpected error:", err)
 	}
@@ -220,6 +231,9 @@ func TestNew(t *testing.T) {
 	if len(v.payload) == 0 || len(v.signature) == 0 {
 		t.Fatal("New() returned invalid value")
 	}
+	if v.KeyID() != "sign-and-verify" {
+		t.Fatalf("New() returned wrong key-id, expected: 'sign-and-verify', got '%s'", v.KeyID())
+	}
 	err = st.signer.Verify(v.payload, v.signature)
 	if err != nil {
 		t.Fatal("unexpected error:", err)
@@ -250,7 +264,7 @@ func TestVerify(t *testing.T) {
 		t.Fatal("unexpected error:", err)
 	}
 
-	_, err = st.Verify("")
+	_, err = st.Verify("", ClientInfo{})
 	if err == nil {
 		t.Fatal("verifing invalid cookie value should fail")
 	}
@@ -271,7 +285,7 @@ func TestVerify(t *testing.T) {
 	if err != nil {
 		t.Fatal("unexpected error:", err)
 	}
-	_, err = st.Verify(testValue.String())
+	_, err = st.Verify(testValue.String(), ClientInfo{})
 	if err == nil {
 		t.Fatal("signature signed by unknown signer should not verify")
 	}
@@ -281,7 +295,7 @@ func TestVerify(t *testing.T) {
 	if err != nil {
 		t.Fatal("unexpected error:", err)
 	}
-	_, err = st.Verify(testValue.String())
+	_, err = st.Verify(testValue.String(), ClientInfo{})
 	if err == nil {
 		t.Fatal("extracting an ivalid payload should fail")
 	}
@@ -293,7 +307,7 @@ func TestVerify(t *testing.T) {
 	if err != nil {
 		t.Fatal("unexpected error:", err)
 	}
-	_, err = st.Verify(testValue.String())
+	_, err = st.Verify(testValue.String(), ClientInfo{})
 	if err == nil {
 		t.Fatal("expired cookie should not successfully verify")
 	}
@@ -307,7 +321,7 @@ func TestVerify(t *testing.T) {
 		t.Fatal("unexpected error:", err)
 	}
 
-	s, err := st.Verify(testValue.String())
+	s, err := st.Verify(testValue.String(), ClientInfo{})
 	if err != nil {
 		t.Fatal("unexpected error:", err)
 	}
@@ -322,7 +336,7 @@ func TestVerify(t *testing.T) {
 		t.Fatal("unexpected error:", err)
 	}
 
-	_, err = st.Verify(testValue.String())
+	_, err = st.Verify(testValue.String(), ClientInfo{})
 	if err == nil {
 		t.Fatal("revoked session should not successfully verify")
 	}
@@ -343,12 +357,12 @@ func TestNewThenVerifyMultipleKeys(t *testing.T) {
 
 	testUser := "test-user"
 	testAgent := AgentInfo{Name: "test-agent", OS: "test-os"}
-	value, _, err := st.New(testUser, testAgent)
+	value, _, err := st.New(testUser, testAgent, ClientInfo{})
 	if err != nil {
 		t.Fatal("unexpected error:", err)
 	}
 
-	_, err = st.Verify(value)
+	_, err = st.Verify(value, ClientInfo{})
 	if err != nil {
 		t.Fatal("unexpected error:", err)
 	}
@@ -370,13 +384,31 @@ func TestNewThenVerifyMultipleKeys(t *testing.T) {
 	if err != nil {
 		t.Fatal("unexpected error:", err)
 	}
-	_, err = st.Verify(testValue.String())
+	_, err = st.Verify(testValue.String(), ClientInfo{})
 	if err == nil {
 		t.Fatal("signature signed by unknown signer should not verify")
 	}
 
-	st.keys = append(st.keys, testSigner)
-	_, err = st.Verify(testValue.String())
+	if _, err = st.addKey(testSignerName, testSigner); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	_, err = st.Verify(testValue.String(), ClientInfo{})
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+
+	testValue.keyID = "sign-and-verify"
+	_, err = st.Verify(testValue.String(), ClientInfo{})
+	if err == nil {
+		t.Fatal("signature with key-id not matching the signer should not verify")
+	}
+	testValue.keyID = "unknown"
+	_, err = st.Verify(testValue.String(), ClientInfo{})
+	if err == nil {
+		t.Fatal("signature with unknown key-id should not verify")
+	}
+	testValue.keyID = testSignerName
+	_, err = st.Verify(testValue.String(), ClientInfo{})
 	if err != nil {
 		t.Fatal("unexpected error:", err)
 	}
@@ -406,7 +438,7 @@ func TestListUser(t *testing.T) {
 	}
 
 	testAgent1 := AgentInfo{Name: "test-agent1", OS: "test-os1"}
-	value1, _, err := st.New(testUser, testAgent1)
+	value1, _, err := st.New(testUser, testAgent1, ClientInfo{IP: "192.0.2.1"})
 	if err != nil {
 		t.Fatal("unexpected error:", err)
 	}
@@ -418,9 +450,12 @@ func TestListUser(t *testing.T) {
 	if len(list) != 1 {
 		t.Fatalf("unexpected session list length: expected 1, got %d", len(list))
 	}
+	if list[0].LoginIP != "192.0.2.1" {
+		t.Fatalf("unexpected login IP: expected '192.0.2.1', got '%s'", list[0].LoginIP)
+	}
 
 	testAgent2 := AgentInfo{Name: "test-agent2", OS: "test-os2"}
-	value2, _, err := st.New(testUser, testAgent2)
+	value2, _, err := st.New(testUser, testAgent2, ClientInfo{})
 	if err != nil {
 		t.Fatal("unexpected error:", err)
 	}
@@ -434,7 +469,7 @@ func TestListUser(t *testing.T) {
 	}
 
 	testUser2 := "other-user"
-	_, _, err = st.New(testUser2, testAgent1)
+	_, _, err = st.New(testUser2, testAgent1, ClientInfo{})
 	if err != nil {
 		t.Fatal("unexpected error:", err)
 	}
@@ -516,7 +551,7 @@ func TestListRevoked(t *testing.T) {
 
 	testUser := "test-user"
 	testAgent := AgentInfo{Name: "test-agent", OS: "test-os"}
-	value, _, err := st.New(testUser, testAgent)
+	value, _, err := st.New(testUser, testAgent, ClientInfo{})
 	if err != nil {
 		t.Fatal("unexpected error:", err)
 	}
@@ -528,10 +563,23 @@ func TestListRevoked(t *testing.T) {
 	if !bytes.Equal([]byte("[]"), signed.Revoked) {
 		t.Fatalf("unexpected revocation list: expected '[]', got '%s'", signed.Revoked)
 	}
+	if signed.KeyID != "sign-and-verify" {
+		t.Fatalf("unexpected revocation list key-id: expected 'sign-and-verify', got '%s'", signed.KeyID)
+	}
+	// older verify-only instances only know the untyped signature
 	err = st.keys[0].Verify(signed.Revoked, signed.Signature)
 	if err != nil {
 		t.Fatal("unexpected error:", err)
 	}
+	err = st.keys[0].Verify(typedPayload(signedTypeRevocationList, signed.Revoked), signed.TypedSignature)
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	untyped := signed
+	untyped.TypedSignature = nil
+	if _, _, err = st.verifyAndDecodeSignedRevocationList(untyped, nil); err == nil {
+		t.Fatal("revocation list without typed signature should be rejected")
+	}
 
 	var v Value
 	err = v.FromString(value)
@@ -551,7 +599,7 @@ func TestListRevoked(t *testing.T) {
 	if err != nil {
 		t.Fatal("unexpected error:", err)
 	}
-	list, err := st.verifyAndDecodeSignedRevocationList(signed)
+	list, _, err := st.verifyAndDecodeSignedRevocationList(signed, nil)
 	if err != nil {
 		t.Fatal("unexpected error:", err)
 	}
@@ -559,7 +607,7 @@ func TestListRevoked(t *testing.T) {
 		t.Fatalf("unexpected revocation list length: expected 1, got %d", len(list))
 	}
 
-	value, _, err = st.New(testUser, testAgent)
+	value, _, err = st.New(testUser, testAgent, ClientInfo{})
 	if err != nil {
 		t.Fatal("unexpected error:", err)
 	}
@@ -580,7 +628,7 @@ func TestListRevoked(t *testing.T) {
 	if err != nil {
 		t.Fatal("unexpected error:", err)
 	}
-	list, err = st.verifyAndDecodeSignedRevocationList(signed)
+	list, _, err = st.verifyAndDecodeSignedRevocationList(signed, nil)
 	if err != nil {
 		t.Fatal("unexpected error:", err)
 	}
@@ -590,3 +638,114 @@ func TestListRevoked(t *testing.T) {
 
 	// TODO: actually compare session IDs and in revocation list with expected sessions
 }
+
+func TestReloadKeys(t *testing.T) {
+	conf := &Config{}
+	conf.Keys = []SignerVerifierConfig{
+		SignerVerifierConfig{Name: "old", Ed25519: &Ed25519Config{PrivKeyData: &testPrivKeyEd25519Pem}},
+	}
+	conf.Backend = StoreBackendConfig{InMemory: &InMemoryBackendConfig{}}
+	st, err := NewStore(conf, nil, nil, nil)
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	oldValue, _, err := st.New("test-user", AgentInfo{}, ClientInfo{})
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+
+	err = st.ReloadKeys(&Config{})
+	if err == nil {
+		t.Fatal("reloading an empty key list should fail")
+	}
+	err = st.ReloadKeys(&Config{Keys: []SignerVerifierConfig{
+		SignerVerifierConfig{Name: "new", Ed25519: &Ed25519Config{PubKeyData: &testPubKeyEd25519Pem}},
+		SignerVerifierConfig{Name: "new", Ed25519: &Ed25519Config{PubKeyData: &testPubKeyEd25519Pem}},
+	}})
+	if err == nil {
+		t.Fatal("reloading keys with duplicate names should fail")
+	}
+	if st.currentSigner() == nil || st.currentSigner().id != "old" || len(st.keys) != 1 {
+		t.Fatal("failed reload must not change the current keys")
+	}
+
+	_, priv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(priv)
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	newPrivKeyPem := string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}))
+	err = st.ReloadKeys(&Config{Keys: []SignerVerifierConfig{
+		SignerVerifierConfig{Name: "new", Ed25519: &Ed25519Config{PrivKeyData: &newPrivKeyPem}},
+		SignerVerifierConfig{Name: "old", Ed25519: &Ed25519Config{PubKeyData: &testPubKeyEd25519Pem}},
+	}})
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if signer := st.currentSigner(); signer == nil || signer.id != "new" {
+		t.Fatal("reloading keys must replace the signer")
+	}
+	if len(st.keys) != 2 || len(st.keysByID) != 2 {
+		t.Fatalf("store should have 2 keys after reload but has %d", len(st.keys))
+	}
+	if _, err = st.Verify(oldValue, ClientInfo{}); err != nil {
+		t.Fatal("cookie signed with the old key should still be valid:", err)
+	}
+	newValue, _, err := st.New("test-user", AgentInfo{}, ClientInfo{})
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	var v Value
+	if err = v.FromString(newValue); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if v.KeyID() != "new" {
+		t.Fatalf("New() returned wrong key-id, expected: 'new', got '%s'", v.KeyID())
+	}
+
+	err = st.ReloadKeys(&Config{Keys: []SignerVerifierConfig{
+		SignerVerifierConfig{Name: "new", Ed25519: &Ed25519Config{PrivKeyData: &newPrivKeyPem}},
+	}})
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if _, err = st.Verify(oldValue, ClientInfo{}); err == nil {
+		t.Fatal("cookie signed with a removed key should be rejected")
+	}
+
+	closing := &testClosingKey{SignerVerifier: st.currentSigner().SignerVerifier}
+	st.keys[0] = &storeKey{SignerVerifier: closing, id: "new"}
+	st.keysByID["new"] = st.keys[0]
+	err = st.ReloadKeys(&Config{Keys: []SignerVerifierConfig{
+		SignerVerifierConfig{Name: "new", Ed25519: &Ed25519Config{PubKeyData: &testPubKeyEd25519Pem}},
+		SignerVerifierConfig{Name: "new", Ed25519: &Ed25519Config{PubKeyData: &testPubKeyEd25519Pem}},
+	}})
+	if err == nil {
+		t.Fatal("reloading keys with duplicate names should fail")
+	}
+	if closing.closed != 0 {
+		t.Fatal("keys must not be closed if reloading failed")
+	}
+	err = st.ReloadKeys(&Config{Keys: []SignerVerifierConfig{
+		SignerVerifierConfig{Name: "new", Ed25519: &Ed25519Config{PrivKeyData: &newPrivKeyPem}},
+	}})
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if closing.closed != 1 {
+		t.Fatalf("replaced key should have been closed once, got %d", closing.closed)
+	}
+}
+
+type testClosingKey struct {
+	SignerVerifier
+	closed int
+}
+
+func (k *testClosingKey) Close() error {
+	k.closed++
+	return nil
+}
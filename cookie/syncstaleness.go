@@ -0,0 +1,135 @@
+//
+// Copyright (c) 2023 whawty contributors (see AUTHORS file)
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// * Neither the name of whawty.nginx-sso nor the names of its
+//   contributors may be used to endorse or promote products derived from
+//   this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+//
+
+package cookie
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/oklog/ulid/v2"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	StalenessPolicyLog     = "log"
+	StalenessPolicyDenyNew = "deny-new"
+	StalenessPolicyDenyAll = "deny-all"
+)
+
+var (
+	staleVerifications = prometheus.NewCounterVec(prometheus.CounterOpts{Subsystem: metricsSubsystem, Name: "sync_stale_verifications_total"}, []string{"policy"})
+)
+
+type SyncStalenessConfig struct {
+	MaxAge time.Duration `yaml:"max-age"`
+	Policy string        `yaml:"policy"`
+}
+
+type SyncHealth struct {
+	Enabled      bool      `json:"enabled"`
+	Stale        bool      `json:"stale"`
+	LastSync     time.Time `json:"last-sync"`
+	Staleness    float64   `json:"staleness-seconds"`
+	MaxStaleness float64   `json:"max-staleness-seconds,omitempty"`
+	Policy       string    `json:"policy,omitempty"`
+}
+
+func (st *Store) initSyncStaleness(conf *StoreSyncConfig) error {
+	switch conf.MaxStaleness.Policy {
+	case "":
+		conf.MaxStaleness.Policy = StalenessPolicyDenyAll
+	case StalenessPolicyLog, StalenessPolicyDenyNew, StalenessPolicyDenyAll:
+	default:
+		return fmt.Errorf("sync: invalid max-staleness policy '%s'", conf.MaxStaleness.Policy)
+	}
+	if conf.MaxStaleness.MaxAge <= conf.Interval {
+		return fmt.Errorf("sync: max-staleness must be longer than the sync interval (%v)", conf.Interval)
+	}
+	return nil
+}
+
+func (st *Store) isSyncStale() bool {
+	if st.conf.Backend.Sync == nil || st.conf.Backend.Sync.MaxStaleness == nil {
+		return false
+	}
+	// until the first sync succeeded we don't know anything about revocations
+	if st.lastSync.Load() == 0 {
+		return true
+	}
+	return st.syncStaleness() > st.conf.Backend.Sync.MaxStaleness.MaxAge
+}
+
+// SyncHealth reports whether the revocations have been synced recently enough.
+func (st *Store) SyncHealth() (h SyncHealth) {
+	if len(st.syncClients) == 0 {
+		return
+	}
+	h.Enabled = true
+	if last := st.lastSync.Load(); last != 0 {
+		h.LastSync = time.Unix(0, last)
+	}
+	h.Staleness = st.syncStaleness().Seconds()
+	if conf := st.conf.Backend.Sync.MaxStaleness; conf != nil {
+		h.MaxStaleness = conf.MaxAge.Seconds()
+		h.Policy = conf.Policy
+		h.Stale = st.isSyncStale()
+	}
+	return
+}
+
+// checkSyncStaleness applies the max-staleness policy. The deny-new policy only rejects sessions created after the
+// last successful sync since we have never seen any revocations for them. If there was no successful sync yet
+// all sessions are rejected.
+func (st *Store) checkSyncStaleness(s Session) error {
+	if !st.isSyncStale() {
+		return nil
+	}
+	policy := st.conf.Backend.Sync.MaxStaleness.Policy
+	staleVerifications.WithLabelValues(policy).Inc()
+
+	var err error
+	last := st.lastSync.Load()
+	if last == 0 {
+		err = fmt.Errorf("revocations have never been synced")
+	} else {
+		err = fmt.Errorf("revocations have not been synced since %v", time.Unix(0, last))
+	}
+	switch policy {
+	case StalenessPolicyLog:
+		st.infoLog.Printf("cookie-store: %v, accepting session('%v') anyway", err, s.ID)
+		return nil
+	case StalenessPolicyDenyNew:
+		if last != 0 && ulid.Time(s.ID.Time()).Before(time.Unix(0, last)) {
+			return nil
+		}
+	}
+	return err
+}
@@ -0,0 +1,147 @@
+//
+// Copyright (c) 2023 whawty contributors (see AUTHORS file)
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// * Neither the name of whawty.nginx-sso nor the names of its
+//   contributors may be used to endorse or promote products derived from
+//   this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+//
+
+package cookie
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSyncStalenessConfig(t *testing.T) {
+	conf := &Config{}
+	conf.Keys = []SignerVerifierConfig{
+		SignerVerifierConfig{Name: "verify-only", Ed25519: &Ed25519Config{PubKeyData: &testPubKeyEd25519Pem}},
+	}
+	conf.Backend = StoreBackendConfig{InMemory: &InMemoryBackendConfig{}}
+	conf.Backend.Sync = &StoreSyncConfig{BaseURL: "http://192.0.2.1", Interval: time.Minute, MaxStaleness: &SyncStalenessConfig{MaxAge: time.Hour, Policy: "invalid"}}
+	if _, err := NewStore(conf, nil, nil, nil); err == nil {
+		t.Fatal("initializing store with invalid max-staleness policy should fail")
+	}
+	conf.Backend.Sync.MaxStaleness = &SyncStalenessConfig{MaxAge: time.Second}
+	if _, err := NewStore(conf, nil, nil, nil); err == nil {
+		t.Fatal("initializing store with max-staleness shorter than the sync interval should fail")
+	}
+	conf.Backend.Sync.MaxStaleness = &SyncStalenessConfig{MaxAge: time.Hour}
+	if _, err := NewStore(conf, nil, nil, nil); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if conf.Backend.Sync.MaxStaleness.Policy != StalenessPolicyDenyAll {
+		t.Fatalf("unset policy should be overriden to '%s', got '%s'", StalenessPolicyDenyAll, conf.Backend.Sync.MaxStaleness.Policy)
+	}
+}
+
+func TestSyncStaleness(t *testing.T) {
+	conf := &Config{Expire: time.Hour}
+	conf.Keys = []SignerVerifierConfig{
+		SignerVerifierConfig{Name: "sign-and-verify", Ed25519: &Ed25519Config{PrivKeyData: &testPrivKeyEd25519Pem}},
+	}
+	conf.Backend = StoreBackendConfig{InMemory: &InMemoryBackendConfig{}}
+	conf.Backend.Sync = &StoreSyncConfig{BaseURL: "http://192.0.2.1", Interval: time.Hour, MaxStaleness: &SyncStalenessConfig{MaxAge: 2 * time.Hour}}
+	st, err := NewStore(conf, nil, nil, nil)
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+
+	older, _, err := st.New("test-user", AgentInfo{}, ClientInfo{})
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if health := st.SyncHealth(); !health.Stale || !health.LastSync.IsZero() || health.Staleness > time.Minute.Seconds() {
+		t.Fatalf("sync should be stale until the first sync succeeded: %+v", health)
+	}
+	if _, err = st.Verify(older, ClientInfo{}); err == nil {
+		t.Fatal("verifying sessions before the first sync should fail with policy deny-all")
+	}
+	st.syncSucceeded(st.syncClients[0])
+	newer, _, err := st.New("test-user", AgentInfo{}, ClientInfo{})
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+
+	if health := st.SyncHealth(); !health.Enabled || health.Stale {
+		t.Fatalf("sync should not be stale: %+v", health)
+	}
+	for _, value := range []string{older, newer} {
+		if _, err = st.Verify(value, ClientInfo{}); err != nil {
+			t.Fatal("unexpected error:", err)
+		}
+	}
+
+	// pretend the last sync happened 3 hours ago
+	st.lastSync.Add(int64(-3 * time.Hour))
+	if health := st.SyncHealth(); !health.Stale || health.Policy != StalenessPolicyDenyAll {
+		t.Fatalf("sync should be stale: %+v", health)
+	}
+	for _, value := range []string{older, newer} {
+		if _, err = st.Verify(value, ClientInfo{}); err == nil {
+			t.Fatal("verifying sessions while sync is stale should fail with policy deny-all")
+		}
+	}
+
+	conf.Backend.Sync.MaxStaleness.Policy = StalenessPolicyLog
+	for _, value := range []string{older, newer} {
+		if _, err = st.Verify(value, ClientInfo{}); err != nil {
+			t.Fatal("verifying sessions while sync is stale should succeed with policy log:", err)
+		}
+	}
+}
+
+func TestSyncStalenessDenyNew(t *testing.T) {
+	conf := &Config{Expire: time.Hour}
+	conf.Keys = []SignerVerifierConfig{
+		SignerVerifierConfig{Name: "sign-and-verify", Ed25519: &Ed25519Config{PrivKeyData: &testPrivKeyEd25519Pem}},
+	}
+	conf.Backend = StoreBackendConfig{InMemory: &InMemoryBackendConfig{}}
+	conf.Backend.Sync = &StoreSyncConfig{BaseURL: "http://192.0.2.1", Interval: time.Hour, MaxStaleness: &SyncStalenessConfig{MaxAge: 2 * time.Hour, Policy: StalenessPolicyDenyNew}}
+	st, err := NewStore(conf, nil, nil, nil)
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+
+	older, _, err := st.New("test-user", AgentInfo{}, ClientInfo{})
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if _, err = st.Verify(older, ClientInfo{}); err == nil {
+		t.Fatal("all sessions should be rejected with policy deny-new as long as there was no successful sync")
+	}
+	time.Sleep(2 * time.Millisecond)
+	st.lastSync.Store(time.Now().Add(-3 * time.Hour).UnixNano())
+	if _, err = st.Verify(older, ClientInfo{}); err == nil {
+		t.Fatal("sessions created after the last sync should be rejected with policy deny-new")
+	}
+	st.lastSync.Store(time.Now().UnixNano())
+	conf.Backend.Sync.MaxStaleness.MaxAge = time.Millisecond
+	time.Sleep(2 * time.Millisecond)
+	if _, err = st.Verify(older, ClientInfo{}); err != nil {
+		t.Fatal("sessions created before the last sync should be accepted with policy deny-new:", err)
+	}
+}
@@ -46,8 +46,9 @@ const (
 )
 
 type SessionBase struct {
-	Username string `json:"u"`
-	Expires  int64  `json:"e"`
+	Username string          `json:"u"`
+	Expires  int64           `json:"e"`
+	Binding  *SessionBinding `json:"b,omitempty"`
 }
 
 func (s *SessionBase) SetExpiry(lifetime time.Duration) {
@@ -72,6 +73,7 @@ func (s Session) ExpiresAt() time.Time {
 }
 
 type Value struct {
+	keyID     string
 	payload   []byte
 	signature []byte
 }
@@ -96,13 +98,35 @@ func MakeValue(id ulid.ULID, s SessionBase) (v *Value, err error) {
 	return
 }
 
+func (v *Value) KeyID() string {
+	return v.keyID
+}
+
 func (v *Value) String() string {
-	return base64.RawURLEncoding.EncodeToString(v.payload) + "." + base64.RawURLEncoding.EncodeToString(v.signature)
+	encoded := base64.RawURLEncoding.EncodeToString(v.payload) + "." + base64.RawURLEncoding.EncodeToString(v.signature)
+	if v.keyID == "" {
+		return encoded
+	}
+	return base64.RawURLEncoding.EncodeToString([]byte(v.keyID)) + "." + encoded
 }
 
 func (v *Value) FromString(encoded string) (err error) {
-	parts := strings.SplitN(encoded, ".", 2)
-	if len(parts) != 2 {
+	parts := strings.SplitN(encoded, ".", 4)
+	switch len(parts) {
+	case 2:
+		// values generated by older versions don't contain a key-id
+		v.keyID = ""
+	case 3:
+		if parts[0] == "" {
+			return fmt.Errorf("invalid cookie value")
+		}
+		var keyID []byte
+		if keyID, err = base64.RawURLEncoding.DecodeString(parts[0]); err != nil {
+			return fmt.Errorf("invalid cookie value: %v", err)
+		}
+		v.keyID = string(keyID)
+		parts = parts[1:]
+	default:
 		return fmt.Errorf("invalid cookie value")
 	}
 	if parts[0] == "" || parts[1] == "" {
@@ -98,6 +98,14 @@ func TestValueToString(t *testing.T) {
 	if expected != encoded {
 		t.Fatalf("encoding cookie value failed, expected: '%s', got '%s'", expected, encoded)
 	}
+
+	v.keyID = "2023-11"
+	encoded = v.String()
+	expected = "MjAyMy0xMQ.ABEiM0RVZneImaq7zN3u_3sidSI6InRlc3QiLCJlIjoxMDAwfQ.dGhpcy1pcy1ub3QtYS1zaWduYXR1cmU"
+
+	if expected != encoded {
+		t.Fatalf("encoding cookie value with key-id failed, expected: '%s', got '%s'", expected, encoded)
+	}
 }
 
 func TestValueFromString(t *testing.T) {
@@ -120,6 +128,12 @@ func TestValueFromString(t *testing.T) {
 		{"foooooooooooooooooooooo.bar+blub", false},
 		{"foooooooooooooooooooooo.bar=", false},
 		{"foooooooooooooooooooooo=.bar", false},
+		{"a2V5.foooooooooooooooooooooo.bar", true},
+		{".foooooooooooooooooooooo.bar", false},
+		{"a2V5=.foooooooooooooooooooooo.bar", false},
+		{"a2V5..bar", false},
+		{"a2V5.foooooooooooooooooooooo.", false},
+		{"a2V5.foooooooooooooooooooooo.bar.blub", false},
 	}
 	for _, vector := range vectors {
 		var v Value
@@ -159,4 +173,19 @@ func TestValueFromString(t *testing.T) {
 	if s.ID.Compare(expectedID) != 0 {
 		t.Fatalf("decoding cookie id failed, expected: '%v', got '%v'", expectedID, s.ID)
 	}
+	if v.KeyID() != "" {
+		t.Fatalf("decoding cookie value without key-id should return empty key-id, got '%s'", v.KeyID())
+	}
+
+	expectedKeyID := "2023-11"
+	err = v.FromString("MjAyMy0xMQ." + encoded)
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if v.KeyID() != expectedKeyID {
+		t.Fatalf("decoding cookie key-id failed, expected: '%s', got '%s'", expectedKeyID, v.KeyID())
+	}
+	if !bytes.Equal(v.signature, expectedSignature) {
+		t.Fatalf("encoding cookie session failed, expected: '%s', got '%s'", expectedSignature, v.signature)
+	}
 }
@@ -0,0 +1,103 @@
+//
+// Copyright (c) 2023 whawty contributors (see AUTHORS file)
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// * Neither the name of whawty.nginx-sso nor the names of its
+//   contributors may be used to endorse or promote products derived from
+//   this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+//
+
+package cookie
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// Watermarks maps usernames to a point in time (unix milliseconds) before which all sessions of
+// the user are invalid. The entry for the empty username applies to all users.
+type Watermarks map[string]int64
+
+// SetWatermark invalidates all sessions of the user which have been created before notBefore. If
+// username is empty the sessions of all users are invalidated. Watermarks can only be moved forward.
+func (st *Store) SetWatermark(username string, notBefore time.Time) error {
+	cnt, err := st.backend.LoadWatermarks(Watermarks{username: notBefore.UnixMilli()})
+	if err != nil {
+		return err
+	}
+	if cnt > 0 {
+		st.revocations.notify()
+	}
+	if username == "" {
+		st.infoLog.Printf("cookie-store: all sessions issued before %v are now invalid", notBefore)
+	} else {
+		st.infoLog.Printf("cookie-store: all sessions of user '%s' issued before %v are now invalid", username, notBefore)
+	}
+	return nil
+}
+
+func (st *Store) ListWatermarks() (Watermarks, error) {
+	return st.backend.ListWatermarks()
+}
+
+func (st *Store) checkWatermark(s Session) error {
+	notBefore, err := st.backend.Watermark(s.Username)
+	if err != nil {
+		return fmt.Errorf("failed to check for cookie revocation: %v", err)
+	}
+	if s.CreatedAt().Before(time.UnixMilli(notBefore)) {
+		return fmt.Errorf("cookie is revoked")
+	}
+	return nil
+}
+
+func (st *Store) signWatermarks(result *SignedRevocationList, signer *storeKey) (err error) {
+	var watermarks Watermarks
+	if watermarks, err = st.backend.ListWatermarks(); err != nil {
+		return
+	}
+	if result.Watermarks, err = json.Marshal(watermarks); err != nil {
+		return
+	}
+	result.WatermarksSignature, err = signTyped(signer, signedTypeWatermarks, result.Watermarks)
+	return
+}
+
+func (st *Store) verifyAndDecodeWatermarks(signed SignedRevocationList) (watermarks Watermarks, err error) {
+	if len(signed.Watermarks) == 0 {
+		err = fmt.Errorf("revocation list contains no watermarks")
+		st.infoLog.Printf("sync-store: %v", err)
+		return
+	}
+	if _, err = st.verifyTypedSignature(signed.KeyID, signedTypeWatermarks, signed.Watermarks, signed.WatermarksSignature); err != nil {
+		st.infoLog.Printf("sync-store: watermarks signature is invalid: %v", err)
+		return
+	}
+	if err = json.Unmarshal(signed.Watermarks, &watermarks); err != nil {
+		st.infoLog.Printf("sync-store: error parsing watermarks: %v", err)
+		return
+	}
+	return
+}
@@ -0,0 +1,176 @@
+//
+// Copyright (c) 2023 whawty contributors (see AUTHORS file)
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// * Neither the name of whawty.nginx-sso nor the names of its
+//   contributors may be used to endorse or promote products derived from
+//   this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+//
+
+package cookie
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+)
+
+func TestWatermarks(t *testing.T) {
+	backends := map[string]StoreBackendConfig{
+		"in-memory": StoreBackendConfig{InMemory: &InMemoryBackendConfig{}},
+		"bolt":      StoreBackendConfig{Bolt: &BoltBackendConfig{Path: filepath.Join(t.TempDir(), "sessions.db")}},
+		"redis":     StoreBackendConfig{Redis: &RedisBackendConfig{Addr: miniredis.RunT(t).Addr()}},
+	}
+	for name, backend := range backends {
+		t.Run(name, func(t *testing.T) {
+			conf := &Config{Expire: time.Hour}
+			conf.Keys = []SignerVerifierConfig{
+				SignerVerifierConfig{Name: "sign-and-verify", Ed25519: &Ed25519Config{PrivKeyData: &testPrivKeyEd25519Pem}},
+			}
+			conf.Backend = backend
+			st, err := NewStore(conf, nil, nil, nil)
+			if err != nil {
+				t.Fatal("unexpected error:", err)
+			}
+
+			user1, _, err := st.New("user1", AgentInfo{}, ClientInfo{})
+			if err != nil {
+				t.Fatal("unexpected error:", err)
+			}
+			user2, _, err := st.New("user2", AgentInfo{}, ClientInfo{})
+			if err != nil {
+				t.Fatal("unexpected error:", err)
+			}
+			time.Sleep(2 * time.Millisecond)
+
+			if err = st.SetWatermark("user1", time.Now()); err != nil {
+				t.Fatal("unexpected error:", err)
+			}
+			if _, err = st.Verify(user1, ClientInfo{}); err == nil {
+				t.Fatal("session issued before the watermark of the user should be rejected")
+			}
+			if _, err = st.Verify(user2, ClientInfo{}); err != nil {
+				t.Fatal("the watermark of a user should not affect other users:", err)
+			}
+			newUser1, _, err := st.New("user1", AgentInfo{}, ClientInfo{})
+			if err != nil {
+				t.Fatal("unexpected error:", err)
+			}
+			if _, err = st.Verify(newUser1, ClientInfo{}); err != nil {
+				t.Fatal("session issued after the watermark should be accepted:", err)
+			}
+
+			// watermarks can't be moved backwards
+			if err = st.SetWatermark("user1", time.Now().Add(-time.Hour)); err != nil {
+				t.Fatal("unexpected error:", err)
+			}
+			if _, err = st.Verify(user1, ClientInfo{}); err == nil {
+				t.Fatal("session issued before the watermark of the user should be rejected")
+			}
+
+			time.Sleep(2 * time.Millisecond)
+			if err = st.SetWatermark("", time.Now()); err != nil {
+				t.Fatal("unexpected error:", err)
+			}
+			for _, value := range []string{user2, newUser1} {
+				if _, err = st.Verify(value, ClientInfo{}); err == nil {
+					t.Fatal("session issued before the global watermark should be rejected")
+				}
+			}
+
+			watermarks, err := st.ListWatermarks()
+			if err != nil {
+				t.Fatal("unexpected error:", err)
+			}
+			if len(watermarks) != 2 || watermarks[""] == 0 || watermarks["user1"] == 0 {
+				t.Fatalf("unexpected watermarks: %+v", watermarks)
+			}
+		})
+	}
+}
+
+func TestSyncWatermarks(t *testing.T) {
+	conf := &Config{Expire: time.Hour}
+	conf.Keys = []SignerVerifierConfig{
+		SignerVerifierConfig{Name: "sign-and-verify", Ed25519: &Ed25519Config{PrivKeyData: &testPrivKeyEd25519Pem}},
+	}
+	conf.Backend = StoreBackendConfig{InMemory: &InMemoryBackendConfig{}}
+	signing, err := NewStore(conf, nil, nil, nil)
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+
+	tamper := false
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		signed, err := signing.ListRevoked()
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		if tamper {
+			signed.Watermarks = json.RawMessage(`{"":0,"user":0}`)
+		}
+		json.NewEncoder(w).Encode(signed) //nolint:errcheck
+	}))
+	defer srv.Close()
+
+	conf = &Config{Expire: time.Hour}
+	conf.Keys = []SignerVerifierConfig{
+		SignerVerifierConfig{Name: "sign-and-verify", Ed25519: &Ed25519Config{PubKeyData: &testPubKeyEd25519Pem}},
+	}
+	conf.Backend = StoreBackendConfig{InMemory: &InMemoryBackendConfig{}}
+	verifier, err := NewStore(conf, nil, nil, nil)
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	baseURL, _ := url.Parse(srv.URL)
+	c := verifier.newSyncClient(baseURL, "", nil, "")
+
+	value, _, err := signing.New("user", AgentInfo{}, ClientInfo{})
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	time.Sleep(2 * time.Millisecond)
+	if err = signing.SetWatermark("user", time.Now()); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+
+	tamper = true
+	if verifier.syncRevocations(c) {
+		t.Fatal("syncing tampered watermarks should fail")
+	}
+	tamper = false
+	if !verifier.syncRevocations(c) {
+		t.Fatal("syncing revocations failed")
+	}
+	if _, err = verifier.Verify(value, ClientInfo{}); err == nil {
+		t.Fatal("session issued before the synced watermark should be rejected")
+	}
+}